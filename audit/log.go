@@ -0,0 +1,290 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync-volume-data/utils"
+	"time"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	// lockTimeout is how long Append waits for another process appending, a lock file older than lockStale is
+	// left over by a process which died
+	lockTimeout = 10 * time.Second
+	lockStale   = 30 * time.Second
+)
+
+// ErrCut is returned when the log doesn't end with a newline: a process died while it wrote its entry. An entry
+// chained to the cut one could never be verified, so nothing is appended until the log is repaired.
+var ErrCut = errors.New("the last entry is not terminated, it was cut")
+
+// Target is a volume a command worked on
+type Target struct {
+	Cluster   string `json:"cluster"`
+	KubeUser  string `json:"kubeUser"`
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Pod       string `json:"pod"`
+	Node      string `json:"node"`
+	Volume    string `json:"volume"`
+	// Direction is the action on the volume: to, from, sync, put, cat, exec...
+	Direction string `json:"direction"`
+}
+
+// Entry is a line of the audit log, one per command
+type Entry struct {
+	Time    time.Time `json:"time"`
+	OSUser  string    `json:"osUser"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	// Args are the arguments of the command, passwords are masked
+	Args    []string `json:"args"`
+	Targets []Target `json:"targets,omitempty"`
+	// Files are the paths transferred as reported by the tools, at most MaxFiles of FileCount
+	Files     []string `json:"files,omitempty"`
+	FileCount int      `json:"fileCount"`
+	Bytes     int64    `json:"bytes"`
+	// Hashes are the sha256 of the data streamed through the tool: the files sync pushes or pulls, the files
+	// restored and the streams of put and cat, at most MaxFiles of HashCount
+	Hashes    map[string]string `json:"hashes,omitempty"`
+	HashCount int               `json:"hashCount"`
+	Result    string            `json:"result"`
+	ExitCode  int               `json:"exitCode"`
+	Error     string            `json:"error,omitempty"`
+	Duration  time.Duration     `json:"durationNs"`
+	// PrevHash is the Hash of the previous entry, empty for the first one. Hash covers every other field, so that
+	// changing, inserting or removing an entry breaks the chain.
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// DefaultPath is where the audit log is kept when no path is given
+func DefaultPath() string {
+	return filepath.Join(utils.HomeDir(), ".sync-volume-data", "audit.jsonl")
+}
+
+// Append chains entry to the last entry of the log at path and appends it. Concurrent processes are serialized by a
+// lock file next to the log.
+func Append(path string, entry *Entry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	unlock, err := lock(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	last, err := lastLine(f)
+	if err != nil {
+		return cutError(path, err)
+	}
+	entry.PrevHash = ""
+	if len(last) > 0 {
+		var prev Entry
+		if err = json.Unmarshal(last, &prev); err != nil {
+			return errors.New(fmt.Sprintf("read the last entry of audit log %s failed: %s", path, err))
+		}
+		entry.PrevHash = prev.Hash
+	}
+
+	entry.Hash = ""
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if entry.Hash, err = lineHash(line); err != nil {
+		return err
+	}
+	if line, err = json.Marshal(entry); err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Check fails when the log at path can't be appended to because its last entry was cut, a missing log is fine
+func Check(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = lastLine(f)
+	return cutError(path, err)
+}
+
+// cutError tells how to repair a log which was cut
+func cutError(path string, err error) error {
+	if err == ErrCut {
+		return errors.New(fmt.Sprintf("audit log %s: %s, run audit verify, then move the log away or remove the cut line", path, err))
+	}
+	return err
+}
+
+// VerifyResult is what Verify found in a log which is intact
+type VerifyResult struct {
+	Entries  int    `json:"entries"`
+	LastHash string `json:"lastHash"`
+}
+
+// Verify checks every entry of the log at path against its hash and the hash of the entry before it. The first
+// broken entry is reported with its line number.
+func Verify(path string) (*VerifyResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := &VerifyResult{}
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return result, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("line %d: entry is not terminated, it was cut", n))
+		}
+
+		line = line[:len(line)-1]
+		var entry Entry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: not an entry: %s", n, err))
+		}
+		if entry.PrevHash != result.LastHash {
+			return nil, errors.New(fmt.Sprintf("line %d: chain broken, previous hash %q but the entry before is %q, an entry was removed or inserted",
+				n, entry.PrevHash, result.LastHash))
+		}
+		hash, err := lineHash(line)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", n, err))
+		}
+		if hash != entry.Hash {
+			return nil, errors.New(fmt.Sprintf("line %d: hash %q doesn't match the content %q, the entry was modified", n, entry.Hash, hash))
+		}
+		result.Entries++
+		result.LastHash = entry.Hash
+	}
+}
+
+// lineHash is the sha256 of an entry without its hash. The fields are sorted by name so that the hash doesn't
+// depend on the order they are written in, unknown fields are covered too.
+func lineHash(line []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "hash")
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastLine returns the last entry of f without its newline, reading backwards from the end. ErrCut is returned when
+// the last entry has no newline.
+func lastLine(f *os.File) ([]byte, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		end := make([]byte, 1)
+		if _, err = f.ReadAt(end, size-1); err != nil {
+			return nil, err
+		}
+		if end[0] != '\n' {
+			return nil, ErrCut
+		}
+	}
+	var tail []byte
+	for offset := size; offset > 0; {
+		chunk := int64(64 << 10)
+		if chunk > offset {
+			chunk = offset
+		}
+		offset -= chunk
+		buf := make([]byte, chunk)
+		if _, err = f.ReadAt(buf, offset); err != nil {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		// the last byte is the newline of the last entry
+		if i := bytes.LastIndexByte(tail[:len(tail)-1], '\n'); i >= 0 {
+			return tail[i+1 : len(tail)-1], nil
+		}
+	}
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	return tail[:len(tail)-1], nil
+}
+
+// lock creates the lock file, it waits while another process holds it
+func lock(path string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > lockStale {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New(fmt.Sprintf("audit log is locked by %s, remove it if no other command runs", path))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLog appends n entries to a new log and returns its path and its lines
+func writeLog(t *testing.T, n int) (string, [][]byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < n; i++ {
+		entry := &Entry{
+			Time:     time.Date(2021, 12, 1, 2, 0, i, 0, time.UTC),
+			OSUser:   "ops",
+			Command:  "sync-volume-data to",
+			Args:     []string{"to", "deploy", "nginx", "-s", string(rune('a' + i))},
+			Result:   ResultSuccess,
+			Duration: time.Second,
+		}
+		if err := Append(path, entry); err != nil {
+			t.Fatalf("Append() failed: %s", err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, bytes.SplitAfter(data, []byte("\n"))[:n]
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// change turns the lines of a log of 3 entries into the content to verify
+		change  func(lines [][]byte) []byte
+		entries int
+		// wantErr is a part of the error, empty when the log is intact
+		wantErr string
+	}{
+		{name: "intact", change: func(lines [][]byte) []byte { return bytes.Join(lines, nil) }, entries: 3},
+		{name: "empty", change: func(lines [][]byte) []byte { return nil }, entries: 0},
+		{
+			name: "modified",
+			change: func(lines [][]byte) []byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"osUser":"ops"`), []byte(`"osUser":"eve"`), 1)
+				return bytes.Join(lines, nil)
+			},
+			wantErr: "line 2: hash",
+		},
+		{
+			name:    "removed",
+			change:  func(lines [][]byte) []byte { return bytes.Join([][]byte{lines[0], lines[2]}, nil) },
+			wantErr: "line 2: chain broken",
+		},
+		{
+			name:    "inserted",
+			change:  func(lines [][]byte) []byte { return bytes.Join([][]byte{lines[0], lines[0], lines[1], lines[2]}, nil) },
+			wantErr: "line 2: chain broken",
+		},
+		{
+			name:    "swapped",
+			change:  func(lines [][]byte) []byte { return bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil) },
+			wantErr: "line 1: chain broken",
+		},
+		{
+			name: "cut",
+			change: func(lines [][]byte) []byte {
+				return append(bytes.Join(lines[:2], nil), lines[2][:len(lines[2])/2]...)
+			},
+			wantErr: "line 3: entry is not terminated",
+		},
+		{
+			name: "not an entry",
+			change: func(lines [][]byte) []byte {
+				return bytes.Join([][]byte{lines[0], []byte("garbage\n"), lines[1]}, nil)
+			},
+			wantErr: "line 2: not an entry",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, lines := writeLog(t, 3)
+			if err := ioutil.WriteFile(path, tt.change(lines), 0600); err != nil {
+				t.Fatal(err)
+			}
+			result, err := Verify(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() failed: %s", err)
+			}
+			if result.Entries != tt.entries {
+				t.Errorf("Verify() found %d entries, want %d", result.Entries, tt.entries)
+			}
+		})
+	}
+}
+
+func TestAppendToCutLog(t *testing.T) {
+	path, lines := writeLog(t, 2)
+	cut := append(append([]byte(nil), lines[0]...), lines[1][:10]...)
+	if err := ioutil.WriteFile(path, cut, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(path); err == nil {
+		t.Errorf("Check() of a cut log succeeded")
+	}
+	if err := Append(path, &Entry{Command: "sync-volume-data from"}); err == nil {
+		t.Errorf("Append() to a cut log succeeded")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, cut) {
+		t.Errorf("Append() changed a cut log")
+	}
+	if err = Check(filepath.Join(t.TempDir(), "missing.jsonl")); err != nil {
+		t.Errorf("Check() of a missing log failed: %s", err)
+	}
+}
+
+func TestLineHash(t *testing.T) {
+	base := `{"command":"to","prevHash":"","args":["a"]}`
+	hash, err := lineHash([]byte(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		line string
+		same bool
+	}{
+		{name: "other field order", line: `{"args":["a"],"prevHash":"","command":"to"}`, same: true},
+		{name: "spaces", line: `{ "command": "to", "prevHash": "", "args": [ "a" ] }`, same: true},
+		{name: "hash field ignored", line: `{"command":"to","prevHash":"","args":["a"],"hash":"x"}`, same: true},
+		{name: "other value", line: `{"command":"from","prevHash":"","args":["a"]}`, same: false},
+		{name: "other previous hash", line: `{"command":"to","prevHash":"x","args":["a"]}`, same: false},
+		{name: "unknown field", line: `{"command":"to","prevHash":"","args":["a"],"extra":1}`, same: false},
+		{name: "missing field", line: `{"command":"to","prevHash":""}`, same: false},
+	}
+	for _, tt := range tests {
+		got, err := lineHash([]byte(tt.line))
+		if err != nil {
+			t.Errorf("%s: lineHash() failed: %s", tt.name, err)
+			continue
+		}
+		if (got == hash) != tt.same {
+			t.Errorf("%s: lineHash() = %s, base %s, want same %v", tt.name, got, hash, tt.same)
+		}
+	}
+	if _, err = lineHash([]byte("not json")); err == nil {
+		t.Errorf("lineHash() of a line which is not json succeeded")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// MaxFiles is how many paths and hashes an entry lists, the others are only counted
+const MaxFiles = 1000
+
+// the entry of the running command, the commands fill it in as they go and it is appended to the log once when
+// the process ends
+var (
+	mu       sync.Mutex
+	current  *Entry
+	logPath  string
+	lastErr  string
+	started  time.Time
+	finished bool
+)
+
+// Begin starts the entry of the running command, it is written to the log at path by Exit or Finish. Nothing is
+// recorded when the log can't be appended to.
+func Begin(path, command string, args []string) error {
+	if err := Check(path); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	host, _ := os.Hostname()
+	osUser := "unknown"
+	if u, err := user.Current(); err == nil {
+		osUser = u.Username
+	}
+	started = time.Now()
+	logPath = path
+	current = &Entry{
+		Time:    started.UTC(),
+		OSUser:  osUser,
+		Host:    host,
+		Command: command,
+		Args:    args,
+	}
+	// Fatal logs end the process through logrus.Exit, which runs the handlers
+	logrus.RegisterExitHandler(func() { finish(1) })
+	return nil
+}
+
+// Update changes the entry of the running command, nothing happens when there is none
+func Update(update func(entry *Entry)) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil {
+		update(current)
+	}
+}
+
+// AddTarget records a volume the command works on, once
+func AddTarget(target Target) {
+	Update(func(entry *Entry) {
+		for _, t := range entry.Targets {
+			if t == target {
+				return
+			}
+		}
+		entry.Targets = append(entry.Targets, target)
+	})
+}
+
+// AddFile records a transferred path
+func AddFile(name string) {
+	Update(func(entry *Entry) {
+		entry.FileCount++
+		if len(entry.Files) < MaxFiles {
+			entry.Files = append(entry.Files, name)
+		}
+	})
+}
+
+// AddHash records the sha256 of a file or of a stream, a name recorded again keeps the last sum
+func AddHash(name, sum string) {
+	Update(func(entry *Entry) {
+		if _, ok := entry.Hashes[name]; ok {
+			entry.Hashes[name] = sum
+			return
+		}
+		entry.HashCount++
+		if len(entry.Hashes) >= MaxFiles {
+			return
+		}
+		if entry.Hashes == nil {
+			entry.Hashes = make(map[string]string)
+		}
+		entry.Hashes[name] = sum
+	})
+}
+
+// Finish writes the entry of a command which returned, code is its exit code. The command fails when its entry
+// can't be written.
+func Finish(code int) {
+	if err := finish(code); err != nil {
+		logrus.Exit(1)
+	}
+}
+
+// Exit writes the entry and exits with code, the handlers of logrus run too
+func Exit(code int) {
+	if err := finish(code); err != nil && code == 0 {
+		code = 1
+	}
+	logrus.Exit(code)
+}
+
+func finish(code int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil || finished {
+		return nil
+	}
+	finished = true
+	current.ExitCode = code
+	current.Duration = time.Since(started)
+	current.Result = ResultSuccess
+	if code != 0 {
+		current.Result = ResultFailure
+		current.Error = lastErr
+	}
+	err := Append(logPath, current)
+	if err != nil {
+		logrus.Errorf("write audit log %s failed: %s", logPath, err)
+	}
+	return err
+}
+
+// Hook keeps the last error logged, it is the error of the entry when the command fails
+type Hook struct{}
+
+func (Hook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (Hook) Fire(e *logrus.Entry) error {
+	mu.Lock()
+	defer mu.Unlock()
+	lastErr = e.Message
+	return nil
+}
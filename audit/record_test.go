@@ -0,0 +1,98 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recording runs record against a fresh entry of the running command and returns it
+func recording(t *testing.T, record func()) *Entry {
+	t.Helper()
+	mu.Lock()
+	current = &Entry{}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		current = nil
+		mu.Unlock()
+	}()
+	record()
+	return current
+}
+
+func TestAddFile(t *testing.T) {
+	entry := recording(t, func() {
+		for i := 0; i < MaxFiles+5; i++ {
+			AddFile(fmt.Sprintf("f%d", i))
+		}
+	})
+	if entry.FileCount != MaxFiles+5 || len(entry.Files) != MaxFiles {
+		t.Errorf("AddFile() recorded %d of %d files, want %d of %d", len(entry.Files), entry.FileCount, MaxFiles, MaxFiles+5)
+	}
+	if entry.Files[0] != "f0" || entry.Files[MaxFiles-1] != fmt.Sprintf("f%d", MaxFiles-1) {
+		t.Errorf("AddFile() kept %s..%s, want the first files", entry.Files[0], entry.Files[MaxFiles-1])
+	}
+}
+
+func TestAddHash(t *testing.T) {
+	tests := []struct {
+		name      string
+		hashes    [][2]string
+		want      map[string]string
+		wantCount int
+	}{
+		{"none", nil, nil, 0},
+		{"one", [][2]string{{"a", "1"}}, map[string]string{"a": "1"}, 1},
+		{"again", [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}}, map[string]string{"a": "3", "b": "2"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := recording(t, func() {
+				for _, h := range tt.hashes {
+					AddHash(h[0], h[1])
+				}
+			})
+			if entry.HashCount != tt.wantCount {
+				t.Errorf("HashCount = %d, want %d", entry.HashCount, tt.wantCount)
+			}
+			if len(entry.Hashes) != len(tt.want) {
+				t.Fatalf("Hashes = %v, want %v", entry.Hashes, tt.want)
+			}
+			for name, sum := range tt.want {
+				if entry.Hashes[name] != sum {
+					t.Errorf("Hashes[%s] = %s, want %s", name, entry.Hashes[name], sum)
+				}
+			}
+		})
+	}
+
+	entry := recording(t, func() {
+		for i := 0; i < MaxFiles+5; i++ {
+			AddHash(fmt.Sprintf("f%d", i), "sum")
+		}
+		// a name which is listed is still updated at the cap
+		AddHash("f0", "new")
+	})
+	if entry.HashCount != MaxFiles+5 || len(entry.Hashes) != MaxFiles {
+		t.Errorf("AddHash() recorded %d of %d hashes, want %d of %d", len(entry.Hashes), entry.HashCount, MaxFiles, MaxFiles+5)
+	}
+	if entry.Hashes["f0"] != "new" {
+		t.Errorf("Hashes[f0] = %s, want new", entry.Hashes["f0"])
+	}
+}
@@ -0,0 +1,358 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backup implements the archive format of volume backups: a gzip or zstd compressed tar whose first
+// entry is the metadata of the backup, followed by the files of the volume and a manifest of their checksums.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FormatVersion = 1
+
+	MetadataName = ".sync-volume-data/metadata.json"
+	ManifestName = ".sync-volume-data/manifest.json"
+
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Metadata describes where a backup comes from, it is the first entry of the archive
+type Metadata struct {
+	Version               int       `json:"version"`
+	Namespace             string    `json:"namespace"`
+	Kind                  string    `json:"kind"`
+	Name                  string    `json:"name"`
+	InstanceIndex         int       `json:"instanceIndex,omitempty"`
+	Volume                string    `json:"volume"`
+	Pod                   string    `json:"pod"`
+	Node                  string    `json:"node"`
+	PersistentVolumeClaim string    `json:"persistentVolumeClaim,omitempty"`
+	PersistentVolume      string    `json:"persistentVolume,omitempty"`
+	StorageClass          string    `json:"storageClass,omitempty"`
+	Compression           string    `json:"compression"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+// ManifestEntry is a file of the backup
+type ManifestEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    int64     `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// Manifest lists every entry of the backup, it is the last entry of the archive since the checksums
+// are only known once the data has been streamed
+type Manifest struct {
+	Entries    []ManifestEntry `json:"entries"`
+	Files      int             `json:"files"`
+	TotalBytes int64           `json:"totalBytes"`
+}
+
+func entryType(flag byte) string {
+	switch flag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return "other"
+	}
+}
+
+// ValidateCompression checks a compression algorithm, empty means the default zstd
+func ValidateCompression(compression string) error {
+	switch compression {
+	case "", CompressGzip, CompressZstd:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("not support compression %s, please use %s or %s", compression, CompressGzip, CompressZstd))
+	}
+}
+
+func compressWriter(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	switch compression {
+	case CompressGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressZstd, "":
+		opts := []zstd.EOption{}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nil, ValidateCompression(compression)
+}
+
+// decompressReader detects the compression of r by its magic bytes
+func decompressReader(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("read archive header failed: %s", err))
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		return gz, CompressGzip, err
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), CompressZstd, nil
+	default:
+		return nil, "", errors.New("unknown archive format, expect a gzip or zstd compressed backup")
+	}
+}
+
+// Write turns the tar stream of a volume into an archive written to w. onFile is called for every regular file.
+func Write(w io.Writer, tarStream io.Reader, meta Metadata, level int, onFile func(name string, size int64)) (*Manifest, error) {
+	if meta.Compression == "" {
+		meta.Compression = CompressZstd
+	}
+	meta.Version = FormatVersion
+
+	cw, err := compressWriter(w, meta.Compression, level)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(cw)
+
+	if err = writeJSON(tw, MetadataName, meta, meta.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	tr := tar.NewReader(tarStream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("read tar stream of the volume failed: %s", err))
+		}
+
+		entry := ManifestEntry{
+			Path:    strings.TrimPrefix(hdr.Name, "./"),
+			Type:    entryType(hdr.Typeflag),
+			Size:    hdr.Size,
+			Mode:    hdr.Mode,
+			ModTime: hdr.ModTime,
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if entry.Type == "file" {
+			h := sha256.New()
+			if _, err = io.Copy(io.MultiWriter(tw, h), tr); err != nil {
+				return nil, errors.New(fmt.Sprintf("archive %s failed: %s", hdr.Name, err))
+			}
+			entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+			manifest.Files++
+			manifest.TotalBytes += hdr.Size
+			if onFile != nil {
+				onFile(entry.Path, hdr.Size)
+			}
+		}
+		if entry.Path != "" && entry.Path != "." {
+			manifest.Entries = append(manifest.Entries, entry)
+		}
+	}
+
+	if err = writeJSON(tw, ManifestName, manifest, time.Now()); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, cw.Close()
+}
+
+func writeJSON(tw *tar.Writer, name string, v interface{}, modTime time.Time) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Reader reads an archive written by Write
+type Reader struct {
+	Metadata Metadata
+	// Encrypted tells whether the archive was encrypted with age, the metadata is then authenticated as well
+	Encrypted bool
+	rc        io.ReadCloser
+	tr        *tar.Reader
+}
+
+// NewReader opens an archive and reads its metadata, an encrypted archive is decrypted with the identities of keys
+func NewReader(r io.Reader, keys *Keys) (*Reader, error) {
+	r, encrypted, err := decryptReader(r, keys)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := decompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != MetadataName {
+		rc.Close()
+		return nil, errors.New("not a sync-volume-data backup, the metadata entry is missing")
+	}
+
+	reader := &Reader{rc: rc, tr: tr, Encrypted: encrypted}
+	if err = json.NewDecoder(tr).Decode(&reader.Metadata); err != nil {
+		rc.Close()
+		return nil, errors.New(fmt.Sprintf("decode backup metadata failed: %s", err))
+	}
+	if reader.Metadata.Version > FormatVersion {
+		rc.Close()
+		return nil, errors.New(fmt.Sprintf("backup format version %d is newer than the supported version %d", reader.Metadata.Version, FormatVersion))
+	}
+	return reader, nil
+}
+
+// Extract writes the files of the archive as a plain tar stream to w. The checksums are computed on the way and
+// compared with the manifest at the end, a mismatch or a missing manifest is an error when verify is set.
+func (r *Reader) Extract(w io.Writer, verify bool, onFile func(name string, size int64)) (*Manifest, error) {
+	defer r.rc.Close()
+
+	tw := tar.NewWriter(w)
+	sums := make(map[string]string)
+	var manifest *Manifest
+	for {
+		hdr, err := r.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("read archive failed: %s", err))
+		}
+
+		if hdr.Name == ManifestName {
+			manifest = &Manifest{}
+			if err = json.NewDecoder(r.tr).Decode(manifest); err != nil {
+				return nil, errors.New(fmt.Sprintf("decode backup manifest failed: %s", err))
+			}
+			continue
+		}
+
+		if w != nil {
+			if err = tw.WriteHeader(hdr); err != nil {
+				return nil, err
+			}
+		}
+		if entryType(hdr.Typeflag) == "file" {
+			h := sha256.New()
+			dst := io.Writer(h)
+			if w != nil {
+				dst = io.MultiWriter(tw, h)
+			}
+			if _, err = io.Copy(dst, r.tr); err != nil {
+				return nil, errors.New(fmt.Sprintf("extract %s failed: %s", hdr.Name, err))
+			}
+			name := strings.TrimPrefix(hdr.Name, "./")
+			sums[name] = hex.EncodeToString(h.Sum(nil))
+			if onFile != nil {
+				onFile(name, hdr.Size)
+			}
+		}
+	}
+	if w != nil {
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !verify {
+		return manifest, nil
+	}
+	if manifest == nil {
+		return nil, errors.New("backup manifest is missing, the archive is truncated")
+	}
+	return manifest, verifySums(manifest, sums)
+}
+
+// Close releases the archive without reading the rest of it
+func (r *Reader) Close() error {
+	return r.rc.Close()
+}
+
+// Verify reads the whole archive and compares the checksum of every file with the manifest
+func (r *Reader) Verify() (*Manifest, error) {
+	return r.Extract(nil, true, nil)
+}
+
+func verifySums(manifest *Manifest, sums map[string]string) error {
+	var mismatch []string
+	for _, entry := range manifest.Entries {
+		if entry.Type != "file" {
+			continue
+		}
+		if sums[entry.Path] != entry.SHA256 {
+			mismatch = append(mismatch, entry.Path)
+		}
+	}
+	if len(mismatch) == 0 {
+		return nil
+	}
+	count := len(mismatch)
+	sort.Strings(mismatch)
+	if count > 10 {
+		mismatch = append(mismatch[:10], "...")
+	}
+	return errors.New(fmt.Sprintf("checksum mismatch of %d files: %s", count, strings.Join(mismatch, ", ")))
+}
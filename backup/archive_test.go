@@ -0,0 +1,237 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+var archiveFiles = map[string]string{
+	"./data/a.txt":   "hello world",
+	"./data/b.bin":   "\x00\x01\x02",
+	"./empty":        "",
+	"./data/sub/c.t": strings.Repeat("c", 10000),
+}
+
+// volumeTar is the tar stream the node sends for a volume: directories, files and a symlink
+func volumeTar(t *testing.T) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	at := time.Date(2021, 12, 1, 2, 3, 4, 0, time.UTC)
+	for _, dir := range []string{"./", "./data/", "./data/sub/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"./data/a.txt", "./data/b.bin", "./empty", "./data/sub/c.t"} {
+		data := archiveFiles[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: at}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "./link", Typeflag: tar.TypeSymlink, Linkname: "data/a.txt", ModTime: at}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func writeArchive(t *testing.T, compression string) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	meta := Metadata{Namespace: "db", Kind: "sts", Name: "pg", InstanceIndex: 1, Volume: "data", Compression: compression}
+	var files []string
+	manifest, err := Write(&archive, volumeTar(t), meta, 0, func(name string, size int64) { files = append(files, name) })
+	if err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	if manifest.Files != len(archiveFiles) || len(files) != len(archiveFiles) {
+		t.Errorf("Write() archived %d files, reported %d, want %d", manifest.Files, len(files), len(archiveFiles))
+	}
+	if manifest.TotalBytes != 10000+11+3 {
+		t.Errorf("Write() archived %d bytes, want %d", manifest.TotalBytes, 10000+11+3)
+	}
+	return archive.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, compression := range []string{CompressGzip, CompressZstd} {
+		t.Run(compression, func(t *testing.T) {
+			archive := writeArchive(t, compression)
+			r, err := NewReader(bytes.NewReader(archive), nil)
+			if err != nil {
+				t.Fatalf("NewReader() failed: %s", err)
+			}
+			if r.Metadata.Name != "pg" || r.Metadata.InstanceIndex != 1 || r.Metadata.Compression != compression ||
+				r.Metadata.Version != FormatVersion || r.Encrypted {
+				t.Errorf("metadata = %+v", r.Metadata)
+			}
+
+			var out bytes.Buffer
+			manifest, err := r.Extract(&out, true, nil)
+			if err != nil {
+				t.Fatalf("Extract() failed: %s", err)
+			}
+			types := map[string]string{}
+			for _, entry := range manifest.Entries {
+				types[entry.Path] = entry.Type
+			}
+			if types["data/"] != "dir" || types["link"] != "symlink" || types["data/a.txt"] != "file" {
+				t.Errorf("manifest types = %v", types)
+			}
+
+			got := map[string]string{}
+			tr := tar.NewReader(&out)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeSymlink {
+					got[hdr.Name] = "-> " + hdr.Linkname
+					continue
+				}
+				data, _ := ioutil.ReadAll(tr)
+				if hdr.Typeflag == tar.TypeReg {
+					got[hdr.Name] = string(data)
+				}
+			}
+			for name, data := range archiveFiles {
+				if got[name] != data {
+					t.Errorf("extracted %s = %q, want %q", name, got[name], data)
+				}
+			}
+			if got["./link"] != "-> data/a.txt" {
+				t.Errorf("extracted link = %q", got["./link"])
+			}
+		})
+	}
+}
+
+// rewriteGzip decompresses a gzip archive, changes it with edit and compresses it again
+func rewriteGzip(t *testing.T, archive []byte, edit func(plain []byte) []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	if _, err = zw.Write(edit(plain)); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestArchiveTampered(t *testing.T) {
+	archive := writeArchive(t, CompressGzip)
+	tampered := rewriteGzip(t, archive, func(plain []byte) []byte {
+		// same size, the tar stream stays valid and only the checksum tells
+		return bytes.Replace(plain, []byte("hello world"), []byte("HELLO WORLD"), 1)
+	})
+
+	r, err := NewReader(bytes.NewReader(tampered), nil)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %s", err)
+	}
+	_, err = r.Verify()
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch of 1 files: data/a.txt") {
+		t.Fatalf("Verify() of a tampered archive = %v, want a checksum mismatch of data/a.txt", err)
+	}
+
+	// without verify the data is extracted as it is
+	r, err = NewReader(bytes.NewReader(tampered), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Extract(ioutil.Discard, false, nil); err != nil {
+		t.Errorf("Extract() without verify failed: %s", err)
+	}
+}
+
+func TestArchiveTruncated(t *testing.T) {
+	archive := writeArchive(t, CompressGzip)
+	truncated := rewriteGzip(t, archive, func(plain []byte) []byte {
+		// cut right before the manifest and end the tar stream there
+		i := bytes.Index(plain, []byte(ManifestName))
+		return append(append([]byte{}, plain[:i]...), make([]byte, 1024)...)
+	})
+
+	r, err := NewReader(bytes.NewReader(truncated), nil)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %s", err)
+	}
+	if _, err = r.Verify(); err == nil || !strings.Contains(err.Error(), "manifest is missing") {
+		t.Errorf("Verify() of a truncated archive = %v, want the manifest to be missing", err)
+	}
+
+	if _, err = NewReader(strings.NewReader("plain text, not an archive"), nil); err == nil {
+		t.Errorf("NewReader() accepted a file which is not an archive")
+	}
+}
+
+func TestObjectName(t *testing.T) {
+	at := time.Date(2021, 12, 1, 2, 3, 4, 0, time.FixedZone("CST", 8*3600))
+	tests := []struct {
+		kind        string
+		index       int
+		compression string
+		encrypted   bool
+		want        string
+	}{
+		{kind: "deploy", want: "web/nginx/data/deploy-20211130T180304Z.tar.zst"},
+		{kind: "statefulset", index: 2, compression: CompressZstd, want: "web/nginx/data/sts-2-20211130T180304Z.tar.zst"},
+		{kind: "sts", index: 0, compression: CompressGzip, encrypted: true, want: "web/nginx/data/sts-0-20211130T180304Z.tar.gz.age"},
+		{kind: "DaemonSet", want: "web/nginx/data/ds-20211130T180304Z.tar.zst"},
+		{kind: "pod", want: "web/nginx/data/pod-20211130T180304Z.tar.zst"},
+	}
+	for _, tt := range tests {
+		got := ObjectName("web", tt.kind, "nginx", tt.index, "data", tt.compression, tt.encrypted, at)
+		if got != tt.want {
+			t.Errorf("ObjectName(%s, %d) = %q, want %q", tt.kind, tt.index, got, tt.want)
+		}
+		if !IsArchive(got) {
+			t.Errorf("IsArchive(%q) = false", got)
+		}
+	}
+	if IsArchive("web/nginx/data/snapshots/abc.json") {
+		t.Errorf("IsArchive() accepted a snapshot")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"io"
+)
+
+// the chunk sizes are part of the repository format, changing them breaks the deduplication with older snapshots
+const (
+	MinChunkSize = 256 << 10
+	AvgChunkSize = 1 << 20
+	MaxChunkSize = 4 << 20
+)
+
+var (
+	// a cut point needs more zero bits below the average size and less above it, which keeps most
+	// chunks close to the average size (normalized chunking)
+	maskSmall = chunkMask(22)
+	maskLarge = chunkMask(18)
+	gear      = gearTable()
+)
+
+func chunkMask(bits uint) uint64 {
+	return ((uint64(1) << bits) - 1) << (64 - bits)
+}
+
+// gearTable returns 256 pseudo random values, it is generated with splitmix64 from a fixed seed so that
+// it never changes
+func gearTable() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x53594e43564f4c44) // "SYNCVOLD"
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// Chunker splits a stream into content defined chunks with a gear rolling hash, an insertion or a deletion
+// in a file only changes the chunks around it
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	// buf[start:end] holds the data read but not returned yet
+	start, end int
+	eof        bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxChunkSize)}
+}
+
+// Reset starts chunking r, the buffer is kept so that a chunker can be reused for many small files
+func (c *Chunker) Reset(r io.Reader) {
+	c.r = r
+	c.start, c.end = 0, 0
+	c.eof = false
+}
+
+// Next returns the next chunk, io.EOF once the stream is exhausted. The chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	n := cutPoint(data)
+	chunk := data[:n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill reads until a full chunk is buffered or the stream ends
+func (c *Chunker) fill() error {
+	if c.end-c.start >= MaxChunkSize || c.eof {
+		return nil
+	}
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < MaxChunkSize {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cutPoint(data []byte) int {
+	if len(data) <= MinChunkSize {
+		return len(data)
+	}
+	if len(data) > MaxChunkSize {
+		data = data[:MaxChunkSize]
+	}
+
+	var h uint64
+	i := MinChunkSize
+	for ; i < len(data) && i < AvgChunkSize; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
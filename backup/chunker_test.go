@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks splits data read through r and checks that the chunks put together give data back
+func chunks(t *testing.T, c *Chunker, data []byte) [][]byte {
+	t.Helper()
+	var result [][]byte
+	var joined []byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() failed: %s", err)
+		}
+		result = append(result, append([]byte(nil), chunk...))
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("chunks of %d bytes put together give %d other bytes", len(data), len(joined))
+	}
+	return result
+}
+
+func TestChunker(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// reader wraps the stream, the chunks must not depend on the size of the reads
+		reader func(r io.Reader) io.Reader
+		// count is the number of chunks, -1 when it only has to be in line with the sizes
+		count int
+	}{
+		{name: "empty", data: nil, count: 0},
+		{name: "one byte", data: []byte{1}, count: 1},
+		{name: "smaller than the minimum", data: randomData(1, MinChunkSize-1), count: 1},
+		{name: "minimum", data: randomData(2, MinChunkSize), count: 1},
+		{name: "zeros", data: make([]byte, 3*MaxChunkSize+1), count: -1},
+		{name: "random", data: randomData(3, 12*AvgChunkSize), count: -1},
+		{name: "random half reads", data: randomData(3, 12*AvgChunkSize), reader: iotest.HalfReader, count: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tt.data)
+			if tt.reader != nil {
+				r = tt.reader(r)
+			}
+			got := chunks(t, NewChunker(r), tt.data)
+			if tt.count >= 0 && len(got) != tt.count {
+				t.Fatalf("got %d chunks, want %d", len(got), tt.count)
+			}
+			for i, chunk := range got {
+				if len(chunk) > MaxChunkSize {
+					t.Errorf("chunk %d has %d bytes, more than the maximum", i, len(chunk))
+				}
+				if i < len(got)-1 && len(chunk) < MinChunkSize {
+					t.Errorf("chunk %d has %d bytes, less than the minimum", i, len(chunk))
+				}
+			}
+
+			// the chunks are the same whatever the reads and the reuse of the chunker
+			c := NewChunker(bytes.NewReader([]byte("something else")))
+			chunks(t, c, []byte("something else"))
+			c.Reset(bytes.NewReader(tt.data))
+			again := chunks(t, c, tt.data)
+			if len(again) != len(got) {
+				t.Fatalf("a reset chunker returns %d chunks, want %d", len(again), len(got))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], again[i]) {
+					t.Errorf("chunk %d differs after a reset", i)
+				}
+			}
+		})
+	}
+}
+
+// TestChunkerShift checks that an insertion at the beginning of a stream only changes the chunks around it
+func TestChunkerShift(t *testing.T) {
+	data := randomData(4, 16*AvgChunkSize)
+	shifted := append([]byte("inserted"), data...)
+
+	seen := make(map[string]bool)
+	for _, chunk := range chunks(t, NewChunker(bytes.NewReader(data)), data) {
+		seen[string(chunk)] = true
+	}
+	got := chunks(t, NewChunker(bytes.NewReader(shifted)), shifted)
+	changed := 0
+	for _, chunk := range got {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after an insertion at the beginning", changed, len(got))
+	}
+}
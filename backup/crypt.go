@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// AgeExtension is appended to the name of encrypted archives
+const AgeExtension = ".age"
+
+var ageMagic = []byte("age-encryption.org/")
+
+// Keys encrypt with age: archives are encrypted to the recipients, and decrypted with the identities
+type Keys struct {
+	Recipients []age.Recipient
+	Identities []age.Identity
+}
+
+// LoadKeys parses the keys of the command line. A recipient is an age1... public key or a file of public keys,
+// an identity is a file of AGE-SECRET-KEY-1... private keys. A passphrase is both a recipient and an identity,
+// age doesn't allow to mix it with public keys.
+func LoadKeys(recipients, identityFiles []string, passphrase string) (*Keys, error) {
+	keys := &Keys{}
+	for _, r := range recipients {
+		parsed, err := parseRecipients(r)
+		if err != nil {
+			return nil, err
+		}
+		keys.Recipients = append(keys.Recipients, parsed...)
+	}
+	for _, file := range identityFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("parse identity file %s failed: %s", file, err))
+		}
+		keys.Identities = append(keys.Identities, parsed...)
+	}
+
+	if passphrase != "" {
+		if len(keys.Recipients) > 0 {
+			return nil, errors.New("a passphrase can't be used together with recipients")
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys.Recipients = append(keys.Recipients, recipient)
+		keys.Identities = append(keys.Identities, identity)
+	}
+	return keys, nil
+}
+
+func parseRecipients(r string) ([]age.Recipient, error) {
+	if strings.HasPrefix(r, "age1") {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{recipient}, nil
+	}
+
+	f, err := os.Open(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("recipient %s is neither an age public key nor a readable file: %s", r, err))
+	}
+	defer f.Close()
+	recipients, err := age.ParseRecipients(f)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("parse recipients file %s failed: %s", r, err))
+	}
+	return recipients, nil
+}
+
+// Encrypting tells whether new data is encrypted
+func (k *Keys) Encrypting() bool {
+	return k != nil && len(k.Recipients) > 0
+}
+
+func (k *Keys) identities() []age.Identity {
+	if k == nil {
+		return nil
+	}
+	return k.Identities
+}
+
+// EncryptWriter encrypts what is written to w when keys has recipients, closing it writes the last block but
+// doesn't close w
+func EncryptWriter(w io.Writer, keys *Keys) (io.WriteCloser, error) {
+	if !keys.Encrypting() {
+		return nopWriteCloser{w}, nil
+	}
+	return age.Encrypt(w, keys.Recipients...)
+}
+
+// decryptReader decrypts r when it is encrypted with age. Every block is authenticated, a modified archive
+// fails to decrypt.
+func decryptReader(r io.Reader, keys *Keys) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(ageMagic))
+	if !bytes.Equal(magic, ageMagic) {
+		return br, false, nil
+	}
+	if len(keys.identities()) == 0 {
+		return nil, true, errors.New("the backup is encrypted, please set --identity or --passphrase-file")
+	}
+	dr, err := age.Decrypt(br, keys.identities()...)
+	if err != nil {
+		return nil, true, errors.New(fmt.Sprintf("decrypt backup failed: %s", err))
+	}
+	return dr, true, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"filippo.io/age"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encryptArchive writes an archive encrypted with keys
+func encryptArchive(t *testing.T, keys *Keys) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	ew, err := EncryptWriter(&out, keys)
+	if err != nil {
+		t.Fatalf("EncryptWriter() failed: %s", err)
+	}
+	if _, err = ew.Write(writeArchive(t, CompressZstd)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// newIdentity writes a new age identity into dir and returns the file and its public key
+func newIdentity(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(file, []byte("# "+name+"\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, identity.Recipient().String()
+}
+
+func TestEncryptRecipients(t *testing.T) {
+	dir := t.TempDir()
+	aliceKey, alice := newIdentity(t, dir, "alice.key")
+	bobKey, bob := newIdentity(t, dir, "bob.key")
+	_, eve := newIdentity(t, dir, "eve.key")
+	eveKey := filepath.Join(dir, "eve.key")
+
+	// a recipient is a public key or a file of public keys
+	recipients := filepath.Join(dir, "recipients.txt")
+	if err := ioutil.WriteFile(recipients, []byte("# team\n"+bob+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys([]string{alice, recipients}, nil, "")
+	if err != nil {
+		t.Fatalf("LoadKeys() failed: %s", err)
+	}
+	if !keys.Encrypting() || len(keys.Recipients) != 2 {
+		t.Fatalf("LoadKeys() has %d recipients, want 2", len(keys.Recipients))
+	}
+	archive := encryptArchive(t, keys)
+	if bytes.Contains(archive, []byte(MetadataName)) {
+		t.Errorf("the encrypted archive contains the metadata in clear")
+	}
+
+	for _, identity := range []string{aliceKey, bobKey} {
+		keys, err := LoadKeys(nil, []string{identity}, "")
+		if err != nil {
+			t.Fatalf("LoadKeys() failed: %s", err)
+		}
+		if keys.Encrypting() {
+			t.Errorf("identities alone encrypt new data")
+		}
+		r, err := NewReader(bytes.NewReader(archive), keys)
+		if err != nil {
+			t.Fatalf("NewReader() with %s failed: %s", filepath.Base(identity), err)
+		}
+		if !r.Encrypted || r.Metadata.Name != "pg" {
+			t.Errorf("NewReader() = encrypted %v, metadata %+v", r.Encrypted, r.Metadata)
+		}
+		if _, err = r.Verify(); err != nil {
+			t.Errorf("Verify() with %s failed: %s", filepath.Base(identity), err)
+		}
+	}
+
+	wrong, err := LoadKeys([]string{eve}, []string{eveKey}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewReader(bytes.NewReader(archive), wrong); err == nil || !strings.Contains(err.Error(), "decrypt backup failed") {
+		t.Errorf("NewReader() with the wrong key = %v, want it to fail", err)
+	}
+	if _, err = NewReader(bytes.NewReader(archive), nil); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("NewReader() without a key = %v, want it to ask for one", err)
+	}
+}
+
+func TestEncryptPassphrase(t *testing.T) {
+	keys, err := LoadKeys(nil, nil, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("LoadKeys() failed: %s", err)
+	}
+	archive := encryptArchive(t, keys)
+
+	r, err := NewReader(bytes.NewReader(archive), keys)
+	if err != nil {
+		t.Fatalf("NewReader() with the passphrase failed: %s", err)
+	}
+	if _, err = r.Verify(); err != nil {
+		t.Errorf("Verify() failed: %s", err)
+	}
+
+	wrong, err := LoadKeys(nil, nil, "wrong horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewReader(bytes.NewReader(archive), wrong); err == nil {
+		t.Errorf("NewReader() with the wrong passphrase succeeded")
+	}
+}
+
+func TestEncryptTampered(t *testing.T) {
+	dir := t.TempDir()
+	key, recipient := newIdentity(t, dir, "key")
+	keys, err := LoadKeys([]string{recipient}, []string{key}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := encryptArchive(t, keys)
+	// flip a byte of the last block, every block is authenticated
+	archive[len(archive)-20] ^= 0xff
+
+	r, err := NewReader(bytes.NewReader(archive), keys)
+	if err == nil {
+		_, err = r.Verify()
+	}
+	if err == nil {
+		t.Errorf("a modified encrypted archive was read without an error")
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, recipient := newIdentity(t, dir, "key")
+	tests := []struct {
+		name       string
+		recipients []string
+		identities []string
+		passphrase string
+		wantErr    string
+	}{
+		{name: "passphrase and recipients", recipients: []string{recipient}, passphrase: "secret", wantErr: "can't be used together"},
+		{name: "bad public key", recipients: []string{"age1notakey"}, wantErr: "age1notakey"},
+		{name: "missing recipients file", recipients: []string{filepath.Join(dir, "missing")}, wantErr: "neither an age public key nor a readable file"},
+		{name: "missing identity file", identities: []string{filepath.Join(dir, "missing")}, wantErr: "missing"},
+		{name: "not an identity", identities: []string{filepath.Join(dir, "key.pub")}, wantErr: "parse identity file"},
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pub"), []byte(recipient+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeys(tt.recipients, tt.identities, tt.passphrase)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadKeys() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
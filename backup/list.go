@@ -0,0 +1,128 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TypeArchive  = "archive"
+	TypeSnapshot = "snapshot"
+)
+
+// Listing is a backup found in a store, an archive or a snapshot of a repository
+type Listing struct {
+	Name     string         `json:"name"`
+	Type     string         `json:"type"`
+	Metadata Metadata       `json:"metadata"`
+	Stats    *SnapshotStats `json:"stats,omitempty"`
+	Snapshot *Snapshot      `json:"-"`
+}
+
+// IsArchive tells whether name looks like an archive written by Write
+func IsArchive(name string) bool {
+	name = strings.TrimSuffix(name, AgeExtension)
+	return strings.HasSuffix(name, ".tar.zst") || strings.HasSuffix(name, ".tar.gz")
+}
+
+// Extension returns the file extension of an archive compressed with compression
+func Extension(compression string, encrypted bool) string {
+	ext := ".tar.zst"
+	if compression == CompressGzip {
+		ext = ".tar.gz"
+	}
+	if encrypted {
+		ext += AgeExtension
+	}
+	return ext
+}
+
+// ObjectName is the default name of a backup in a store, backups of the same volume share a prefix. The kind and
+// the ordinal of a StatefulSet pod are part of the name, so that the backups of several pods taken at the same
+// time don't overwrite each other.
+func ObjectName(namespace, kind, name string, index int, volume, compression string, encrypted bool, at time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/%s-%s%s", namespace, name, volume, InstanceName(kind, index), at.UTC().Format("20060102T150405Z"),
+		Extension(compression, encrypted))
+}
+
+// InstanceName names the resource a backup is taken from by its short kind, followed by the ordinal for a
+// StatefulSet, e.g. sts-1 or deploy. kind is either the kind of the command line or the one of the metadata.
+func InstanceName(kind string, index int) string {
+	switch strings.ToLower(kind) {
+	case "deploy", "deployment":
+		return "deploy"
+	case "sts", "statefulset":
+		return fmt.Sprintf("sts-%d", index)
+	case "ds", "daemonset":
+		return "ds"
+	case "pod":
+		return "pod"
+	}
+	return strings.ToLower(kind)
+}
+
+// List reads the metadata of every archive under prefix, the newest first. Only the beginning of every
+// archive is read, encrypted archives need the identities of keys. Objects that are not readable backups are skipped and returned in skipped.
+func List(store Store, prefix string, keys *Keys) (backups []Listing, skipped map[string]error, err error) {
+	names, err := store.List(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skipped = make(map[string]error)
+	for _, name := range names {
+		if !IsArchive(name) || strings.HasPrefix(name, SnapshotsDir) {
+			continue
+		}
+		meta, err := ReadMetadata(store, name, keys)
+		if err != nil {
+			skipped[name] = err
+			continue
+		}
+		backups = append(backups, Listing{Name: name, Type: TypeArchive, Metadata: *meta})
+	}
+
+	sortListings(backups)
+	return backups, skipped, nil
+}
+
+// sortListings puts the newest first
+func sortListings(listings []Listing) {
+	sort.SliceStable(listings, func(i, j int) bool {
+		return listings[i].Metadata.CreatedAt.After(listings[j].Metadata.CreatedAt)
+	})
+}
+
+// ReadMetadata reads the metadata entry of the archive name of store
+func ReadMetadata(store Store, name string, keys *Keys) (*Metadata, error) {
+	rc, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	reader, err := NewReader(rc, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return &reader.Metadata, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy tells which backups of a volume are kept, a backup is kept as soon as one rule keeps it
+type RetentionPolicy struct {
+	// Last keeps the newest backups
+	Last int
+	// Daily, Weekly and Monthly keep the newest backup of as many days, weeks and months
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+func (p RetentionPolicy) Empty() bool {
+	return p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0
+}
+
+// GroupKey identifies the volume a backup was taken from, the retention policy applies per group
+func GroupKey(l Listing) string {
+	meta := l.Metadata
+	return fmt.Sprintf("%s %s/%s/%s/%d/%s", l.Type, meta.Namespace, meta.Kind, meta.Name, meta.InstanceIndex, meta.Volume)
+}
+
+// Apply splits the backups of a group into the kept and the removed ones
+func (p RetentionPolicy) Apply(listings []Listing) (keep, remove []Listing) {
+	sorted := append([]Listing(nil), listings...)
+	sortListings(sorted)
+
+	buckets := []struct {
+		count int
+		key   func(t time.Time) string
+		seen  map[string]bool
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }, map[string]bool{}},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}, map[string]bool{}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }, map[string]bool{}},
+	}
+
+	for i, l := range sorted {
+		kept := i < p.Last
+		at := l.Metadata.CreatedAt.Local()
+		for j := range buckets {
+			b := &buckets[j]
+			key := b.key(at)
+			if len(b.seen) < b.count && !b.seen[key] {
+				b.seen[key] = true
+				kept = true
+			}
+		}
+		if kept {
+			keep = append(keep, l)
+		} else {
+			remove = append(remove, l)
+		}
+	}
+	return keep, remove
+}
+
+// GCResult counts the blobs no snapshot references anymore
+type GCResult struct {
+	Chunks int `json:"chunks"`
+	Trees  int `json:"trees"`
+}
+
+// ActiveLocks returns the locks of other running backups or prunes, stale locks are ignored
+func (r *Repository) ActiveLocks() ([]Lock, error) {
+	locks, err := r.Locks()
+	if err != nil {
+		return nil, err
+	}
+	var active []Lock
+	for _, lock := range locks {
+		if !lock.Stale() {
+			active = append(active, lock)
+		}
+	}
+	return active, nil
+}
+
+// GC removes the chunks and the trees no snapshot of the repository references. A backup running at the same
+// time could reference a chunk that looks unreferenced, so the caller must hold the prune lock of the repository.
+func (r *Repository) GC(dryRun bool) (*GCResult, error) {
+	snapshots, skipped, err := r.Snapshots("")
+	if err != nil {
+		return nil, err
+	}
+	if len(skipped) > 0 {
+		// a snapshot that can't be read may reference any chunk
+		var names []string
+		for name := range skipped {
+			names = append(names, name)
+		}
+		return nil, errors.New(fmt.Sprintf("can't read snapshots %s, refuse to collect garbage", strings.Join(names, ", ")))
+	}
+
+	trees := make(map[string]bool)
+	chunks := make(map[string]bool)
+	for _, snap := range snapshots {
+		if trees[snap.Snapshot.Tree] {
+			continue
+		}
+		trees[snap.Snapshot.Tree] = true
+		tree, err := r.LoadTree(snap.Snapshot.Tree)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("read tree of %s failed: %s", snap.Name, err))
+		}
+		for _, node := range tree.Nodes {
+			for _, id := range node.Chunks {
+				chunks[id] = true
+			}
+		}
+	}
+
+	result := &GCResult{}
+	if result.Chunks, err = r.removeUnreferenced(chunksDir, chunks, dryRun); err != nil {
+		return result, err
+	}
+	result.Trees, err = r.removeUnreferenced(treesDir, trees, dryRun)
+	return result, err
+}
+
+func (r *Repository) removeUnreferenced(dir string, referenced map[string]bool, dryRun bool) (int, error) {
+	ids, err := r.listBlobs(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, id := range ids {
+		if referenced[id] {
+			continue
+		}
+		if !dryRun {
+			if err = r.store.Remove(blobName(dir, id)); err != nil {
+				return removed, errors.New(fmt.Sprintf("remove %s%s failed: %s", dir, id, err))
+			}
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// RemoveSnapshot removes a snapshot, its chunks are removed by GC
+func (r *Repository) RemoveSnapshot(name string) error {
+	return r.store.Remove(name)
+}
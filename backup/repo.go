@@ -0,0 +1,545 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layout of a repository in its store:
+//
+//	config.json                               chunk sizes of the repository
+//	key.age                                   data key of an encrypted repository, encrypted with age
+//	chunks/<id[:2]>/<id>                      compressed file contents, id is the sha256 of the content
+//	trees/<id[:2]>/<id>                       compressed file lists of snapshots
+//	snapshots/<namespace>/<name>/<volume>/<kind>[-<ordinal>]-<time>.snapshot
+//	locks/<host>-<pid>-<time>.json            running backups and prunes
+const (
+	repoConfigName    = "config.json"
+	repoKeyName       = "key.age"
+	chunksDir         = "chunks/"
+	treesDir          = "trees/"
+	SnapshotsDir      = "snapshots/"
+	locksDir          = "locks/"
+	SnapshotExtension = ".snapshot"
+
+	// a lock not refreshed for this long is left over by a killed process
+	StaleLockAge = 24 * time.Hour
+	// LockRefreshInterval is how often a running operation refreshes its lock
+	LockRefreshInterval = 10 * time.Minute
+
+	// purposes of the locks
+	LockBackup = "backup"
+	LockPrune  = "prune"
+)
+
+// RepoConfig is written when the repository is initialized
+type RepoConfig struct {
+	Version      int       `json:"version"`
+	MinChunkSize int       `json:"minChunkSize"`
+	AvgChunkSize int       `json:"avgChunkSize"`
+	MaxChunkSize int       `json:"maxChunkSize"`
+	Encrypted    bool      `json:"encrypted,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Repository is a content addressed store of chunks shared by the snapshots of every volume
+type Repository struct {
+	store Store
+	enc   *zstd.Encoder
+	dec   *zstd.Decoder
+	// aead and idKey are set for an encrypted repository, blobs are then sealed with XChaCha20-Poly1305 and
+	// named after a HMAC of their content so that the names don't reveal the content
+	aead  cipher.AEAD
+	idKey []byte
+
+	mu sync.Mutex
+	// known caches the ids of the chunks in the store, it is loaded on the first use
+	known map[string]bool
+}
+
+// RepositoryExists tells whether store holds a repository
+func RepositoryExists(store Store) (bool, error) {
+	return store.Exists(repoConfigName)
+}
+
+// OpenRepository opens the repository kept in store, initializing it when the store is empty. A repository
+// initialized with the recipients of keys is encrypted, opening it again needs the identities of keys.
+func OpenRepository(store Store, keys *Keys) (*Repository, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{store: store, enc: enc, dec: dec}
+
+	exists, err := store.Exists(repoConfigName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return repo, repo.init(keys)
+	}
+
+	data, err := readObject(store, repoConfigName)
+	if err != nil {
+		return nil, err
+	}
+	var cfg RepoConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.New(fmt.Sprintf("decode repository config failed: %s", err))
+	}
+	if cfg.Version > FormatVersion {
+		return nil, errors.New(fmt.Sprintf("repository format version %d is newer than the supported version %d", cfg.Version, FormatVersion))
+	}
+	if cfg.MinChunkSize != MinChunkSize || cfg.AvgChunkSize != AvgChunkSize || cfg.MaxChunkSize != MaxChunkSize {
+		return nil, errors.New("the chunk sizes of the repository differ from the ones of this version")
+	}
+
+	if !cfg.Encrypted {
+		if keys.Encrypting() {
+			return nil, errors.New("the repository was initialized without encryption, please use another repository to encrypt the backups")
+		}
+		return repo, nil
+	}
+	if len(keys.identities()) == 0 {
+		return nil, errors.New("the repository is encrypted, please set --identity or --passphrase-file")
+	}
+	blob, err := readObject(store, repoKeyName)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("read repository key failed: %s", err))
+	}
+	dr, err := age.Decrypt(bytes.NewReader(blob), keys.identities()...)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decrypt repository key failed: %s", err))
+	}
+	dataKey, err := ioutil.ReadAll(dr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decrypt repository key failed: %s", err))
+	}
+	return repo, repo.setKey(dataKey)
+}
+
+// init writes the config of a new repository, and its data key encrypted to the recipients of keys
+func (r *Repository) init(keys *Keys) error {
+	cfg := RepoConfig{Version: FormatVersion, MinChunkSize: MinChunkSize, AvgChunkSize: AvgChunkSize,
+		MaxChunkSize: MaxChunkSize, Encrypted: keys.Encrypting(), CreatedAt: time.Now()}
+
+	if cfg.Encrypted {
+		dataKey := make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return err
+		}
+		var blob bytes.Buffer
+		w, err := age.Encrypt(&blob, keys.Recipients...)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(dataKey); err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+		if err = r.store.Put(repoKeyName, blob.Bytes()); err != nil {
+			return err
+		}
+		if err = r.setKey(dataKey); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.store.Put(repoConfigName, data)
+}
+
+// setKey derives the encryption key and the HMAC key of the blob ids from the data key of the repository
+func (r *Repository) setKey(dataKey []byte) error {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, dataKey)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	aead, err := chacha20poly1305.NewX(derive("sync-volume-data encryption"))
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	r.idKey = derive("sync-volume-data blob id")
+	return nil
+}
+
+// String describes the repository in logs
+func (r *Repository) String() string {
+	return r.store.String()
+}
+
+// seal encodes the blob name before it is stored. The name is authenticated with the content, so that a blob
+// moved to another name fails to unseal.
+func (r *Repository) seal(name string, data []byte) ([]byte, error) {
+	compressed := r.enc.EncodeAll(data, nil)
+	if r.aead == nil {
+		return compressed, nil
+	}
+	nonce := make([]byte, r.aead.NonceSize(), r.aead.NonceSize()+len(compressed)+r.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return r.aead.Seal(nonce, nonce, compressed, []byte(name)), nil
+}
+
+// unseal decodes a blob written by seal
+func (r *Repository) unseal(name string, blob []byte) ([]byte, error) {
+	if r.aead != nil {
+		if len(blob) < r.aead.NonceSize() {
+			return nil, errors.New("blob is truncated")
+		}
+		nonce, ciphertext := blob[:r.aead.NonceSize()], blob[r.aead.NonceSize():]
+		plain, err := r.aead.Open(nil, nonce, ciphertext, []byte(name))
+		if err != nil {
+			return nil, errors.New("blob is corrupted or was tampered with")
+		}
+		blob = plain
+	}
+	return r.dec.DecodeAll(blob, nil)
+}
+
+// blobID names a blob after its content
+func (r *Repository) blobID(data []byte) string {
+	if r.idKey == nil {
+		return hashID(data)
+	}
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func blobName(dir, id string) string {
+	return dir + id[:2] + "/" + id
+}
+
+func hashID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// listBlobs returns the ids of the blobs of dir
+func (r *Repository) listBlobs(dir string) ([]string, error) {
+	names, err := r.store.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		ids = append(ids, path.Base(name))
+	}
+	return ids, nil
+}
+
+func (r *Repository) loadKnown() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.known != nil {
+		return nil
+	}
+	ids, err := r.listBlobs(chunksDir)
+	if err != nil {
+		return errors.New(fmt.Sprintf("list chunks of the repository failed: %s", err))
+	}
+	r.known = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		r.known[id] = true
+	}
+	return nil
+}
+
+// claimChunk tells whether the chunk id must be stored, a chunk is only claimed once
+func (r *Repository) claimChunk(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.known[id] {
+		return false
+	}
+	r.known[id] = true
+	return true
+}
+
+func (r *Repository) dropChunk(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.known, id)
+}
+
+// saveChunk stores the chunk data whose sha256 is id
+func (r *Repository) saveChunk(id string, data []byte) error {
+	blob, err := r.seal(blobName(chunksDir, id), data)
+	if err != nil {
+		return err
+	}
+	if err = r.store.Put(blobName(chunksDir, id), blob); err != nil {
+		r.dropChunk(id)
+		return errors.New(fmt.Sprintf("store chunk %s failed: %s", id, err))
+	}
+	return nil
+}
+
+// LoadChunk reads a chunk and checks its content against its id
+func (r *Repository) LoadChunk(id string) ([]byte, error) {
+	return r.loadBlob(chunksDir, id)
+}
+
+func (r *Repository) loadBlob(dir, id string) ([]byte, error) {
+	blob, err := readObject(r.store, blobName(dir, id))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("read %s%s failed: %s", dir, id, err))
+	}
+	data, err := r.unseal(blobName(dir, id), blob)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decode %s%s failed: %s", dir, id, err))
+	}
+	if r.blobID(data) != id {
+		return nil, errors.New(fmt.Sprintf("%s%s is corrupted, its checksum does not match", dir, id))
+	}
+	return data, nil
+}
+
+// saveTree stores the file list of a snapshot, identical lists are stored once
+func (r *Repository) saveTree(tree *Tree) (string, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return "", err
+	}
+	id := r.blobID(data)
+	exists, err := r.store.Exists(blobName(treesDir, id))
+	if err != nil || exists {
+		return id, err
+	}
+	blob, err := r.seal(blobName(treesDir, id), data)
+	if err != nil {
+		return "", err
+	}
+	return id, r.store.Put(blobName(treesDir, id), blob)
+}
+
+// LoadTree reads the file list of a snapshot
+func (r *Repository) LoadTree(id string) (*Tree, error) {
+	data, err := r.loadBlob(treesDir, id)
+	if err != nil {
+		return nil, err
+	}
+	tree := &Tree{}
+	return tree, json.Unmarshal(data, tree)
+}
+
+// SnapshotName is the name of a snapshot in the repository
+func SnapshotName(meta Metadata) string {
+	return SnapshotsDir + strings.TrimSuffix(ObjectName(meta.Namespace, meta.Kind, meta.Name, meta.InstanceIndex, meta.Volume,
+		"", false, meta.CreatedAt), Extension("", false)) + SnapshotExtension
+}
+
+func (r *Repository) saveSnapshot(snap *Snapshot) (string, error) {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := SnapshotName(snap.Metadata)
+	blob, err := r.seal(name, data)
+	if err != nil {
+		return "", err
+	}
+	return name, r.store.Put(name, blob)
+}
+
+// LoadSnapshot reads the snapshot name
+func (r *Repository) LoadSnapshot(name string) (*Snapshot, error) {
+	blob, err := readObject(r.store, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.unseal(name, blob)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decode snapshot %s failed: %s", name, err))
+	}
+	snap := &Snapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return nil, errors.New(fmt.Sprintf("decode snapshot %s failed: %s", name, err))
+	}
+	return snap, nil
+}
+
+// Snapshots lists the snapshots under prefix, a namespace/name/volume path, the newest first
+func (r *Repository) Snapshots(prefix string) (snapshots []Listing, skipped map[string]error, err error) {
+	names, err := r.store.List(SnapshotsDir + prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	skipped = make(map[string]error)
+	for _, name := range names {
+		if !strings.HasSuffix(name, SnapshotExtension) {
+			continue
+		}
+		snap, err := r.LoadSnapshot(name)
+		if err != nil {
+			skipped[name] = err
+			continue
+		}
+		snapshots = append(snapshots, Listing{Name: name, Type: TypeSnapshot, Metadata: snap.Metadata, Snapshot: snap})
+	}
+	sortListings(snapshots)
+	return snapshots, skipped, nil
+}
+
+// Lock records a running backup or prune in the repository
+type Lock struct {
+	Name        string    `json:"-"`
+	Host        string    `json:"host"`
+	PID         int       `json:"pid"`
+	Purpose     string    `json:"purpose"`
+	CreatedAt   time.Time `json:"createdAt"`
+	RefreshedAt time.Time `json:"refreshedAt,omitempty"`
+}
+
+// Stale tells whether the lock was left over by a killed process
+func (l Lock) Stale() bool {
+	seen := l.RefreshedAt
+	if seen.IsZero() {
+		seen = l.CreatedAt
+	}
+	return time.Since(seen) >= StaleLockAge
+}
+
+// String describes the holder of the lock in errors
+func (l Lock) String() string {
+	return fmt.Sprintf("%s by %s pid %d since %s", l.Purpose, l.Host, l.PID, l.CreatedAt.Local().Format(time.RFC3339))
+}
+
+// conflicts tells whether an operation for purpose can't run while the lock is held, backups can run at the
+// same time but a prune needs the repository for itself
+func (l Lock) conflicts(purpose string) bool {
+	return purpose == LockPrune || l.Purpose == LockPrune
+}
+
+// Lock registers a running operation, the returned function removes the lock. The lock is written before the
+// other locks are listed, so that of two conflicting operations started at the same time at least one sees
+// the other and gives up. The lock is refreshed until it is removed so that a long backup is never taken as
+// stale.
+func (r *Repository) Lock(purpose string) (func() error, error) {
+	host, _ := os.Hostname()
+	lock := Lock{Host: host, PID: os.Getpid(), Purpose: purpose, CreatedAt: time.Now()}
+	name := fmt.Sprintf("%s%s-%d-%d.json", locksDir, host, lock.PID, lock.CreatedAt.UnixNano())
+	write := func() error {
+		lock.RefreshedAt = time.Now()
+		data, err := json.Marshal(lock)
+		if err != nil {
+			return err
+		}
+		return r.store.Put(name, data)
+	}
+	if err := write(); err != nil {
+		return nil, errors.New(fmt.Sprintf("lock repository failed: %s", err))
+	}
+
+	locks, err := r.ActiveLocks()
+	if err != nil {
+		r.store.Remove(name)
+		return nil, errors.New(fmt.Sprintf("lock repository failed: %s", err))
+	}
+	var holders []string
+	for _, other := range locks {
+		if other.Name != name && other.conflicts(purpose) {
+			holders = append(holders, other.String())
+		}
+	}
+	if len(holders) > 0 {
+		r.store.Remove(name)
+		return nil, &LockedError{Holders: holders}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(LockRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a failed refresh is retried on the next tick, the lock only turns stale after StaleLockAge
+				write()
+			}
+		}
+	}()
+	return func() error {
+		close(stop)
+		<-done
+		return r.store.Remove(name)
+	}, nil
+}
+
+// LockedError is returned by Lock when a conflicting operation holds the repository
+type LockedError struct {
+	Holders []string
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("the repository is in use (%s)", strings.Join(e.Holders, "; "))
+}
+
+// Locks lists the locks of the repository
+func (r *Repository) Locks() ([]Lock, error) {
+	names, err := r.store.List(locksDir)
+	if err != nil {
+		return nil, err
+	}
+	var locks []Lock
+	for _, name := range names {
+		data, err := readObject(r.store, name)
+		if err != nil {
+			continue
+		}
+		lock := Lock{Name: name}
+		if json.Unmarshal(data, &lock) == nil {
+			locks = append(locks, lock)
+		}
+	}
+	return locks, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	SSENone = ""
+	SSES3   = "AES256"
+	SSEKMS  = "aws:kms"
+
+	// DefaultPartSize bounds the memory used by an upload, an object has at most 10000 parts so it also
+	// bounds the size of a backup to 640 GiB
+	DefaultPartSize = 64 << 20
+)
+
+// S3Config describes a bucket of an S3 compatible object storage such as AWS S3 or MinIO
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+	// SSE asks the storage to encrypt the objects, AES256 or aws:kms
+	SSE         string
+	SSEKMSKeyID string
+	PartSize    uint64
+}
+
+// S3Store keeps backups in a bucket, objects are streamed with multipart uploads so nothing is staged on disk
+type S3Store struct {
+	client *minio.Client
+	cfg    S3Config
+	sse    encrypt.ServerSide
+}
+
+// NewS3Store connects to the bucket of cfg. Without an access key the credentials are read from the
+// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or MINIO_ROOT_USER/MINIO_ROOT_PASSWORD environment variables.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket are required")
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}})
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	}
+
+	store := &S3Store{cfg: cfg}
+	switch cfg.SSE {
+	case SSENone:
+	case SSES3:
+		store.sse = encrypt.NewSSE()
+	case SSEKMS:
+		sse, err := encrypt.NewSSEKMS(cfg.SSEKMSKeyID, nil)
+		if err != nil {
+			return nil, err
+		}
+		store.sse = sse
+	default:
+		return nil, errors.New(fmt.Sprintf("not support server side encryption %s, please use %s or %s", cfg.SSE, SSES3, SSEKMS))
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{Creds: creds, Secure: !cfg.Insecure, Region: cfg.Region})
+	if err != nil {
+		return nil, err
+	}
+	store.client = client
+
+	exists, err := client.BucketExists(context.TODO(), cfg.Bucket)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("check bucket %s failed: %s", cfg.Bucket, err))
+	}
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("bucket %s does not exist", cfg.Bucket))
+	}
+	return store, nil
+}
+
+func (s *S3Store) key(name string) string {
+	if s.cfg.Prefix == "" {
+		return name
+	}
+	return s.cfg.Prefix + "/" + name
+}
+
+func (s *S3Store) Create(name string) (Writer, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+	opts := minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		PartSize:             s.cfg.PartSize,
+		ServerSideEncryption: s.sse,
+	}
+	go func() {
+		// an unknown size makes the client upload parts as they are filled, a failed upload is aborted
+		_, err := s.client.PutObject(context.TODO(), s.cfg.Bucket, s.key(name), pr, -1, opts)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (s *S3Store) Put(name string, data []byte) error {
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream", ServerSideEncryption: s.sse}
+	_, err := s.client.PutObject(context.TODO(), s.cfg.Bucket, s.key(name), bytes.NewReader(data), int64(len(data)), opts)
+	return err
+}
+
+func (s *S3Store) Open(name string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.TODO(), s.cfg.Bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, stat it so that a missing object fails here
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, errors.New(fmt.Sprintf("open %s failed: %s", s.key(name), err))
+	}
+	return obj, nil
+}
+
+func (s *S3Store) List(prefix string) ([]string, error) {
+	var names []string
+	root := s.key("")
+	for obj := range s.client.ListObjects(context.TODO(), s.cfg.Bucket, minio.ListObjectsOptions{Prefix: s.key(prefix), Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, root))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *S3Store) Remove(name string) error {
+	return s.client.RemoveObject(context.TODO(), s.cfg.Bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Store) Exists(name string) (bool, error) {
+	_, err := s.client.StatObject(context.TODO(), s.cfg.Bucket, s.key(name), minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *S3Store) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.cfg.Bucket, s.cfg.Prefix)
+}
+
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+func (w *s3Writer) Abort(err error) {
+	if err == nil {
+		err = errors.New("upload aborted")
+	}
+	w.pw.CloseWithError(err)
+	<-w.done
+}
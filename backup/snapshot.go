@@ -0,0 +1,438 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FindFormat is the -printf format of find whose output is parsed by ReadNodes, every field ends with a NUL
+// byte so that any file name can be parsed
+const FindFormat = `%y\0%s\0%T@\0%m\0%U\0%G\0%l\0%P\0`
+
+const (
+	NodeFile    = "file"
+	NodeDir     = "dir"
+	NodeSymlink = "symlink"
+	NodeOther   = "other"
+
+	// uploadWorkers is the number of chunks stored concurrently, object stores are latency bound
+	uploadWorkers = 8
+)
+
+// Node is an entry of a snapshot
+type Node struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size,omitempty"`
+	Mode    int64     `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	ModTime time.Time `json:"modTime"`
+	Target  string    `json:"target,omitempty"`
+	Chunks  []string  `json:"chunks,omitempty"`
+}
+
+// Tree lists the entries of a snapshot sorted by path, so a directory comes before its content
+type Tree struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// SnapshotStats summarizes a snapshot
+type SnapshotStats struct {
+	Files        int   `json:"files"`
+	Dirs         int   `json:"dirs"`
+	TotalBytes   int64 `json:"totalBytes"`
+	ChangedFiles int   `json:"changedFiles"`
+	ReadBytes    int64 `json:"readBytes"`
+	NewChunks    int   `json:"newChunks"`
+	NewBytes     int64 `json:"newBytes"`
+}
+
+// Snapshot is a point in time of a volume kept in a repository
+type Snapshot struct {
+	Metadata Metadata      `json:"metadata"`
+	Parent   string        `json:"parent,omitempty"`
+	Tree     string        `json:"tree"`
+	Stats    SnapshotStats `json:"stats"`
+}
+
+// ReadNodes parses the output of find with FindFormat
+func ReadNodes(r io.Reader) ([]Node, error) {
+	br := bufio.NewReader(r)
+	var nodes []Node
+	fields := make([]string, 8)
+	for {
+		for i := range fields {
+			field, err := br.ReadString(0)
+			if err == io.EOF && i == 0 && field == "" {
+				sortNodes(nodes)
+				return nodes, nil
+			}
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("parse file list failed: %s", err))
+			}
+			fields[i] = strings.TrimSuffix(field, "\x00")
+		}
+
+		node, err := parseNode(fields)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+func parseNode(fields []string) (Node, error) {
+	node := Node{Path: fields[7], Target: fields[6]}
+	switch fields[0] {
+	case "f":
+		node.Type = NodeFile
+	case "d":
+		node.Type = NodeDir
+	case "l":
+		node.Type = NodeSymlink
+	default:
+		node.Type = NodeOther
+	}
+
+	var err error
+	if node.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return node, errors.New(fmt.Sprintf("parse size of %s failed: %s", node.Path, err))
+	}
+	if node.ModTime, err = parseFindTime(fields[2]); err != nil {
+		return node, errors.New(fmt.Sprintf("parse mtime of %s failed: %s", node.Path, err))
+	}
+	if node.Mode, err = strconv.ParseInt(fields[3], 8, 64); err != nil {
+		return node, errors.New(fmt.Sprintf("parse mode of %s failed: %s", node.Path, err))
+	}
+	if node.UID, err = strconv.Atoi(fields[4]); err != nil {
+		return node, errors.New(fmt.Sprintf("parse uid of %s failed: %s", node.Path, err))
+	}
+	if node.GID, err = strconv.Atoi(fields[5]); err != nil {
+		return node, errors.New(fmt.Sprintf("parse gid of %s failed: %s", node.Path, err))
+	}
+	if node.Type != NodeFile {
+		node.Size = 0
+	}
+	return node, nil
+}
+
+// parseFindTime parses the seconds.nanoseconds of %T@
+func parseFindTime(s string) (time.Time, error) {
+	parts := strings.SplitN(s, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		frac := (parts[1] + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+func sortNodes(nodes []Node) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+}
+
+// Plan reuses the chunks of the parent tree for the files whose size and mtime did not change and returns
+// the paths of the files that have to be read
+func Plan(nodes []Node, parent *Tree) (changed []string) {
+	previous := make(map[string]*Node)
+	if parent != nil {
+		for i := range parent.Nodes {
+			previous[parent.Nodes[i].Path] = &parent.Nodes[i]
+		}
+	}
+
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Type != NodeFile {
+			continue
+		}
+		if p := previous[node.Path]; p != nil && p.Type == NodeFile && p.Size == node.Size && p.ModTime.Equal(node.ModTime) {
+			node.Chunks = p.Chunks
+			continue
+		}
+		changed = append(changed, node.Path)
+	}
+	return changed
+}
+
+// uploader stores chunks concurrently and keeps the first error
+type uploader struct {
+	repo *Repository
+	jobs chan chunkJob
+	wg   sync.WaitGroup
+
+	mu    sync.Mutex
+	err   error
+	count int
+	bytes int64
+}
+
+type chunkJob struct {
+	id   string
+	data []byte
+}
+
+func newUploader(repo *Repository) *uploader {
+	u := &uploader{repo: repo, jobs: make(chan chunkJob, uploadWorkers)}
+	for i := 0; i < uploadWorkers; i++ {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			for job := range u.jobs {
+				err := u.repo.saveChunk(job.id, job.data)
+				u.mu.Lock()
+				if err != nil && u.err == nil {
+					u.err = err
+				}
+				if err == nil {
+					u.count++
+					u.bytes += int64(len(job.data))
+				}
+				u.mu.Unlock()
+			}
+		}()
+	}
+	return u
+}
+
+func (u *uploader) failed() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+func (u *uploader) wait() error {
+	close(u.jobs)
+	u.wg.Wait()
+	return u.err
+}
+
+// StoreFiles chunks the files of tarStream, a tar of the changed files, and stores the chunks missing in the
+// repository. The nodes of the files are updated with their chunks and the size actually read, files
+// missing from the stream are removed from the tree.
+func (r *Repository) StoreFiles(tree *Tree, changed []string, tarStream io.Reader, stats *SnapshotStats, onFile func(name string, size int64)) error {
+	if err := r.loadKnown(); err != nil {
+		return err
+	}
+	index := make(map[string]*Node, len(tree.Nodes))
+	for i := range tree.Nodes {
+		index[tree.Nodes[i].Path] = &tree.Nodes[i]
+	}
+
+	up := newUploader(r)
+	read := make(map[string]bool, len(changed))
+	tr := tar.NewReader(tarStream)
+	chunker := NewChunker(nil)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			up.wait()
+			return errors.New(fmt.Sprintf("read tar stream of the volume failed: %s", err))
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		node := index[name]
+		if node == nil || node.Type != NodeFile || entryType(hdr.Typeflag) != "file" {
+			continue
+		}
+
+		node.Chunks = nil
+		node.Size = hdr.Size
+		chunker.Reset(tr)
+		for {
+			chunk, err := chunker.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				up.wait()
+				return errors.New(fmt.Sprintf("read %s failed: %s", name, err))
+			}
+			id := r.blobID(chunk)
+			node.Chunks = append(node.Chunks, id)
+			if r.claimChunk(id) {
+				up.jobs <- chunkJob{id: id, data: append([]byte(nil), chunk...)}
+			}
+		}
+		if err = up.failed(); err != nil {
+			up.wait()
+			return err
+		}
+
+		read[name] = true
+		stats.ChangedFiles++
+		stats.ReadBytes += hdr.Size
+		if onFile != nil {
+			onFile(name, hdr.Size)
+		}
+	}
+	if err := up.wait(); err != nil {
+		return err
+	}
+	stats.NewChunks += up.count
+	stats.NewBytes += up.bytes
+
+	// a file removed between the listing and the read is not part of the snapshot
+	if len(read) != len(changed) {
+		missing := make(map[string]bool)
+		for _, name := range changed {
+			if !read[name] {
+				missing[name] = true
+			}
+		}
+		nodes := tree.Nodes[:0]
+		for _, node := range tree.Nodes {
+			if !missing[node.Path] {
+				nodes = append(nodes, node)
+			}
+		}
+		tree.Nodes = nodes
+	}
+	return nil
+}
+
+// Commit stores the tree and the snapshot, stats gets the totals of the tree
+func (r *Repository) Commit(snap *Snapshot, tree *Tree) (string, error) {
+	snap.Stats.Files, snap.Stats.Dirs, snap.Stats.TotalBytes = 0, 0, 0
+	for _, node := range tree.Nodes {
+		switch node.Type {
+		case NodeFile:
+			snap.Stats.Files++
+			snap.Stats.TotalBytes += node.Size
+		case NodeDir:
+			snap.Stats.Dirs++
+		}
+	}
+
+	id, err := r.saveTree(tree)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("store tree failed: %s", err))
+	}
+	snap.Tree = id
+	snap.Metadata.Version = FormatVersion
+	return r.saveSnapshot(snap)
+}
+
+// WriteTar writes the entries of tree as a tar stream, the content of every chunk is checked on the way.
+// Entries that are neither files, directories nor symlinks are skipped and returned. onFile gets the sha256 of the
+// content of every file written.
+func (r *Repository) WriteTar(w io.Writer, tree *Tree, onFile func(name string, size int64, sum string)) (skipped []string, err error) {
+	tw := tar.NewWriter(w)
+	for _, node := range tree.Nodes {
+		hdr := &tar.Header{
+			Name:    "./" + node.Path,
+			Mode:    node.Mode,
+			Uid:     node.UID,
+			Gid:     node.GID,
+			ModTime: node.ModTime,
+		}
+		switch node.Type {
+		case NodeFile:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = node.Size
+		case NodeDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case NodeSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = node.Target
+		default:
+			skipped = append(skipped, node.Path)
+			continue
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return skipped, err
+		}
+		if node.Type != NodeFile {
+			continue
+		}
+
+		var written int64
+		h := sha256.New()
+		for _, id := range node.Chunks {
+			data, err := r.LoadChunk(id)
+			if err != nil {
+				return skipped, errors.New(fmt.Sprintf("restore %s failed: %s", node.Path, err))
+			}
+			if written+int64(len(data)) > node.Size {
+				return skipped, errors.New(fmt.Sprintf("restore %s failed: the chunks are larger than the file", node.Path))
+			}
+			if _, err = tw.Write(data); err != nil {
+				return skipped, err
+			}
+			h.Write(data)
+			written += int64(len(data))
+		}
+		if written != node.Size {
+			return skipped, errors.New(fmt.Sprintf("restore %s failed: the chunks are smaller than the file", node.Path))
+		}
+		if onFile != nil {
+			onFile(node.Path, node.Size, hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+	return skipped, tw.Close()
+}
+
+// Check reads every chunk of tree and checks its content
+func (r *Repository) Check(tree *Tree) error {
+	seen := make(map[string]bool)
+	for _, node := range tree.Nodes {
+		for _, id := range node.Chunks {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if _, err := r.LoadChunk(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ChangedList encodes paths for tar -T with --null, every path is made relative to the working directory
+func ChangedList(paths []string) io.Reader {
+	var buf bytes.Buffer
+	for _, p := range paths {
+		buf.WriteString("./")
+		buf.WriteString(p)
+		buf.WriteByte(0)
+	}
+	return &buf
+}
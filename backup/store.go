@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Store keeps backups, names are slash separated paths relative to the root of the store
+type Store interface {
+	// Create starts a new object, it only becomes visible once the returned writer is closed
+	Create(name string) (Writer, error)
+	// Put stores a small object in one request
+	Put(name string, data []byte) error
+	Open(name string) (io.ReadCloser, error)
+	// List returns the names of every object under prefix, sorted
+	List(prefix string) ([]string, error)
+	Remove(name string) error
+	Exists(name string) (bool, error)
+	// String describes the store in logs, e.g. s3://bucket/prefix
+	String() string
+}
+
+// Writer is an object being written, Close commits it and Abort drops what was written so far
+type Writer interface {
+	io.Writer
+	Close() error
+	Abort(err error)
+}
+
+// LocalStore keeps backups in a directory of the local machine
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore returns a store rooted at dir, an empty dir means names are paths of the local machine
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{root: dir}
+}
+
+func (l *LocalStore) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *LocalStore) Create(name string) (Writer, error) {
+	path := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// write next to the final path first, so that an interrupted backup never looks complete
+	f, err := os.Create(path + ".partial")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f, path: path}, nil
+}
+
+func (l *LocalStore) Put(name string, data []byte) error {
+	w, err := l.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Abort(err)
+		return err
+	}
+	return w.Close()
+}
+
+func (l *LocalStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *LocalStore) List(prefix string) ([]string, error) {
+	root := l.root
+	if root == "" {
+		root = "."
+	}
+	var names []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".partial") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (l *LocalStore) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *LocalStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(l.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *LocalStore) String() string {
+	if l.root == "" {
+		return "."
+	}
+	return l.root
+}
+
+// readObject reads a whole object of store
+func readObject(store Store, name string) ([]byte, error) {
+	rc, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+type localWriter struct {
+	*os.File
+	path string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		w.Abort(err)
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.path)
+}
+
+func (w *localWriter) Abort(error) {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
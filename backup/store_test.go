@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+
+	if err := store.Put("web/nginx/data/deploy-1.tar.zst", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := store.Create("web/nginx/data/deploy-2.tar.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("two"))
+	// an unfinished object is neither listed nor found
+	if names, _ := store.List(""); !reflect.DeepEqual(names, []string{"web/nginx/data/deploy-1.tar.zst"}) {
+		t.Errorf("List() while writing = %q", names)
+	}
+	if ok, _ := store.Exists("web/nginx/data/deploy-2.tar.zst"); ok {
+		t.Errorf("Exists() of an unfinished object = true")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	aborted, err := store.Create("web/nginx/data/deploy-3.tar.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Write([]byte("three"))
+	aborted.Abort(errors.New("interrupted"))
+	if err = store.Put("db/pg/data/sts-0.tar.zst", []byte("pg")); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := store.List("web/")
+	want := []string{"web/nginx/data/deploy-1.tar.zst", "web/nginx/data/deploy-2.tar.zst"}
+	if err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("List(web/) = %q, %v, want %q", names, err, want)
+	}
+	if data, err := readObject(store, "web/nginx/data/deploy-2.tar.zst"); err != nil || string(data) != "two" {
+		t.Errorf("readObject() = %q, %v, want two", data, err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "web/nginx/data")); len(entries) != 2 {
+		t.Errorf("partial objects are left: %v", entries)
+	}
+
+	if err = store.Remove("web/nginx/data/deploy-1.tar.zst"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Exists("web/nginx/data/deploy-1.tar.zst"); ok || err != nil {
+		t.Errorf("Exists() of a removed object = %v, %v", ok, err)
+	}
+
+	// a store which has never been written to is empty
+	if names, err := NewLocalStore(filepath.Join(dir, "missing")).List(""); len(names) != 0 || err != nil {
+		t.Errorf("List() of a missing store = %q, %v", names, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	store := NewLocalStore(t.TempDir())
+	at := time.Date(2021, 12, 1, 2, 0, 0, 0, time.UTC)
+	put := func(meta Metadata) string {
+		var buf bytes.Buffer
+		if _, err := Write(&buf, volumeTar(t), meta, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		name := ObjectName(meta.Namespace, meta.Kind, meta.Name, meta.InstanceIndex, meta.Volume, meta.Compression, false, meta.CreatedAt)
+		if err := store.Put(name, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	older := put(Metadata{Namespace: "db", Kind: "sts", Name: "pg", Volume: "data", CreatedAt: at})
+	newer := put(Metadata{Namespace: "db", Kind: "sts", Name: "pg", Volume: "data", Compression: CompressGzip, CreatedAt: at.Add(time.Hour)})
+	put(Metadata{Namespace: "web", Kind: "deploy", Name: "nginx", Volume: "data", CreatedAt: at})
+	store.Put("db/pg/data/broken.tar.zst", []byte("not an archive"))
+	store.Put("db/pg/data/notes.txt", []byte("not a backup"))
+
+	backups, skipped, err := List(store, "db/", nil)
+	if err != nil {
+		t.Fatalf("List() failed: %s", err)
+	}
+	var names []string
+	for _, b := range backups {
+		names = append(names, b.Name)
+		if b.Type != TypeArchive || b.Metadata.Name != "pg" {
+			t.Errorf("listing of %s = %+v", b.Name, b)
+		}
+	}
+	if want := []string{newer, older}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List() = %q, want %q", names, want)
+	}
+	if _, ok := skipped["db/pg/data/broken.tar.zst"]; !ok || len(skipped) != 1 {
+		t.Errorf("skipped = %v, want the broken archive only", skipped)
+	}
+}
+
+func TestNewS3StoreConfig(t *testing.T) {
+	tests := []S3Config{
+		{Bucket: "backups"},
+		{Endpoint: "s3.example.com"},
+		{Endpoint: "s3.example.com", Bucket: "backups", SSE: "aws:unknown"},
+	}
+	for _, cfg := range tests {
+		if _, err := NewS3Store(cfg); err == nil {
+			t.Errorf("NewS3Store(%+v) succeeded", cfg)
+		}
+	}
+
+	// NewS3Store trims the slashes around the prefix
+	for prefix, want := range map[string]string{"": "db/pg", "team": "team/db/pg", "a/b": "a/b/db/pg"} {
+		s := &S3Store{cfg: S3Config{Prefix: prefix}}
+		if got := s.key("db/pg"); got != want {
+			t.Errorf("key() with prefix %q = %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/progress"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "check the audit log every command is recorded in",
+}
+
+// auditVerifyCmd represents the audit verify command
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "check that no entry of the audit log was modified, inserted or removed",
+	Long: `check the audit log of "--audit-log": every entry carries the sha256 of its content and the hash of the
+	entry before it, so an entry which was modified, inserted or removed breaks the chain. The first broken entry is
+	reported with its line number and the exit code is 1. Removing the last entries can't be detected from the log
+	alone, keep the last hash printed somewhere else to compare with.
+ For example:
+
+	sync-volume-data audit verify
+	sync-volume-data audit verify --audit-log /var/log/sync-volume-data/audit.jsonl -o json
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger()
+		if err := progress.ValidateOutput(*output); err != nil {
+			logger.Fatal(err)
+		}
+		result, err := audit.Verify(*auditLog)
+		if err != nil {
+			logger.Fatalf("audit log %s is not intact: %s", *auditLog, err)
+		}
+
+		if *output == progress.OutputJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err = enc.Encode(result); err != nil {
+				logger.Fatal(err)
+			}
+			return
+		}
+		fmt.Printf("audit log %s is intact: %d entries, last hash %s\n", *auditLog, result.Entries, valueOrNone(result.LastHash))
+	},
+}
+
+// audited tells whether cmd is recorded in the audit log, only the help is not
+func audited(cmd *cobra.Command) bool {
+	return cmd.HasParent() && cmd.Name() != "help" && !strings.HasPrefix(cmd.CommandPath(), cmd.Root().Name()+" completion")
+}
+
+// maskArgs hides the values of the password and secret flags
+func maskArgs(args []string) []string {
+	masked := make([]string, len(args))
+	copy(masked, args)
+	for i := 0; i < len(masked); i++ {
+		arg := masked[i]
+		if arg == "--" {
+			break
+		}
+		var name, value string
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name = strings.TrimPrefix(arg, "--")
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value = name[:eq], name[eq+1:]
+				if secretFlag(name) {
+					masked[i] = "--" + name + "=***"
+				}
+				continue
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			name, value = arg[1:2], strings.TrimPrefix(arg[2:], "=")
+		default:
+			continue
+		}
+		if !secretFlag(name) {
+			continue
+		}
+		if value != "" {
+			masked[i] = arg[:len(arg)-len(value)] + "***"
+		} else if i+1 < len(masked) {
+			masked[i+1] = "***"
+			i++
+		}
+	}
+	return masked
+}
+
+func secretFlag(name string) bool {
+	return name == "p" || strings.HasSuffix(name, "ssh-password") || name == "s3-secret-key"
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	// the log is local, no namespace is involved
+	namespaceOptional[auditVerifyCmd] = func() bool { return true }
+
+	// the fatal errors of the standard logger end up in the audit log too
+	logrus.AddHook(audit.Hook{})
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sync-volume-data/backup"
+	"sync-volume-data/server"
+	"time"
+)
+
+var (
+	backupFile    *string
+	backupIndex   *int
+	backupStore   *storeFlags
+	restoreFile   *string
+	restoreIndex  *int
+	restoreVerify *bool
+	restoreStore  *storeFlags
+
+	backupIncremental *bool
+	restoreSnapshot   *string
+)
+
+// validateTargetArg checks the single kind/name argument of backup/restore
+func validateTargetArg(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("you need specific a target, e.g. deploy/nginx or sts/postgres")
+	}
+	_, _, err := parseTarget(args[0])
+	return err
+}
+
+// defaultBackupFile names a backup after its target and the current time, backups kept in a directory
+// or a bucket are grouped by namespace/name/volume
+func defaultBackupFile(kind, name string, flags *storeFlags, encrypted bool) string {
+	if flags.remote() || *flags.dir != "" {
+		return backup.ObjectName(*namespace, kind, name, *backupIndex, *volume, *compress, encrypted, time.Now())
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s%s", *namespace, name, backup.InstanceName(kind, *backupIndex), *volume,
+		time.Now().Format("20060102-150405"), backup.Extension(*compress, encrypted))
+}
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "backup a volume of a resource into a local archive",
+	Long: `backup a volume of a deploy/sts/ds/pod kind resource into a local archive, or into a bucket of an S3 compatible
+	storage with "--s3-bucket" where the archive is streamed with a multipart upload.
+	The archive is a zstd (or gzip with --compress gzip) compressed tar, it records where the data comes from
+	(namespace, workload, volume, PVC, PV, storage class, time) and the sha256 of every file.
+	"--incremental" turns the directory or the bucket into a deduplicated repository: the files are split into content
+	defined chunks stored once, and only the files changed since the last snapshot of the volume are read from the node.
+ For example:
+
+	sync-volume-data backup sts/postgres -n db -v data -i 0 -p "myPassword" -f postgres-0.tar.zst
+	sync-volume-data backup sts/postgres -n db -v data -i 0 -p "myPassword" --s3-endpoint minio.local:9000 --s3-bucket backups
+	sync-volume-data backup sts/postgres -n db -v data -i 0 -p "myPassword" --dir /backups/repo --incremental
+`,
+	Args: validateTargetArg,
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, name, _ := parseTarget(args[0])
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"target":    args[0],
+		})
+		store, err := backupStore.store()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts := transferOptions()
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+			&[]string{}, *backupIndex, logger, server.TransferFrom, opts)
+
+		if *backupIncremental {
+			if !backupStore.remote() && *backupStore.dir == "" {
+				logger.Fatal("--incremental needs a repository, please set --dir or --s3-bucket")
+			}
+			if *backupFile != "" {
+				logger.Fatal("--file can't be used with --incremental, snapshots are named after the volume and the time")
+			}
+			repo, err := backup.OpenRepository(store, opts.Keys)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			logger.Infof("backup %s volume %s into repository %s", args[0], *volume, repo)
+			s.Snapshot(repo)
+			return
+		}
+
+		file := *backupFile
+		if file == "" {
+			file = defaultBackupFile(kind, name, backupStore, opts.Keys.Encrypting())
+		}
+		logger.Infof("backup %s volume %s into %s %s", args[0], *volume, store, file)
+		s.Backup(store, file)
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "restore a local archive into a volume of a resource",
+	Long: `restore an archive written by the backup command into a volume of a deploy/sts/ds/pod kind resource,
+	the target can differ from the one the backup was taken from. With "--s3-bucket" the archive is streamed from the bucket.
+	"--snapshot" restores a snapshot of a repository written by "backup --incremental" instead of an archive.
+	"--verify" checks the sha256 of every file of the archive, or every chunk of the snapshot, before anything is
+	written to the volume.
+ For example:
+
+	sync-volume-data restore sts/postgres -n db -v data -i 1 -p "myPassword" -f postgres-0.tar.zst --verify
+	sync-volume-data restore sts/postgres -n db -v data -i 0 -p "myPassword" --dir /backups/repo --snapshot latest
+`,
+	Args: validateTargetArg,
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, name, _ := parseTarget(args[0])
+
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"target":    args[0],
+		})
+		if (*restoreFile == "") == (*restoreSnapshot == "") {
+			logger.Fatal("you need specific either an archive with --file or a snapshot with --snapshot")
+		}
+		store, err := restoreStore.store()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts := transferOptions()
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+			&[]string{}, *restoreIndex, logger, server.TransferTo, opts)
+
+		if *restoreSnapshot != "" {
+			exists, err := backup.RepositoryExists(store)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			if !exists {
+				logger.Fatalf("no repository in %s", store)
+			}
+			repo, err := backup.OpenRepository(store, opts.Keys)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			logger.Infof("restore snapshot %s of %s into %s volume %s", *restoreSnapshot, repo, args[0], *volume)
+			s.RestoreSnapshot(repo, *restoreSnapshot, *restoreVerify)
+			return
+		}
+
+		logger.Infof("restore %s %s into %s volume %s", store, *restoreFile, args[0], *volume)
+		s.Restore(store, *restoreFile, *restoreVerify)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+
+	backupFile = backupCmd.Flags().StringP("file", "f", "", "path of the archive (default <namespace>-<name>-<volume>-<time>.tar.zst, <namespace>/<name>/<volume>/<time>.tar.zst with --dir or --s3-bucket)")
+	backupIndex = backupCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	backupStore = addStoreFlags(backupCmd)
+	backupIncremental = backupCmd.Flags().Bool("incremental", false, "store a deduplicated snapshot in the repository of --dir or --s3-bucket")
+
+	restoreFile = restoreCmd.Flags().StringP("file", "f", "", "path of the archive to restore, relative to --dir or --s3-prefix")
+	restoreIndex = restoreCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	restoreVerify = restoreCmd.Flags().Bool("verify", false, "check the sha256 of every file of the archive, or every chunk of the snapshot, before restoring it")
+	restoreStore = addStoreFlags(restoreCmd)
+	restoreSnapshot = restoreCmd.Flags().String("snapshot", "", "snapshot of the repository to restore, or latest for the newest snapshot of the volume")
+}
@@ -0,0 +1,300 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	listStore   *storeFlags
+	pruneStore  *storeFlags
+	pruneKeep   backup.RetentionPolicy
+	pruneDryRun *bool
+	pruneNoGC   *bool
+)
+
+// backupsCmd represents the backups command
+var backupsCmd = &cobra.Command{
+	Use:   "backups",
+	Short: "manage the backups written by the backup command",
+}
+
+// backupsListCmd represents the backups list command
+var backupsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the restore points of a namespace, the newest first",
+	Long: `list the archives and the snapshots of a namespace kept in a local directory or a bucket, the newest first.
+	The metadata stored at the beginning of every archive is read, the archives are not downloaded.
+	An optional kind/name argument and "-v" narrow the list to a workload and a volume.
+ For example:
+
+	sync-volume-data backups list sts/postgres -n db -v data --s3-endpoint minio.local:9000 --s3-bucket backups
+	sync-volume-data backups list -n db --dir /backups -o json
+`,
+	Args: validateOptionalTarget,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger()
+		if err := progress.ValidateOutput(*output); err != nil {
+			logger.Fatal(err)
+		}
+		_, _, matched, err := findBackups(listStore, args, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		if *output == progress.OutputJSON {
+			if matched == nil {
+				matched = []backup.Listing{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err = enc.Encode(matched); err != nil {
+				logger.Fatal(err)
+			}
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CREATED\tTYPE\tKIND\tNAME\tVOLUME\tPVC\tPOD\tBACKUP")
+		for _, b := range matched {
+			meta := b.Metadata
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", meta.CreatedAt.Local().Format(time.RFC3339), b.Type, meta.Kind,
+				meta.Name, meta.Volume, valueOrNone(meta.PersistentVolumeClaim), meta.Pod, b.Name)
+		}
+		w.Flush()
+	},
+}
+
+// validateOptionalTarget checks the optional kind/name argument of backups list/prune
+func validateOptionalTarget(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return errors.New("you can only specific one target")
+	}
+	if len(args) == 1 {
+		_, _, err := parseTarget(args[0])
+		return err
+	}
+	return nil
+}
+
+// findBackups returns the archives and the snapshots of the namespace, narrowed by the optional target
+// argument and --volume, the newest first. The repository is nil when the store holds no snapshot.
+func findBackups(flags *storeFlags, args []string, logger *logrus.Logger) (backup.Store, *backup.Repository, []backup.Listing, error) {
+	store, err := flags.store()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keys, err := encryptionKeys()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// backups kept in a directory or a bucket are grouped by namespace/name/volume, see backup.ObjectName
+	prefix := ""
+	name := ""
+	if len(args) == 1 {
+		_, name, _ = parseTarget(args[0])
+	}
+	if flags.remote() || *flags.dir != "" {
+		prefix = *namespace + "/"
+		if name != "" {
+			prefix += name + "/"
+			if *volume != "" {
+				prefix += *volume + "/"
+			}
+		}
+	}
+
+	backups, skipped, err := backup.List(store, prefix, keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var repo *backup.Repository
+	exists, err := backup.RepositoryExists(store)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if exists {
+		if repo, err = backup.OpenRepository(store, keys); err != nil {
+			return nil, nil, nil, err
+		}
+		snapshots, skippedSnapshots, err := repo.Snapshots(prefix)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		backups = append(backups, snapshots...)
+		for object, err := range skippedSnapshots {
+			skipped[object] = err
+		}
+		sort.SliceStable(backups, func(i, j int) bool {
+			return backups[i].Metadata.CreatedAt.After(backups[j].Metadata.CreatedAt)
+		})
+	}
+	for object, err := range skipped {
+		logger.Warnf("skip %s: %s", object, err)
+	}
+
+	var matched []backup.Listing
+	for _, b := range backups {
+		meta := b.Metadata
+		if meta.Namespace != *namespace || (name != "" && meta.Name != name) || (*volume != "" && meta.Volume != *volume) {
+			continue
+		}
+		matched = append(matched, b)
+	}
+	return store, repo, matched, nil
+}
+
+// backupsPruneCmd represents the backups prune command
+var backupsPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "remove the backups a retention policy doesn't keep and the chunks no snapshot references",
+	Long: `remove the archives and the snapshots of a namespace that the retention policy doesn't keep, then remove the
+	chunks of the repository no snapshot references anymore. The policy applies to the backups of every volume on their own,
+	a backup is kept as soon as one of the --keep-* flags keeps it.
+	The chunks are only collected when no backup is running on the repository.
+ For example:
+
+	sync-volume-data backups prune -n db --s3-endpoint minio.local:9000 --s3-bucket backups --keep-daily 7 --keep-weekly 4 --keep-monthly 12
+`,
+	Args: validateOptionalTarget,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := newLogger()
+		if err := progress.ValidateOutput(*output); err != nil {
+			logger.Fatal(err)
+		}
+		if pruneKeep.Empty() {
+			logger.Fatal("you need specific at least one of --keep-last, --keep-daily, --keep-weekly or --keep-monthly")
+		}
+		store, repo, matched, err := findBackups(pruneStore, args, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		groups := make(map[string][]backup.Listing)
+		for _, b := range matched {
+			key := backup.GroupKey(b)
+			groups[key] = append(groups[key], b)
+		}
+		var keep, remove []backup.Listing
+		for _, group := range groups {
+			k, r := pruneKeep.Apply(group)
+			keep = append(keep, k...)
+			remove = append(remove, r...)
+		}
+
+		if !*pruneDryRun {
+			for _, b := range remove {
+				if b.Type == backup.TypeSnapshot {
+					err = repo.RemoveSnapshot(b.Name)
+				} else {
+					err = store.Remove(b.Name)
+				}
+				if err != nil {
+					logger.Fatalf("remove %s failed: %s", b.Name, err)
+				}
+				logger.Infof("remove %s %s", b.Type, b.Name)
+			}
+		}
+
+		var gc *backup.GCResult
+		if repo != nil && !*pruneNoGC {
+			if gc, err = collectGarbage(repo, *pruneDryRun, logger); err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		if *output == progress.OutputJSON {
+			result := struct {
+				DryRun bool             `json:"dryRun"`
+				Keep   []backup.Listing `json:"keep"`
+				Remove []backup.Listing `json:"remove"`
+				GC     *backup.GCResult `json:"gc,omitempty"`
+			}{*pruneDryRun, keep, remove, gc}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err = enc.Encode(result); err != nil {
+				logger.Fatal(err)
+			}
+			return
+		}
+
+		verb := "removed"
+		if *pruneDryRun {
+			verb = "would remove"
+		}
+		fmt.Printf("%d backups kept, %d backups %s\n", len(keep), len(remove), verb)
+		for _, b := range remove {
+			fmt.Printf("  %s %s (%s)\n", b.Type, b.Name, b.Metadata.CreatedAt.Local().Format(time.RFC3339))
+		}
+		if gc != nil {
+			fmt.Printf("%d chunks and %d trees %s\n", gc.Chunks, gc.Trees, verb)
+		}
+	},
+}
+
+// collectGarbage removes the unreferenced chunks unless a backup is running on the repository
+func collectGarbage(repo *backup.Repository, dryRun bool, logger *logrus.Logger) (*backup.GCResult, error) {
+	unlock, err := repo.Lock(backup.LockPrune)
+	if err != nil {
+		if _, ok := err.(*backup.LockedError); ok {
+			return nil, errors.New(fmt.Sprintf("%s, run prune again later to remove the unreferenced chunks", err))
+		}
+		return nil, err
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			logger.Warnf("unlock repository failed: %s", err)
+		}
+	}()
+	return repo.GC(dryRun)
+}
+
+func valueOrNone(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+	return v
+}
+
+func init() {
+	rootCmd.AddCommand(backupsCmd)
+	backupsCmd.AddCommand(backupsListCmd)
+
+	listStore = addStoreFlags(backupsListCmd)
+
+	backupsCmd.AddCommand(backupsPruneCmd)
+	pruneStore = addStoreFlags(backupsPruneCmd)
+	backupsPruneCmd.Flags().IntVar(&pruneKeep.Last, "keep-last", 0, "keep the newest backups of every volume")
+	backupsPruneCmd.Flags().IntVar(&pruneKeep.Daily, "keep-daily", 0, "keep the newest backup of as many days")
+	backupsPruneCmd.Flags().IntVar(&pruneKeep.Weekly, "keep-weekly", 0, "keep the newest backup of as many weeks")
+	backupsPruneCmd.Flags().IntVar(&pruneKeep.Monthly, "keep-monthly", 0, "keep the newest backup of as many months")
+	pruneDryRun = backupsPruneCmd.Flags().Bool("dry-run", false, "only print what would be removed")
+	pruneNoGC = backupsPruneCmd.Flags().Bool("no-gc", false, "don't remove the unreferenced chunks of the repository")
+}
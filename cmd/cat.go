@@ -0,0 +1,84 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"sync-volume-data/server"
+)
+
+var (
+	catIndex  *int
+	catOffset *int64
+	catLength *int64
+	catFollow *bool
+)
+
+// catCmd represents the cat command
+var catCmd = &cobra.Command{
+	Use:   "cat",
+	Short: "write a file of a volume of a resource to stdout",
+	Long: `write a file of a volume of a deploy/sts/ds/pod kind resource to stdout, the path after the resource is relative
+	to the root of the volume. Nothing but the file goes to stdout so it can be piped into other commands.
+	"--offset"/"--length" read a part of the file, a negative offset counts from the end of the file. "-f" keeps
+	writing what is appended to the file like tail -F until Ctrl-C.
+ For example:
+
+	sync-volume-data cat deploy/web -n my-web -v data -p "myPassword" app.log | grep ERROR
+	sync-volume-data cat deploy/web -n my-web -v data -p "myPassword" app.log --offset -4096 -f
+`,
+	Args: validateStreamArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		newStreamServer(args, *catIndex, server.TransferCat).Cat(server.CatOptions{
+			Path:   args[1],
+			Offset: *catOffset,
+			Length: *catLength,
+			Follow: *catFollow,
+		}, os.Stdout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(catCmd)
+
+	catIndex = catCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	catOffset = catCmd.Flags().Int64("offset", 0, "byte to start reading at, counted from the end of the file when negative")
+	catLength = catCmd.Flags().Int64("length", 0, "number of bytes to read, 0 reads up to the end of the file")
+	catFollow = catCmd.Flags().BoolP("follow", "f", false, "keep writing the data appended to the file, like tail -F")
+}
+
+// validateStreamArgs checks the kind/name and the file arguments of cat/put
+func validateStreamArgs(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return errors.New("you need specific a target and a file in its volume, e.g. deploy/nginx conf/nginx.conf")
+	}
+	_, _, err := parseTarget(args[0])
+	return err
+}
+
+func newStreamServer(args []string, index int, action string) *server.Server {
+	kind, name, _ := parseTarget(args[0])
+	logger := newLogger().WithFields(logrus.Fields{
+		"namespace": *namespace,
+		"target":    args[0],
+	})
+	return server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+		&[]string{args[1]}, index, logger, action, transferOptions())
+}
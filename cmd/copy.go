@@ -0,0 +1,119 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sync-volume-data/server"
+)
+
+// endpointFlags select the volumes on both sides of copy/migrate
+type endpointFlags struct {
+	fromVolume  *string
+	fromIndex   *int
+	toVolume    *string
+	toIndex     *int
+	toNamespace *string
+}
+
+func addEndpointFlags(cmd *cobra.Command) *endpointFlags {
+	return &endpointFlags{
+		fromVolume:  cmd.Flags().String("from-volume", "", "volume name in the source resource (default the value of --volume)"),
+		fromIndex:   cmd.Flags().Int("from-index", -1, "instance index when the source is a statefulset"),
+		toVolume:    cmd.Flags().String("to-volume", "", "volume name in the destination resource (default the value of --volume)"),
+		toIndex:     cmd.Flags().Int("to-index", -1, "instance index when the destination is a statefulset"),
+		toNamespace: cmd.Flags().String("to-namespace", "", "namespace of the destination resource (default the value of --namespace)"),
+	}
+}
+
+// resolve fills the defaults from the global --volume/--namespace flags
+func (f *endpointFlags) resolve() (srcVolume, dstVolume, dstNamespace string) {
+	srcVolume, dstVolume, dstNamespace = *volume, *volume, *namespace
+	if *f.fromVolume != "" {
+		srcVolume = *f.fromVolume
+	}
+	if *f.toVolume != "" {
+		dstVolume = *f.toVolume
+	}
+	if *f.toNamespace != "" {
+		dstNamespace = *f.toNamespace
+	}
+	return srcVolume, dstVolume, dstNamespace
+}
+
+// validateEndpoints checks the two kind/name arguments of copy/migrate
+func validateEndpoints(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return errors.New("you need specific a source and a destination, e.g. sts/postgres deploy/pg-restore")
+	}
+	for _, arg := range args {
+		if _, _, err := parseTarget(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	copyEndpoints *endpointFlags
+	copyVerify    *bool
+)
+
+// copyCmd represents the copy command
+var copyCmd = &cobra.Command{
+	Use:   "copy",
+	Short: "copy data from a volume of a resource to a volume of another resource",
+	Long: `copy data from a volume of a deploy/sts/ds/pod kind resource to a volume of another one, without a copy on the local machine.
+	Both volumes on the same node are copied on the node. Otherwise the data is streamed from node to node when the source node
+	can ssh into the destination node with a key, or through this tool as a last resort.
+	"-v" sets both volumes, "--from-volume"/"--to-volume" override it. "-s" limits the copy to some paths of the source volume.
+ For example:
+
+	sync-volume-data copy sts/postgres deploy/pg-restore -n db -v data --from-index 0 -p "myPassword"
+`,
+	Args: validateEndpoints,
+	Run: func(cmd *cobra.Command, args []string) {
+		srcKind, srcName, _ := parseTarget(args[0])
+		dstKind, dstName, _ := parseTarget(args[1])
+
+		srcVolume, dstVolume, dstNamespace := copyEndpoints.resolve()
+
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"from":      args[0],
+			"to":        args[1],
+		})
+		logger.Infof("copy %s volume %s to %s/%s volume %s", args[0], srcVolume, dstNamespace, args[1], dstVolume)
+
+		src := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, srcKind, srcName, srcVolume,
+			&[]string{}, *copyEndpoints.fromIndex, logger, server.TransferFrom, server.TransferOptions{})
+		dst := server.NewServer("", *sshuser, *sshpwd, *sshPort, dstNamespace, dstKind, dstName, dstVolume,
+			&[]string{}, *copyEndpoints.toIndex, logger, server.TransferTo, transferOptions())
+		copier := server.NewCopier(src, dst, *source, logger)
+		copier.Verify = *copyVerify
+		copier.Run()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(copyCmd)
+
+	copyEndpoints = addEndpointFlags(copyCmd)
+	copyVerify = copyCmd.Flags().Bool("verify", false, "compare the sha256 of every file on both sides after the copy")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		arg      string
+		wantKind string
+		wantName string
+		wantErr  bool
+	}{
+		{arg: "deploy/nginx", wantKind: "deploy", wantName: "nginx"},
+		{arg: "statefulset/web", wantKind: "statefulset", wantName: "web"},
+		{arg: "pod/web-0", wantKind: "pod", wantName: "web-0"},
+		{arg: "ds/agent/x", wantKind: "ds", wantName: "agent/x"},
+		{arg: "nginx", wantErr: true},
+		{arg: "deploy/", wantErr: true},
+		{arg: "/nginx", wantErr: true},
+		{arg: "job/backup", wantErr: true},
+	}
+	for _, tt := range tests {
+		kind, name, err := parseTarget(tt.arg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTarget(%q) error = %v, wantErr %v", tt.arg, err, tt.wantErr)
+			continue
+		}
+		if kind != tt.wantKind || name != tt.wantName {
+			t.Errorf("parseTarget(%q) = %s, %s, want %s, %s", tt.arg, kind, name, tt.wantKind, tt.wantName)
+		}
+	}
+}
+
+func TestCopyEndpoints(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"sts/postgres", "deploy/pg-restore"}},
+		{args: []string{"sts/postgres"}, wantErr: true},
+		{args: []string{"sts/postgres", "deploy/a", "deploy/b"}, wantErr: true},
+		{args: []string{"sts/postgres", "cronjob/x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateEndpoints(copyCmd, tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("validateEndpoints(%q) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+		}
+	}
+
+	*volume, *namespace = "data", "db"
+	defer func() { *volume, *namespace = "", "" }()
+	if err := copyCmd.ParseFlags([]string{"--to-volume", "restore", "--to-namespace", "staging"}); err != nil {
+		t.Fatal(err)
+	}
+	src, dst, ns := copyEndpoints.resolve()
+	if src != "data" || dst != "restore" || ns != "staging" {
+		t.Errorf("resolve() = %s, %s, %s, want data, restore, staging", src, dst, ns)
+	}
+}
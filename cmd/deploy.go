@@ -56,14 +56,14 @@ func newDeployCmd() *cobra.Command {
 					args[0], *volume, *namespace, *source, *sshuser, *sshpwd, *sshPort, cmd.Parent().Use)
 
 				s := server.NewServer(RsyncTool, *sshuser, *sshpwd, *sshPort, *namespace, "deploy",
-					args[0], *volume, source, -1, logger, cmd.Parent().Use)
+					args[0], *volume, source, -1, logger, cmd.Parent().Use, transferOptions())
 				s.Run()
 			} else if cmd.Parent().Parent().Use == ScpTool {
 				logger.Infof("execute rsync deploy %s, volume is %s, namespace is %s, rousce is %v, sshuser: %s, sshpwd:%s, sshport:%s, action:%s\n",
 					args[0], *volume, *namespace, *source, *sshuser, *sshpwd, *sshPort, cmd.Parent().Use)
 
 				s := server.NewServer(ScpTool, *sshuser, *sshpwd, *sshPort, *namespace, "deploy",
-					args[0], *volume, source, -1, logger, cmd.Parent().Use)
+					args[0], *volume, source, -1, logger, cmd.Parent().Use, transferOptions())
 				s.Run()
 			}
 		},
@@ -0,0 +1,80 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"sync-volume-data/audit"
+	"sync-volume-data/server"
+)
+
+var (
+	diffIndex    *int
+	diffChecksum *bool
+	diffShow     *bool
+	diffMaxSize  *int64
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "compare local files/directories with a volume of a resource",
+	Long: `compare the local files/directories of "-s" with a volume of a deploy/sts/ds/pod kind resource, they are mapped
+	into the volume like "rsync to" does: a source goes into the root of the volume under its own name, the content of
+	"dir/" goes into the root of the volume.
+	Every path only local, only in the volume, or which differs by type, size or mtime is listed, "--checksum" compares
+	the sha256 of files of the same size instead of their mtime. "--show-diff" prints a unified diff of small text files.
+	The exit code is 0 without differences, 1 with differences and 2 on errors, like diff.
+ For example:
+
+	sync-volume-data diff deploy/nginx -n my-web -v web -p "myPassword" -s html/ --checksum --show-diff
+`,
+	Args:         validateTargetArg,
+	SilenceUsage: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, name, _ := parseTarget(args[0])
+		base := newLogger()
+		// 1 means that differences were found, every failure exits 2
+		exitOnError := func(int) { os.Exit(server.DiffExitError) }
+		base.ExitFunc = exitOnError
+		logrus.StandardLogger().ExitFunc = exitOnError
+		logger := base.WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"target":    args[0],
+		})
+
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+			source, *diffIndex, logger, server.TransferDiff, transferOptions())
+		audit.Exit(s.Diff(server.DiffOptions{
+			Checksum: *diffChecksum,
+			ShowDiff: *diffShow,
+			MaxSize:  *diffMaxSize,
+		}))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	usageExitCodes[diffCmd] = server.DiffExitError
+
+	diffIndex = diffCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	diffChecksum = diffCmd.Flags().Bool("checksum", false, "compare the sha256 of files of the same size instead of their mtime")
+	diffShow = diffCmd.Flags().Bool("show-diff", false, "print a unified diff of the differing text files")
+	diffMaxSize = diffCmd.Flags().Int64("max-diff-size", server.DefaultDiffMaxSize, "largest file in bytes whose unified diff is printed")
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"sync-volume-data/server"
+	"testing"
+)
+
+func TestDiffUsageErrors(t *testing.T) {
+	tests := [][]string{
+		{"diff"},
+		{"diff", "deploy/web", "extra"},
+		{"diff", "deploy/web", "--checksum=maybe"},
+		{"diff", "deploy/web", "--no-such-flag"},
+	}
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&out)
+	defer func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		rootCmd.SetArgs(nil)
+	}()
+	for _, args := range tests {
+		out.Reset()
+		*namespace = ""
+		rootCmd.SetArgs(args)
+		cmd, err := rootCmd.ExecuteC()
+		if err == nil {
+			t.Fatalf("%v succeeded", args)
+		}
+		if cmd != diffCmd || usageExitCodes[cmd] != server.DiffExitError {
+			t.Errorf("%v exits %d from %s, want %d", args, usageExitCodes[cmd], cmd.Name(), server.DiffExitError)
+		}
+		if strings.Contains(out.String(), "Usage:") {
+			t.Errorf("%v printed the usage:\n%s", args, out.String())
+		}
+	}
+}
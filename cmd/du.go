@@ -0,0 +1,73 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"github.com/spf13/cobra"
+	"sync-volume-data/server"
+)
+
+var (
+	duAllNamespaces *bool
+	duSort          *string
+	duTop           *int
+	duDepth         *int
+)
+
+// duCmd represents the du command
+var duCmd = &cobra.Command{
+	Use:   "du",
+	Short: "report the usage of the volumes of every workload in a namespace",
+	Long: `report the usage of the data volumes (pvc, generic ephemeral, emptyDir and csi inline volumes) mounted by the
+	running pods of a namespace, or of all namespaces with "-A". Every volume is found on its node like "to"/"from" do,
+	the used bytes and inodes are counted with du and find in it, the capacity comes from the status of the pvc and the
+	filesystem which holds it from df. A pvc mounted by several pods is measured once.
+	The largest directories of every volume are listed too, "--top 0" leaves them out. "-o json" or "-o csv" exports
+	the report.
+ For example:
+
+	sync-volume-data du -n my-web -p "myPassword"
+	sync-volume-data du -A -p "myPassword" --sort percent --top 3 -o csv > usage.csv
+`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return errors.New("du takes no argument, use -n or -A to select the namespaces")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, "", "", "", &[]string{}, -1,
+			newLogger().WithField("namespace", *namespace), server.TransferUsage, transferOptions())
+		s.Usage(server.UsageOptions{
+			AllNamespaces: *duAllNamespaces,
+			Sort:          *duSort,
+			Top:           *duTop,
+			Depth:         *duDepth,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(duCmd)
+
+	duAllNamespaces = duCmd.Flags().BoolP("all-namespaces", "A", false, "report the volumes of all namespaces")
+	namespaceOptional[duCmd] = func() bool { return *duAllNamespaces }
+	duSort = duCmd.Flags().String("sort", server.UsageSortUsed, "sort the volumes by used, inodes, capacity, percent (used of the capacity) or name")
+	duTop = duCmd.Flags().Int("top", server.DefaultUsageTop, "number of largest directories listed per volume")
+	duDepth = duCmd.Flags().Int("depth", server.DefaultUsageDepth, "how deep the largest directories are looked for")
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import "testing"
+
+func TestDuNamespace(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"du", "-A", "-p", "pwd"}},
+		{args: []string{"du", "--all-namespaces", "--sort", "percent", "-o", "csv"}},
+		{args: []string{"du", "-n", "web", "-p", "pwd"}},
+		{args: []string{"du", "-p", "pwd"}, wantErr: true},
+		{args: []string{"du", "-A=false", "-p", "pwd"}, wantErr: true},
+		{args: []string{"audit", "verify"}},
+		{args: []string{"ls", "deploy/web", "-v", "data"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		*namespace, *duAllNamespaces = "", false
+		cmd, flags, err := rootCmd.Find(tt.args)
+		if err != nil {
+			t.Fatalf("find command of %v failed: %s", tt.args, err)
+		}
+		if err = cmd.ParseFlags(flags); err != nil {
+			t.Fatalf("parse flags %v failed: %s", tt.args, err)
+		}
+		if err = validateNamespace(cmd); (err != nil) != tt.wantErr {
+			t.Errorf("validateNamespace(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sync-volume-data/audit"
+	"sync-volume-data/server"
+)
+
+var (
+	execIndex *int
+	execTTY   *bool
+)
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec",
+	Short: "run a command on the node in a volume of a resource",
+	Long: `run a command on the node of a volume of a deploy/sts/ds/pod kind resource, the directory of the volume is its
+	working directory. The command follows "--" and is run as is, use sh -c for globs and pipes. Its stdout/stderr are
+	streamed and its exit code is the exit code of exec, 255 when it could not be run.
+	The command gets no terminal and stdin only when stdin is piped. Interactive commands such as a shell without
+	arguments, vi, less or top are refused unless "--tty" is given, "--tty" without command opens a shell.
+ For example:
+
+	sync-volume-data exec deploy/nginx -n my-web -v web -p "myPassword" -- tar xzf site.tgz
+	sync-volume-data exec sts/postgres -i 0 -n db -v data -p "myPassword" -- sh -c 'rm -f *.lock'
+	sync-volume-data exec sts/postgres -i 0 -n db -v data -p "myPassword" --tty
+`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errors.New("you need specific a target, e.g. deploy/nginx or sts/postgres")
+		}
+		if dash := cmd.ArgsLenAtDash(); dash > 1 || (dash < 0 && len(args) > 1) {
+			return errors.New(`the command has to follow "--", e.g. exec deploy/nginx -v web -- ls -l`)
+		}
+		_, _, err := parseTarget(args[0])
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, name, _ := parseTarget(args[0])
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"target":    args[0],
+		})
+
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+			&[]string{}, *execIndex, logger, server.TransferExec, transferOptions())
+		audit.Exit(s.Exec(args[1:], *execTTY))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	execIndex = execCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	execTTY = execCmd.Flags().BoolP("tty", "t", false, "run the command on a terminal, needed by interactive commands")
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sync-volume-data/server"
+)
+
+var inspectIndex *int
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "explain how a volume of a resource maps to a directory on its node",
+	Long: `explain how a volume of a deploy/sts/ds/pod kind resource maps to a directory on its node, step by step: the
+	workload and its rollout state, the ReplicaSet of a deployment, the pod chosen and why, the node and the address
+	used to ssh into it, the pvc, pv, storage class and csi driver of the volume, the path expected on the node and the
+	path actually found there over ssh. A rollout in progress is reported instead of refused.
+	The exit code is 1 when a step fails, the steps before it are still printed.
+ For example:
+
+	sync-volume-data inspect sts/postgres -i 0 -n db -v data -p "myPassword"
+	sync-volume-data inspect deploy/nginx -n my-web -v web -p "myPassword" -o json
+`,
+	Args: validateTargetArg,
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, name, _ := parseTarget(args[0])
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"target":    args[0],
+		})
+
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+			&[]string{}, *inspectIndex, logger, server.TransferInspect, transferOptions())
+		s.Inspect()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectIndex = inspectCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+}
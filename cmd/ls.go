@@ -0,0 +1,85 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sync-volume-data/server"
+)
+
+var (
+	lsIndex     *int
+	lsRecursive *bool
+	lsGlob      *string
+	lsHuman     *bool
+)
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list the files of a volume of a resource",
+	Long: `list the files of a volume of a deploy/sts/ds/pod kind resource, the volume is found like "to"/"from" do.
+	The paths after the resource are relative to the root of the volume, the root is listed without any. Every entry
+	shows its mode, owner uid/gid (the users of the container are usually unknown to the node), size and mtime,
+	its path can be given to "from -s" as is.
+ For example:
+
+	sync-volume-data ls deploy/nginx -n my-web -v web -p "myPassword"
+	sync-volume-data ls deploy/nginx -n my-web -v web -p "myPassword" logs -R --glob "*.log" --human
+	sync-volume-data ls deploy/nginx -n my-web -v web -p "myPassword" -o json
+`,
+	Args: validateBrowseArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		newBrowseServer(args, *lsIndex).List(args[1:], server.BrowseOptions{
+			Recursive: *lsRecursive,
+			Glob:      *lsGlob,
+			Human:     *lsHuman,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+
+	lsIndex = lsCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	lsRecursive = lsCmd.Flags().BoolP("recursive", "R", false, "list the content of the directories recursively")
+	lsGlob = lsCmd.Flags().String("glob", "", `list only the entries whose name matches, e.g. "*.log", or whose path matches when it contains a "/"`)
+	lsHuman = lsCmd.Flags().Bool("human", false, "print the sizes as KiB, MiB...")
+}
+
+// validateBrowseArgs checks the kind/name argument of ls/tree/stat, the paths in the volume follow it
+func validateBrowseArgs(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("you need specific a target, e.g. deploy/nginx or sts/postgres")
+	}
+	_, _, err := parseTarget(args[0])
+	return err
+}
+
+// newBrowseServer builds the server of ls/tree/stat, args are the target and the paths in the volume
+func newBrowseServer(args []string, index int) *server.Server {
+	kind, name, _ := parseTarget(args[0])
+	logger := newLogger().WithFields(logrus.Fields{
+		"namespace": *namespace,
+		"target":    args[0],
+	})
+	paths := args[1:]
+	return server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+		&paths, index, logger, server.TransferBrowse, transferOptions())
+}
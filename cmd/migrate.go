@@ -0,0 +1,126 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	"sync-volume-data/server"
+	"sync-volume-data/utils"
+)
+
+// clusterFlags are the kubeconfig and ssh settings of one side of a migration
+type clusterFlags struct {
+	kubeconfig *string
+	context    *string
+	sshuser    *string
+	sshpwd     *string
+	sshPort    *string
+}
+
+func addClusterFlags(cmd *cobra.Command, side string) *clusterFlags {
+	return &clusterFlags{
+		kubeconfig: cmd.Flags().String(side+"-kubeconfig", "", "kubeconfig file of the "+side+" cluster (default the value of --kubeconfig)"),
+		context:    cmd.Flags().String(side+"-context", "", "kubeconfig context of the "+side+" cluster (default the current context)"),
+		sshuser:    cmd.Flags().String(side+"-ssh-user", "", "user which can ssh to the nodes of the "+side+" cluster (default the value of --ssh-user)"),
+		sshpwd:     cmd.Flags().String(side+"-ssh-password", "", "password which can ssh to the nodes of the "+side+" cluster (default the value of --ssh-password)"),
+		sshPort:    cmd.Flags().String(side+"-ssh-port", "", "port which can ssh to the nodes of the "+side+" cluster (default the value of --ssh-port)"),
+	}
+}
+
+// restConfig returns the config of the cluster
+func (f *clusterFlags) restConfig(logger *logrus.Entry) *rest.Config {
+	kubeconfig := *f.kubeconfig
+	if kubeconfig == "" {
+		kubeconfig = *utils.Kubeconfig
+	}
+	config, err := utils.NewRestConfigFor(kubeconfig, *f.context)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return config
+}
+
+// ssh returns the ssh settings of the cluster, the global flags fill what is not set
+func (f *clusterFlags) ssh() (user, pwd, port string) {
+	user, pwd, port = *sshuser, *sshpwd, *sshPort
+	if *f.sshuser != "" {
+		user = *f.sshuser
+	}
+	if *f.sshpwd != "" {
+		pwd = *f.sshpwd
+	}
+	if *f.sshPort != "" {
+		port = *f.sshPort
+	}
+	return user, pwd, port
+}
+
+var (
+	migrateEndpoints *endpointFlags
+	migrateFrom      *clusterFlags
+	migrateTo        *clusterFlags
+	migrateVerify    *bool
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "migrate data from a volume of a resource in a cluster to a volume of a resource in another cluster",
+	Long: `migrate data from a volume of a deploy/sts/ds/pod kind resource in a cluster to a volume of a resource in another cluster.
+	Each side has its own kubeconfig/context and ssh settings, the data is streamed through this tool without a local copy,
+	then the checksums of every file are compared on both sides.
+ For example:
+
+	sync-volume-data migrate sts/postgres sts/postgres -n db -v data --from-index 0 --to-index 0 \
+		--from-context cluster-a --to-context cluster-b --from-ssh-password "pwdA" --to-ssh-password "pwdB"
+`,
+	Args: validateEndpoints,
+	Run: func(cmd *cobra.Command, args []string) {
+		srcKind, srcName, _ := parseTarget(args[0])
+		dstKind, dstName, _ := parseTarget(args[1])
+		srcVolume, dstVolume, dstNamespace := migrateEndpoints.resolve()
+
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"from":      *migrateFrom.context + "/" + args[0],
+			"to":        *migrateTo.context + "/" + args[1],
+		})
+		logger.Infof("migrate %s volume %s to %s/%s volume %s", args[0], srcVolume, dstNamespace, args[1], dstVolume)
+
+		srcUser, srcPwd, srcPort := migrateFrom.ssh()
+		dstUser, dstPwd, dstPort := migrateTo.ssh()
+		src := server.NewServerForCluster(migrateFrom.restConfig(logger), "", srcUser, srcPwd, srcPort, *namespace,
+			srcKind, srcName, srcVolume, &[]string{}, *migrateEndpoints.fromIndex, logger, server.TransferFrom, server.TransferOptions{})
+		dst := server.NewServerForCluster(migrateTo.restConfig(logger), "", dstUser, dstPwd, dstPort, dstNamespace,
+			dstKind, dstName, dstVolume, &[]string{}, *migrateEndpoints.toIndex, logger, server.TransferTo, transferOptions())
+
+		copier := server.NewCopier(src, dst, *source, logger)
+		copier.Verify = *migrateVerify
+		copier.Run()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateEndpoints = addEndpointFlags(migrateCmd)
+	migrateFrom = addClusterFlags(migrateCmd, "from")
+	migrateTo = addClusterFlags(migrateCmd, "to")
+	migrateVerify = migrateCmd.Flags().Bool("verify", true, "compare the sha256 of every file on both sides after the migration")
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import "testing"
+
+func TestClusterFlags(t *testing.T) {
+	*sshuser, *sshpwd, *sshPort = "root", "global", "22"
+	defer func() { *sshuser, *sshpwd, *sshPort = "root", "", "22" }()
+	if err := migrateCmd.ParseFlags([]string{"--from-ssh-password", "pwdA", "--to-ssh-user", "admin", "--to-ssh-port", "2222"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, pwd, port := migrateFrom.ssh(); user != "root" || pwd != "pwdA" || port != "22" {
+		t.Errorf("ssh() of the source = %s, %s, %s, want root, pwdA, 22", user, pwd, port)
+	}
+	if user, pwd, port := migrateTo.ssh(); user != "admin" || pwd != "global" || port != "2222" {
+		t.Errorf("ssh() of the destination = %s, %s, %s, want admin, global, 2222", user, pwd, port)
+	}
+}
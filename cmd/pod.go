@@ -18,7 +18,6 @@ package cmd
 
 import (
 	"errors"
-	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"sync-volume-data/server"
@@ -49,17 +48,17 @@ func newPodCmd() *cobra.Command {
 			})
 			logger.Debug("pod called")
 			if cmd.Parent().Parent().Use == RsyncTool {
-				fmt.Printf("execute rsync pod %s, volume is %s, namespace is %s, rousce is %v, sshuser: %s, sshpwd:%s, sshport:%s\n",
+				logger.Infof("execute rsync pod %s, volume is %s, namespace is %s, rousce is %v, sshuser: %s, sshpwd:%s, sshport:%s\n",
 					args[0], *volume, *namespace, *source, *sshuser, *sshpwd, *sshPort)
 
 				s := server.NewServer(RsyncTool, *sshuser, *sshpwd, *sshPort, *namespace, "pod",
-					args[0], *volume, source, -1, logger, cmd.Parent().Use)
+					args[0], *volume, source, -1, logger, cmd.Parent().Use, transferOptions())
 				s.Run()
 			} else if cmd.Parent().Parent().Use == ScpTool {
-				fmt.Printf("execute scp pod %s, volume is %s\n", args[0], *volume)
+				logger.Infof("execute scp pod %s, volume is %s\n", args[0], *volume)
 
 				s := server.NewServer(ScpTool, *sshuser, *sshpwd, *sshPort, *namespace, "pod",
-					args[0], *volume, source, -1, logger, cmd.Parent().Use)
+					args[0], *volume, source, -1, logger, cmd.Parent().Use, transferOptions())
 				s.Run()
 			}
 		},
@@ -0,0 +1,53 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"os"
+	"sync-volume-data/server"
+)
+
+var putIndex *int
+
+// putCmd represents the put command
+var putCmd = &cobra.Command{
+	Use:   "put",
+	Short: "write stdin into a file of a volume of a resource",
+	Long: `write stdin into a file of a volume of a deploy/sts/ds/pod kind resource, the path after the resource is relative
+	to the root of the volume and its directory is created if needed. The data is streamed without any local temporary
+	file, it is written next to the file and renamed into place once complete, a replaced file keeps its owner and mode.
+	"--chown"/"--chmod"/"--selinux-relabel" apply like for "to".
+ For example:
+
+	pg_dump mydb | sync-volume-data put sts/pg -i 0 -n db -v data -p "myPassword" backups/dump.sql
+`,
+	Args: validateStreamArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			newLogger().Fatal("put reads the file from stdin, pipe or redirect the data into it")
+		}
+		newStreamServer(args, *putIndex, server.TransferPut).Put(args[1], os.Stdin)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(putCmd)
+
+	putIndex = putCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+}
@@ -17,14 +17,21 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/backup"
+	"sync-volume-data/server"
 	"sync-volume-data/utils"
+	"time"
 )
 
 var (
@@ -35,8 +42,53 @@ var (
 	sshpwd     *string
 	sshPort    *string
 	Kubeconfig *string
+
+	bwLimit       *string
+	bwLimitScope  *string
+	compress      *string
+	compressLevel *int
+	output        *string
+	chown         *string
+	chmod         *string
+	numericIDs    *bool
+	relabel       *bool
+	xattrs        *bool
+	acls          *bool
+	atomic        *bool
+	atomicMode    *string
+
+	encryptRecipients *[]string
+	identities        *[]string
+	passphraseFile    *string
+	encryptPull       *bool
+
+	watch         *bool
+	watchDebounce *time.Duration
+
+	preHook       *string
+	postHook      *string
+	hookContainer *string
+	hookTimeout   *time.Duration
+	hookFailure   *string
+
+	quiesce        *bool
+	quiesceTimeout *time.Duration
+	quiesceImage   *string
+
+	restart        *bool
+	restartTimeout *time.Duration
+
+	waitLock    *time.Duration
+	forceUnlock *bool
+
+	annotatePVC *bool
+
+	auditLog *string
 )
 
+// passphraseEnv holds the passphrase when --passphrase-file is not set
+const passphraseEnv = "SYNC_VOLUME_DATA_PASSPHRASE"
+
 const (
 	RsyncTool = "rsync"
 	ScpTool   = "scp"
@@ -52,6 +104,23 @@ var rootCmd = &cobra.Command{
            the network of the local machine and the internal IP of the K8S node are communicating.
 `,
 	Version: "alpha v1.0",
+	// every command is recorded in the audit log, see cmd/audit.go
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateNamespace(cmd); err != nil {
+			return err
+		}
+		if audited(cmd) {
+			// a cut log stops every command but the one which checks it
+			err := audit.Begin(*auditLog, cmd.CommandPath(), maskArgs(os.Args[1:]))
+			if err != nil && cmd != auditVerifyCmd {
+				newLogger().Fatal(err)
+			}
+		}
+		return nil
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		audit.Finish(0)
+	},
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
@@ -62,9 +131,18 @@ var rootCmd = &cobra.Command{
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	cmd, err := rootCmd.ExecuteC()
+	if code, ok := usageExitCodes[cmd]; ok && err != nil {
+		// cobra printed the error already
+		os.Exit(code)
+	}
+	cobra.CheckErr(err)
 }
 
+// usageExitCodes are the exit codes of the argument and flag errors of the commands whose exit code 1 means
+// something else than a failure, e.g. the differences found by diff
+var usageExitCodes = map[*cobra.Command]int{}
+
 func init() {
 
 	// Here you will define your flags and configuration settings.
@@ -78,22 +156,119 @@ func init() {
 	sshuser = rootCmd.PersistentFlags().StringP("ssh-user", "u", "root", "specific user which can ssh to node")
 	sshpwd = rootCmd.PersistentFlags().StringP("ssh-password", "p", "", "specific password which can ssh to node")
 	sshPort = rootCmd.PersistentFlags().StringP("ssh-port", "P", "22", "specific port which can ssh to node")
+	bwLimit = rootCmd.PersistentFlags().String("bwlimit", "", "limit the transfer bandwidth, e.g. 20MiB/s or 500KB/s, a bare number means KiB/s")
+	bwLimitScope = rootCmd.PersistentFlags().String("bwlimit-scope", server.BwLimitGlobal, "what --bwlimit applies to: global (all the streams of the command together) or node (the streams to and from each node)")
+	compress = rootCmd.PersistentFlags().String("compress", "", "compress data in transit, gzip or zstd")
+	compressLevel = rootCmd.PersistentFlags().Int("compress-level", 0, "compression level of --compress, 0 means the default level of the algorithm")
+	output = rootCmd.PersistentFlags().StringP("output", "o", "text", "how to report the progress, text or json. text renders a progress bar on a terminal")
+	chown = rootCmd.PersistentFlags().String("chown", "", "change the owner of pushed files on the node: auto (from the pod securityContext), uid, uid:gid or :gid")
+	chmod = rootCmd.PersistentFlags().String("chmod", "", "change the mode of pushed files on the node, e.g. D755,F644 or u+rwX,g+rX")
+	numericIDs = rootCmd.PersistentFlags().Bool("numeric-ids", false, "keep numeric uid/gid instead of mapping them by name (rsync only), a from pull only keeps the ownership when run as root")
+	relabel = rootCmd.PersistentFlags().Bool("selinux-relabel", false, "relabel pushed files with the selinux context of the volume and the level of the pod seLinuxOptions")
+	xattrs = rootCmd.PersistentFlags().Bool("xattrs", false, "preserve extended attributes (rsync only)")
+	acls = rootCmd.PersistentFlags().Bool("acls", false, "preserve posix ACLs (rsync only)")
+	atomic = rootCmd.PersistentFlags().Bool("atomic", false, "upload into a hidden staging directory of the volume and swap it into place, readers only see the old tree or the new one")
+	atomicMode = rootCmd.PersistentFlags().String("atomic-mode", server.AtomicSymlink, "how --atomic swaps the data into place, symlink (all entries at once through a ..data symlink like ConfigMap volumes) or rename (a single file)")
+	encryptRecipients = rootCmd.PersistentFlags().StringArray("encrypt-recipient", []string{}, "encrypt backups, snapshots and pulled data with age to this public key (age1...) or file of public keys")
+	identities = rootCmd.PersistentFlags().StringArray("identity", []string{}, "age identity file used to decrypt backups and snapshots")
+	passphraseFile = rootCmd.PersistentFlags().String("passphrase-file", "", "encrypt and decrypt with a passphrase read from this file (default $"+passphraseEnv+")")
+	encryptPull = rootCmd.PersistentFlags().Bool("encrypt-pull", false, "write the data of a from transfer as an encrypted archive instead of plain files")
+	watch = rootCmd.PersistentFlags().Bool("watch", false, "keep watching the sources after the transfer and push every change until Ctrl-C, the pod is resolved again when the workload rolls")
+	watchDebounce = rootCmd.PersistentFlags().Duration("watch-debounce", server.DefaultWatchDebounce, "how long the sources must stay quiet before --watch pushes the changes")
+	preHook = rootCmd.PersistentFlags().String("pre-hook", "", "shell command run in the container of the pod before the transfer, e.g. \"pg_ctl stop\" or \"fsfreeze -f /data\"")
+	postHook = rootCmd.PersistentFlags().String("post-hook", "", "shell command run in the container of the pod after the transfer, even when it failed")
+	hookContainer = rootCmd.PersistentFlags().String("hook-container", "", "container the hooks run in (default the first container mounting the volume)")
+	hookTimeout = rootCmd.PersistentFlags().Duration("hook-timeout", server.DefaultHookTimeout, "how long a hook is waited for")
+	hookFailure = rootCmd.PersistentFlags().String("hook-failure", server.HookAbort, "what a failing hook does: abort (skip the transfer, or fail after it) or continue (only warn)")
+	quiesce = rootCmd.PersistentFlags().Bool("quiesce", false, "stop the deploy/sts/ds during the transfer, which goes through a temporary pod mounting the volume, then start it again")
+	quiesceTimeout = rootCmd.PersistentFlags().Duration("quiesce-timeout", server.DefaultQuiesceTimeout, "how long --quiesce waits for the pods to stop, the temporary pod to run and the workload to be ready")
+	quiesceImage = rootCmd.PersistentFlags().String("quiesce-image", server.DefaultQuiesceImage, "image of the temporary pod of --quiesce")
+	restart = rootCmd.PersistentFlags().Bool("restart", false, "restart the pods of the deploy/sts/ds after a successful transfer and wait for the rollout")
+	restartTimeout = rootCmd.PersistentFlags().Duration("restart-timeout", server.DefaultRestartTimeout, "how long --restart waits for the rollout to complete")
+	waitLock = rootCmd.PersistentFlags().Duration("wait-lock", 0, "how long to wait for the lock of a volume someone else is writing into, 0 fails at once")
+	forceUnlock = rootCmd.PersistentFlags().Bool("force-unlock", false, "take the lock of the volume even when someone else holds it")
+	annotatePVC = rootCmd.PersistentFlags().Bool("annotate-pvc", false, "stamp the pvc after a write with the time, the writer and a digest of the volume listing")
+	auditLog = rootCmd.PersistentFlags().String("audit-log", audit.DefaultPath(), "append-only log every command is recorded in")
 	utils.Kubeconfig = rootCmd.PersistentFlags().StringP("kubeconfig", "k", filepath.Join(utils.HomeDir(), ".kube", "config"), "(optional) path to the kubeconfig file")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	//rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
-	// mark Required flag
-	rootCmd.MarkPersistentFlagRequired("volume")
-	rootCmd.MarkPersistentFlagRequired("namespace")
-	rootCmd.MarkPersistentFlagRequired("source")
-	rootCmd.MarkPersistentFlagRequired("ssh-password")
+	// volume, source and ssh-password are checked by the server, not every command needs them.
+	// namespace is checked by validateNamespace, some commands run without it.
+}
+
+// namespaceOptional are the commands which can run without --namespace, as long as their function returns true
+var namespaceOptional = map[*cobra.Command]func() bool{}
+
+// validateNamespace fails when --namespace is missing and cmd needs it
+func validateNamespace(cmd *cobra.Command) error {
+	if *namespace != "" || !audited(cmd) {
+		return nil
+	}
+	if optional, ok := namespaceOptional[cmd]; ok && optional() {
+		return nil
+	}
+	return errors.New(`required flag(s) "namespace" not set`)
+}
+
+// encryptionKeys loads the keys of --encrypt-recipient, --identity and --passphrase-file
+func encryptionKeys() (*backup.Keys, error) {
+	passphrase := os.Getenv(passphraseEnv)
+	if *passphraseFile != "" {
+		data, err := ioutil.ReadFile(*passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	return backup.LoadKeys(*encryptRecipients, *identities, passphrase)
+}
 
+// transferOptions collects the transfer tuning flags
+func transferOptions() server.TransferOptions {
+	keys, err := encryptionKeys()
+	if err != nil {
+		logrus.Fatalf("load encryption keys failed: %s", err)
+	}
+	return server.TransferOptions{
+		Keys:           keys,
+		BwLimit:        *bwLimit,
+		BwLimitScope:   *bwLimitScope,
+		Compress:       *compress,
+		CompressLevel:  *compressLevel,
+		Output:         *output,
+		Chown:          *chown,
+		Chmod:          *chmod,
+		NumericIDs:     *numericIDs,
+		SELinuxRelabel: *relabel,
+		Xattrs:         *xattrs,
+		ACLs:           *acls,
+		Atomic:         *atomic,
+		AtomicMode:     *atomicMode,
+		EncryptPull:    *encryptPull,
+		Watch:          *watch,
+		WatchDebounce:  *watchDebounce,
+		PreHook:        *preHook,
+		PostHook:       *postHook,
+		HookContainer:  *hookContainer,
+		HookTimeout:    *hookTimeout,
+		HookFailure:    *hookFailure,
+		Quiesce:        *quiesce,
+		QuiesceTimeout: *quiesceTimeout,
+		QuiesceImage:   *quiesceImage,
+		Restart:        *restart,
+		RestartTimeout: *restartTimeout,
+		WaitLock:       *waitLock,
+		ForceUnlock:    *forceUnlock,
+		AnnotateClaim:  *annotatePVC,
+	}
 }
 
 func newLogger() *logrus.Logger {
 	logger := logrus.New()
+	logger.AddHook(audit.Hook{})
 	logger.SetReportCaller(true)
 	logger.SetLevel(logrus.DebugLevel)
 	logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true,
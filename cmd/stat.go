@@ -0,0 +1,45 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var statIndex *int
+
+// statCmd represents the stat command
+var statCmd = &cobra.Command{
+	Use:   "stat",
+	Short: "print the details of files of a volume of a resource",
+	Long: `print the type, size, mode, owner and mtime of files/directories of a volume of a deploy/sts/ds/pod kind
+	resource, and where they are on the node. The paths after the resource are relative to the root of the volume.
+ For example:
+
+	sync-volume-data stat deploy/nginx -n my-web -v web -p "myPassword" index.html conf/nginx.conf
+`,
+	Args: validateBrowseArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		newBrowseServer(args, *statIndex).Stat(args[1:])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statCmd)
+
+	statIndex = statCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"sync-volume-data/backup"
+)
+
+// storeFlags select where backups are kept: the local machine, or a bucket when --s3-bucket is set
+type storeFlags struct {
+	dir         *string
+	endpoint    *string
+	bucket      *string
+	prefix      *string
+	region      *string
+	accessKey   *string
+	secretKey   *string
+	insecure    *bool
+	sse         *string
+	sseKMSKeyID *string
+	partSize    *uint64
+}
+
+func addStoreFlags(cmd *cobra.Command) *storeFlags {
+	return &storeFlags{
+		dir:         cmd.Flags().String("dir", "", "local directory of the backups (default the current directory)"),
+		endpoint:    cmd.Flags().String("s3-endpoint", "s3.amazonaws.com", "endpoint of the S3 compatible storage, e.g. minio.local:9000"),
+		bucket:      cmd.Flags().String("s3-bucket", "", "keep the backups in this bucket instead of the local machine"),
+		prefix:      cmd.Flags().String("s3-prefix", "", "prefix of the backup objects in the bucket"),
+		region:      cmd.Flags().String("s3-region", "", "region of the bucket"),
+		accessKey:   cmd.Flags().String("s3-access-key", "", "access key (default $AWS_ACCESS_KEY_ID or $MINIO_ROOT_USER)"),
+		secretKey:   cmd.Flags().String("s3-secret-key", "", "secret key (default $AWS_SECRET_ACCESS_KEY or $MINIO_ROOT_PASSWORD)"),
+		insecure:    cmd.Flags().Bool("s3-insecure", false, "connect to the endpoint with http instead of https"),
+		sse:         cmd.Flags().String("s3-sse", "", "server side encryption of the objects, AES256 or aws:kms"),
+		sseKMSKeyID: cmd.Flags().String("s3-sse-kms-key-id", "", "KMS key of --s3-sse aws:kms"),
+		partSize:    cmd.Flags().Uint64("s3-part-size", backup.DefaultPartSize>>20, "size in MiB of the parts of multipart uploads"),
+	}
+}
+
+// remote tells whether the backups are kept in a bucket
+func (f *storeFlags) remote() bool {
+	return *f.bucket != ""
+}
+
+func (f *storeFlags) store() (backup.Store, error) {
+	if !f.remote() {
+		return backup.NewLocalStore(*f.dir), nil
+	}
+	return backup.NewS3Store(backup.S3Config{
+		Endpoint:    *f.endpoint,
+		Bucket:      *f.bucket,
+		Prefix:      *f.prefix,
+		Region:      *f.region,
+		AccessKey:   *f.accessKey,
+		SecretKey:   *f.secretKey,
+		Insecure:    *f.insecure,
+		SSE:         *f.sse,
+		SSEKMSKeyID: *f.sseKMSKeyID,
+		PartSize:    *f.partSize << 20,
+	})
+}
@@ -69,14 +69,14 @@ func newStsCmd() *cobra.Command {
 					args[0], *volume, *namespace, *source, *sshuser, *sshpwd, *sshPort, *instanceIndex)
 
 				s := server.NewServer(RsyncTool, *sshuser, *sshpwd, *sshPort, *namespace, "sts",
-					args[0], *volume, source, *instanceIndex, logger, cmd.Parent().Use)
+					args[0], *volume, source, *instanceIndex, logger, cmd.Parent().Use, transferOptions())
 				s.Run()
 			} else if cmd.Parent().Parent().Use == ScpTool {
 				logger.Printf("execute rsync deploy %s, volume is %s, namespace is %s, rousce is %v, sshuser: %s, sshpwd:%s, sshport:%s, instanceIdex:%d\n",
 					args[0], *volume, *namespace, *source, *sshuser, *sshpwd, *sshPort, *instanceIndex)
 
 				s := server.NewServer(ScpTool, *sshuser, *sshpwd, *sshPort, *namespace, "sts",
-					args[0], *volume, source, *instanceIndex, logger, cmd.Parent().Use)
+					args[0], *volume, source, *instanceIndex, logger, cmd.Parent().Use, transferOptions())
 				s.Run()
 			}
 		},
@@ -0,0 +1,75 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"sync-volume-data/server"
+)
+
+var (
+	syncDir            *string
+	syncIndex          *int
+	syncConflict       *string
+	syncConflictSuffix *string
+	syncDryRun         *bool
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "synchronize a local directory and a volume of a resource in both directions",
+	Long: `synchronize a local directory and a volume of a deploy/sts/ds/pod kind resource in both directions.
+	The state of both sides after every sync is kept in ~/.sync-volume-data/sync, the next sync carries the changes of
+	each side since then to the other side. A path changed on both sides is a conflict, "--conflict" resolves it:
+	skip (default) reports it and leaves it alone, prefer-local, prefer-remote, or keep-both which keeps the local
+	version and the remote one under a name with "--conflict-suffix" and the time.
+ For example:
+
+	sync-volume-data sync deploy/cms -n web -v uploads -p "myPassword" -d ./uploads --conflict keep-both
+	sync-volume-data sync deploy/cms -n web -v uploads -p "myPassword" -d ./uploads --dry-run
+`,
+	Args: validateTargetArg,
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, name, _ := parseTarget(args[0])
+		logger := newLogger().WithFields(logrus.Fields{
+			"namespace": *namespace,
+			"target":    args[0],
+		})
+		logger.Infof("sync %s with %s volume %s", *syncDir, args[0], *volume)
+
+		s := server.NewServer("", *sshuser, *sshpwd, *sshPort, *namespace, kind, name, *volume,
+			&[]string{}, *syncIndex, logger, server.TransferSync, transferOptions())
+		s.Sync(server.SyncOptions{
+			LocalDir:       *syncDir,
+			Conflict:       *syncConflict,
+			ConflictSuffix: *syncConflictSuffix,
+			DryRun:         *syncDryRun,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncDir = syncCmd.Flags().StringP("dir", "d", ".", "local directory synchronized with the volume")
+	syncIndex = syncCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	syncConflict = syncCmd.Flags().String("conflict", server.ConflictSkip, "how to resolve a path changed on both sides: skip, prefer-local, prefer-remote or keep-both")
+	syncConflictSuffix = syncCmd.Flags().String("conflict-suffix", server.DefaultConflictSuffix, "suffix of the copy moved aside by --conflict keep-both, inserted before the extension with the time")
+	syncDryRun = syncCmd.Flags().Bool("dry-run", false, "print what would be pushed, pulled, removed and the conflicts without changing anything")
+}
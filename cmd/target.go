@@ -0,0 +1,38 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parseTarget splits a kind/name argument such as deploy/nginx or sts/web
+func parseTarget(arg string) (kind, name string, err error) {
+	parts := strings.SplitN(arg, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("invalid target %q, expect kind/name such as deploy/nginx, sts/web, ds/agent or pod/web-0", arg))
+	}
+
+	switch parts[0] {
+	case "deploy", "deployment", "sts", "statefulset", "ds", "daemonset", "pod":
+		return parts[0], parts[1], nil
+	default:
+		return "", "", errors.New(fmt.Sprintf("kind %s not supported, please use deploy, sts, ds or pod", parts[0]))
+	}
+}
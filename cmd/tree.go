@@ -0,0 +1,60 @@
+/*
+Copyright © 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"sync-volume-data/server"
+)
+
+var (
+	treeIndex *int
+	treeLevel *int
+	treeGlob  *string
+	treeHuman *bool
+)
+
+// treeCmd represents the tree command
+var treeCmd = &cobra.Command{
+	Use:   "tree",
+	Short: "print the files of a volume of a resource as a tree",
+	Long: `print the files of a volume of a deploy/sts/ds/pod kind resource as a tree, the paths after the resource are
+	relative to the root of the volume, the root is printed without any. "--glob" keeps the matching entries and the
+	directories leading to them, "-o json" prints the tree as nested entries.
+ For example:
+
+	sync-volume-data tree sts/postgres -i 0 -n db -v data -p "myPassword" -L 2
+	sync-volume-data tree sts/postgres -i 0 -n db -v data -p "myPassword" pgdata --glob "*.conf"
+`,
+	Args: validateBrowseArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		newBrowseServer(args, *treeIndex).Tree(args[1:], server.BrowseOptions{
+			Depth: *treeLevel,
+			Glob:  *treeGlob,
+			Human: *treeHuman,
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(treeCmd)
+
+	treeIndex = treeCmd.Flags().IntP("instance-index", "i", -1, "instance index when the target is a statefulset")
+	treeLevel = treeCmd.Flags().IntP("level", "L", 0, "descend only this many levels, 0 for all of them")
+	treeGlob = treeCmd.Flags().String("glob", "", `print only the entries whose name matches, e.g. "*.log", or whose path matches when it contains a "/"`)
+	treeHuman = treeCmd.Flags().Bool("human", false, "print the sizes as KiB, MiB...")
+}
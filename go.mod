@@ -3,13 +3,18 @@ module sync-volume-data
 go 1.16
 
 require (
+	filippo.io/age v1.0.0
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/google/gofuzz v1.2.0 // indirect
 	github.com/imdario/mergo v0.3.12 // indirect
+	github.com/klauspost/compress v1.16.0
+	github.com/minio/minio-go/v7 v7.0.50
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/sirupsen/logrus v1.8.1
+	github.com/pmezard/go-difflib v1.0.0
+	github.com/sirupsen/logrus v1.9.0
 	github.com/spf13/cobra v1.3.0
-	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
-	golang.org/x/sys v0.0.0-20211210111614-af8b64212486 // indirect
+	golang.org/x/crypto v0.6.0
+	golang.org/x/term v0.5.0
 	k8s.io/api v0.22.4
 	k8s.io/apimachinery v0.22.4
 	k8s.io/client-go v0.22.4
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const barWidth = 30
+
+// barReporter redraws a single progress line in place, it is used when the output is a terminal
+type barReporter struct {
+	w      io.Writer
+	mu     sync.Mutex
+	status Status
+	drawn  bool
+}
+
+func newBarReporter(w io.Writer) *barReporter {
+	return &barReporter{w: w}
+}
+
+func (b *barReporter) Start(start Start) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.w, "%s %s pod %s/%s on node %s(%s), volume path %s\n", start.Tool, start.Action,
+		start.Target.Namespace, start.Target.Pod, start.Target.Node, start.Target.NodeIP, start.Target.VolumePath)
+	b.status.TotalBytes = start.TotalBytes
+	b.draw()
+}
+
+func (b *barReporter) File(string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Files++
+	b.draw()
+}
+
+func (b *barReporter) Progress(status Status) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// the file counter is owned by File()
+	status.Files = b.status.Files
+	b.status = status
+	b.draw()
+}
+
+func (b *barReporter) Done(summary Summary) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Percent = 100
+	b.status.Bytes = summary.Bytes
+	b.status.Files = summary.Files
+	b.status.ETA = 0
+	b.draw()
+	fmt.Fprintln(b.w)
+	printSummary(b.w, summary)
+}
+
+func (b *barReporter) Error(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.drawn {
+		fmt.Fprintln(b.w)
+	}
+	fmt.Fprintln(b.w, separator)
+	fmt.Fprintf(b.w, "sync data failed: %s\n", err)
+}
+
+func (b *barReporter) draw() {
+	percent := b.status.Percent
+	if percent > 100 {
+		percent = 100
+	}
+	filled := barWidth * percent / 100
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+
+	total := "?"
+	if b.status.TotalBytes > 0 {
+		total = HumanBytes(b.status.TotalBytes)
+	}
+
+	// \033[K clears the rest of a previously longer line
+	fmt.Fprintf(b.w, "\r[%s] %3d%%  %s/%s  %s/s  ETA %s  files %d\033[K", bar, percent,
+		HumanBytes(b.status.Bytes), total, HumanBytes(int64(b.status.Throughput)),
+		formatDuration(b.status.ETA), b.status.Files)
+	b.drawn = true
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// event is a single line of the json output
+type event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Start    *Start    `json:"start,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Progress *Status   `json:"progress,omitempty"`
+	Summary  *Summary  `json:"summary,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// jsonReporter writes one json object per line so that pipelines can parse the transfer
+type jsonReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONReporter(w io.Writer) *jsonReporter {
+	return &jsonReporter{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonReporter) Start(start Start) {
+	j.emit(event{Event: "start", Start: &start})
+}
+
+func (j *jsonReporter) File(name string) {
+	j.emit(event{Event: "file", File: name})
+}
+
+func (j *jsonReporter) Progress(status Status) {
+	j.emit(event{Event: "progress", Progress: &status})
+}
+
+func (j *jsonReporter) Done(summary Summary) {
+	j.emit(event{Event: "done", Summary: &summary})
+}
+
+func (j *jsonReporter) Error(err error) {
+	j.emit(event{Event: "error", Error: err.Error()})
+}
+
+func (j *jsonReporter) emit(e event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e.Time = time.Now()
+	// nothing useful can be done if stdout is gone
+	_ = j.enc.Encode(e)
+}
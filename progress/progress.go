@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Target describes where the data goes to or comes from
+type Target struct {
+	Namespace  string `json:"namespace"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Pod        string `json:"pod"`
+	Node       string `json:"node"`
+	NodeIP     string `json:"nodeIP"`
+	Volume     string `json:"volume"`
+	VolumePath string `json:"volumePath"`
+}
+
+// Start is reported once the target has been resolved and the transfer begins
+type Start struct {
+	Tool   string `json:"tool"`
+	Action string `json:"action"`
+	Target Target `json:"target"`
+	// Source is set when the data comes from another volume instead of the local machine
+	Source *Target `json:"source,omitempty"`
+	// TotalBytes is 0 when the size is not known in advance
+	TotalBytes int64 `json:"totalBytes,omitempty"`
+}
+
+// Status is a snapshot of a running transfer
+type Status struct {
+	Files      int           `json:"files"`
+	Bytes      int64         `json:"bytes"`
+	TotalBytes int64         `json:"totalBytes,omitempty"`
+	Percent    int           `json:"percent"`
+	Throughput float64       `json:"throughput"` // bytes per second
+	ETA        time.Duration `json:"etaNs"`
+}
+
+// Summary is reported when the transfer has finished successfully
+type Summary struct {
+	Tool     string        `json:"tool"`
+	Action   string        `json:"action"`
+	Target   Target        `json:"target"`
+	Source   *Target       `json:"source,omitempty"`
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Removed  int           `json:"removed,omitempty"` // paths deleted from the volume by --watch
+	Duration time.Duration `json:"durationNs"`
+}
+
+// Reporter receives the lifecycle events of a transfer and renders them
+type Reporter interface {
+	Start(start Start)
+	File(name string)
+	Progress(status Status)
+	Done(summary Summary)
+	Error(err error)
+}
+
+// ValidateOutput checks the value of the --output flag
+func ValidateOutput(output string) error {
+	switch output {
+	case "", OutputText, OutputJSON:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("not support output %s, please use %s or %s", output, OutputText, OutputJSON))
+	}
+}
+
+// New returns the reporter matching output. For text output a live progress bar is
+// rendered when w is a terminal, otherwise plain lines are printed.
+func New(output string, w io.Writer) Reporter {
+	if output == OutputJSON {
+		return newJSONReporter(w)
+	}
+
+	if f, ok := w.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		return newBarReporter(w)
+	}
+	return newTextReporter(w)
+}
+
+// HumanBytes formats a byte count with binary units, e.g. 1.5 MiB
+func HumanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	d -= h * time.Hour
+	m := d / time.Minute
+	d -= m * time.Minute
+	return fmt.Sprintf("%d:%02d:%02d", h, m, d/time.Second)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONReporter(t *testing.T) {
+	var buf bytes.Buffer
+	r := New(OutputJSON, &buf)
+	r.Start(Start{Tool: "rsync", Action: "to", TotalBytes: 100})
+	r.File("a.txt")
+	r.Progress(Status{Bytes: 50, TotalBytes: 100, Percent: 50})
+	r.Done(Summary{Tool: "rsync", Action: "to", Files: 1, Bytes: 100})
+	r.Error(errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{"start", "file", "progress", "done", "error"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var e event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("event %d is not json: %s", i, err)
+		}
+		if e.Event != want[i] || e.Time.IsZero() {
+			t.Errorf("event %d = %q at %s, want %q", i, e.Event, e.Time, want[i])
+		}
+	}
+	var e event
+	_ = json.Unmarshal([]byte(lines[2]), &e)
+	if e.Progress == nil || e.Progress.Percent != 50 || e.Progress.Bytes != 50 {
+		t.Errorf("progress event = %+v", e.Progress)
+	}
+	_ = json.Unmarshal([]byte(lines[4]), &e)
+	if e.Error != "boom" {
+		t.Errorf("error event = %q, want boom", e.Error)
+	}
+}
+
+func TestTextReporter(t *testing.T) {
+	var buf bytes.Buffer
+	r := New(OutputText, &buf)
+	if _, ok := r.(*textReporter); !ok {
+		t.Fatalf("New() = %T for a buffer, want *textReporter", r)
+	}
+	r.Start(Start{Tool: "rsync", Action: "to", TotalBytes: 2048})
+	r.File("a.txt")
+
+	status := Status{Bytes: 1024, Percent: 50, Throughput: 512, ETA: 2 * time.Second}
+	r.Progress(status)
+	if strings.Contains(buf.String(), "progress:") {
+		t.Errorf("status printed before %s:\n%s", statusInterval, buf.String())
+	}
+	r.(*textReporter).printed = time.Now().Add(-statusInterval)
+	r.Progress(status)
+	if want := "progress: 50%  1.0 KiB/2.0 KiB  512 B/s  ETA 0:00:02  files 1\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("status line missing, want %q in:\n%s", want, buf.String())
+	}
+
+	r.Done(Summary{Action: "to", Files: 1, Bytes: 2048, Duration: 2 * time.Second})
+	if !strings.Contains(buf.String(), "  bytes:       2.0 KiB (2048)\n") || !strings.Contains(buf.String(), "(1.0 KiB/s)") {
+		t.Errorf("summary missing:\n%s", buf.String())
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		b    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := HumanBytes(tt.b); got != tt.want {
+			t.Errorf("HumanBytes(%d) = %q, want %q", tt.b, got, tt.want)
+		}
+	}
+	if got := formatDuration(time.Hour + 2*time.Minute + 3500*time.Millisecond); got != "1:02:04" {
+		t.Errorf("formatDuration() = %q, want 1:02:04", got)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const separator = "#####################################################################################"
+
+// statusInterval is how often textReporter prints the throughput and the ETA
+const statusInterval = 10 * time.Second
+
+// textReporter prints one line per file and a status line every statusInterval, it is used when the output is
+// not a terminal
+type textReporter struct {
+	w       io.Writer
+	mu      sync.Mutex
+	files   int
+	total   int64
+	printed time.Time
+}
+
+func newTextReporter(w io.Writer) *textReporter {
+	return &textReporter{w: w}
+}
+
+func (t *textReporter) Start(start Start) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%s %s pod %s/%s on node %s(%s), volume path %s\n", start.Tool, start.Action,
+		start.Target.Namespace, start.Target.Pod, start.Target.Node, start.Target.NodeIP, start.Target.VolumePath)
+	t.total = start.TotalBytes
+	t.printed = time.Now()
+}
+
+func (t *textReporter) File(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files++
+	fmt.Fprintln(t.w, name)
+}
+
+func (t *textReporter) Progress(status Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.printed) < statusInterval {
+		return
+	}
+	t.printed = time.Now()
+
+	total := "?"
+	if status.TotalBytes > 0 {
+		total = HumanBytes(status.TotalBytes)
+	} else if t.total > 0 {
+		total = HumanBytes(t.total)
+	}
+	fmt.Fprintf(t.w, "progress: %d%%  %s/%s  %s/s  ETA %s  files %d\n", status.Percent, HumanBytes(status.Bytes), total,
+		HumanBytes(int64(status.Throughput)), formatDuration(status.ETA), t.files)
+}
+
+func (t *textReporter) Done(summary Summary) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	printSummary(t.w, summary)
+}
+
+func (t *textReporter) Error(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintln(t.w, separator)
+	fmt.Fprintf(t.w, "sync data failed: %s\n", err)
+}
+
+func printSummary(w io.Writer, summary Summary) {
+	rate := int64(0)
+	if secs := summary.Duration.Seconds(); secs > 0 {
+		rate = int64(float64(summary.Bytes) / secs)
+	}
+
+	lines := []string{
+		separator,
+		fmt.Sprintf("sync data %s pod volume succeed !!", summary.Action),
+		fmt.Sprintf("  pod:         %s/%s", summary.Target.Namespace, summary.Target.Pod),
+		fmt.Sprintf("  node:        %s (%s)", summary.Target.Node, summary.Target.NodeIP),
+		fmt.Sprintf("  volume:      %s", summary.Target.Volume),
+		fmt.Sprintf("  volume path: %s", summary.Target.VolumePath),
+		fmt.Sprintf("  files:       %d", summary.Files),
+		fmt.Sprintf("  bytes:       %s (%d)", HumanBytes(summary.Bytes), summary.Bytes),
+		fmt.Sprintf("  duration:    %s (%s/s)", formatDuration(summary.Duration), HumanBytes(rate)),
+	}
+	if summary.Source != nil {
+		lines = append(lines[:2], append([]string{
+			fmt.Sprintf("  source:      %s/%s %s (%s)", summary.Source.Namespace, summary.Source.Pod,
+				summary.Source.VolumePath, summary.Source.NodeIP),
+		}, lines[2:]...)...)
+	}
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
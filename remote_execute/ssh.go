@@ -20,11 +20,13 @@ import (
 	"errors"
 	//"github.com/mitchellh/go-homedir"
 	gossh "golang.org/x/crypto/ssh"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path"
+	"sync"
 )
 
 const (
@@ -32,6 +34,9 @@ const (
 	SshKey      = "key"
 )
 
+// ErrAborted is returned by every command run after Abort
+var ErrAborted = errors.New("the ssh connection was aborted")
+
 type Cli struct {
 	user       string
 	pwd        gossh.AuthMethod
@@ -41,6 +46,10 @@ type Cli struct {
 	client     *gossh.Client
 	session    *gossh.Session
 	LastResult string
+
+	mu sync.Mutex
+	// aborted refuses to connect again after Abort
+	aborted bool
 }
 
 func (c *Cli) Connect() (*Cli, error) {
@@ -63,12 +72,7 @@ func (c *Cli) Connect() (*Cli, error) {
 }
 
 func (c *Cli) Run(shell string) (string, error) {
-	if c.client == nil {
-		if _, err := c.Connect(); err != nil {
-			return "", err
-		}
-	}
-	session, err := c.client.NewSession()
+	session, err := c.newSession()
 	if err != nil {
 		return "", err
 	}
@@ -98,6 +102,105 @@ func (c *Cli) Run(shell string) (string, error) {
 	return string(stdoutMsg), nil
 }
 
+// Stream runs shell on the remote host and wires its standard streams to stdin/stdout/stderr, nil ones are
+// left unconnected. A non-zero exit status is returned as *ssh.ExitError.
+func (c *Cli) Stream(shell string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(shell)
+}
+
+// WindowSize is the size of a terminal in characters
+type WindowSize struct {
+	Width  int
+	Height int
+}
+
+// StreamTerminal runs shell on a pseudo terminal of the remote host, term is its TERM and size its first size, every
+// size received from resize is passed on to it. The output of the terminal goes to stdout.
+func (c *Cli) StreamTerminal(shell string, stdin io.Reader, stdout io.Writer, term string, size WindowSize, resize <-chan WindowSize) error {
+	session, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	modes := gossh.TerminalModes{gossh.ECHO: 1, gossh.TTY_OP_ISPEED: 14400, gossh.TTY_OP_OSPEED: 14400}
+	if err = session.RequestPty(term, size.Height, size.Width, modes); err != nil {
+		return err
+	}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stdout
+	if err = session.Start(shell); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case size := <-resize:
+				session.WindowChange(size.Height, size.Width)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return session.Wait()
+}
+
+// newSession opens a session, connecting first when needed
+func (c *Cli) newSession() (*gossh.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aborted {
+		return nil, ErrAborted
+	}
+	if c.client == nil {
+		if _, err := c.Connect(); err != nil {
+			return nil, err
+		}
+	}
+	return c.client.NewSession()
+}
+
+// Close closes the connection to the remote host, the next Run or Stream connects again
+func (c *Cli) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// Abort closes the connection to the remote host, the running commands fail and so do the next ones
+func (c *Cli) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aborted = true
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// Addr returns the host:port the client connects to
+func (c *Cli) Addr() string {
+	return c.addr
+}
+
 func NewCli(user, pwd, addr, sshType, publicKey string) *Cli {
 	if sshType == SshPassword {
 		return &Cli{
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync-volume-data/utils"
+	"time"
+)
+
+const (
+	// AtomicSymlink keeps every version in a hidden directory and flips the ..data symlink like ConfigMap volumes,
+	// it is the default
+	AtomicSymlink = "symlink"
+	// AtomicRename uploads a single file into a hidden staging directory and renames it into place
+	AtomicRename = "rename"
+
+	stagingPrefix = ".sync-volume-data-staging-"
+	dataLink      = "..data"
+)
+
+func validateAtomicMode(mode string) error {
+	switch mode {
+	case "", AtomicRename, AtomicSymlink:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("not support atomic-mode %s, please use %s or %s", mode, AtomicSymlink, AtomicRename))
+	}
+}
+
+// validateAtomicRename checks that the rename mode swaps a single file. Several entries or a directory can't be
+// swapped with one rename(2), readers would see a mix of old and new entries or miss the directory for a moment.
+func validateAtomicRename(sources []string) error {
+	if len(sources) == 1 {
+		if info, err := os.Stat(sources[0]); err == nil && info.Mode().IsRegular() {
+			return nil
+		}
+	}
+	return errors.New("atomic-mode rename only swaps a single file, use atomic-mode symlink to push a directory or several entries")
+}
+
+// prepareStaging creates the hidden directory which receives the data, the returned target points to it
+func (s *Server) prepareStaging(target *Target) (*Target, error) {
+	staged := *target
+	now := time.Now()
+
+	var script string
+	if s.opts.AtomicMode == AtomicRename {
+		staged.VolumePath = path.Join(target.VolumePath, stagingPrefix+fmt.Sprint(now.UnixNano()))
+		script = fmt.Sprintf("mkdir %s", utils.ShellQuote(staged.VolumePath))
+	} else {
+		staged.VolumePath = path.Join(target.VolumePath, ".."+now.Format("2006_01_02_15_04_05.000000000"))
+		script = seedScript(target.VolumePath, staged.VolumePath)
+	}
+
+	s.log.Infof("upload into staging directory %s", staged.VolumePath)
+	if _, err := target.sshcli.Run(script); err != nil {
+		return nil, errors.New(fmt.Sprintf("create staging directory on node %s failed: %s", target.NodeIP, err))
+	}
+	return &staged, nil
+}
+
+// dropStaging removes the staging directory after a failure, readers keep seeing the old tree
+func (s *Server) dropStaging(staged *Target) {
+	s.log.Warnf("remove staging directory %s", staged.VolumePath)
+	if _, err := staged.sshcli.Run(fmt.Sprintf("rm -rf %s", utils.ShellQuote(staged.VolumePath))); err != nil {
+		s.log.Errorf("remove staging directory %s on node %s failed: %s", staged.VolumePath, staged.NodeIP, err)
+	}
+}
+
+// seedScript creates the directory of a new version and seeds it with a copy of the current one, so entries which
+// are not pushed this time survive. The copy has inodes of its own: rsync updates the attributes of unchanged files
+// in place and the ownership and relabel passes change the new version, the live one must not see any of it.
+func seedScript(volumePath, version string) string {
+	vol := utils.ShellQuote(volumePath)
+	return fmt.Sprintf("mkdir %[1]s && if [ -L %[2]s/%[3]s ]; then cp -a %[2]s/%[3]s/. %[1]s/; fi",
+		utils.ShellQuote(version), vol, dataLink)
+}
+
+// swapIn moves the pushed entries of the staging directory into the volume
+func (s *Server) swapIn(target, staged *Target) error {
+	var names []string
+	for _, p := range s.pushedPaths(staged) {
+		names = append(names, path.Base(p))
+	}
+
+	var script string
+	if s.opts.AtomicMode == AtomicRename {
+		if len(names) != 1 {
+			return errors.New(fmt.Sprintf("atomic-mode rename swaps a single file, %d entries were pushed", len(names)))
+		}
+		script = renameSwapScript(target.VolumePath, path.Base(staged.VolumePath), names[0])
+	} else {
+		script = symlinkSwapScript(target.VolumePath, path.Base(staged.VolumePath), names)
+	}
+
+	s.log.Infof("swap %d entries into %s", len(names), target.VolumePath)
+	if _, err := target.sshcli.Run(script); err != nil {
+		return errors.New(fmt.Sprintf("swap staging directory into place on node %s failed: %s", target.NodeIP, err))
+	}
+	return nil
+}
+
+// renameSwapScript renames the file name of staging over the live one, rename(2) replaces it atomically
+func renameSwapScript(volumePath, staging, name string) string {
+	return strings.Join([]string{
+		"set -e",
+		"cd " + utils.ShellQuote(volumePath),
+		fmt.Sprintf("mv -fT %s/%s %s", utils.ShellQuote(staging), utils.ShellQuote(name), utils.ShellQuote(name)),
+		"rm -rf " + utils.ShellQuote(staging),
+	}, "\n")
+}
+
+// symlinkSwapScript points ..data to the new version with a single rename, the same way kubelet updates
+// ConfigMap volumes. Every pushed entry is a symlink to ..data/<name>, the first push replaces real entries.
+func symlinkSwapScript(volumePath, version string, names []string) string {
+	lines := []string{
+		"set -e",
+		"cd " + utils.ShellQuote(volumePath),
+		fmt.Sprintf("old=$(readlink %s || true)", dataLink),
+		fmt.Sprintf("ln -sfn %s %s_tmp", utils.ShellQuote(version), dataLink),
+		fmt.Sprintf("mv -T %[1]s_tmp %[1]s", dataLink),
+	}
+	for _, name := range names {
+		n := utils.ShellQuote(name)
+		link := utils.ShellQuote(dataLink + "/" + name)
+		lines = append(lines, fmt.Sprintf(`if [ "$(readlink %[1]s)" != %[2]s ]; then rm -rf %[1]s && ln -s %[2]s %[1]s; fi`, n, link))
+	}
+	lines = append(lines, fmt.Sprintf(`if [ -n "$old" ] && [ "$old" != %s ]; then rm -rf "$old"; fi`, utils.ShellQuote(version)))
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runScript runs a generated script with sh, the way the node runs it over ssh
+func runScript(t *testing.T, script string) {
+	t.Helper()
+	out, err := exec.Command("sh", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %s %s\n%s", err, out, script)
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestValidateAtomicMode(t *testing.T) {
+	for mode, wantErr := range map[string]bool{"": false, AtomicRename: false, AtomicSymlink: false, "copy": true} {
+		if err := validateAtomicMode(mode); (err != nil) != wantErr {
+			t.Errorf("validateAtomicMode(%q) error = %v, wantErr %v", mode, err, wantErr)
+		}
+	}
+}
+
+func TestSymlinkSwap(t *testing.T) {
+	tests := []struct {
+		name string
+		// live is the volume before the first push, pushes are the entries written into each new version
+		live   map[string]string
+		pushes []map[string]string
+		// want is what readers see through the entries after the last push
+		want map[string]string
+	}{
+		{
+			name:   "first push replaces real entries",
+			live:   map[string]string{"conf/app.yaml": "old", "other": "kept"},
+			pushes: []map[string]string{{"conf/app.yaml": "new"}},
+			want:   map[string]string{"conf/app.yaml": "new", "other": "kept"},
+		},
+		{
+			name:   "entries not pushed again survive",
+			pushes: []map[string]string{{"a/1": "a1", "b": "b1"}, {"b": "b2"}},
+			want:   map[string]string{"a/1": "a1", "b": "b2"},
+		},
+		{
+			name:   "names which need quoting",
+			pushes: []map[string]string{{"it's a dir/f": "1", "$(touch pwned)": "2"}, {"it's a dir/f": "3"}},
+			want:   map[string]string{"it's a dir/f": "3", "$(touch pwned)": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vol := filepath.Join(t.TempDir(), "vol ume")
+			writeFiles(t, vol, tt.live)
+			if err := os.MkdirAll(vol, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for i, push := range tt.pushes {
+				version := filepath.Join(vol, "..v"+string(rune('0'+i)))
+				runScript(t, seedScript(vol, version))
+				writeFiles(t, version, push)
+				names := map[string]bool{}
+				for name := range push {
+					names[strings.SplitN(name, "/", 2)[0]] = true
+				}
+				var list []string
+				for name := range names {
+					list = append(list, name)
+				}
+				runScript(t, symlinkSwapScript(vol, filepath.Base(version), list))
+			}
+
+			for name, content := range tt.want {
+				if got := readFile(t, filepath.Join(vol, name)); got != content {
+					t.Errorf("%s = %q, want %q", name, got, content)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(vol, "pwned")); err == nil {
+				t.Errorf("a name was run by the shell")
+			}
+			// only the live version is left
+			entries, _ := filepath.Glob(filepath.Join(vol, "..v*"))
+			if len(entries) != 1 {
+				t.Errorf("versions left: %v", entries)
+			}
+		})
+	}
+}
+
+// TestSeedCopies checks that the new version doesn't share inodes with the live one: changing the mode or the
+// content of a file in the new version must not show through the live entries
+func TestSeedCopies(t *testing.T) {
+	vol := t.TempDir()
+	v1 := filepath.Join(vol, "..v1")
+	runScript(t, seedScript(vol, v1))
+	writeFiles(t, v1, map[string]string{"conf/app.yaml": "v1"})
+	runScript(t, symlinkSwapScript(vol, "..v1", []string{"conf"}))
+
+	v2 := filepath.Join(vol, "..v2")
+	runScript(t, seedScript(vol, v2))
+	if got := readFile(t, filepath.Join(v2, "conf/app.yaml")); got != "v1" {
+		t.Fatalf("the new version is seeded with %q, want v1", got)
+	}
+	if err := os.Chmod(filepath.Join(v2, "conf/app.yaml"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(v2, "conf/app.yaml"), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("v2")
+	f.Close()
+
+	info, err := os.Stat(filepath.Join(vol, "conf/app.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("the live file has mode %o, the change of the new version shows through", info.Mode().Perm())
+	}
+	if got := readFile(t, filepath.Join(vol, "conf/app.yaml")); got != "v1" {
+		t.Errorf("the live file reads %q before the swap", got)
+	}
+}
+
+func TestRenameSwap(t *testing.T) {
+	tests := []struct {
+		name string
+		live bool
+	}{
+		{name: "app.yaml", live: true},
+		{name: "new file", live: false},
+		{name: "it's $(id)", live: true},
+	}
+	for _, tt := range tests {
+		vol := t.TempDir()
+		staging := stagingPrefix + "1"
+		if tt.live {
+			writeFiles(t, vol, map[string]string{tt.name: "old"})
+		}
+		writeFiles(t, filepath.Join(vol, staging), map[string]string{tt.name: "new"})
+		runScript(t, renameSwapScript(vol, staging, tt.name))
+		if got := readFile(t, filepath.Join(vol, tt.name)); got != "new" {
+			t.Errorf("%s = %q, want new", tt.name, got)
+		}
+		if _, err := os.Stat(filepath.Join(vol, staging)); !os.IsNotExist(err) {
+			t.Errorf("staging directory of %s is left", tt.name)
+		}
+	}
+}
+
+func TestValidateAtomicRename(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.yaml": "a", "b.yaml": "b", "conf/c.yaml": "c"})
+	tests := []struct {
+		sources []string
+		wantErr bool
+	}{
+		{sources: []string{filepath.Join(dir, "a.yaml")}},
+		{sources: []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")}, wantErr: true},
+		{sources: []string{filepath.Join(dir, "conf")}, wantErr: true},
+		{sources: []string{filepath.Join(dir, "conf") + "/"}, wantErr: true},
+		{sources: []string{filepath.Join(dir, "missing")}, wantErr: true},
+		{sources: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateAtomicRename(tt.sources); (err != nil) != tt.wantErr {
+			t.Errorf("validateAtomicRename(%v) error = %v, wantErr %v", tt.sources, err, tt.wantErr)
+		}
+	}
+}
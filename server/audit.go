@@ -0,0 +1,55 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync-volume-data/audit"
+	"sync-volume-data/progress"
+)
+
+// recordingReporter passes everything on to Reporter, keeps the summary of the transfer for its events and records
+// the files and the bytes in the audit log
+type recordingReporter struct {
+	progress.Reporter
+	summary *progress.Summary
+}
+
+func (r *recordingReporter) File(name string) {
+	audit.AddFile(name)
+	r.Reporter.File(name)
+}
+
+func (r *recordingReporter) Done(summary progress.Summary) {
+	r.summary = &summary
+	audit.Update(func(entry *audit.Entry) { entry.Bytes += summary.Bytes })
+	r.Reporter.Done(summary)
+}
+
+// auditTarget records a resolved target in the audit log, with the cluster and who it is accessed as
+func (s *Server) auditTarget(target *Target) {
+	audit.AddTarget(audit.Target{
+		Cluster:   s.restConfig.Host,
+		KubeUser:  s.identity().KubeUser,
+		Namespace: target.Pod.Namespace,
+		Kind:      s.resourceKind,
+		Name:      s.resourceName,
+		Pod:       target.Pod.Name,
+		Node:      target.Pod.Spec.NodeName,
+		Volume:    s.volume,
+		Direction: s.action,
+	})
+}
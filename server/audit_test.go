@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync-volume-data/audit"
+	"testing"
+)
+
+// TestTarHashes checks that the files are hashed as they are streamed, on the sending and on the receiving side
+func TestTarHashes(t *testing.T) {
+	if err := audit.Begin(filepath.Join(t.TempDir(), "audit.jsonl"), "sync-volume-data sync", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Update(func(entry *audit.Entry) { *entry = audit.Entry{} })
+
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := map[string]string{"conf/app.yaml": "replicas: 3\n", "empty": ""}
+	for name, data := range content {
+		if err := ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("conf/app.yaml", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	entries := []pushEntry{
+		{local: filepath.Join(src, "conf"), remote: "conf"},
+		{local: filepath.Join(src, "empty"), remote: "empty"},
+		{local: filepath.Join(src, "link"), remote: "link"},
+	}
+	if _, _, err := writeTar(&buf, entries, true); err != nil {
+		t.Fatalf("writeTar() failed: %s", err)
+	}
+	check := func(side string) {
+		audit.Update(func(entry *audit.Entry) {
+			if entry.HashCount != len(content) || len(entry.Hashes) != len(content) {
+				t.Errorf("%s recorded %d of %d hashes, want %d", side, len(entry.Hashes), entry.HashCount, len(content))
+			}
+			for name, data := range content {
+				sum := sha256.Sum256([]byte(data))
+				if got := entry.Hashes[name]; got != hex.EncodeToString(sum[:]) {
+					t.Errorf("%s hash of %s = %q, want %x", side, name, got, sum)
+				}
+			}
+			entry.Hashes, entry.HashCount = nil, 0
+		})
+	}
+	check("writeTar()")
+
+	if _, _, err := extractLocal(&buf, t.TempDir(), func(string) {}); err != nil {
+		t.Fatalf("extractLocal() failed: %s", err)
+	}
+	check("extractLocal()")
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"time"
+)
+
+// claimInfo returns the PVC, the PV and the storage class behind the volume of pod, generic ephemeral volumes
+// included, empty for other kinds of volumes
+func (s *Server) claimInfo(pod *corev1.Pod, volume *corev1.Volume) (pvcName, pvName, storageClass string) {
+	pvc, pv, err := s.volumeClaim(pod.Namespace, pod, volume)
+	if err != nil {
+		s.log.Warnf("get the claim of volume %s failed: %s", volume.Name, err)
+		return "", "", ""
+	}
+	if pvc == nil {
+		return "", "", ""
+	}
+	storageClass = pv.Spec.StorageClassName
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+	return pvc.Name, pv.Name, storageClass
+}
+
+func (s *Server) backupMetadata(target *Target) backup.Metadata {
+	pvc, pv, sc := s.claimInfo(target.Pod, target.Volume)
+	meta := backup.Metadata{
+		Namespace:             s.namespace,
+		Kind:                  s.resourceKind,
+		Name:                  s.resourceName,
+		Volume:                s.volume,
+		Pod:                   target.Pod.Name,
+		Node:                  target.Pod.Spec.NodeName,
+		PersistentVolumeClaim: pvc,
+		PersistentVolume:      pv,
+		StorageClass:          sc,
+		Compression:           s.opts.Compress,
+		CreatedAt:             time.Now(),
+	}
+	if s.resourceKind == statefulsetKind {
+		meta.InstanceIndex = s.instanceIndex
+	}
+	return meta
+}
+
+// volumeSize returns the size of tarPaths in the volume on the node, 0 when it can't be known
+func (s *Server) volumeSize(target *Target, tarPaths string) int64 {
+	out, err := target.sshcli.Run(fmt.Sprintf("cd %s && du -sbc -- %s | tail -n 1 | cut -f 1", utils.ShellQuote(target.VolumePath), tarPaths))
+	if err != nil {
+		s.log.Warnf("get size of volume failed: %s", err)
+		return 0
+	}
+	size, _ := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	return size
+}
+
+// Backup writes the content of the volume into the archive name of store
+func (s *Server) Backup(store backup.Store, name string) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	s.exitOnInvalid()
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	target, err := s.resolveTarget()
+	if err == nil {
+		err = s.guardTransfer(target, func(target *Target) error { return s.backupToStore(target, store, name) })
+	}
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+// backupToStore streams the archive into store, it only becomes visible there once it is complete
+func (s *Server) backupToStore(target *Target, store backup.Store, name string) error {
+	w, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+
+	// the archive is compressed before it is encrypted, encrypted data doesn't compress
+	ew, err := backup.EncryptWriter(w, s.opts.Keys)
+	if err != nil {
+		w.Abort(err)
+		return err
+	}
+	summary, err := s.backup(target, ew, ".")
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		w.Abort(err)
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return errors.New(fmt.Sprintf("store backup %s in %s failed: %s", name, store, err))
+	}
+
+	s.reporter.Done(*summary)
+	s.log.Infof("backup volume %s of %s/%s into %s %s succeed !!", s.volume, s.namespace, target.Pod.Name, store, name)
+	return nil
+}
+
+// backup streams a tar of tarPaths, shell quoted paths of the volume, from the node and turns it into an archive
+// written to w
+func (s *Server) backup(target *Target, w io.Writer, tarPaths string) (*progress.Summary, error) {
+	meta := s.backupMetadata(target)
+	total := s.volumeSize(target, tarPaths)
+	startTime := time.Now()
+	start := progress.Start{Tool: "backup", Action: TransferFrom, Target: s.progressTarget(target), TotalBytes: total}
+	s.reporter.Start(start)
+
+	pr, pw := io.Pipe()
+	counter := utils.NewCountingReader(pr)
+	srcErr := make(chan error, 1)
+	go func() {
+		var stderr bytes.Buffer
+		err := target.sshcli.Stream(fmt.Sprintf("tar -C %s -cf - -- %s", utils.ShellQuote(target.VolumePath), tarPaths), nil, pw, &stderr)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("read volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+		}
+		pw.CloseWithError(err)
+		srcErr <- err
+	}()
+
+	done := make(chan struct{})
+	go reportRelayProgress(s.reporter, counter, total, done)
+
+	limiter := s.limiter(target)
+	manifest, err := backup.Write(w, limiter.Reader(counter), meta, s.opts.CompressLevel, func(name string, size int64) {
+		s.reporter.File(name)
+	})
+	close(done)
+	if err == nil {
+		// tar pads the stream after its end marker, let the remote side finish writing it
+		io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(io.ErrClosedPipe)
+	if e := <-srcErr; e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &progress.Summary{
+		Tool:     "backup",
+		Action:   TransferFrom,
+		Target:   start.Target,
+		Files:    manifest.Files,
+		Bytes:    manifest.TotalBytes,
+		Duration: time.Since(startTime),
+	}, nil
+}
+
+// pullEncrypted writes the source paths of the volume into an encrypted archive of the working directory instead
+// of plain files, restore pushes it back with the matching identity
+func (s *Server) pullEncrypted(target *Target) error {
+	tarPaths := "."
+	if len(*s.sourceDir) > 0 {
+		paths, err := volumeRelPaths(*s.sourceDir)
+		if err != nil {
+			return err
+		}
+		tarPaths = utils.ShellQuoteAll(paths)
+	}
+
+	name := fmt.Sprintf("%s-%s-%s-%s-%s%s", s.namespace, s.resourceName, backup.InstanceName(s.resourceKind, s.instanceIndex),
+		s.volume, time.Now().Format("20060102-150405"), backup.Extension(s.opts.Compress, true))
+	store := backup.NewLocalStore("")
+	w, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	ew, err := backup.EncryptWriter(w, s.opts.Keys)
+	if err != nil {
+		w.Abort(err)
+		return err
+	}
+	summary, err := s.backup(target, ew, tarPaths)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		w.Abort(err)
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	s.reporter.Done(*summary)
+	s.log.Infof("pull volume %s of %s/%s into encrypted archive %s succeed !!", s.volume, s.namespace, target.Pod.Name, name)
+	return nil
+}
+
+// Restore puts the content of the archive name of store back into the volume, verify checks every checksum before
+func (s *Server) Restore(store backup.Store, name string, verify bool) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	s.exitOnInvalid()
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	var total int64
+	if verify {
+		manifest, err := s.verifyArchive(store, name)
+		if err != nil {
+			s.reporter.Error(err)
+			s.log.Fatal(err)
+		}
+		total = manifest.TotalBytes
+		s.log.Infof("verify backup %s succeed, %d files", name, manifest.Files)
+	}
+
+	f, err := store.Open(name)
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+	defer f.Close()
+
+	target, err := s.resolveTarget()
+	if err == nil {
+		err = s.guardTransfer(target, func(target *Target) error { return s.restore(target, f, total, verify) })
+	}
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+func (s *Server) verifyArchive(store backup.Store, name string) (*backup.Manifest, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader, err := backup.NewReader(f, s.opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return reader.Verify()
+}
+
+// restore streams the files of the archive read from r into the volume
+func (s *Server) restore(target *Target, r io.Reader, total int64, verify bool) error {
+	reader, err := backup.NewReader(r, s.opts.Keys)
+	if err != nil {
+		return err
+	}
+	s.checkOrigin(reader.Metadata)
+
+	startTime := time.Now()
+	start := progress.Start{Tool: "restore", Action: TransferTo, Target: s.progressTarget(target), TotalBytes: total}
+	s.reporter.Start(start)
+
+	files := 0
+	var manifest *backup.Manifest
+	err = s.extractOnNode(target, total, func(w io.Writer) error {
+		var err error
+		manifest, err = reader.Extract(w, verify, func(name string, size int64) {
+			files++
+			s.reporter.File(name)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var bytesMoved int64
+	var restored []string
+	if manifest != nil {
+		bytesMoved = manifest.TotalBytes
+		for _, entry := range manifest.Entries {
+			restored = append(restored, entry.Path)
+			if entry.SHA256 != "" {
+				audit.AddHash(entry.Path, entry.SHA256)
+			}
+		}
+	}
+	return s.finishRestore(target, progress.Summary{
+		Tool:     "restore",
+		Action:   TransferTo,
+		Target:   start.Target,
+		Files:    files,
+		Bytes:    bytesMoved,
+		Duration: time.Since(startTime),
+	}, restored)
+}
+
+// checkOrigin warns when a backup is restored into another volume than the one it was taken from
+func (s *Server) checkOrigin(meta backup.Metadata) {
+	s.log.Infof("restore backup of %s %s/%s volume %s taken at %s", meta.Kind, meta.Namespace, meta.Name, meta.Volume,
+		meta.CreatedAt.Format(time.RFC3339))
+	if meta.Namespace != s.namespace || meta.Name != s.resourceName || meta.Volume != s.volume {
+		s.log.Warnf("the backup comes from %s/%s volume %s, restore it into %s/%s volume %s",
+			meta.Namespace, meta.Name, meta.Volume, s.namespace, s.resourceName, s.volume)
+	}
+}
+
+// extractOnNode streams the tar written by produce into the volume
+func (s *Server) extractOnNode(target *Target, total int64, produce func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	counter := utils.NewCountingReader(pr)
+	produced := make(chan error, 1)
+	go func() {
+		err := produce(pw)
+		pw.CloseWithError(err)
+		produced <- err
+	}()
+
+	done := make(chan struct{})
+	go reportRelayProgress(s.reporter, counter, total, done)
+
+	var stderr bytes.Buffer
+	limiter := s.limiter(target)
+	err := target.sshcli.Stream(fmt.Sprintf("tar -C %s -xf -", utils.ShellQuote(target.VolumePath)), limiter.Reader(counter), nil, &stderr)
+	close(done)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if e := <-produced; e != nil {
+		return e
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("write volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+// finishRestore applies --chown/--chmod/--selinux-relabel to the restored paths and reports the summary
+func (s *Server) finishRestore(target *Target, summary progress.Summary, restored []string) error {
+	pushed := topLevelPaths(target.VolumePath, restored)
+	if err := s.applyOwnership(target, pushed); err != nil {
+		return err
+	}
+	if err := s.relabel(target, pushed); err != nil {
+		return err
+	}
+
+	s.reporter.Done(summary)
+	s.log.Infof("restore volume %s of %s/%s succeed !!", s.volume, s.namespace, target.Pod.Name)
+	return nil
+}
+
+// topLevelPaths returns the distinct top level entries of paths relative to dir, joined to dir
+func topLevelPaths(dir string, paths []string) []string {
+	seen := make(map[string]bool)
+	var top []string
+	for _, p := range paths {
+		name := strings.SplitN(p, "/", 2)[0]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		top = append(top, path.Join(dir, name))
+	}
+	return top
+}
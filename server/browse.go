@@ -0,0 +1,383 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"text/tabwriter"
+	"time"
+)
+
+const TransferBrowse = "browse"
+
+// BrowseOptions tunes what ls and tree list
+type BrowseOptions struct {
+	// Recursive lists the whole content of the directories, ls only
+	Recursive bool
+	// Depth is the number of levels tree descends, 0 for all of them
+	Depth int
+	// Glob keeps the entries whose name matches, or whose path matches when it contains a slash
+	Glob string
+	// Human prints the sizes as KiB, MiB...
+	Human bool
+}
+
+// VolumeEntry is a file, directory or symlink in the volume, its path is relative to the root of the volume
+type VolumeEntry struct {
+	Path        string         `json:"path"`
+	Type        string         `json:"type"`
+	Size        int64          `json:"size"`
+	Mode        string         `json:"mode"`
+	Permissions string         `json:"permissions"`
+	UID         int            `json:"uid"`
+	GID         int            `json:"gid"`
+	ModTime     time.Time      `json:"modTime"`
+	Target      string         `json:"target,omitempty"`
+	Children    []*VolumeEntry `json:"children,omitempty"`
+}
+
+// List prints the entries of paths in the volume like ls, the content of a directory rather than the directory
+func (s *Server) List(paths []string, opts BrowseOptions) {
+	target := s.startBrowse(opts)
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	depth := 1
+	if opts.Recursive {
+		depth = -1
+	}
+	var all []*VolumeEntry
+	for i, p := range paths {
+		nodes, err := s.findVolume(target, p, depth)
+		if err != nil {
+			s.log.Fatal(err)
+		}
+		var entries []*VolumeEntry
+		for j := range nodes {
+			// a directory itself is left out, its content is listed
+			if j == 0 && nodes[j].Type == backup.NodeDir {
+				continue
+			}
+			if globMatch(opts.Glob, nodes[j].Path) {
+				entries = append(entries, volumeEntry(&nodes[j]))
+			}
+		}
+
+		if s.opts.Output == progress.OutputJSON {
+			all = append(all, entries...)
+			continue
+		}
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", nodes[0].Path)
+		}
+		printEntries(entries, opts.Human)
+	}
+
+	if s.opts.Output == progress.OutputJSON {
+		if all == nil {
+			all = []*VolumeEntry{}
+		}
+		s.printJSON(all)
+	}
+}
+
+// Tree prints paths of the volume and their content as a tree
+func (s *Server) Tree(paths []string, opts BrowseOptions) {
+	target := s.startBrowse(opts)
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	depth := opts.Depth
+	if depth <= 0 {
+		depth = -1
+	}
+	var roots []*VolumeEntry
+	for _, p := range paths {
+		nodes, err := s.findVolume(target, p, depth)
+		if err != nil {
+			s.log.Fatal(err)
+		}
+		roots = append(roots, buildTree(nodes, opts.Glob))
+	}
+
+	if s.opts.Output == progress.OutputJSON {
+		s.printJSON(roots)
+		return
+	}
+	var dirs, files int
+	var size int64
+	for _, root := range roots {
+		fmt.Println(treeName(root, root.Path, opts.Human))
+		d, f, b := printTree(root.Children, "", opts.Human)
+		dirs, files, size = dirs+d, files+f, size+b
+	}
+	fmt.Printf("\n%d directories, %d files, %s\n", dirs, files, progress.HumanBytes(size))
+}
+
+// Stat prints the details of paths in the volume
+func (s *Server) Stat(paths []string) {
+	target := s.startBrowse(BrowseOptions{})
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	entries := make([]*VolumeEntry, 0, len(paths))
+	for _, p := range paths {
+		nodes, err := s.findVolume(target, p, 0)
+		if err != nil {
+			s.log.Fatal(err)
+		}
+		entries = append(entries, volumeEntry(&nodes[0]))
+	}
+
+	if s.opts.Output == progress.OutputJSON {
+		s.printJSON(entries)
+		return
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		name := entry.Path
+		if entry.Type == backup.NodeSymlink {
+			name += " -> " + entry.Target
+		}
+		fmt.Printf("  Path: %s\n", name)
+		fmt.Printf("  Type: %s\n", entry.Type)
+		fmt.Printf("  Size: %d (%s)\n", entry.Size, progress.HumanBytes(entry.Size))
+		fmt.Printf("Access: (%s/%s)  Uid: %d  Gid: %d\n", entry.Mode, entry.Permissions, entry.UID, entry.GID)
+		fmt.Printf("Modify: %s\n", entry.ModTime.Local().Format(time.RFC3339Nano))
+		fmt.Printf("  Node: %s:%s\n", target.NodeIP, path.Join(target.VolumePath, entry.Path))
+	}
+}
+
+// startBrowse validates the parameters and resolves the volume, it exits on any error
+func (s *Server) startBrowse(opts BrowseOptions) *Target {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	if opts.Glob != "" {
+		if _, err := path.Match(opts.Glob, ""); err != nil {
+			s.errMsg = append(s.errMsg, errors.New(fmt.Sprintf("invalid glob %q: %s", opts.Glob, err)))
+		}
+	}
+	s.exitOnInvalid()
+
+	target, err := s.resolveTarget()
+	if err != nil {
+		s.log.Fatal(err)
+	}
+	return target
+}
+
+// findVolume returns p and its content down to maxDepth levels below it, all of them when maxDepth is negative. The
+// nodes are sorted by path, p comes first.
+func (s *Server) findVolume(target *Target, p string, maxDepth int) ([]backup.Node, error) {
+	rel, err := volumeRelPath(p)
+	if err != nil {
+		return nil, err
+	}
+	quoted, depth := utils.ShellQuote(rel), ""
+	if maxDepth >= 0 {
+		depth = fmt.Sprintf(" -maxdepth %d", maxDepth)
+	}
+	script := fmt.Sprintf("cd %s && if [ -e %s ] || [ -L %s ]; then find %s%s -printf %s; fi",
+		utils.ShellQuote(target.VolumePath), quoted, quoted, quoted, depth, utils.ShellQuote(backup.FindFormat))
+	var listing, stderr bytes.Buffer
+	if err = target.sshcli.Stream(script, nil, &listing, &stderr); err != nil {
+		return nil, errors.New(fmt.Sprintf("list %s on node %s failed: %s %s", rel, target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	nodes, err := backup.ReadNodes(&listing)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: no such file or directory in volume %s", rel, s.volume))
+	}
+	for i := range nodes {
+		nodes[i].Path = path.Join(rel, nodes[i].Path)
+	}
+	return nodes, nil
+}
+
+func volumeEntry(node *backup.Node) *VolumeEntry {
+	return &VolumeEntry{
+		Path:        node.Path,
+		Type:        node.Type,
+		Size:        node.Size,
+		Mode:        fmt.Sprintf("%04o", node.Mode),
+		Permissions: permissions(node),
+		UID:         node.UID,
+		GID:         node.GID,
+		ModTime:     node.ModTime,
+		Target:      node.Target,
+	}
+}
+
+// permissions renders the mode like ls -l does
+func permissions(node *backup.Node) string {
+	perm := []byte("?rwxrwxrwx")
+	switch node.Type {
+	case backup.NodeFile:
+		perm[0] = '-'
+	case backup.NodeDir:
+		perm[0] = 'd'
+	case backup.NodeSymlink:
+		perm[0] = 'l'
+	}
+	for i := uint(0); i < 9; i++ {
+		if node.Mode&(1<<(8-i)) == 0 {
+			perm[i+1] = '-'
+		}
+	}
+	special := []struct {
+		bit      int64
+		pos      int
+		set, off byte
+	}{{04000, 3, 's', 'S'}, {02000, 6, 's', 'S'}, {01000, 9, 't', 'T'}}
+	for _, sp := range special {
+		if node.Mode&sp.bit == 0 {
+			continue
+		}
+		if perm[sp.pos] == '-' {
+			perm[sp.pos] = sp.off
+		} else {
+			perm[sp.pos] = sp.set
+		}
+	}
+	return string(perm)
+}
+
+// globMatch matches the name of p, or p itself when the pattern contains a slash
+func globMatch(glob, p string) bool {
+	if glob == "" {
+		return true
+	}
+	name := path.Base(p)
+	if strings.Contains(glob, "/") {
+		name = p
+	}
+	matched, _ := path.Match(glob, name)
+	return matched
+}
+
+func printEntries(entries []*VolumeEntry, human bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODE\tUID\tGID\tSIZE\tMODIFIED\tPATH")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", entry.Permissions, entry.UID, entry.GID, entrySize(entry, human),
+			entry.ModTime.Local().Format(time.RFC3339), entryName(entry, entry.Path))
+	}
+	w.Flush()
+}
+
+func entrySize(entry *VolumeEntry, human bool) string {
+	if human {
+		return progress.HumanBytes(entry.Size)
+	}
+	return strconv.FormatInt(entry.Size, 10)
+}
+
+// entryName marks a directory with a trailing slash and shows the target of a symlink
+func entryName(entry *VolumeEntry, name string) string {
+	switch entry.Type {
+	case backup.NodeDir:
+		if !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+	case backup.NodeSymlink:
+		name += " -> " + entry.Target
+	}
+	return name
+}
+
+// buildTree nests the sorted nodes under the first one. With a glob only the matching entries and the directories
+// leading to them are kept.
+func buildTree(nodes []backup.Node, glob string) *VolumeEntry {
+	entries := make(map[string]*VolumeEntry, len(nodes))
+	keep := make(map[string]bool, len(nodes))
+	root := volumeEntry(&nodes[0])
+	entries[root.Path], keep[root.Path] = root, true
+	for i := range nodes[1:] {
+		node := &nodes[i+1]
+		entries[node.Path] = volumeEntry(node)
+		if globMatch(glob, node.Path) {
+			for p := node.Path; !keep[p]; p = path.Dir(p) {
+				keep[p] = true
+			}
+		}
+	}
+	// the nodes are sorted so the children are appended in order
+	for i := range nodes[1:] {
+		p := nodes[i+1].Path
+		if keep[p] {
+			parent := entries[path.Dir(p)]
+			parent.Children = append(parent.Children, entries[p])
+		}
+	}
+	return root
+}
+
+// printTree prints entries under prefix and counts the directories, the files and their bytes
+func printTree(entries []*VolumeEntry, prefix string, human bool) (dirs, files int, size int64) {
+	for i, entry := range entries {
+		branch, indent := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, indent = "└── ", "    "
+		}
+		fmt.Println(prefix + branch + treeName(entry, path.Base(entry.Path), human))
+		if entry.Type == backup.NodeDir {
+			dirs++
+			d, f, b := printTree(entry.Children, prefix+indent, human)
+			dirs, files, size = dirs+d, files+f, size+b
+		} else {
+			files++
+			size += entry.Size
+		}
+	}
+	return dirs, files, size
+}
+
+func treeName(entry *VolumeEntry, name string, human bool) string {
+	name = entryName(entry, name)
+	if entry.Type == backup.NodeFile {
+		name = fmt.Sprintf("%s [%s]", name, entrySize(entry, human))
+	}
+	return name
+}
+
+func (s *Server) printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		s.log.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"sync-volume-data/backup"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	tests := []struct {
+		node backup.Node
+		want string
+	}{
+		{node: backup.Node{Type: backup.NodeFile, Mode: 0644}, want: "-rw-r--r--"},
+		{node: backup.Node{Type: backup.NodeDir, Mode: 0755}, want: "drwxr-xr-x"},
+		{node: backup.Node{Type: backup.NodeSymlink, Mode: 0777}, want: "lrwxrwxrwx"},
+		{node: backup.Node{Type: backup.NodeOther, Mode: 0600}, want: "?rw-------"},
+		{node: backup.Node{Type: backup.NodeFile, Mode: 04755}, want: "-rwsr-xr-x"},
+		{node: backup.Node{Type: backup.NodeFile, Mode: 02644}, want: "-rw-r-Sr--"},
+		{node: backup.Node{Type: backup.NodeDir, Mode: 01777}, want: "drwxrwxrwt"},
+		{node: backup.Node{Type: backup.NodeDir, Mode: 01770}, want: "drwxrwx--T"},
+	}
+	for _, tt := range tests {
+		if got := permissions(&tt.node); got != tt.want {
+			t.Errorf("permissions(%s %04o) = %s, want %s", tt.node.Type, tt.node.Mode, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		glob string
+		p    string
+		want bool
+	}{
+		{glob: "", p: "logs/app.log", want: true},
+		{glob: "*.log", p: "logs/app.log", want: true},
+		{glob: "*.log", p: "logs/app.log.1"},
+		{glob: "logs/*.log", p: "logs/app.log", want: true},
+		{glob: "logs/*.log", p: "old/logs/app.log"},
+		{glob: "app.*", p: "app.yaml", want: true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.glob, tt.p); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.glob, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestEntryName(t *testing.T) {
+	tests := []struct {
+		entry VolumeEntry
+		want  string
+	}{
+		{entry: VolumeEntry{Path: "data", Type: backup.NodeDir}, want: "data/"},
+		{entry: VolumeEntry{Path: "data/", Type: backup.NodeDir}, want: "data/"},
+		{entry: VolumeEntry{Path: "current", Type: backup.NodeSymlink, Target: "releases/v2"}, want: "current -> releases/v2"},
+		{entry: VolumeEntry{Path: "app.yaml", Type: backup.NodeFile}, want: "app.yaml"},
+	}
+	for _, tt := range tests {
+		if got := entryName(&tt.entry, tt.entry.Path); got != tt.want {
+			t.Errorf("entryName(%s) = %q, want %q", tt.entry.Path, got, tt.want)
+		}
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	nodes := []backup.Node{
+		{Path: ".", Type: backup.NodeDir},
+		{Path: "conf", Type: backup.NodeDir},
+		{Path: "conf/app.yaml", Type: backup.NodeFile},
+		{Path: "conf/db.yaml", Type: backup.NodeFile},
+		{Path: "logs", Type: backup.NodeDir},
+		{Path: "logs/app.log", Type: backup.NodeFile},
+		{Path: "readme", Type: backup.NodeFile},
+	}
+	// paths returns the tree as "path: children"
+	var paths func(entry *VolumeEntry, m map[string][]string) map[string][]string
+	paths = func(entry *VolumeEntry, m map[string][]string) map[string][]string {
+		for _, child := range entry.Children {
+			m[entry.Path] = append(m[entry.Path], child.Path)
+			paths(child, m)
+		}
+		return m
+	}
+
+	tests := []struct {
+		glob string
+		want map[string][]string
+	}{
+		{
+			glob: "",
+			want: map[string][]string{
+				".":    {"conf", "logs", "readme"},
+				"conf": {"conf/app.yaml", "conf/db.yaml"},
+				"logs": {"logs/app.log"},
+			},
+		},
+		{
+			glob: "*.yaml",
+			want: map[string][]string{".": {"conf"}, "conf": {"conf/app.yaml", "conf/db.yaml"}},
+		},
+		{
+			glob: "logs",
+			want: map[string][]string{".": {"logs"}},
+		},
+		{glob: "*.txt", want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		root := buildTree(nodes, tt.glob)
+		if got := paths(root, map[string][]string{}); root.Path != "." || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("buildTree(%q) = %v, want %v", tt.glob, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"k8s.io/client-go/rest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"time"
+)
+
+// Copier copies data from the volume of a resource into the volume of another resource without a local copy
+type Copier struct {
+	src *Server
+	dst *Server
+	// paths inside the source volume, empty means the whole volume
+	paths    []string
+	log      *logrus.Entry
+	reporter progress.Reporter
+	// Verify compares the checksums of every copied file on both sides after the copy
+	Verify bool
+}
+
+func NewCopier(src, dst *Server, paths []string, logger *logrus.Entry) *Copier {
+	return &Copier{
+		src:   src,
+		dst:   dst,
+		paths: paths,
+		log:   logger,
+	}
+}
+
+func (c *Copier) Run() {
+	c.src.validateTarget()
+	c.src.exitOnInvalid()
+
+	c.dst.validateTarget()
+	c.dst.ValidateTransferOptions()
+	if c.dst.opts.Atomic {
+		c.dst.errMsg = append(c.dst.errMsg, errors.New("atomic is not supported by copy"))
+	}
+	paths, err := volumeRelPaths(c.paths)
+	if err != nil {
+		c.dst.errMsg = append(c.dst.errMsg, err)
+	}
+	c.dst.exitOnInvalid()
+	c.paths = paths
+
+	c.reporter = progress.New(c.dst.opts.Output, os.Stdout)
+	c.dst.reporter = c.reporter
+
+	srcTarget, err := c.src.resolveTarget()
+	if err != nil {
+		c.reporter.Error(err)
+		c.log.Fatal(err)
+	}
+	dstTarget, err := c.dst.resolveTarget()
+	if err != nil {
+		c.reporter.Error(err)
+		c.log.Fatal(err)
+	}
+
+	// the hooks and --quiesce are those of the destination, they quiesce the application whose volume is written
+	err = c.dst.guardTransfer(dstTarget, func(dstTarget *Target) error {
+		// the destination records the summary for its events
+		c.reporter = c.dst.reporter
+		// the source node writes into the destination node when they stream directly
+		c.dst.stopOnLockLoss(srcTarget.sshcli)
+		return c.copy(srcTarget, dstTarget)
+	})
+	if err != nil {
+		c.reporter.Error(err)
+		c.log.Fatal(err)
+	}
+}
+
+// copy streams a tar of the source volume into the destination volume. Both volumes on the same node are copied
+// on the node, otherwise the source node pipes into the destination node over ssh when it can log in with a key,
+// the data goes through this tool as a last resort.
+func (c *Copier) copy(srcTarget, dstTarget *Target) error {
+	tarPaths := "."
+	if len(c.paths) > 0 {
+		tarPaths = utils.ShellQuoteAll(c.paths)
+	}
+
+	total, err := c.sourceSize(srcTarget, tarPaths)
+	if err != nil {
+		c.log.Warnf("get size of source volume failed: %s", err)
+	}
+
+	source := c.src.progressTarget(srcTarget)
+	start := progress.Start{Tool: "copy", Action: TransferTo, Target: c.dst.progressTarget(dstTarget), Source: &source}
+	if c.dst.opts.Compress == "" {
+		start.TotalBytes = total
+	}
+	startTime := time.Now()
+	c.reporter.Start(start)
+
+	files := &fileEventWriter{reporter: c.reporter}
+	var bytesMoved int64
+	srcTar := fmt.Sprintf("tar -C %s -cf - -- %s", utils.ShellQuote(srcTarget.VolumePath), tarPaths)
+	dstTar := fmt.Sprintf("tar -C %s -xvf -", utils.ShellQuote(dstTarget.VolumePath))
+
+	if c.sameNode(srcTarget, dstTarget) {
+		c.log.Infof("both volumes are on node %s, copy on the node", srcTarget.Pod.Spec.NodeName)
+		err = c.stream(dstTarget, srcTar+" | "+dstTar, nil, files)
+		bytesMoved = total
+	} else if c.canPaceDirectly(srcTarget) && c.canReachDirectly(srcTarget, dstTarget) {
+		c.log.Infof("stream from node %s to node %s directly", srcTarget.NodeIP, dstTarget.NodeIP)
+		compress, decompress := c.compressCommands()
+		if c.dst.bwLimit > 0 {
+			compress += fmt.Sprintf(" | pv -q -L %d", c.dst.bwLimit)
+		}
+		remote := decompress + dstTar
+		script := fmt.Sprintf("%s%s | ssh %s %s", srcTar, compress, c.nodeSSHArgs(dstTarget), utils.ShellQuote(remote))
+		err = c.stream(srcTarget, script, nil, files)
+		bytesMoved = total
+	} else {
+		c.log.Infof("stream from node %s to node %s through this tool", srcTarget.NodeIP, dstTarget.NodeIP)
+		bytesMoved, err = c.relay(srcTarget, dstTarget, srcTar, dstTar, start.TotalBytes, files)
+	}
+	files.flush()
+	if err != nil {
+		return err
+	}
+
+	var pushed []string
+	if len(c.paths) > 0 {
+		for _, p := range c.paths {
+			pushed = append(pushed, path.Join(dstTarget.VolumePath, p))
+		}
+	} else if pushed, err = c.topLevelEntries(srcTarget, dstTarget.VolumePath); err != nil {
+		return err
+	}
+	if err = c.dst.applyOwnership(dstTarget, pushed); err != nil {
+		return err
+	}
+	if err = c.dst.relabel(dstTarget, pushed); err != nil {
+		return err
+	}
+
+	if c.Verify {
+		if err = c.verify(srcTarget, dstTarget, tarPaths); err != nil {
+			return err
+		}
+	}
+
+	c.reporter.Done(progress.Summary{
+		Tool:     "copy",
+		Action:   TransferTo,
+		Target:   start.Target,
+		Source:   &source,
+		Files:    files.count,
+		Bytes:    bytesMoved,
+		Duration: time.Since(startTime),
+	})
+	c.log.Infof("copy data from %s/%s to %s/%s succeed !!", source.Namespace, source.Pod, start.Target.Namespace, start.Target.Pod)
+	return nil
+}
+
+// verify compares the sha256 of every copied file on both nodes
+func (c *Copier) verify(srcTarget, dstTarget *Target, tarPaths string) error {
+	c.log.Infof("verify checksums of copied files")
+	script := "cd %s && find %s -type f -print0 | sort -z | xargs -0 -r sha256sum"
+	srcSums, err := srcTarget.sshcli.Run(fmt.Sprintf(script, utils.ShellQuote(srcTarget.VolumePath), tarPaths))
+	if err != nil {
+		return errors.New(fmt.Sprintf("checksum source volume on node %s failed: %s", srcTarget.NodeIP, err))
+	}
+	dstSums, err := dstTarget.sshcli.Run(fmt.Sprintf(script, utils.ShellQuote(dstTarget.VolumePath), tarPaths))
+	if err != nil {
+		return errors.New(fmt.Sprintf("checksum destination volume on node %s failed: %s", dstTarget.NodeIP, err))
+	}
+
+	dst := parseChecksums(dstSums)
+	var mismatch []string
+	src := parseChecksums(srcSums)
+	for file, sum := range src {
+		if dst[file] != sum {
+			mismatch = append(mismatch, file)
+		}
+	}
+	if count := len(mismatch); count > 0 {
+		sort.Strings(mismatch)
+		if count > 10 {
+			mismatch = append(mismatch[:10], "...")
+		}
+		return errors.New(fmt.Sprintf("verify failed, %d files differ: %s", count, strings.Join(mismatch, ", ")))
+	}
+
+	c.log.Infof("verify succeed, %d files have the same checksum", len(src))
+	return nil
+}
+
+// parseChecksums parses the output of sha256sum into a map of file to checksum
+func parseChecksums(out string) map[string]string {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) == 2 {
+			sums[strings.TrimPrefix(parts[1], "./")] = parts[0]
+		}
+	}
+	return sums
+}
+
+// relay pipes the tar stream of the source node into the destination node through this tool
+func (c *Copier) relay(srcTarget, dstTarget *Target, srcTar, dstTar string, total int64, files io.Writer) (int64, error) {
+	compress, decompress := c.compressCommands()
+	pr, pw := io.Pipe()
+	counter := utils.NewCountingReader(pr)
+
+	srcErr := make(chan error, 1)
+	go func() {
+		var stderr bytes.Buffer
+		err := srcTarget.sshcli.Stream(srcTar+compress, nil, pw, &stderr)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("read source volume on node %s failed: %s %s", srcTarget.NodeIP, err, strings.TrimSpace(stderr.String())))
+		}
+		pw.CloseWithError(err)
+		srcErr <- err
+	}()
+
+	done := make(chan struct{})
+	go reportRelayProgress(c.reporter, counter, total, done)
+
+	// the stream leaves the source node and enters the destination node, with the node scope both limits apply
+	dstLimiter := c.dst.limiter(dstTarget)
+	srcLimiter := sharedLimiter(c.dst.bwLimit, c.dst.opts.BwLimitScope, c.src.restConfig, srcTarget)
+	r := dstLimiter.Reader(counter)
+	if srcLimiter != dstLimiter {
+		r = srcLimiter.Reader(r)
+	}
+	err := c.stream(dstTarget, decompress+dstTar, r, files)
+	close(done)
+	// unblock the source if the destination gave up early
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	if e := <-srcErr; e != nil {
+		return counter.Count(), e
+	}
+	return counter.Count(), err
+}
+
+func reportRelayProgress(reporter progress.Reporter, counter *utils.CountingReader, total int64, done chan struct{}) {
+	startTime := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n := counter.Count()
+			status := progress.Status{Bytes: n, TotalBytes: total}
+			status.Throughput = float64(n) / time.Since(startTime).Seconds()
+			if total > 0 {
+				status.Percent = int(n * 100 / total)
+				if status.Throughput > 0 && total > n {
+					status.ETA = time.Duration(float64(total-n) / status.Throughput * float64(time.Second))
+				}
+			}
+			reporter.Progress(status)
+		}
+	}
+}
+
+// stream runs script on the node of target, stdout of the script are the names printed by tar -v
+func (c *Copier) stream(target *Target, script string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	if err := target.sshcli.Stream(script, stdin, stdout, &stderr); err != nil {
+		return errors.New(fmt.Sprintf("run %q on node %s failed: %s %s", script, target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+// compressCommands returns the shell pipeline stages which compress/decompress the tar stream
+func (c *Copier) compressCommands() (compress, decompress string) {
+	level := ""
+	if c.dst.opts.CompressLevel > 0 {
+		level = " -" + strconv.Itoa(c.dst.opts.CompressLevel)
+	}
+	switch c.dst.opts.Compress {
+	case CompressGzip:
+		return " | gzip -c" + level, "gzip -dc | "
+	case CompressZstd:
+		if c.dst.opts.CompressLevel > 19 {
+			level = " --ultra" + level
+		}
+		return " | zstd -q -c" + level, "zstd -q -dc | "
+	}
+	return "", ""
+}
+
+func (c *Copier) nodeSSHArgs(dstTarget *Target) string {
+	return fmt.Sprintf("-o BatchMode=yes -o StrictHostKeyChecking=no -p %s %s", utils.ShellQuote(c.dst.sshPort),
+		utils.ShellQuote(c.dst.sshuser+"@"+dstTarget.NodeIP))
+}
+
+// sameNode tells whether both volumes are on the same node. Two clusters may well use the same private node
+// IPs, so the node is only the same within the same cluster.
+func (c *Copier) sameNode(srcTarget, dstTarget *Target) bool {
+	return sameCluster(c.src.restConfig, c.dst.restConfig) && srcTarget.Pod.Spec.NodeName == dstTarget.Pod.Spec.NodeName
+}
+
+func sameCluster(a, b *rest.Config) bool {
+	return a.Host == b.Host && a.TLSClientConfig.CAFile == b.TLSClientConfig.CAFile &&
+		bytes.Equal(a.TLSClientConfig.CAData, b.TLSClientConfig.CAData)
+}
+
+// canPaceDirectly tells whether a direct stream from the source node keeps to --bwlimit, pv paces it on the node
+func (c *Copier) canPaceDirectly(srcTarget *Target) bool {
+	if c.dst.bwLimit <= 0 {
+		return true
+	}
+	if _, err := srcTarget.sshcli.Run("command -v pv"); err != nil {
+		c.log.Infof("pv is not installed on node %s, stream through this tool to keep to the bandwidth limit", srcTarget.NodeIP)
+		return false
+	}
+	return true
+}
+
+// canReachDirectly checks whether the source node can log into the destination node with a key. The IP of the
+// destination node may lead to another host from the source node, e.g. when both clusters use the same private
+// network, so the boot id of the host reached is compared with the one of the destination node.
+func (c *Copier) canReachDirectly(srcTarget, dstTarget *Target) bool {
+	const bootID = "cat /proc/sys/kernel/random/boot_id"
+	want, err := dstTarget.sshcli.Run(bootID)
+	if err != nil || strings.TrimSpace(want) == "" {
+		return false
+	}
+	got, err := srcTarget.sshcli.Run(fmt.Sprintf("ssh -o ConnectTimeout=5 %s %s 2>/dev/null", c.nodeSSHArgs(dstTarget),
+		utils.ShellQuote(bootID)))
+	if err != nil {
+		return false
+	}
+	if strings.TrimSpace(got) != strings.TrimSpace(want) {
+		c.log.Warnf("%s leads to another host from node %s, stream through this tool", dstTarget.NodeIP, srcTarget.NodeIP)
+		return false
+	}
+	return true
+}
+
+func (c *Copier) sourceSize(srcTarget *Target, tarPaths string) (int64, error) {
+	out, err := srcTarget.sshcli.Run(fmt.Sprintf("cd %s && du -sbc -- %s | tail -n 1 | cut -f 1", utils.ShellQuote(srcTarget.VolumePath), tarPaths))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// topLevelEntries lists the entries of the source volume, joined to dir
+func (c *Copier) topLevelEntries(srcTarget *Target, dir string) ([]string, error) {
+	out, err := srcTarget.sshcli.Run(fmt.Sprintf("ls -A %s", utils.ShellQuote(srcTarget.VolumePath)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, name := range strings.Split(out, "\n") {
+		if name != "" {
+			entries = append(entries, path.Join(dir, name))
+		}
+	}
+	return entries, nil
+}
+
+// fileEventWriter turns the names printed by tar -v into file events
+type fileEventWriter struct {
+	reporter progress.Reporter
+	buf      []byte
+	count    int
+}
+
+func (f *fileEventWriter) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+	for {
+		i := bytes.IndexByte(f.buf, '\n')
+		if i < 0 {
+			break
+		}
+		f.emit(string(f.buf[:i]))
+		f.buf = f.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (f *fileEventWriter) flush() {
+	if len(f.buf) > 0 {
+		f.emit(string(f.buf))
+		f.buf = nil
+	}
+}
+
+func (f *fileEventWriter) emit(name string) {
+	name = strings.TrimPrefix(name, "./")
+	if name == "" || strings.HasSuffix(name, "/") {
+		return
+	}
+	f.count++
+	f.reporter.File(name)
+}
+
+// volumeRelPaths cleans paths given inside a volume and refuses anything which escapes it
+func volumeRelPaths(paths []string) ([]string, error) {
+	var cleaned []string
+	for _, p := range paths {
+		c, err := volumeRelPath(p)
+		if err != nil {
+			return nil, err
+		}
+		cleaned = append(cleaned, c)
+	}
+	return cleaned, nil
+}
+
+func volumeRelPath(p string) (string, error) {
+	c := path.Clean("/" + p)[1:]
+	if c == "" {
+		c = "."
+	}
+	if strings.HasPrefix(p, "/") || strings.Contains("/"+p+"/", "/../") {
+		return "", errors.New(fmt.Sprintf("path %q must be relative to the volume and can't contain ..", p))
+	}
+	return c, nil
+}
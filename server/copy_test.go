@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"k8s.io/client-go/rest"
+	"reflect"
+	"testing"
+)
+
+func TestVolumeRelPaths(t *testing.T) {
+	tests := []struct {
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{paths: nil, want: nil},
+		{paths: []string{"", ".", "./"}, want: []string{".", ".", "."}},
+		{paths: []string{"data/", "./conf//app.yaml", "a/./b"}, want: []string{"data", "conf/app.yaml", "a/b"}},
+		{paths: []string{"..data", "a..b"}, want: []string{"..data", "a..b"}},
+		{paths: []string{"data", "/etc"}, wantErr: true},
+		{paths: []string{"../other"}, wantErr: true},
+		{paths: []string{"data/../../other"}, wantErr: true},
+		{paths: []string{"data/.."}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := volumeRelPaths(tt.paths)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("volumeRelPaths(%q) error = %v, wantErr %v", tt.paths, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("volumeRelPaths(%q) = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	out := "e3b0c442  ./empty\n" +
+		"9f86d081  ./dir/two  spaces\n" +
+		"\n" +
+		"garbage\n"
+	want := map[string]string{"empty": "e3b0c442", "dir/two  spaces": "9f86d081"}
+	if got := parseChecksums(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseChecksums() = %v, want %v", got, want)
+	}
+}
+
+func TestCompressCommands(t *testing.T) {
+	tests := []struct {
+		opts           TransferOptions
+		wantCompress   string
+		wantDecompress string
+	}{
+		{opts: TransferOptions{}},
+		{opts: TransferOptions{Compress: CompressGzip}, wantCompress: " | gzip -c", wantDecompress: "gzip -dc | "},
+		{opts: TransferOptions{Compress: CompressGzip, CompressLevel: 9}, wantCompress: " | gzip -c -9", wantDecompress: "gzip -dc | "},
+		{opts: TransferOptions{Compress: CompressZstd, CompressLevel: 3}, wantCompress: " | zstd -q -c -3", wantDecompress: "zstd -q -dc | "},
+		{opts: TransferOptions{Compress: CompressZstd, CompressLevel: 22}, wantCompress: " | zstd -q -c --ultra -22", wantDecompress: "zstd -q -dc | "},
+	}
+	for _, tt := range tests {
+		c := &Copier{dst: &Server{opts: tt.opts}}
+		compress, decompress := c.compressCommands()
+		if compress != tt.wantCompress || decompress != tt.wantDecompress {
+			t.Errorf("compressCommands() with %+v = %q, %q, want %q, %q", tt.opts, compress, decompress, tt.wantCompress, tt.wantDecompress)
+		}
+	}
+}
+
+func TestFileEventWriter(t *testing.T) {
+	r := &recorder{}
+	f := &fileEventWriter{reporter: r}
+	// the names arrive in arbitrary chunks, directories are not files
+	for _, chunk := range []string{"./", "\n./conf/\n./conf/app", ".yaml\n./da", "ta.db\n\n./last"} {
+		if n, err := f.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+		}
+	}
+	f.flush()
+	want := []string{"conf/app.yaml", "data.db", "last"}
+	if !reflect.DeepEqual(r.files, want) || f.count != len(want) {
+		t.Errorf("files = %q (%d), want %q", r.files, f.count, want)
+	}
+}
+
+func TestSameNode(t *testing.T) {
+	a := &rest.Config{Host: "https://10.0.0.1:6443"}
+	tests := []struct {
+		name    string
+		src     *rest.Config
+		dst     *rest.Config
+		srcNode string
+		dstNode string
+		want    bool
+	}{
+		{name: "same node", src: a, dst: &rest.Config{Host: a.Host}, srcNode: "node-1", dstNode: "node-1", want: true},
+		{name: "other node", src: a, dst: a, srcNode: "node-1", dstNode: "node-2"},
+		{name: "other cluster", src: a, dst: &rest.Config{Host: "https://10.1.0.1:6443"}, srcNode: "node-1", dstNode: "node-1"},
+		{
+			name:    "same address, other CA",
+			src:     &rest.Config{Host: a.Host, TLSClientConfig: rest.TLSClientConfig{CAData: []byte("ca-a")}},
+			dst:     &rest.Config{Host: a.Host, TLSClientConfig: rest.TLSClientConfig{CAData: []byte("ca-b")}},
+			srcNode: "node-1",
+			dstNode: "node-1",
+		},
+	}
+	for _, tt := range tests {
+		c := &Copier{src: &Server{restConfig: tt.src}, dst: &Server{restConfig: tt.dst}}
+		if got := c.sameNode(nodeTarget(tt.srcNode), nodeTarget(tt.dstNode)); got != tt.want {
+			t.Errorf("%s: sameNode() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -83,7 +83,7 @@ func (d *daemonsetServer) getPodFromSource() (pod *corev1.Pod, err error) {
 	for _, pod := range pods.Items {
 		for _, own := range pod.OwnerReferences {
 			if own.Name == d.resourceName && *own.Controller && pod.Status.Phase == corev1.PodRunning &&
-				own.Kind == daemonsetKind {
+				pod.DeletionTimestamp == nil && own.Kind == daemonsetKind {
 				return &pod, nil
 			}
 		}
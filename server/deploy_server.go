@@ -25,7 +25,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
-	"os"
 	"strings"
 )
 
@@ -59,8 +58,7 @@ func (d *deployServer) getVolumePod() (volume *corev1.Volume, pod *corev1.Pod, e
 	//get pod from specific deploy
 	pod, err = d.getPodFromSource()
 	if err != nil {
-		d.log.Errorf("%s", err.Error())
-		os.Exit(1)
+		return nil, nil, err
 	}
 	d.log.Infof("get pod %s from deployment %s\n", pod.Name, deploy.Name)
 
@@ -96,7 +94,7 @@ func (d *deployServer) getPodFromSource() (pod *corev1.Pod, err error) {
 			deployName := own.Name[0:strings.LastIndex(own.Name, "-")]
 			//log.Infof("get deploy name: %s from pod %s", deployName, pod.Name)
 			if deployName == d.resourceName && *own.Controller &&
-				own.Kind == replicaSetKind && pod.Status.Phase == corev1.PodRunning {
+				own.Kind == replicaSetKind && pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
 				return &pod, nil
 				// 基于以上的判断足够了...
 				//rs, err := s.kubeclient.AppsV1().ReplicaSets(s.namespace).Get(context.TODO(), own.Name, metav1.GetOptions{})
@@ -0,0 +1,344 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	TransferDiff = "diff"
+
+	DiffOnlyLocal  = "only-local"
+	DiffOnlyRemote = "only-remote"
+	DiffDiffer     = "differ"
+
+	// exit codes of Diff, the same as diff(1)
+	DiffExitSame  = 0
+	DiffExitFound = 1
+	DiffExitError = 2
+
+	DefaultDiffMaxSize = 64 << 10
+)
+
+// DiffOptions tunes how the local sources are compared with the volume
+type DiffOptions struct {
+	// Checksum compares the sha256 of files of the same size instead of their mtime
+	Checksum bool
+	// ShowDiff adds a unified diff of the differing text files up to MaxSize bytes
+	ShowDiff bool
+	MaxSize  int64
+}
+
+// DiffEntry is a path which is not the same on both sides
+type DiffEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	// Reason tells why a path present on both sides differs: type, size, mtime, hash or target
+	Reason        string     `json:"reason,omitempty"`
+	Type          string     `json:"type"`
+	LocalSize     int64      `json:"localSize,omitempty"`
+	RemoteSize    int64      `json:"remoteSize,omitempty"`
+	LocalModTime  *time.Time `json:"localModTime,omitempty"`
+	RemoteModTime *time.Time `json:"remoteModTime,omitempty"`
+	Diff          string     `json:"diff,omitempty"`
+}
+
+// DiffResult lists the differences, the content of a directory present on one side only is not listed
+type DiffResult struct {
+	Target     progress.Target `json:"target"`
+	Entries    []DiffEntry     `json:"entries"`
+	OnlyLocal  int             `json:"onlyLocal"`
+	OnlyRemote int             `json:"onlyRemote"`
+	Differ     int             `json:"differ"`
+}
+
+// Diff compares the local sources with the volume, they are mapped to the volume like rsync does. It returns
+// DiffExitSame, DiffExitFound or DiffExitError so that it can be used to check for drift.
+func (s *Server) Diff(opts DiffOptions) int {
+	s.validateTarget()
+	s.ValidateSourceDir()
+	s.ValidateTransferOptions()
+	if len(s.errMsg) > 0 {
+		for _, err := range s.errMsg {
+			s.log.Errorf(err.Error())
+		}
+		return DiffExitError
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultDiffMaxSize
+	}
+
+	target, err := s.resolveTarget()
+	var result *DiffResult
+	if err == nil {
+		result, err = s.diff(target, opts)
+	}
+	if err != nil {
+		s.log.Error(err)
+		return DiffExitError
+	}
+
+	if err = s.printDiff(result); err != nil {
+		s.log.Error(err)
+		return DiffExitError
+	}
+	if len(result.Entries) > 0 {
+		return DiffExitFound
+	}
+	return DiffExitSame
+}
+
+func (s *Server) diff(target *Target, opts DiffOptions) (*DiffResult, error) {
+	roots, err := sourceRoots(*s.sourceDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	local := make(map[string]*backup.Node)
+	localPaths := make(map[string]string)
+	remote := make(map[string]*backup.Node)
+	for _, root := range roots {
+		if err = rootNodes(root, local, localPaths); err != nil {
+			return nil, err
+		}
+		rel := root.remote
+		if rel == "" {
+			rel = "."
+		}
+		nodes, err := s.listVolume(target, rel)
+		if err != nil {
+			return nil, err
+		}
+		for name, node := range nodes {
+			remote[name] = node
+		}
+	}
+
+	var hashed []string
+	if opts.Checksum {
+		for name, l := range local {
+			if r := remote[name]; r != nil && l.Type == backup.NodeFile && r.Type == backup.NodeFile && l.Size == r.Size {
+				hashed = append(hashed, name)
+			}
+		}
+		sort.Strings(hashed)
+	}
+	same, err := s.sameContent(target, hashed, func(name string) string { return localPaths[name] })
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(local)+len(remote))
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if local[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := &DiffResult{Target: s.progressTarget(target)}
+	var onlyOneSide []string
+	for _, name := range names {
+		if underAny(onlyOneSide, name) {
+			continue
+		}
+		l, r := local[name], remote[name]
+		entry := DiffEntry{Path: name}
+		switch {
+		case r == nil:
+			entry.Status, entry.Type = DiffOnlyLocal, l.Type
+			result.OnlyLocal++
+		case l == nil:
+			entry.Status, entry.Type = DiffOnlyRemote, r.Type
+			result.OnlyRemote++
+		default:
+			entry.Reason = differReason(l, r, opts.Checksum, same[name])
+			if entry.Reason == "" {
+				continue
+			}
+			entry.Status, entry.Type = DiffDiffer, l.Type
+			result.Differ++
+		}
+		if l != nil {
+			entry.LocalSize = l.Size
+			modTime := l.ModTime
+			entry.LocalModTime = &modTime
+		}
+		if r != nil {
+			entry.RemoteSize = r.Size
+			modTime := r.ModTime
+			entry.RemoteModTime = &modTime
+		}
+		if entry.Status != DiffDiffer && entry.Type == backup.NodeDir {
+			onlyOneSide = append(onlyOneSide, name)
+		}
+
+		if opts.ShowDiff && entry.Status == DiffDiffer && entry.Type == backup.NodeFile && entry.Reason != "type" &&
+			l.Size <= opts.MaxSize && r.Size <= opts.MaxSize {
+			if entry.Diff, err = s.unifiedDiff(target, name, localPaths[name]); err != nil {
+				return nil, err
+			}
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result, nil
+}
+
+// rootNodes adds the entries of a local source to nodes, named after their path in the volume, and their local
+// paths to paths
+func rootNodes(root watchRoot, nodes map[string]*backup.Node, paths map[string]string) error {
+	info, err := os.Lstat(root.local)
+	if err != nil {
+		return err
+	}
+	if root.remote != "" {
+		node, err := localNode(root.local, root.remote, info)
+		if err != nil {
+			return err
+		}
+		nodes[node.Path], paths[node.Path] = node, root.local
+	}
+	if root.file {
+		return nil
+	}
+
+	children, err := localNodes(root.local)
+	if err != nil {
+		return err
+	}
+	for rel, node := range children {
+		node.Path = path.Join(root.remote, rel)
+		nodes[node.Path], paths[node.Path] = node, filepath.Join(root.local, filepath.FromSlash(rel))
+	}
+	return nil
+}
+
+// differReason tells why two entries of the same path differ, empty when they are the same. The mtime is compared
+// to the second since scp and tar don't keep anything finer.
+func differReason(l, r *backup.Node, checksum, sameContent bool) string {
+	if l.Type != r.Type {
+		return "type"
+	}
+	switch l.Type {
+	case backup.NodeFile:
+		switch {
+		case l.Size != r.Size:
+			return "size"
+		case checksum && !sameContent:
+			return "hash"
+		case !checksum && l.ModTime.Unix() != r.ModTime.Unix():
+			return "mtime"
+		}
+	case backup.NodeSymlink:
+		if l.Target != r.Target {
+			return "target"
+		}
+	}
+	return ""
+}
+
+// unifiedDiff returns the unified diff of a text file, empty for a binary file or when the content is the same
+func (s *Server) unifiedDiff(target *Target, name, localPath string) (string, error) {
+	localData, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return "", err
+	}
+	var remoteData, stderr bytes.Buffer
+	cat := fmt.Sprintf("cat -- %s", utils.ShellQuote(path.Join(target.VolumePath, name)))
+	if err = target.sshcli.Stream(cat, nil, &remoteData, &stderr); err != nil {
+		return "", errors.New(fmt.Sprintf("read %s on node %s failed: %s %s", name, target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	if !isText(localData) || !isText(remoteData.Bytes()) {
+		return "", nil
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(string(localData)),
+		B:        splitLines(remoteData.String()),
+		FromFile: "local/" + name,
+		ToFile:   "remote/" + name,
+		Context:  3,
+	})
+}
+
+// splitLines splits text after every newline, the last line gets one when it has none
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n"
+	}
+	return lines
+}
+
+func isText(data []byte) bool {
+	return !bytes.Contains(data, []byte{0}) && utf8.Valid(data)
+}
+
+// printDiff prints the differences as a table or as json
+func (s *Server) printDiff(result *DiffResult) error {
+	if s.opts.Output == progress.OutputJSON {
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+
+	for _, entry := range result.Entries {
+		name := entry.Path
+		if entry.Type == backup.NodeDir {
+			name += "/"
+		}
+		switch {
+		case entry.Reason == "size":
+			fmt.Printf("%-12s %s (%s local, %s remote)\n", entry.Status, name, progress.HumanBytes(entry.LocalSize), progress.HumanBytes(entry.RemoteSize))
+		case entry.Reason == "mtime":
+			fmt.Printf("%-12s %s (modified %s local, %s remote)\n", entry.Status, name,
+				entry.LocalModTime.Format(time.RFC3339), entry.RemoteModTime.Format(time.RFC3339))
+		case entry.Reason != "":
+			fmt.Printf("%-12s %s (%s)\n", entry.Status, name, entry.Reason)
+		default:
+			fmt.Printf("%-12s %s\n", entry.Status, name)
+		}
+		if entry.Diff != "" {
+			fmt.Print(entry.Diff)
+		}
+	}
+	if len(result.Entries) == 0 {
+		fmt.Printf("no differences with %s/%s volume %s\n", result.Target.Namespace, result.Target.Pod, result.Target.Volume)
+		return nil
+	}
+	fmt.Printf("%d only local, %d only remote, %d differ\n", result.OnlyLocal, result.OnlyRemote, result.Differ)
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync-volume-data/backup"
+	"testing"
+	"time"
+)
+
+func TestDifferReason(t *testing.T) {
+	at := time.Date(2021, 12, 1, 2, 3, 4, 0, time.UTC)
+	file := func(size int64, modTime time.Time) *backup.Node {
+		return &backup.Node{Type: backup.NodeFile, Size: size, ModTime: modTime}
+	}
+	link := func(target string) *backup.Node { return &backup.Node{Type: backup.NodeSymlink, Target: target} }
+	tests := []struct {
+		name        string
+		l, r        *backup.Node
+		checksum    bool
+		sameContent bool
+		want        string
+	}{
+		{name: "same", l: file(10, at), r: file(10, at)},
+		{name: "mtime below a second", l: file(10, at), r: file(10, at.Add(900*time.Millisecond))},
+		{name: "mtime", l: file(10, at), r: file(10, at.Add(time.Second)), want: "mtime"},
+		{name: "size", l: file(10, at), r: file(11, at), want: "size"},
+		{name: "type", l: file(10, at), r: &backup.Node{Type: backup.NodeDir}, want: "type"},
+		{name: "checksum ignores mtime", l: file(10, at), r: file(10, at.Add(time.Hour)), checksum: true, sameContent: true},
+		{name: "checksum", l: file(10, at), r: file(10, at), checksum: true, want: "hash"},
+		{name: "checksum size", l: file(10, at), r: file(12, at), checksum: true, want: "size"},
+		{name: "directories", l: &backup.Node{Type: backup.NodeDir, ModTime: at}, r: &backup.Node{Type: backup.NodeDir}},
+		{name: "symlink", l: link("a"), r: link("a")},
+		{name: "symlink target", l: link("a"), r: link("b"), want: "target"},
+	}
+	for _, tt := range tests {
+		if got := differReason(tt.l, tt.r, tt.checksum, tt.sameContent); got != tt.want {
+			t.Errorf("%s: differReason() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRootNodes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"html/index.html": "<html>", "html/css/site.css": "body", "notes.txt": "n"})
+	if err := os.Symlink("index.html", filepath.Join(dir, "html", "home.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    map[string]string
+	}{
+		{
+			name:    "directory",
+			sources: []string{filepath.Join(dir, "html")},
+			want: map[string]string{"html": backup.NodeDir, "html/css": backup.NodeDir, "html/css/site.css": backup.NodeFile,
+				"html/index.html": backup.NodeFile, "html/home.html": backup.NodeSymlink},
+		},
+		{
+			name:    "content of a directory",
+			sources: []string{filepath.Join(dir, "html") + "/"},
+			want: map[string]string{"css": backup.NodeDir, "css/site.css": backup.NodeFile, "index.html": backup.NodeFile,
+				"home.html": backup.NodeSymlink},
+		},
+		{
+			name:    "file",
+			sources: []string{filepath.Join(dir, "notes.txt")},
+			want:    map[string]string{"notes.txt": backup.NodeFile},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots, err := sourceRoots(tt.sources, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes, paths := map[string]*backup.Node{}, map[string]string{}
+			for _, root := range roots {
+				if err = rootNodes(root, nodes, paths); err != nil {
+					t.Fatalf("rootNodes() failed: %s", err)
+				}
+			}
+			got := map[string]string{}
+			for name, node := range nodes {
+				got[name] = node.Type
+				if _, err := os.Lstat(paths[name]); err != nil {
+					t.Errorf("local path of %s: %s", name, err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rootNodes() = %v, want %v", got, tt.want)
+			}
+			if link := nodes["html/home.html"]; link != nil && link.Target != "index.html" {
+				t.Errorf("symlink target = %q", link.Target)
+			}
+		})
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"a\nb\n", []string{"a\n", "b\n"}},
+		{"a\nb", []string{"a\n", "b\n"}},
+		{"a", []string{"a\n"}},
+		{"\n", []string{"\n"}},
+	}
+	for _, tt := range tests {
+		if got := splitLines(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	texts := []string{"plain", "utf-8 中文", ""}
+	binaries := []string{"a\x00b", "\xff\xfe"}
+	for _, text := range texts {
+		if !isText([]byte(text)) {
+			t.Errorf("isText(%q) = false", text)
+		}
+	}
+	for _, data := range binaries {
+		if isText([]byte(data)) {
+			t.Errorf("isText(%q) = true", data)
+		}
+	}
+}
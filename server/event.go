@@ -0,0 +1,215 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"sort"
+	"sync-volume-data/progress"
+	"time"
+)
+
+const (
+	eventStarted   = "VolumeTransferStarted"
+	eventSucceeded = "VolumeTransferSucceeded"
+	eventFailed    = "VolumeTransferFailed"
+
+	// the message of an event is cut to this length
+	eventMessageLimit = 1024
+
+	LastSyncTimeAnnotation   = "sync-volume-data/last-sync-time"
+	LastSyncByAnnotation     = "sync-volume-data/last-sync-by"
+	ManifestDigestAnnotation = "sync-volume-data/manifest-digest"
+)
+
+// validateAnnotateClaim checks --annotate-pvc, only writes change the content of the volume
+func (s *Server) validateAnnotateClaim() error {
+	if s.opts.AnnotateClaim && !s.writes() {
+		return errors.New("annotate-pvc can only be used when transfer data to a volume")
+	}
+	return nil
+}
+
+// withEvents records the start and the result of transfer as events of the pod and of the workload of target, so
+// that anyone looking at them in the cluster sees who changed the volume. Events which can't be created only warn.
+func (s *Server) withEvents(target *Target, transfer func() error) error {
+	recorder := &recordingReporter{Reporter: s.reporter}
+	s.reporter = recorder
+	defer func() { s.reporter = recorder.Reporter }()
+
+	objects := []corev1.ObjectReference{{
+		Kind:       podKind,
+		APIVersion: "v1",
+		Namespace:  target.Pod.Namespace,
+		Name:       target.Pod.Name,
+		UID:        target.Pod.UID,
+	}}
+	if workload, err := s.workloadReference(); err != nil {
+		s.log.Warnf("get %s %s for its events failed: %s", s.resourceKind, s.resourceName, err)
+	} else if workload != nil {
+		objects = append(objects, *workload)
+	}
+
+	who, what := s.identity(), s.transferDescription()
+	s.emitEvents(objects, corev1.EventTypeNormal, eventStarted, fmt.Sprintf("%s started %s", who, what))
+	err := transfer()
+	if err != nil {
+		s.emitEvents(objects, corev1.EventTypeWarning, eventFailed, fmt.Sprintf("%s failed %s: %s", who, what, err))
+		return err
+	}
+	message := fmt.Sprintf("%s finished %s", who, what)
+	if summary := recorder.summary; summary != nil {
+		message += fmt.Sprintf(": %d files, %s in %s", summary.Files, progress.HumanBytes(summary.Bytes), summary.Duration.Round(time.Millisecond))
+	}
+	s.emitEvents(objects, corev1.EventTypeNormal, eventSucceeded, message)
+	return nil
+}
+
+// transferDescription tells the direction of the transfer, e.g. "transfer to volume data"
+func (s *Server) transferDescription() string {
+	switch s.action {
+	case TransferFrom:
+		return fmt.Sprintf("transfer from volume %s", s.volume)
+	case TransferSync:
+		return fmt.Sprintf("sync with volume %s", s.volume)
+	case TransferPut:
+		return fmt.Sprintf("put into volume %s", s.volume)
+	}
+	return fmt.Sprintf("transfer to volume %s", s.volume)
+}
+
+// workloadReference refers to the deploy/sts/ds of the target, it is nil for a pod
+func (s *Server) workloadReference() (*corev1.ObjectReference, error) {
+	apps := s.kubeclient.AppsV1()
+	var meta metav1.ObjectMeta
+	switch s.resourceKind {
+	case deployKind:
+		deploy, err := apps.Deployments(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = deploy.ObjectMeta
+	case statefulsetKind:
+		sts, err := apps.StatefulSets(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = sts.ObjectMeta
+	case daemonsetKind:
+		ds, err := apps.DaemonSets(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = ds.ObjectMeta
+	default:
+		return nil, nil
+	}
+	return &corev1.ObjectReference{
+		Kind:       s.resourceKind,
+		APIVersion: "apps/v1",
+		Namespace:  meta.Namespace,
+		Name:       meta.Name,
+		UID:        meta.UID,
+	}, nil
+}
+
+func (s *Server) emitEvents(objects []corev1.ObjectReference, eventType, reason, message string) {
+	if len(message) > eventMessageLimit {
+		message = message[:eventMessageLimit-3] + "..."
+	}
+	host, _ := os.Hostname()
+	now := time.Now()
+	for _, object := range objects {
+		event := &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+				Namespace: object.Namespace,
+			},
+			InvolvedObject: object,
+			Reason:         reason,
+			Message:        message,
+			Type:           eventType,
+			Source:         corev1.EventSource{Component: managedBy, Host: host},
+			FirstTimestamp: metav1.NewTime(now),
+			LastTimestamp:  metav1.NewTime(now),
+			Count:          1,
+		}
+		if _, err := s.kubeclient.CoreV1().Events(object.Namespace).Create(context.TODO(), event, metav1.CreateOptions{}); err != nil {
+			s.log.Warnf("record event %s of %s %s failed: %s", reason, object.Kind, object.Name, err)
+		}
+	}
+}
+
+// annotateClaim stamps the PVC of the volume after a write with the time, who wrote and a digest of the listing of
+// the volume, which changes whenever a path, a type, a size, a mode, an owner or a mtime does. Failures only warn.
+func (s *Server) annotateClaim(target *Target) {
+	if !s.opts.AnnotateClaim {
+		return
+	}
+	pvc, _, err := s.volumeClaim(target.Pod.Namespace, target.Pod, target.Volume)
+	if err == nil && pvc == nil {
+		s.log.Warnf("volume %s has no pvc to annotate", s.volume)
+		return
+	}
+	var digest string
+	if err == nil {
+		digest, err = s.manifestDigest(target)
+	}
+	if err == nil {
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": map[string]string{
+				LastSyncTimeAnnotation:   time.Now().UTC().Format(time.RFC3339),
+				LastSyncByAnnotation:     s.identity().String(),
+				ManifestDigestAnnotation: digest,
+			}},
+		})
+		_, err = s.kubeclient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(context.TODO(), pvc.Name,
+			types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		s.log.Warnf("annotate the pvc of volume %s failed: %s", s.volume, err)
+	}
+}
+
+// manifestDigest is the sha256 of the sorted listing of the whole volume
+func (s *Server) manifestDigest(target *Target) (string, error) {
+	nodes, err := s.listVolume(target, ".")
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		node := nodes[name]
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%o\x00%d:%d\x00%d\x00%s\n", node.Path, node.Type, node.Size, node.Mode,
+			node.UID, node.GID, node.ModTime.Unix(), node.Target)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"sync-volume-data/progress"
+	"testing"
+	"time"
+)
+
+// events decodes the events created among requests
+func events(t *testing.T, requests []string) []corev1.Event {
+	t.Helper()
+	var list []corev1.Event
+	for _, request := range requests {
+		parts := strings.SplitN(request, " ", 3)
+		if parts[0] != "POST" || !strings.HasSuffix(parts[1], "/events") {
+			continue
+		}
+		var event corev1.Event
+		if err := json.Unmarshal([]byte(parts[2]), &event); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, event)
+	}
+	return list
+}
+
+func TestWithEvents(t *testing.T) {
+	deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "cms", Namespace: "web", UID: "5678"}}
+	api := &fakeAPI{objects: map[string]interface{}{"/apis/apps/v1/namespaces/web/deployments/cms": deploy}}
+	s := fakeServer(t, api, deployKind, "cms")
+	s.action, s.volume, s.reporter = TransferTo, "data", &recorder{}
+	s.who = &Identity{OSUser: "alice", Host: "laptop", KubeUser: "alice@example.com"}
+	target := &Target{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cms-1", Namespace: "web", UID: "1234"}}}
+
+	err := s.withEvents(target, func() error {
+		s.reporter.Done(progress.Summary{Files: 3, Bytes: 2048, Duration: 1500 * time.Millisecond})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withEvents() failed: %s", err)
+	}
+	got := events(t, api.changes())
+	if len(got) != 4 {
+		t.Fatalf("withEvents() created %d events, want a start and a success for the pod and the deployment", len(got))
+	}
+	for i, want := range []struct{ kind, uid, reason, message string }{
+		{podKind, "1234", eventStarted, "alice@laptop (kube user alice@example.com) started transfer to volume data"},
+		{deployKind, "5678", eventStarted, "started transfer to volume data"},
+		{podKind, "1234", eventSucceeded, "finished transfer to volume data: 3 files, 2.0 KiB in 1.5s"},
+		{deployKind, "5678", eventSucceeded, "finished transfer to volume data: 3 files"},
+	} {
+		event := got[i]
+		if event.InvolvedObject.Kind != want.kind || string(event.InvolvedObject.UID) != want.uid || event.Reason != want.reason ||
+			!strings.Contains(event.Message, want.message) || event.Type != corev1.EventTypeNormal || event.Namespace != "web" {
+			t.Errorf("event %d = %s %s %s %s %q, want %s %s %s %q", i, event.Type, event.InvolvedObject.Kind, event.InvolvedObject.UID,
+				event.Reason, event.Message, want.kind, want.uid, want.reason, want.message)
+		}
+	}
+	if _, ok := s.reporter.(*recorder); !ok {
+		t.Errorf("withEvents() left its reporter in place")
+	}
+
+	err = s.withEvents(target, func() error { return errors.New("ssh: connection refused") })
+	got = events(t, api.changes())
+	if err == nil || len(got) != 4 {
+		t.Fatalf("withEvents() of a failure = %v with %d events", err, len(got))
+	}
+	if failed := got[3]; failed.Type != corev1.EventTypeWarning || failed.Reason != eventFailed ||
+		!strings.Contains(failed.Message, "failed transfer to volume data: ssh: connection refused") {
+		t.Errorf("failure event = %s %s %q", failed.Type, failed.Reason, failed.Message)
+	}
+}
+
+func TestEventMessageLimit(t *testing.T) {
+	api := &fakeAPI{objects: map[string]interface{}{}}
+	s := fakeServer(t, api, podKind, "cms-1")
+	object := corev1.ObjectReference{Kind: podKind, APIVersion: "v1", Namespace: "web", Name: "cms-1"}
+	s.emitEvents([]corev1.ObjectReference{object}, corev1.EventTypeWarning, eventFailed, strings.Repeat("x", 2000))
+	got := events(t, api.changes())
+	if len(got) != 1 || len(got[0].Message) != eventMessageLimit || !strings.HasSuffix(got[0].Message, "...") {
+		t.Errorf("emitEvents() of a long message created %d events", len(got))
+	}
+}
+
+func TestTransferDescription(t *testing.T) {
+	for action, want := range map[string]string{
+		TransferTo:   "transfer to volume data",
+		TransferFrom: "transfer from volume data",
+		TransferSync: "sync with volume data",
+		TransferPut:  "put into volume data",
+	} {
+		s := &Server{action: action, volume: "data"}
+		if got := s.transferDescription(); got != want {
+			t.Errorf("transferDescription() of %s = %q, want %q", action, got, want)
+		}
+	}
+}
+
+func TestKubeUser(t *testing.T) {
+	// the fake api server doesn't review the credentials, the user comes from the kubeconfig
+	s := fakeServer(t, &fakeAPI{objects: map[string]interface{}{}}, podKind, "cms-1")
+	if got := s.kubeUser(); got != "unknown" {
+		t.Errorf("kubeUser() without credentials = %q, want unknown", got)
+	}
+	s.restConfig.Username = "admin"
+	if got := s.kubeUser(); got != "admin" {
+		t.Errorf("kubeUser() of basic auth = %q, want admin", got)
+	}
+}
+
+func TestValidateAnnotateClaim(t *testing.T) {
+	for action, wantErr := range map[string]bool{TransferTo: false, TransferSync: false, TransferPut: false, TransferFrom: true} {
+		s := &Server{action: action, opts: TransferOptions{AnnotateClaim: true}}
+		if err := s.validateAnnotateClaim(); (err != nil) != wantErr {
+			t.Errorf("validateAnnotateClaim() of %s error = %v, wantErr %v", action, err, wantErr)
+		}
+	}
+}
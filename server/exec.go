@@ -0,0 +1,152 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	remote "sync-volume-data/remote_execute"
+	"sync-volume-data/utils"
+)
+
+const (
+	TransferExec = "exec"
+
+	// ExecExitError is the exit code of exec when the command could not be run, the same as ssh
+	ExecExitError = 255
+)
+
+// interactiveCommands need a terminal whatever their arguments, shells and clients only without any
+var (
+	interactiveCommands = map[string]bool{"vi": true, "vim": true, "nano": true, "emacs": true, "less": true,
+		"more": true, "top": true, "htop": true, "watch": true}
+	interactiveShells = map[string]bool{"sh": true, "bash": true, "ash": true, "dash": true, "zsh": true, "ksh": true,
+		"python": true, "python3": true, "psql": true, "mysql": true, "redis-cli": true}
+)
+
+// Exec runs command on the node of the volume with the volume as working directory and returns its exit code. The
+// command runs without terminal, stdin is passed on when it is not a terminal, unless tty asks for a terminal.
+// Without command tty opens a shell.
+func (s *Server) Exec(command []string, tty bool) int {
+	s.validateTarget()
+	if len(command) == 0 && !tty {
+		s.errMsg = append(s.errMsg, errors.New("you need specific a command, or --tty for an interactive shell"))
+	} else if !tty && interactive(command) {
+		s.errMsg = append(s.errMsg, errors.New(fmt.Sprintf("%s is interactive, use --tty to run it on a terminal", command[0])))
+	}
+	if tty && !term.IsTerminal(int(os.Stdin.Fd())) {
+		s.errMsg = append(s.errMsg, errors.New("tty needs stdin to be a terminal"))
+	}
+	if len(s.errMsg) > 0 {
+		for _, err := range s.errMsg {
+			s.log.Errorf(err.Error())
+		}
+		return ExecExitError
+	}
+
+	target, err := s.resolveTarget()
+	if err != nil {
+		s.log.Error(err)
+		return ExecExitError
+	}
+	defer target.sshcli.Close()
+
+	// the command runs as root, the working directory must be the volume itself and not where a symlink leads
+	dir, err := resolveInVolume(target, target.VolumePath)
+	if err != nil {
+		s.log.Error(err)
+		return ExecExitError
+	}
+	shell := execScript(dir, command)
+	s.log.Infof("execute %q in %s on node %s", command, dir, target.NodeIP)
+
+	if tty {
+		err = s.execTerminal(target.sshcli, shell)
+	} else {
+		// a command reading a terminal it does not get would wait forever, it reads nothing instead
+		var stdin io.Reader
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			stdin = os.Stdin
+		}
+		err = target.sshcli.Stream(shell, stdin, os.Stdout, os.Stderr)
+	}
+	return s.execExitCode(err)
+}
+
+// execScript runs command, or a shell without command, in dir
+func execScript(dir string, command []string) string {
+	shell := "exec ${SHELL:-/bin/sh}"
+	if len(command) > 0 {
+		shell = "exec " + utils.ShellQuoteAll(command)
+	}
+	return fmt.Sprintf("cd -P -- %s && %s", utils.ShellQuote(dir), shell)
+}
+
+func (s *Server) execTerminal(sshcli *remote.Cli, shell string) error {
+	fd := int(os.Stdin.Fd())
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	winch := make(chan os.Signal, 1)
+	notifyResize(winch)
+	defer signal.Stop(winch)
+	resize := make(chan remote.WindowSize, 1)
+	go func() {
+		for range winch {
+			if w, h, err := term.GetSize(fd); err == nil {
+				resize <- remote.WindowSize{Width: w, Height: h}
+			}
+		}
+	}()
+
+	termName := os.Getenv("TERM")
+	if termName == "" {
+		termName = "xterm"
+	}
+	return sshcli.StreamTerminal(shell, os.Stdin, os.Stdout, termName, remote.WindowSize{Width: width, Height: height}, resize)
+}
+
+// execExitCode is the exit code of the remote command, ExecExitError when it did not run to the end
+func (s *Server) execExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *gossh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	s.log.Error(err)
+	return ExecExitError
+}
+
+func interactive(command []string) bool {
+	name := path.Base(command[0])
+	return interactiveCommands[name] || (interactiveShells[name] && len(command) == 1)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInteractive(t *testing.T) {
+	tests := []struct {
+		command []string
+		want    bool
+	}{
+		{[]string{"tar", "xzf", "site.tgz"}, false},
+		{[]string{"vi", "conf.yaml"}, true},
+		{[]string{"/usr/bin/top"}, true},
+		{[]string{"sh"}, true},
+		{[]string{"sh", "-c", "rm -f *.lock"}, false},
+		{[]string{"psql"}, true},
+		{[]string{"psql", "-c", "select 1"}, false},
+	}
+	for _, tt := range tests {
+		if got := interactive(tt.command); got != tt.want {
+			t.Errorf("interactive(%q) = %v, want %v", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	root := t.TempDir()
+	vol := filepath.Join(root, "it's a volume")
+	writeFiles(t, vol, map[string]string{"a b.txt": "content"})
+	link := filepath.Join(root, "link")
+	if err := os.Symlink(vol, link); err != nil {
+		t.Fatal(err)
+	}
+	realVol, err := filepath.EvalSymlinks(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		command []string
+		want    string
+	}{
+		{name: "arguments are kept", dir: vol, command: []string{"cat", "a b.txt"}, want: "content"},
+		{name: "physical directory", dir: link, command: []string{"pwd"}, want: realVol + "\n"},
+		{name: "no expansion", dir: vol, command: []string{"echo", "*", "$HOME"}, want: "* $HOME\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := exec.Command("sh", "-c", execScript(tt.dir, tt.command)).Output()
+			if err != nil {
+				t.Fatalf("script failed: %s", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("printed %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	if script := execScript(vol, nil); !strings.HasSuffix(script, "exec ${SHELL:-/bin/sh}") {
+		t.Errorf("execScript() without command = %q, want a shell", script)
+	}
+}
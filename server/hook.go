@@ -0,0 +1,193 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	HookAbort    = "abort"
+	HookContinue = "continue"
+
+	DefaultHookTimeout = time.Minute
+)
+
+// ValidateHookFailure checks the policy applied when a hook fails
+func ValidateHookFailure(policy string) error {
+	switch policy {
+	case HookAbort, HookContinue:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("not support hook failure policy %s, please use abort or continue", policy))
+	}
+}
+
+// validateHooks checks --pre-hook/--post-hook and their settings
+func (s *Server) validateHooks() error {
+	if s.opts.PreHook == "" && s.opts.PostHook == "" {
+		return nil
+	}
+	switch s.action {
+	case TransferTo, TransferFrom, TransferSync, TransferPut:
+	default:
+		return errors.New("pre-hook/post-hook can only be used when transfer data to or from a volume")
+	}
+	if err := ValidateHookFailure(s.opts.HookFailure); err != nil {
+		return err
+	}
+	if s.opts.HookTimeout <= 0 {
+		s.opts.HookTimeout = DefaultHookTimeout
+	}
+	return nil
+}
+
+// withHooks runs transfer between the pre-hook and the post-hook. The post-hook runs whatever happened before it, it
+// usually undoes what the pre-hook did, e.g. it unfreezes a filesystem or starts a database again. Ctrl-C stops the
+// transfer and still runs the post-hook.
+//
+// When the pre-hook fails the abort policy skips the transfer, continue only warns. When the post-hook fails abort
+// fails the command after the transfer, continue only warns.
+func (s *Server) withHooks(target *Target, transfer func() error) error {
+	if s.opts.PreHook == "" && s.opts.PostHook == "" {
+		return transfer()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			// rsync and scp get the signal of the terminal themselves, the transfers over ssh end with the connection
+			s.log.Warnf("interrupted, stop the transfer and run the post-hook")
+			target.sshcli.Close()
+		case <-done:
+		}
+	}()
+
+	err := s.runHook("pre-hook", target, s.opts.PreHook)
+	if err != nil && s.opts.HookFailure == HookAbort {
+		err = errors.New(fmt.Sprintf("%s, the transfer is skipped", err))
+	} else {
+		if err != nil {
+			s.log.Warn(err)
+		}
+		err = transfer()
+	}
+
+	if postErr := s.runHook("post-hook", target, s.opts.PostHook); postErr != nil {
+		if err == nil && s.opts.HookFailure == HookAbort {
+			return postErr
+		}
+		s.log.Warn(postErr)
+	}
+	return err
+}
+
+// runHook runs command with sh -c in the container of the pod which mounts the volume, through the exec api of the
+// pod. When it times out it is not waited for any more, it keeps running in the container until it ends by itself.
+func (s *Server) runHook(name string, target *Target, command string) error {
+	if command == "" {
+		return nil
+	}
+	container := hookContainer(target.Pod, target.Volume.Name, s.opts.HookContainer)
+	s.log.Infof("run %s in container %s of pod %s: %s", name, container, target.Pod.Name, command)
+
+	req := s.kubeclient.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(target.Pod.Namespace).
+		Name(target.Pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   []string{"sh", "-c", command},
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(s.restConfig, "POST", req.URL())
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s failed: %s", name, err))
+	}
+
+	// the stream keeps writing after a timeout, the buffers are read meanwhile
+	var stdout, stderr lockedBuffer
+	result := make(chan error, 1)
+	go func() {
+		result <- executor.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(s.opts.HookTimeout):
+		err = errors.New(fmt.Sprintf("timed out after %s", s.opts.HookTimeout))
+	}
+
+	if out := strings.TrimSpace(stdout.String()); out != "" {
+		s.log.Infof("%s output: %s", name, out)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s %q failed: %s %s", name, command, err, strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+// lockedBuffer is a bytes.Buffer which can be written and read at the same time
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// hookContainer is the container hooks run in: the one asked for, else the first container mounting the volume, else
+// the first container
+func hookContainer(pod *corev1.Pod, volume, want string) string {
+	if want != "" {
+		return want
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == volume {
+				return container.Name
+			}
+		}
+	}
+	return pod.Spec.Containers[0].Name
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateHooks(t *testing.T) {
+	tests := []struct {
+		action  string
+		opts    TransferOptions
+		wantErr bool
+	}{
+		{action: TransferCat},
+		{action: TransferTo, opts: TransferOptions{PreHook: "sync", HookFailure: HookAbort}},
+		{action: TransferPut, opts: TransferOptions{PostHook: "true", HookFailure: HookContinue}},
+		{action: TransferTo, opts: TransferOptions{PreHook: "sync", HookFailure: "retry"}, wantErr: true},
+		{action: TransferCat, opts: TransferOptions{PreHook: "sync", HookFailure: HookAbort}, wantErr: true},
+	}
+	for _, tt := range tests {
+		s := &Server{action: tt.action, opts: tt.opts}
+		if err := s.validateHooks(); (err != nil) != tt.wantErr {
+			t.Errorf("validateHooks() of %s with %+v error = %v, wantErr %v", tt.action, tt.opts, err, tt.wantErr)
+		}
+		if !tt.wantErr && tt.opts.PreHook+tt.opts.PostHook != "" && s.opts.HookTimeout != DefaultHookTimeout {
+			t.Errorf("validateHooks() left the hook timeout at %s, want %s", s.opts.HookTimeout, DefaultHookTimeout)
+		}
+	}
+}
+
+func TestHookContainer(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "sidecar"},
+		{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "data"}}},
+	}}}
+	tests := []struct {
+		volume string
+		want   string
+		result string
+	}{
+		{volume: "data", result: "app"},
+		{volume: "cache", result: "sidecar"},
+		{volume: "data", want: "sidecar", result: "sidecar"},
+	}
+	for _, tt := range tests {
+		if got := hookContainer(pod, tt.volume, tt.want); got != tt.result {
+			t.Errorf("hookContainer(%s, %q) = %s, want %s", tt.volume, tt.want, got, tt.result)
+		}
+	}
+}
+
+// TestHookFailure runs hooks against an api server which refuses the exec, every hook fails
+func TestHookFailure(t *testing.T) {
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "exec is forbidden", http.StatusForbidden)
+	}))
+	defer apiserver.Close()
+	config := &rest.Config{Host: apiserver.URL}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{
+		Pod:    &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}},
+		Volume: &corev1.Volume{Name: "data"},
+	}
+
+	transferErr := errors.New("transfer failed")
+	tests := []struct {
+		name         string
+		opts         TransferOptions
+		transfer     error
+		wantTransfer bool
+		wantErr      string
+	}{
+		{name: "pre-hook abort", opts: TransferOptions{PreHook: "sync", HookFailure: HookAbort}, wantErr: "the transfer is skipped"},
+		{name: "pre-hook continue", opts: TransferOptions{PreHook: "sync", HookFailure: HookContinue}, wantTransfer: true},
+		{name: "post-hook abort", opts: TransferOptions{PostHook: "start", HookFailure: HookAbort}, wantTransfer: true, wantErr: "post-hook"},
+		{name: "post-hook continue", opts: TransferOptions{PostHook: "start", HookFailure: HookContinue}, wantTransfer: true},
+		{
+			name:         "the transfer error wins over the post-hook",
+			opts:         TransferOptions{PostHook: "start", HookFailure: HookAbort},
+			transfer:     transferErr,
+			wantTransfer: true,
+			wantErr:      transferErr.Error(),
+		},
+		{name: "no hooks", transfer: transferErr, wantTransfer: true, wantErr: transferErr.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.HookTimeout = 10 * time.Second
+			s := &Server{kubeclient: client, restConfig: config, opts: tt.opts, log: testLogger()}
+			transferred := false
+			err := s.withHooks(target, func() error {
+				transferred = true
+				return tt.transfer
+			})
+			if transferred != tt.wantTransfer {
+				t.Errorf("transferred = %v, want %v", transferred, tt.wantTransfer)
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("withHooks() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLockedBuffer(t *testing.T) {
+	var b lockedBuffer
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Write([]byte("x"))
+				_ = b.String()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(b.String()); got != 1000 {
+		t.Errorf("lockedBuffer holds %d bytes, want 1000", got)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sync-volume-data/utils"
+)
+
+// Identity is who runs a transfer, it is recorded in the events of the transfers
+type Identity struct {
+	OSUser   string `json:"osUser"`
+	Host     string `json:"host"`
+	KubeUser string `json:"kubeUser"`
+}
+
+func (i Identity) String() string {
+	return fmt.Sprintf("%s@%s (kube user %s)", i.OSUser, i.Host, i.KubeUser)
+}
+
+// identity returns who runs this process, the kube user is looked up once
+func (s *Server) identity() Identity {
+	if s.who == nil {
+		host, _ := os.Hostname()
+		s.who = &Identity{OSUser: localUser(), Host: host, KubeUser: s.kubeUser()}
+	}
+	return *s.who
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// kubeUser asks the cluster who the credentials belong to with a SelfSubjectReview, older clusters don't serve it
+// and the user is then read from the kubeconfig
+func (s *Server) kubeUser() string {
+	for _, version := range []string{"v1", "v1beta1", "v1alpha1"} {
+		body := fmt.Sprintf(`{"apiVersion":"authentication.k8s.io/%s","kind":"SelfSubjectReview"}`, version)
+		raw, err := s.kubeclient.AuthenticationV1().RESTClient().Post().
+			AbsPath("/apis/authentication.k8s.io", version, "selfsubjectreviews").
+			Body([]byte(body)).
+			DoRaw(context.TODO())
+		if err != nil {
+			continue
+		}
+		var review struct {
+			Status struct {
+				UserInfo struct {
+					Username string `json:"username"`
+				} `json:"userInfo"`
+			} `json:"status"`
+		}
+		if json.Unmarshal(raw, &review) == nil && review.Status.UserInfo.Username != "" {
+			return review.Status.UserInfo.Username
+		}
+	}
+	if name := utils.ConfigUser(s.restConfig); name != "" {
+		return name
+	}
+	return "unknown"
+}
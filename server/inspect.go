@@ -0,0 +1,400 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"strconv"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/progress"
+	remote "sync-volume-data/remote_execute"
+)
+
+const TransferInspect = "inspect"
+
+// Resolution is every step from a workload to the directory of its volume on the node, the steps after the first
+// one which failed are empty
+type Resolution struct {
+	Namespace string           `json:"namespace"`
+	Workload  ResolvedWorkload `json:"workload"`
+	Pod       *ResolvedPod     `json:"pod,omitempty"`
+	Node      *ResolvedNode    `json:"node,omitempty"`
+	Volume    *ResolvedVolume  `json:"volume,omitempty"`
+	Path      *ResolvedPath    `json:"path,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type ResolvedWorkload struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Replicas int32  `json:"replicas"`
+	Ready    int32  `json:"ready"`
+	// Complete is false while a rollout is in progress, transfers refuse such a workload
+	Complete bool `json:"complete"`
+}
+
+type ResolvedPod struct {
+	Name  string `json:"name"`
+	UID   string `json:"uid"`
+	Phase string `json:"phase"`
+	// ReplicaSet is the ReplicaSet which owns the pod of a deployment
+	ReplicaSet string `json:"replicaSet,omitempty"`
+	// Candidates is the number of pods matching the labels of the pod template
+	Candidates int    `json:"candidates"`
+	Reason     string `json:"reason"`
+}
+
+type ResolvedNode struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address"`
+	AddressType string   `json:"addressType"`
+	Addresses   []string `json:"addresses"`
+}
+
+type ResolvedVolume struct {
+	Name         string `json:"name"`
+	Source       string `json:"source"`
+	PVC          string `json:"pvc,omitempty"`
+	PVCPhase     string `json:"pvcPhase,omitempty"`
+	Capacity     string `json:"capacity,omitempty"`
+	PV           string `json:"pv,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Provisioner  string `json:"provisioner,omitempty"`
+	CSIDriver    string `json:"csiDriver,omitempty"`
+	VolumeHandle string `json:"volumeHandle,omitempty"`
+	// Directory is the directory of the volume under the plugin directory of the pod
+	Directory string `json:"directory"`
+}
+
+type ResolvedPath struct {
+	// Pattern is what transfers look for on the node, Expected is the path with the plugin directory kubelet uses for
+	// this kind of volume, when it is known
+	Pattern  string `json:"pattern"`
+	Expected string `json:"expected,omitempty"`
+	SSH      string `json:"ssh"`
+	// Matches are the directories matching Pattern on the node, transfers expect exactly one
+	Matches    []string `json:"matches,omitempty"`
+	Actual     string   `json:"actual,omitempty"`
+	Filesystem string   `json:"filesystem,omitempty"`
+}
+
+// Inspect prints how the target resolves to a directory on a node and exits with 1 if a step fails
+func (s *Server) Inspect() {
+	// the rollout state is part of the report, a workload in the middle of a rollout is still inspected
+	s.ValidateSshPwd()
+	s.ValidateNamespace()
+	s.ValidateSourceKind()
+	s.ValidateVolume()
+	s.ValidateInstanceIndex()
+	if err := progress.ValidateOutput(s.opts.Output); err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	s.exitOnInvalid()
+
+	resolution := &Resolution{Namespace: s.namespace}
+	if err := s.inspect(resolution); err != nil {
+		resolution.Error = err.Error()
+	}
+
+	if s.opts.Output == progress.OutputJSON {
+		s.printJSON(resolution)
+	} else {
+		printResolution(resolution)
+	}
+	if resolution.Error != "" {
+		audit.Exit(1)
+	}
+}
+
+func (s *Server) inspect(r *Resolution) error {
+	selector, err := s.inspectWorkload(&r.Workload)
+	if err != nil {
+		return err
+	}
+
+	volume, pod, err := s.volumePod()
+	if err != nil {
+		return errors.New(fmt.Sprintf("choose a pod: %s", err))
+	}
+	r.Pod = &ResolvedPod{Name: pod.Name, UID: string(pod.UID), Phase: string(pod.Status.Phase)}
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == replicaSetKind {
+		r.Pod.ReplicaSet = owner.Name
+	}
+	if selector != "" {
+		pods, err := s.kubeclient.CoreV1().Pods(s.namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+		r.Pod.Candidates = len(pods.Items)
+	}
+	r.Pod.Reason = s.podReason(r.Pod)
+
+	node, err := s.kubeclient.CoreV1().Nodes().Get(context.TODO(), pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return errors.New(fmt.Sprintf("get node %s: %s", pod.Spec.NodeName, err))
+	}
+	r.Node = &ResolvedNode{Name: node.Name}
+	for _, address := range node.Status.Addresses {
+		r.Node.Addresses = append(r.Node.Addresses, fmt.Sprintf("%s=%s", address.Type, address.Address))
+	}
+	if r.Node.Address, err = s.getNodeIPFromPod(pod); err != nil {
+		return err
+	}
+	r.Node.AddressType = string(corev1.NodeInternalIP)
+
+	if volume == nil {
+		return errors.New(fmt.Sprintf("volume %s not found in pod %s", s.volume, pod.Name))
+	}
+	pv, err := s.inspectVolume(r, pod, volume)
+	if err != nil {
+		return err
+	}
+
+	return s.inspectPath(r, pod, volume, pv)
+}
+
+// inspectWorkload describes the workload and returns the label selector of its pod template
+func (s *Server) inspectWorkload(w *ResolvedWorkload) (string, error) {
+	w.Kind, w.Name = s.resourceKind, s.resourceName
+	apps := s.kubeclient.AppsV1()
+	switch s.resourceKind {
+	case deployKind:
+		deploy, err := apps.Deployments(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		w.Replicas, w.Ready = *deploy.Spec.Replicas, deploy.Status.ReadyReplicas
+		w.Complete = DeploymentComplete(deploy, &deploy.Status)
+		return labels.Set(deploy.Spec.Template.Labels).String(), nil
+	case statefulsetKind:
+		sts, err := apps.StatefulSets(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		w.Replicas, w.Ready = *sts.Spec.Replicas, sts.Status.ReadyReplicas
+		w.Complete = StatefulsetComplete(sts, &sts.Status)
+		return labels.Set(sts.Spec.Template.Labels).String(), nil
+	case daemonsetKind:
+		ds, err := apps.DaemonSets(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		w.Replicas, w.Ready = ds.Status.DesiredNumberScheduled, ds.Status.NumberReady
+		w.Complete = DaemonsetComplete(ds, &ds.Status)
+		return labels.Set(ds.Spec.Template.Labels).String(), nil
+	default:
+		pod, err := s.kubeclient.CoreV1().Pods(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		ready := pod.Status.Phase == corev1.PodRunning
+		for _, status := range pod.Status.ContainerStatuses {
+			ready = ready && status.Ready
+		}
+		w.Replicas, w.Complete = 1, ready
+		if ready {
+			w.Ready = 1
+		}
+		return "", nil
+	}
+}
+
+// podReason tells why the pickers of the kinds chose the pod
+func (s *Server) podReason(pod *ResolvedPod) string {
+	switch s.resourceKind {
+	case deployKind:
+		return fmt.Sprintf("the first of %d pods matching the template labels which is running, not being deleted "+
+			"and controlled by a replicaset of the deployment", pod.Candidates)
+	case statefulsetKind:
+		return fmt.Sprintf("the pod of instance index %d (%s-%d)", s.instanceIndex, s.resourceName, s.instanceIndex)
+	case daemonsetKind:
+		return fmt.Sprintf("the first of %d pods matching the template labels which is running, not being deleted "+
+			"and controlled by the daemonset, the node is arbitrary", pod.Candidates)
+	default:
+		return "the pod given as target"
+	}
+}
+
+// inspectVolume describes the volume and what backs it, it returns the PV, nil for a volume without a claim
+func (s *Server) inspectVolume(r *Resolution, pod *corev1.Pod, volume *corev1.Volume) (*corev1.PersistentVolume, error) {
+	v := &ResolvedVolume{Name: volume.Name, Source: volumeSource(volume)}
+	r.Volume = v
+	if volume.CSI != nil {
+		v.CSIDriver = volume.CSI.Driver
+	}
+
+	pvc, pv, err := s.volumeClaim(s.namespace, pod, volume)
+	if err != nil {
+		return nil, err
+	}
+	if pvc != nil {
+		v.PVC, v.PVCPhase, v.PV = pvc.Name, string(pvc.Status.Phase), pv.Name
+		if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+			v.Capacity = capacity.String()
+		}
+		if pvc.Spec.StorageClassName != nil {
+			v.StorageClass = *pvc.Spec.StorageClassName
+		}
+		if pv.Spec.CSI != nil {
+			v.CSIDriver, v.VolumeHandle = pv.Spec.CSI.Driver, pv.Spec.CSI.VolumeHandle
+		}
+	}
+	if v.StorageClass != "" {
+		// reading storage classes may not be allowed, the provisioner is only a hint
+		if sc, err := s.kubeclient.StorageV1().StorageClasses().Get(context.TODO(), v.StorageClass, metav1.GetOptions{}); err == nil {
+			v.Provisioner = sc.Provisioner
+		}
+	}
+	v.Directory = volumeDirectory(volume, pv)
+	return pv, nil
+}
+
+// inspectPath looks for the volume on the node like resolveTarget does
+func (s *Server) inspectPath(r *Resolution, pod *corev1.Pod, volume *corev1.Volume, pv *corev1.PersistentVolume) error {
+	podDir := "/var/lib/kubelet/pods/" + string(pod.UID) + "/volumes/"
+	p := &ResolvedPath{
+		Pattern: podDir + "*/" + r.Volume.Directory,
+		SSH:     fmt.Sprintf("%s@%s:%s", s.sshuser, r.Node.Address, s.sshPort),
+	}
+	r.Path = p
+	if plugin := volumePlugin(volume, pv); plugin != "" {
+		p.Expected = podDir + plugin + "/" + r.Volume.Directory
+	}
+
+	sshcli := remote.NewCli(s.sshuser, s.sshpwd, fmt.Sprintf("%s:%s", r.Node.Address, s.sshPort), remote.SshPassword, "")
+	defer sshcli.Close()
+	out, err := sshcli.Run(fmt.Sprintf("ls -d %s 2>/dev/null; true", p.Pattern))
+	if err != nil {
+		return errors.New(fmt.Sprintf("ssh %s: %s", p.SSH, err))
+	}
+	p.Matches = strings.Fields(out)
+	if len(p.Matches) == 0 {
+		return errors.New(fmt.Sprintf("no directory matches %s on node %s", p.Pattern, r.Node.Name))
+	}
+	p.Actual = p.Matches[0]
+
+	if out, err = sshcli.Run(fmt.Sprintf("df -P %s | tail -n 1", p.Actual)); err == nil {
+		if fields := strings.Fields(out); len(fields) > 0 {
+			p.Filesystem = fields[0]
+		}
+	}
+	return nil
+}
+
+// volumeSource names the kind of a volume like the field of its source in the pod spec
+func volumeSource(volume *corev1.Volume) string {
+	switch {
+	case volume.PersistentVolumeClaim != nil:
+		return "persistentVolumeClaim"
+	case volume.Ephemeral != nil:
+		return "ephemeral"
+	case volume.EmptyDir != nil:
+		return "emptyDir"
+	case volume.CSI != nil:
+		return "csi"
+	case volume.HostPath != nil:
+		return "hostPath"
+	case volume.ConfigMap != nil:
+		return "configMap"
+	case volume.Secret != nil:
+		return "secret"
+	case volume.Projected != nil:
+		return "projected"
+	case volume.NFS != nil:
+		return "nfs"
+	default:
+		return "other"
+	}
+}
+
+// volumePlugin is the plugin directory kubelet mounts a volume under, empty when it is not known here
+func volumePlugin(volume *corev1.Volume, pv *corev1.PersistentVolume) string {
+	switch {
+	case pv != nil && pv.Spec.CSI != nil, volume.CSI != nil:
+		return "kubernetes.io~csi"
+	case pv != nil && pv.Spec.Local != nil:
+		return "kubernetes.io~local-volume"
+	case pv != nil && pv.Spec.NFS != nil, volume.NFS != nil:
+		return "kubernetes.io~nfs"
+	case volume.EmptyDir != nil:
+		return "kubernetes.io~empty-dir"
+	case volume.ConfigMap != nil:
+		return "kubernetes.io~configmap"
+	case volume.Secret != nil:
+		return "kubernetes.io~secret"
+	case volume.Projected != nil:
+		return "kubernetes.io~projected"
+	}
+	return ""
+}
+
+func printResolution(r *Resolution) {
+	w := r.Workload
+	fmt.Printf("workload:      %s %s/%s, %d/%d ready, complete: %s\n", w.Kind, r.Namespace, w.Name, w.Ready, w.Replicas,
+		strconv.FormatBool(w.Complete))
+	if pod := r.Pod; pod != nil {
+		if pod.ReplicaSet != "" {
+			fmt.Printf("replicaset:    %s\n", pod.ReplicaSet)
+		}
+		fmt.Printf("pod:           %s (uid %s, %s)\n", pod.Name, pod.UID, pod.Phase)
+		fmt.Printf("  chosen as:   %s\n", pod.Reason)
+	}
+	if node := r.Node; node != nil {
+		fmt.Printf("node:          %s, %s %s\n", node.Name, node.AddressType, node.Address)
+		fmt.Printf("  addresses:   %s\n", strings.Join(node.Addresses, ", "))
+	}
+	if v := r.Volume; v != nil {
+		fmt.Printf("volume:        %s (%s)\n", v.Name, v.Source)
+		if v.PVC != "" {
+			fmt.Printf("pvc:           %s (%s, %s)\n", v.PVC, v.PVCPhase, valueOrNone(v.Capacity))
+			fmt.Printf("pv:            %s\n", v.PV)
+		}
+		if v.StorageClass != "" {
+			fmt.Printf("storageclass:  %s (provisioner %s)\n", v.StorageClass, valueOrNone(v.Provisioner))
+		}
+		if v.CSIDriver != "" {
+			fmt.Printf("csi driver:    %s (volume handle %s)\n", v.CSIDriver, valueOrNone(v.VolumeHandle))
+		}
+	}
+	if p := r.Path; p != nil {
+		fmt.Printf("pattern:       %s\n", p.Pattern)
+		if p.Expected != "" {
+			fmt.Printf("expected path: %s\n", p.Expected)
+		}
+		if p.Actual != "" {
+			fmt.Printf("actual path:   %s (found over ssh %s)\n", p.Actual, p.SSH)
+			for _, match := range p.Matches[1:] {
+				fmt.Printf("  also:        %s (ambiguous, transfers expect one match)\n", match)
+			}
+			if p.Expected != "" && p.Actual != p.Expected {
+				fmt.Printf("  warning:     the actual path is not the expected one\n")
+			}
+		}
+		if p.Filesystem != "" {
+			fmt.Printf("filesystem:    %s\n", p.Filesystem)
+		}
+	}
+	if r.Error != "" {
+		fmt.Printf("error:         %s\n", r.Error)
+	}
+}
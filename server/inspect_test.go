@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func TestVolumePlugin(t *testing.T) {
+	csiPV := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com"}}}}
+	localPV := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "local-pv"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{Local: &corev1.LocalVolumeSource{Path: "/mnt/disk"}}}}
+	claim := corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}
+	tests := []struct {
+		name       string
+		source     corev1.VolumeSource
+		pv         *corev1.PersistentVolume
+		wantSource string
+		// wantPath is the expected path below the volumes directory of the pod, empty when it is not known
+		wantPath string
+	}{
+		{name: "data", source: claim, pv: csiPV, wantSource: "persistentVolumeClaim", wantPath: "kubernetes.io~csi/pvc-1234/mount"},
+		{name: "data", source: claim, pv: localPV, wantSource: "persistentVolumeClaim", wantPath: "kubernetes.io~local-volume/local-pv"},
+		{name: "cache", source: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}, wantSource: "emptyDir", wantPath: "kubernetes.io~empty-dir/cache"},
+		{name: "inline", source: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{Driver: "secrets-store.csi.k8s.io"}}, wantSource: "csi", wantPath: "kubernetes.io~csi/inline/mount"},
+		{name: "conf", source: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}, wantSource: "configMap", wantPath: "kubernetes.io~configmap/conf"},
+		{name: "share", source: corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}}, wantSource: "nfs", wantPath: "kubernetes.io~nfs/share"},
+		{name: "host", source: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/log"}}, wantSource: "hostPath"},
+	}
+	for _, tt := range tests {
+		volume := &corev1.Volume{Name: tt.name, VolumeSource: tt.source}
+		if got := volumeSource(volume); got != tt.wantSource {
+			t.Errorf("volumeSource(%s) = %s, want %s", tt.name, got, tt.wantSource)
+		}
+		got := ""
+		if plugin := volumePlugin(volume, tt.pv); plugin != "" {
+			got = plugin + "/" + volumeDirectory(volume, tt.pv)
+		}
+		if got != tt.wantPath {
+			t.Errorf("expected path of %s (%s) = %q, want %q", tt.name, tt.wantSource, got, tt.wantPath)
+		}
+	}
+}
+
+func TestPodReason(t *testing.T) {
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{kind: deployKind, want: "the first of 3 pods"},
+		{kind: statefulsetKind, want: "instance index 2 (web-2)"},
+		{kind: daemonsetKind, want: "the node is arbitrary"},
+		{kind: podKind, want: "the pod given as target"},
+	}
+	for _, tt := range tests {
+		s := &Server{resourceKind: tt.kind, resourceName: "web", instanceIndex: 2}
+		if got := s.podReason(&ResolvedPod{Candidates: 3}); !strings.Contains(got, tt.want) {
+			t.Errorf("podReason() of %s = %q, want it to contain %q", tt.kind, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	remote "sync-volume-data/remote_execute"
+	"time"
+)
+
+const (
+	// lockDuration is how long a lock outlives the last renewal of its holder, a holder which died stops
+	// blocking the others after it
+	lockDuration      = 30 * time.Second
+	lockRenewInterval = 10 * time.Second
+	lockPrefix        = "sync-volume-data."
+	managedByLabel    = "app.kubernetes.io/managed-by"
+	managedBy         = "sync-volume-data"
+)
+
+// writes tells whether the action writes into the volume, those are serialized by a lock
+func (s *Server) writes() bool {
+	switch s.action {
+	case TransferTo, TransferSync, TransferPut:
+		return true
+	}
+	return false
+}
+
+// validateLock checks --wait-lock and --force-unlock, only writes take the lock
+func (s *Server) validateLock() error {
+	if s.opts.WaitLock < 0 {
+		return errors.New("wait-lock can't be negative")
+	}
+	if (s.opts.WaitLock > 0 || s.opts.ForceUnlock) && !s.writes() {
+		return errors.New("wait-lock/force-unlock can only be used when transfer data to a volume")
+	}
+	return nil
+}
+
+// withLock holds the lock of the volume of target while transfer writes into it, reads don't take it. A volume
+// locked by someone else fails at once, or is waited for up to --wait-lock. --force-unlock takes the lock whoever
+// holds it.
+func (s *Server) withLock(target *Target, transfer func() error) error {
+	if !s.writes() {
+		return transfer()
+	}
+	name, err := s.lockName(target)
+	if err != nil {
+		return err
+	}
+	lease, err := s.acquireLock(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.scope = &lockScope{ctx: ctx, released: make(chan struct{})}
+	s.stopOnLockLoss(target.sshcli)
+	var lost error
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		renewedAt := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+				renewed, err := s.renewLock(lease)
+				if err == nil {
+					lease, renewedAt = renewed, time.Now()
+					continue
+				}
+				if _, taken := err.(*lockTakenError); !taken && !apierrors.IsNotFound(err) && time.Since(renewedAt) < lockDuration {
+					s.log.Warnf("renew lock %s failed: %s", name, err)
+					continue
+				}
+				// someone else may write into the volume now, stop writing
+				lost = errors.New(fmt.Sprintf("lost lock %s: %s", name, err))
+				s.log.Errorf("%s, stop the transfer", lost)
+				cancel()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err = transfer()
+	close(stop)
+	<-stopped
+	close(s.scope.released)
+	s.scope = nil
+	cancel()
+	if lost != nil {
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s, the transfer was stopped: %s", lost, err))
+		}
+		return errors.New(fmt.Sprintf("%s, the volume may have been written by someone else meanwhile", lost))
+	}
+	s.releaseLock(lease)
+	return err
+}
+
+// lockScope is canceled when the lock of the volume is lost while the transfer writes, see withLock
+type lockScope struct {
+	ctx      context.Context
+	released chan struct{}
+}
+
+// context is canceled when the transfer must stop because the lock of the volume was lost
+func (s *Server) context() context.Context {
+	if s.scope == nil {
+		return context.Background()
+	}
+	return s.scope.ctx
+}
+
+// stopOnLockLoss aborts the ssh connection cli when the lock of the volume is lost, the commands running on
+// the node fail and no other one is started
+func (s *Server) stopOnLockLoss(cli *remote.Cli) {
+	if s.scope == nil || cli == nil {
+		return
+	}
+	go func(scope *lockScope) {
+		select {
+		case <-scope.ctx.Done():
+			select {
+			case <-scope.released:
+			default:
+				cli.Abort()
+			}
+		case <-scope.released:
+		}
+	}(s.scope)
+}
+
+// lockTakenError tells that someone else took the lock
+type lockTakenError struct {
+	holder string
+}
+
+func (e *lockTakenError) Error() string {
+	return "taken by " + e.holder
+}
+
+// lockName names the lock after the PVC of the volume, or after the pod and the volume for a volume without claim.
+// The lease lives in the namespace of the pod.
+func (s *Server) lockName(target *Target) (string, error) {
+	pvc, _, err := s.volumeClaim(target.Pod.Namespace, target.Pod, target.Volume)
+	if err != nil {
+		return "", err
+	}
+	name := lockPrefix + "pod." + string(target.Pod.UID) + "." + target.Volume.Name
+	if pvc != nil {
+		name = lockPrefix + "pvc." + pvc.Name
+	}
+	// a lease name is at most 253 characters
+	if len(name) > 253 {
+		sum := sha256.Sum256([]byte(name))
+		name = name[:236] + "." + hex.EncodeToString(sum[:])[:16]
+	}
+	return name, nil
+}
+
+// acquireLock creates the lease, or takes it over when it expired or --force-unlock is set
+func (s *Server) acquireLock(name string) (*coordinationv1.Lease, error) {
+	leases := s.kubeclient.CoordinationV1().Leases(s.namespace)
+	holder := lockHolder()
+	deadline := time.Now().Add(s.opts.WaitLock)
+	forced, waiting := false, false
+	for {
+		now := metav1.NewMicroTime(time.Now())
+		duration := int32(lockDuration.Seconds())
+		lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			lease, err = leases.Create(context.TODO(), &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: s.namespace,
+					Labels:    map[string]string{managedByLabel: managedBy},
+				},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &holder,
+					LeaseDurationSeconds: &duration,
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			}, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+		} else if err == nil && (lockExpired(lease) || (s.opts.ForceUnlock && !forced)) {
+			if !lockExpired(lease) {
+				s.log.Warnf("break lock %s held by %s", name, lockDescription(lease))
+				forced = true
+			}
+			transitions := int32(1)
+			if lease.Spec.LeaseTransitions != nil {
+				transitions += *lease.Spec.LeaseTransitions
+			}
+			lease.Spec = coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+				LeaseTransitions:     &transitions,
+			}
+			lease, err = leases.Update(context.TODO(), lease, metav1.UpdateOptions{})
+			if apierrors.IsConflict(err) {
+				continue
+			}
+		} else if err == nil {
+			if time.Now().After(deadline) {
+				return nil, errors.New(fmt.Sprintf("volume %s is locked by %s, retry later, wait with --wait-lock or break the lock with --force-unlock",
+					s.volume, lockDescription(lease)))
+			}
+			if !waiting {
+				s.log.Infof("volume %s is locked by %s, wait for it", s.volume, lockDescription(lease))
+				waiting = true
+			}
+			time.Sleep(pollInterval)
+			continue
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("take lock %s failed: %s", name, err))
+		}
+		s.log.Infof("took lock %s", name)
+		return lease, nil
+	}
+}
+
+// renewLock pushes the renew time of the lease forward, it fails when someone else took it
+func (s *Server) renewLock(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	leases := s.kubeclient.CoordinationV1().Leases(lease.Namespace)
+	current, err := leases.Get(context.TODO(), lease.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !sameHolder(current, lease) {
+		return nil, &lockTakenError{holder: lockDescription(current)}
+	}
+	now := metav1.NewMicroTime(time.Now())
+	current.Spec.RenewTime = &now
+	return leases.Update(context.TODO(), current, metav1.UpdateOptions{})
+}
+
+// releaseLock deletes the lease unless someone else took it meanwhile
+func (s *Server) releaseLock(lease *coordinationv1.Lease) {
+	leases := s.kubeclient.CoordinationV1().Leases(lease.Namespace)
+	current, err := leases.Get(context.TODO(), lease.Name, metav1.GetOptions{})
+	if err == nil && !sameHolder(current, lease) {
+		s.log.Warnf("lock %s was taken by %s, leave it", lease.Name, lockDescription(current))
+		return
+	}
+	if err == nil {
+		err = leases.Delete(context.TODO(), lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &current.UID, ResourceVersion: &current.ResourceVersion},
+		})
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		s.log.Warnf("release lock %s failed: %s, it expires after %s", lease.Name, err, lockDuration)
+		return
+	}
+	s.log.Infof("released lock %s", lease.Name)
+}
+
+// lockHolder identifies this process: the local user, the host and the pid
+func lockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s (pid %d)", localUser(), host, os.Getpid())
+}
+
+func sameHolder(current, lease *coordinationv1.Lease) bool {
+	return current.Spec.HolderIdentity != nil && *current.Spec.HolderIdentity == *lease.Spec.HolderIdentity &&
+		current.Spec.AcquireTime != nil && current.Spec.AcquireTime.Equal(lease.Spec.AcquireTime)
+}
+
+func lockExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" || lease.Spec.RenewTime == nil {
+		return true
+	}
+	duration := lockDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return lease.Spec.RenewTime.Add(duration).Before(time.Now())
+}
+
+// lockDescription tells who holds the lease and since when
+func lockDescription(lease *coordinationv1.Lease) string {
+	holder, since := "-", "-"
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.AcquireTime != nil {
+		since = lease.Spec.AcquireTime.Local().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s since %s", holder, since)
+}
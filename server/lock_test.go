@@ -0,0 +1,187 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLease = "/apis/coordination.k8s.io/v1/namespaces/web/leases/sync-volume-data.pvc.data"
+
+// has tells whether the object of path p exists
+func (f *fakeAPI) has(p string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects[p]
+	return ok
+}
+
+func lockTarget() *Target {
+	return &Target{
+		Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cms-0", Namespace: "web", UID: "1234"}},
+		Volume: &corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+		}},
+	}
+}
+
+func lockAPI() *fakeAPI {
+	return &fakeAPI{objects: map[string]interface{}{
+		"/api/v1/namespaces/web/persistentvolumeclaims/data": &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "web"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pvc-1234"},
+		},
+		"/api/v1/persistentvolumes/pvc-1234": &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"}},
+	}}
+}
+
+func TestLockName(t *testing.T) {
+	s := fakeServer(t, lockAPI(), deployKind, "cms")
+	if name, err := s.lockName(lockTarget()); err != nil || name != "sync-volume-data.pvc.data" {
+		t.Errorf("lockName() of a claim = %q, %v", name, err)
+	}
+
+	target := lockTarget()
+	target.Volume = &corev1.Volume{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+	if name, err := s.lockName(target); err != nil || name != "sync-volume-data.pod.1234.cache" {
+		t.Errorf("lockName() of a volume without claim = %q, %v", name, err)
+	}
+	target.Volume.Name = strings.Repeat("v", 300)
+	name, err := s.lockName(target)
+	if err != nil || len(name) > 253 || !strings.HasPrefix(name, "sync-volume-data.pod.1234.vvv") {
+		t.Errorf("lockName() of a long name = %q (%d), %v", name, len(name), err)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	api := lockAPI()
+	s := fakeServer(t, api, deployKind, "cms")
+	s.action = TransferTo
+	lease, err := s.acquireLock("sync-volume-data.pvc.data")
+	if err != nil {
+		t.Fatalf("acquireLock() failed: %s", err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != lockHolder() || lockExpired(lease) {
+		t.Errorf("acquireLock() = %+v, want a live lease of %s", lease.Spec, lockHolder())
+	}
+	if renewed, err := s.renewLock(lease); err != nil || !sameHolder(renewed, lease) {
+		t.Errorf("renewLock() = %v, want the lease renewed", err)
+	}
+
+	// someone else fails at once, or takes the lock over with force-unlock
+	other := fakeServer(t, api, deployKind, "cms")
+	other.action = TransferTo
+	if _, err = other.acquireLock("sync-volume-data.pvc.data"); err == nil || !strings.Contains(err.Error(), "is locked by") {
+		t.Errorf("acquireLock() of a held lock error = %v", err)
+	}
+	other.opts.ForceUnlock = true
+	forced, err := other.acquireLock("sync-volume-data.pvc.data")
+	if err != nil {
+		t.Fatalf("acquireLock() with force-unlock failed: %s", err)
+	}
+	if forced.Spec.LeaseTransitions == nil || *forced.Spec.LeaseTransitions != 1 {
+		t.Errorf("acquireLock() with force-unlock transitions = %v, want 1", forced.Spec.LeaseTransitions)
+	}
+
+	// the first holder notices and leaves the lock alone
+	if _, err = s.renewLock(lease); err == nil {
+		t.Errorf("renewLock() of a lock taken over succeeded")
+	} else if _, taken := err.(*lockTakenError); !taken {
+		t.Errorf("renewLock() of a lock taken over error = %v, want lockTakenError", err)
+	}
+	s.releaseLock(lease)
+	if !api.has(testLease) {
+		t.Errorf("releaseLock() deleted the lock of someone else")
+	}
+	other.releaseLock(forced)
+	if api.has(testLease) {
+		t.Errorf("releaseLock() left the lock")
+	}
+}
+
+func TestAcquireExpiredLock(t *testing.T) {
+	api := lockAPI()
+	holder, duration := "gone@host (pid 1)", int32(30)
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	api.objects[testLease] = &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "sync-volume-data.pvc.data", Namespace: "web"},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration, AcquireTime: &renewed, RenewTime: &renewed},
+	}
+	s := fakeServer(t, api, deployKind, "cms")
+	lease, err := s.acquireLock("sync-volume-data.pvc.data")
+	if err != nil {
+		t.Fatalf("acquireLock() of an expired lock failed: %s", err)
+	}
+	if *lease.Spec.HolderIdentity != lockHolder() {
+		t.Errorf("acquireLock() of an expired lock is held by %s", *lease.Spec.HolderIdentity)
+	}
+}
+
+func TestWithLock(t *testing.T) {
+	api := lockAPI()
+	s := fakeServer(t, api, deployKind, "cms")
+	for _, action := range []string{TransferFrom, TransferCat} {
+		s.action = action
+		if err := s.withLock(lockTarget(), func() error { return nil }); err != nil {
+			t.Errorf("withLock() of %s failed: %s", action, err)
+		}
+	}
+	if changes := api.changes(); len(changes) != 0 {
+		t.Errorf("reads took the lock: %q", changes)
+	}
+
+	s.action = TransferTo
+	transferErr := errors.New("transfer failed")
+	err := s.withLock(lockTarget(), func() error {
+		if !api.has(testLease) {
+			t.Errorf("the lock is not held during the transfer")
+		}
+		return transferErr
+	})
+	if err != transferErr {
+		t.Errorf("withLock() error = %v, want the one of the transfer", err)
+	}
+	if api.has(testLease) {
+		t.Errorf("withLock() left the lock after a failed transfer")
+	}
+}
+
+func TestValidateLock(t *testing.T) {
+	tests := []struct {
+		action  string
+		opts    TransferOptions
+		wantErr bool
+	}{
+		{action: TransferFrom},
+		{action: TransferTo, opts: TransferOptions{WaitLock: time.Minute, ForceUnlock: true}},
+		{action: TransferPut, opts: TransferOptions{WaitLock: time.Minute}},
+		{action: TransferTo, opts: TransferOptions{WaitLock: -time.Second}, wantErr: true},
+		{action: TransferFrom, opts: TransferOptions{ForceUnlock: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		s := &Server{action: tt.action, opts: tt.opts}
+		if err := s.validateLock(); (err != nil) != tt.wantErr {
+			t.Errorf("validateLock() of %s with %+v error = %v, wantErr %v", tt.action, tt.opts, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync-volume-data/progress"
+	"time"
+)
+
+// rsync --info=progress2 line, e.g. "  1,234,567  45%   12.34MB/s    0:00:12 (xfr#3, to-chk=5/10)". Older rsync
+// only prints the same line for every file with --progress, "(xfer#3, to-check=5/10)" once the file is done.
+var rsyncProgressLine = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%\s+([\d.]+)([kMGT]?B)/s\s+(\d+):(\d+):(\d+)`)
+
+// the version printed by rsync --version, e.g. "rsync  version 3.2.3  protocol version 31", or by openrsync
+// "rsync version 2.6.9 compatible"
+var rsyncVersionLine = regexp.MustCompile(`rsync\s+version\s+v?(\d+)\.(\d+)`)
+
+// lines printed by rsync -v which are not file names
+var rsyncNoiseLines = []string{
+	"sending incremental file list",
+	"receiving incremental file list",
+	"receiving file list",
+	"building file list",
+	"sent ",
+	"total size is ",
+	"created directory ",
+	"deleting ",
+	"skipping ",
+}
+
+var rateUnits = map[string]float64{
+	"B":  1,
+	"kB": 1000,
+	"MB": 1000 * 1000,
+	"GB": 1000 * 1000 * 1000,
+	"TB": 1000 * 1000 * 1000 * 1000,
+}
+
+// transferStats is what we learned from the output of the transfer tool
+type transferStats struct {
+	files int
+	bytes int64
+}
+
+// scanLines splits on both \n and \r, rsync redraws its progress line with \r
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[0:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// rsyncHasProgress2 tells whether the local rsync supports --info=progress2, rsync < 3.1.0 such as the 2.6.9 of
+// macOS rejects it
+func rsyncHasProgress2() bool {
+	out, err := exec.Command("rsync", "--version").Output()
+	if err != nil {
+		return false
+	}
+	return hasProgress2(string(out))
+}
+
+func hasProgress2(version string) bool {
+	m := rsyncVersionLine.FindStringSubmatch(version)
+	if m == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 3 || major == 3 && minor >= 1
+}
+
+// fileProgress adds the progress lines rsync < 3.1.0 prints for every file up to the progress of the transfer,
+// total is 0 when the size of the transfer is unknown
+type fileProgress struct {
+	total int64
+	done  int64
+}
+
+func (p *fileProgress) status(line string, file progress.Status) progress.Status {
+	status := progress.Status{Bytes: p.done + file.Bytes, TotalBytes: p.total, Throughput: file.Throughput}
+	if strings.Contains(line, "(xfer#") {
+		p.done += file.Bytes
+	}
+	if p.total > 0 {
+		status.Percent = int(status.Bytes * 100 / p.total)
+		if status.Percent > 100 {
+			status.Percent = 100
+		}
+		if status.Throughput > 0 && p.total > status.Bytes {
+			status.ETA = time.Duration(float64(p.total-status.Bytes) / status.Throughput * float64(time.Second))
+		}
+	}
+	return status
+}
+
+// watchOutput reads the combined output of the transfer tool until EOF and turns it into progress events, total
+// is the size of the transfer when it is known beforehand
+func (s *Server) watchOutput(r io.Reader, total int64) (stats transferStats) {
+	files := &fileProgress{total: total}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if s.tool != "rsync" {
+			// scp prints nothing but warnings and errors when it is not attached to a terminal
+			s.log.Info(line)
+			continue
+		}
+
+		if status, ok := parseRsyncProgress(line); ok {
+			if !s.progress2 {
+				status = files.status(line, status)
+			}
+			status.Files = stats.files
+			stats.bytes = status.Bytes
+			s.reporter.Progress(status)
+			continue
+		}
+
+		if strings.HasPrefix(line, "rsync:") || strings.HasPrefix(line, "rsync error:") {
+			s.log.Warn(line)
+			continue
+		}
+
+		if isRsyncNoise(line) || strings.HasSuffix(line, "/") {
+			continue
+		}
+
+		stats.files++
+		s.reporter.File(line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		s.log.Warnf("read output of %s failed: %s", s.tool, err)
+	}
+	return stats
+}
+
+func isRsyncNoise(line string) bool {
+	for _, prefix := range rsyncNoiseLines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRsyncProgress(line string) (status progress.Status, ok bool) {
+	m := rsyncProgressLine.FindStringSubmatch(line)
+	if m == nil {
+		return status, false
+	}
+
+	status.Bytes, _ = strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+	status.Percent, _ = strconv.Atoi(m[2])
+	rate, _ := strconv.ParseFloat(m[3], 64)
+	status.Throughput = rate * rateUnits[m[4]]
+
+	h, _ := strconv.Atoi(m[5])
+	min, _ := strconv.Atoi(m[6])
+	sec, _ := strconv.Atoi(m[7])
+	status.ETA = time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+
+	if status.Percent > 0 {
+		status.TotalBytes = status.Bytes * 100 / int64(status.Percent)
+	}
+	return status, true
+}
+
+// localSize returns the number of regular files and their total size under paths, missing paths are ignored
+func localSize(paths []string) (files int, size int64) {
+	for _, p := range paths {
+		_ = filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				files++
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return files, size
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"sync-volume-data/progress"
+	"testing"
+	"time"
+)
+
+// recorder keeps the events a transfer reports
+type recorder struct {
+	files    []string
+	statuses []progress.Status
+	summary  *progress.Summary
+}
+
+func (r *recorder) Start(progress.Start)            {}
+func (r *recorder) File(name string)                { r.files = append(r.files, name) }
+func (r *recorder) Progress(status progress.Status) { r.statuses = append(r.statuses, status) }
+func (r *recorder) Done(summary progress.Summary)   { r.summary = &summary }
+func (r *recorder) Error(error)                     {}
+
+func TestParseRsyncProgress(t *testing.T) {
+	tests := []struct {
+		line string
+		want progress.Status
+		ok   bool
+	}{
+		{
+			line: "  1,234,567  45%   12.34MB/s    0:00:12 (xfr#3, to-chk=5/10)",
+			want: progress.Status{Bytes: 1234567, TotalBytes: 2743482, Percent: 45, Throughput: 12340000, ETA: 12 * time.Second},
+			ok:   true,
+		},
+		{
+			line: "      32768 100%  512.00kB/s    1:02:03 (xfer#1, to-check=0/1)",
+			want: progress.Status{Bytes: 32768, TotalBytes: 32768, Percent: 100, Throughput: 512000, ETA: time.Hour + 2*time.Minute + 3*time.Second},
+			ok:   true,
+		},
+		{line: "          0   0%    0.00B/s    0:00:00", want: progress.Status{}, ok: true},
+		{line: "dir/file 100%"},
+		{line: "sending incremental file list"},
+	}
+	for _, tt := range tests {
+		got, ok := parseRsyncProgress(tt.line)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseRsyncProgress(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHasProgress2(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"rsync  version 3.2.3  protocol version 31\nCopyright (C) 1996-2020 by Andrew Tridgell", true},
+		{"rsync  version v3.2.7  protocol version 31", true},
+		{"rsync  version 3.1.0  protocol version 31", true},
+		{"rsync  version 3.0.9  protocol version 30", false},
+		{"rsync  version 2.6.9  protocol version 29", false},
+		{"openrsync: protocol version 29\nrsync version 2.6.9 compatible", false},
+		{"rsync  version 4.0.0  protocol version 32", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := hasProgress2(tt.version); got != tt.want {
+			t.Errorf("hasProgress2(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestWatchOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		progress2 bool
+		total     int64
+		output    string
+		wantFiles []string
+		wantBytes []int64
+		wantPct   []int
+	}{
+		{
+			name:      "progress2",
+			progress2: true,
+			output: "sending incremental file list\ndir/\ndir/a.txt\n" +
+				"        512  50%    1.00kB/s    0:00:00\r      1,024 100%    1.00kB/s    0:00:00 (xfr#1, to-chk=0/2)\n" +
+				"\nsent 1,100 bytes  received 35 bytes\ntotal size is 1,024  speedup is 0.90\n",
+			wantFiles: []string{"dir/a.txt"},
+			wantBytes: []int64{512, 1024},
+			wantPct:   []int{50, 100},
+		},
+		{
+			name:  "per file",
+			total: 3000,
+			output: "building file list ... done\na.txt\n" +
+				"        500  50%    1.00kB/s    0:00:00\r       1000 100%    1.00kB/s    0:00:01 (xfer#1, to-check=1/2)\n" +
+				"b.txt\n       1000  50%    1.00kB/s    0:00:01\r       2000 100%    1.00kB/s    0:00:02 (xfer#2, to-check=0/2)\n",
+			wantFiles: []string{"a.txt", "b.txt"},
+			wantBytes: []int64{500, 1000, 2000, 3000},
+			wantPct:   []int{16, 33, 66, 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			s := &Server{tool: "rsync", progress2: tt.progress2, reporter: r, log: testLogger()}
+			stats := s.watchOutput(strings.NewReader(tt.output), tt.total)
+			if !reflect.DeepEqual(r.files, tt.wantFiles) || stats.files != len(tt.wantFiles) {
+				t.Errorf("files = %q (%d), want %q", r.files, stats.files, tt.wantFiles)
+			}
+			var bytes []int64
+			var pct []int
+			for _, status := range r.statuses {
+				bytes = append(bytes, status.Bytes)
+				pct = append(pct, status.Percent)
+			}
+			if !reflect.DeepEqual(bytes, tt.wantBytes) || !reflect.DeepEqual(pct, tt.wantPct) {
+				t.Errorf("progress = %v bytes %v%%, want %v bytes %v%%", bytes, pct, tt.wantBytes, tt.wantPct)
+			}
+			if last := tt.wantBytes[len(tt.wantBytes)-1]; stats.bytes != last {
+				t.Errorf("stats.bytes = %d, want %d", stats.bytes, last)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync-volume-data/utils"
+)
+
+const ChownAuto = "auto"
+
+var (
+	chownPattern = regexp.MustCompile(`^\d+(:\d+)?$|^:\d+$`)
+	// a single chmod rule, optionally prefixed by D (directories) or F (files) like rsync --chmod
+	chmodPattern = regexp.MustCompile(`^[DF]?([0-7]{3,4}|[ugoa]*[-+=][rwxXst]*)$`)
+)
+
+func validateChown(chown string) error {
+	if chown == "" || chown == ChownAuto || chownPattern.MatchString(chown) {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("invalid chown %q, please use auto, uid, uid:gid or :gid", chown))
+}
+
+func validateChmod(chmod string) error {
+	if chmod == "" {
+		return nil
+	}
+	for _, rule := range strings.Split(chmod, ",") {
+		if !chmodPattern.MatchString(rule) {
+			return errors.New(fmt.Sprintf("invalid chmod rule %q, expect rules like D755,F644 or u+rwX,g+rX", rule))
+		}
+	}
+	return nil
+}
+
+// pushedPaths returns the paths on the node which have been written by a "to" transfer
+func (s *Server) pushedPaths(target *Target) []string {
+	var paths []string
+	for _, file := range *s.sourceDir {
+		// rsync copies the content of "dir/" instead of the directory itself
+		if s.tool == "rsync" && strings.HasSuffix(file, "/") {
+			entries, err := os.ReadDir(file)
+			if err != nil {
+				s.log.Warnf("read local directory %s failed: %s", file, err)
+				continue
+			}
+			for _, entry := range entries {
+				paths = append(paths, target.VolumePath+"/"+entry.Name())
+			}
+			continue
+		}
+		paths = append(paths, target.VolumePath+"/"+filepath.Base(filepath.Clean(file)))
+	}
+	return paths
+}
+
+// ownerFromSecurityContext works out the uid/gid the container which mounts the volume expects.
+// The container securityContext wins over the pod one, fsGroup wins over runAsGroup like kubelet does.
+func ownerFromSecurityContext(pod *corev1.Pod, volume *corev1.Volume) (uid, gid *int64, fsGroup bool) {
+	if psc := pod.Spec.SecurityContext; psc != nil {
+		uid = psc.RunAsUser
+		gid = psc.RunAsGroup
+	}
+
+	for _, c := range pod.Spec.Containers {
+		mounted := false
+		for _, m := range c.VolumeMounts {
+			if m.Name == volume.Name {
+				mounted = true
+				break
+			}
+		}
+		if !mounted || c.SecurityContext == nil {
+			continue
+		}
+		if c.SecurityContext.RunAsUser != nil {
+			uid = c.SecurityContext.RunAsUser
+		}
+		if c.SecurityContext.RunAsGroup != nil {
+			gid = c.SecurityContext.RunAsGroup
+		}
+		break
+	}
+
+	if psc := pod.Spec.SecurityContext; psc != nil && psc.FSGroup != nil {
+		gid = psc.FSGroup
+		fsGroup = true
+	}
+	return uid, gid, fsGroup
+}
+
+// applyOwnership changes the owner and the mode of the pushed files on the node
+func (s *Server) applyOwnership(target *Target, paths []string) error {
+	return s.applyOwnershipTo(target, paths, true)
+}
+
+// applyOwnershipTo is applyOwnership, recursive false leaves the content of the directories of paths alone
+func (s *Server) applyOwnershipTo(target *Target, paths []string, recursive bool) error {
+	if len(paths) == 0 || (s.opts.Chown == "" && s.opts.Chmod == "") {
+		return nil
+	}
+	quoted := utils.ShellQuoteAll(paths)
+	flag, depth := "-R ", ""
+	if !recursive {
+		flag, depth = "", " -maxdepth 0"
+	}
+
+	var commands []string
+	owner := s.opts.Chown
+	if owner == ChownAuto {
+		uid, gid, fsGroup := ownerFromSecurityContext(target.Pod, target.Volume)
+		switch {
+		case uid != nil && gid != nil:
+			owner = fmt.Sprintf("%d:%d", *uid, *gid)
+		case uid != nil:
+			owner = fmt.Sprintf("%d", *uid)
+		case gid != nil:
+			owner = fmt.Sprintf(":%d", *gid)
+		default:
+			s.log.Warnf("pod %s has no runAsUser/runAsGroup/fsGroup, skip chown", target.Pod.Name)
+			owner = ""
+		}
+		if fsGroup {
+			// the same as kubelet does for a volume with fsGroup: group rw, setgid on directories
+			commands = append(commands, fmt.Sprintf("chmod %sg+rwX %s", flag, quoted),
+				fmt.Sprintf("find %s%s -type d -exec chmod g+s {} +", quoted, depth))
+		}
+	}
+	if owner != "" {
+		s.log.Infof("chown %s on node %s", owner, target.NodeIP)
+		commands = append([]string{fmt.Sprintf("chown %s%s %s", flag, owner, quoted)}, commands...)
+	}
+
+	if s.opts.Chmod != "" {
+		for _, rule := range strings.Split(s.opts.Chmod, ",") {
+			switch rule[0] {
+			case 'D':
+				commands = append(commands, fmt.Sprintf("find %s%s -type d -exec chmod %s {} +", quoted, depth, rule[1:]))
+			case 'F':
+				commands = append(commands, fmt.Sprintf("find %s%s -type f -exec chmod %s {} +", quoted, depth, rule[1:]))
+			default:
+				commands = append(commands, fmt.Sprintf("chmod %s%s %s", flag, rule, quoted))
+			}
+		}
+		s.log.Infof("chmod %s on node %s", s.opts.Chmod, target.NodeIP)
+	}
+
+	if len(commands) == 0 {
+		return nil
+	}
+	if _, err := target.sshcli.Run(strings.Join(commands, " && ")); err != nil {
+		return errors.New(fmt.Sprintf("change ownership on node %s failed: %s", target.NodeIP, err))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestValidateOwnershipFlags(t *testing.T) {
+	for chown, wantErr := range map[string]bool{"": false, ChownAuto: false, "1000": false, "1000:2000": false, ":2000": false,
+		"1000:": true, "root": true, "1000:2000:3000": true} {
+		if err := validateChown(chown); (err != nil) != wantErr {
+			t.Errorf("validateChown(%q) error = %v, wantErr %v", chown, err, wantErr)
+		}
+	}
+	for chmod, wantErr := range map[string]bool{"": false, "D755,F644": false, "u+rwX,g+rX": false, "0640": false, "Fa=r": false,
+		"D75": true, "X755": true, "D755,": true, "u+z": true} {
+		if err := validateChmod(chmod); (err != nil) != wantErr {
+			t.Errorf("validateChmod(%q) error = %v, wantErr %v", chmod, err, wantErr)
+		}
+	}
+}
+
+func TestOwnerFromSecurityContext(t *testing.T) {
+	id := func(i int64) *int64 { return &i }
+	volume := &corev1.Volume{Name: "data"}
+	mounted := []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}
+	tests := []struct {
+		name        string
+		pod         corev1.PodSpec
+		uid, gid    *int64
+		wantFSGroup bool
+	}{
+		{name: "none"},
+		{
+			name: "pod",
+			pod:  corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{RunAsUser: id(1000), RunAsGroup: id(2000)}},
+			uid:  id(1000),
+			gid:  id(2000),
+		},
+		{
+			name: "container wins",
+			pod: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: id(1000), RunAsGroup: id(2000)},
+				Containers: []corev1.Container{
+					{Name: "sidecar", SecurityContext: &corev1.SecurityContext{RunAsUser: id(1)}},
+					{Name: "app", VolumeMounts: mounted, SecurityContext: &corev1.SecurityContext{RunAsUser: id(999)}},
+				},
+			},
+			uid: id(999),
+			gid: id(2000),
+		},
+		{
+			name: "fsGroup wins",
+			pod: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{FSGroup: id(3000)},
+				Containers: []corev1.Container{
+					{Name: "app", VolumeMounts: mounted, SecurityContext: &corev1.SecurityContext{RunAsUser: id(999), RunAsGroup: id(2000)}},
+				},
+			},
+			uid:         id(999),
+			gid:         id(3000),
+			wantFSGroup: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, fsGroup := ownerFromSecurityContext(&corev1.Pod{Spec: tt.pod}, volume)
+			if !sameID(uid, tt.uid) || !sameID(gid, tt.gid) || fsGroup != tt.wantFSGroup {
+				t.Errorf("ownerFromSecurityContext() = %v, %v, %v, want %v, %v, %v",
+					show(uid), show(gid), fsGroup, show(tt.uid), show(tt.gid), tt.wantFSGroup)
+			}
+		})
+	}
+}
+
+func sameID(a, b *int64) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func show(id *int64) interface{} {
+	if id == nil {
+		return nil
+	}
+	return *id
+}
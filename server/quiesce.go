@@ -0,0 +1,434 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultQuiesceTimeout = 5 * time.Minute
+	DefaultQuiesceImage   = "k8s.gcr.io/pause:3.5"
+
+	// quiescedReplicasAnnotation records the replicas of a deployment/statefulset while it is scaled to zero, it is
+	// what to scale it back to when a quiesce was interrupted for good
+	quiescedReplicasAnnotation = "sync-volume-data/quiesced-replicas"
+	// quiesceNodeSelector is added to the node selector of a daemonset, no node has it so every pod goes away
+	quiesceNodeSelector = "sync-volume-data/quiesce"
+	// quiesceLabel marks the temporary pods with the name of the workload they stand in for
+	quiesceLabel = "sync-volume-data/quiesce-of"
+
+	pollInterval = 2 * time.Second
+)
+
+// validateQuiesce checks --quiesce, the workload must be able to start again by itself once restored
+func (s *Server) validateQuiesce() error {
+	if !s.opts.Quiesce {
+		return nil
+	}
+	switch s.action {
+	case TransferTo, TransferFrom, TransferSync, TransferPut:
+	default:
+		return errors.New("quiesce can only be used when transfer data to or from a volume")
+	}
+	if s.resourceKind == podKind {
+		return errors.New("quiesce needs a deploy/sts/ds, a pod without controller would not come back")
+	}
+	if s.opts.Watch {
+		return errors.New("quiesce can't be used with watch, the workload would stay stopped")
+	}
+	if s.opts.PreHook != "" || s.opts.PostHook != "" {
+		return errors.New("quiesce can't be used with pre-hook/post-hook, the application is stopped")
+	}
+	if s.opts.QuiesceTimeout <= 0 {
+		s.opts.QuiesceTimeout = DefaultQuiesceTimeout
+	}
+	if s.opts.QuiesceImage == "" {
+		s.opts.QuiesceImage = DefaultQuiesceImage
+	}
+	return nil
+}
+
+// withQuiesce stops the workload of target, mounts the volume in a temporary pod on the same node and runs transfer
+// against that pod. Then the temporary pod is deleted, the workload is restored and waited for until it is ready.
+// The workload is restored whatever happened, also on Ctrl-C which stops the transfer.
+func (s *Server) withQuiesce(target *Target, transfer func(target *Target) error) (err error) {
+	if !s.opts.Quiesce {
+		return transfer(target)
+	}
+	if err = quiescable(target.Volume); err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	interrupted, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			s.log.Warnf("interrupted, stop the transfer and restore %s %s", s.resourceKind, s.resourceName)
+			close(interrupted)
+		case <-done:
+		}
+	}()
+
+	restore, err := s.stopWorkload()
+	if restore != nil {
+		defer func() {
+			if restoreErr := restore(); restoreErr != nil {
+				if err != nil {
+					s.log.Error(restoreErr)
+				} else {
+					err = restoreErr
+				}
+			}
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.waitPodGone(target.Pod, interrupted); err != nil {
+		return err
+	}
+
+	pod, err := s.createQuiescePod(target)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if deleteErr := s.deleteQuiescePod(pod); deleteErr != nil {
+			if err != nil {
+				s.log.Error(deleteErr)
+			} else {
+				err = deleteErr
+			}
+		}
+	}()
+	if pod, err = s.waitPodRunning(pod, interrupted); err != nil {
+		return err
+	}
+
+	quiesced, err := s.podTarget(target.Volume, pod)
+	if err != nil {
+		return err
+	}
+	defer quiesced.sshcli.Close()
+	go func() {
+		select {
+		case <-interrupted:
+			// the transfers over ssh end with the connection, rsync and scp get the signal of the terminal
+			quiesced.sshcli.Close()
+		case <-done:
+		}
+	}()
+	return transfer(quiesced)
+}
+
+// quiescable refuses the volumes whose content goes away or is generated again with the pod
+func quiescable(volume *corev1.Volume) error {
+	switch {
+	case volume.EmptyDir != nil, volume.Ephemeral != nil:
+		return errors.New(fmt.Sprintf("volume %s goes away with the pod, it can't be quiesced", volume.Name))
+	case volume.ConfigMap != nil, volume.Secret != nil, volume.DownwardAPI != nil, volume.Projected != nil:
+		return errors.New(fmt.Sprintf("volume %s is generated by kubelet, it can't be quiesced", volume.Name))
+	}
+	return nil
+}
+
+// stopWorkload scales the deployment/statefulset to zero, or moves the pods of the daemonset off every node. The
+// returned function undoes it and waits for the workload to be ready, it is nil when nothing was changed.
+func (s *Server) stopWorkload() (restore func() error, err error) {
+	ctx := context.TODO()
+	apps := s.kubeclient.AppsV1()
+	var patch func(patch map[string]interface{}) error
+	var replicas int32
+	var annotations map[string]string
+
+	switch s.resourceKind {
+	case deployKind:
+		deploy, err := apps.Deployments(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		replicas, annotations = *deploy.Spec.Replicas, deploy.Annotations
+		patch = func(patch map[string]interface{}) error {
+			data, _ := json.Marshal(patch)
+			_, err := apps.Deployments(s.namespace).Patch(ctx, s.resourceName, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}
+	case statefulsetKind:
+		sts, err := apps.StatefulSets(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		replicas, annotations = *sts.Spec.Replicas, sts.Annotations
+		patch = func(patch map[string]interface{}) error {
+			data, _ := json.Marshal(patch)
+			_, err := apps.StatefulSets(s.namespace).Patch(ctx, s.resourceName, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}
+	case daemonsetKind:
+		return s.stopDaemonset()
+	default:
+		return nil, errors.New(fmt.Sprintf("can't quiesce %s %s", s.resourceKind, s.resourceName))
+	}
+
+	if recorded, ok := annotations[quiescedReplicasAnnotation]; ok {
+		return nil, errors.New(fmt.Sprintf("%s %s is already quiesced, scale it back to %s replicas and remove the annotation %s first",
+			s.resourceKind, s.resourceName, recorded, quiescedReplicasAnnotation))
+	}
+	s.log.Infof("scale %s %s from %d replicas to 0", s.resourceKind, s.resourceName, replicas)
+	err = patch(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{quiescedReplicasAnnotation: strconv.Itoa(int(replicas))}},
+		"spec":     map[string]interface{}{"replicas": 0},
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("scale %s %s to 0 failed: %s", s.resourceKind, s.resourceName, err))
+	}
+
+	return func() error {
+		s.log.Infof("scale %s %s back to %d replicas", s.resourceKind, s.resourceName, replicas)
+		err := patch(map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{quiescedReplicasAnnotation: nil}},
+			"spec":     map[string]interface{}{"replicas": replicas},
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("scale %s %s back to %d replicas failed: %s", s.resourceKind, s.resourceName, replicas, err))
+		}
+		return s.waitWorkloadReady()
+	}, nil
+}
+
+// stopDaemonset adds a node selector no node matches, the daemonset controller deletes all of its pods
+func (s *Server) stopDaemonset() (restore func() error, err error) {
+	ctx := context.TODO()
+	daemonsets := s.kubeclient.AppsV1().DaemonSets(s.namespace)
+	ds, err := daemonsets.Get(ctx, s.resourceName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ds.Spec.Template.Spec.NodeSelector[quiesceNodeSelector]; ok {
+		return nil, errors.New(fmt.Sprintf("%s %s is already quiesced, remove the node selector %s first",
+			s.resourceKind, s.resourceName, quiesceNodeSelector))
+	}
+	patch := func(value interface{}) error {
+		data, _ := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{
+				"nodeSelector": map[string]interface{}{quiesceNodeSelector: value},
+			}}},
+		})
+		_, err := daemonsets.Patch(ctx, s.resourceName, types.MergePatchType, data, metav1.PatchOptions{})
+		return err
+	}
+
+	s.log.Infof("move the pods of %s %s off every node with node selector %s", s.resourceKind, s.resourceName, quiesceNodeSelector)
+	if err = patch("true"); err != nil {
+		return nil, errors.New(fmt.Sprintf("patch the node selector of %s %s failed: %s", s.resourceKind, s.resourceName, err))
+	}
+	return func() error {
+		s.log.Infof("remove node selector %s from %s %s", quiesceNodeSelector, s.resourceKind, s.resourceName)
+		if err := patch(nil); err != nil {
+			return errors.New(fmt.Sprintf("remove node selector %s from %s %s failed: %s", quiesceNodeSelector, s.resourceKind, s.resourceName, err))
+		}
+		return s.waitWorkloadReady()
+	}, nil
+}
+
+// waitWorkloadReady waits until the workload is complete, the same as before a transfer
+func (s *Server) waitWorkloadReady() error {
+	err := poll(s.opts.QuiesceTimeout, nil, s.workloadComplete)
+	if err != nil {
+		return errors.New(fmt.Sprintf("wait for %s %s to be ready: %s", s.resourceKind, s.resourceName, err))
+	}
+	s.log.Infof("%s %s is ready", s.resourceKind, s.resourceName)
+	return nil
+}
+
+// workloadComplete tells whether every replica of the workload is updated and ready
+func (s *Server) workloadComplete() (bool, error) {
+	ctx := context.TODO()
+	apps := s.kubeclient.AppsV1()
+	switch s.resourceKind {
+	case deployKind:
+		deploy, err := apps.Deployments(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return DeploymentComplete(deploy, &deploy.Status), nil
+	case statefulsetKind:
+		sts, err := apps.StatefulSets(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return StatefulsetComplete(sts, &sts.Status), nil
+	case daemonsetKind:
+		ds, err := apps.DaemonSets(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		// like kubectl rollout status, the old pods are ready and available until they are replaced
+		return DaemonsetComplete(ds, &ds.Status) && ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled, nil
+	}
+	return true, nil
+}
+
+// waitPodGone waits until pod is deleted, or replaced by a pod of the same name
+func (s *Server) waitPodGone(pod *corev1.Pod, stop <-chan struct{}) error {
+	s.log.Infof("wait for pod %s to stop", pod.Name)
+	err := poll(s.opts.QuiesceTimeout, stop, func() (bool, error) {
+		current, err := s.kubeclient.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return err == nil && current.UID != pod.UID, err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("wait for pod %s to stop: %s", pod.Name, err))
+	}
+	return nil
+}
+
+// createQuiescePod creates a pod which only mounts the volume of target, on the same node. It gets the tolerations
+// and the security context of the pod of the workload, so that the volume is mounted with the same ownership and
+// selinux labels.
+func (s *Server) createQuiescePod(target *Target) (*corev1.Pod, error) {
+	var securityContext *corev1.SecurityContext
+	for _, container := range target.Pod.Spec.Containers {
+		if container.Name == hookContainer(target.Pod, target.Volume.Name, "") {
+			securityContext = container.SecurityContext
+		}
+	}
+	grace, automount := int64(0), false
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "sync-volume-data-quiesce-",
+			Namespace:    target.Pod.Namespace,
+			Labels:       map[string]string{quiesceLabel: s.resourceName},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      target.Pod.Spec.NodeName,
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:            "quiesce",
+				Image:           s.opts.QuiesceImage,
+				VolumeMounts:    []corev1.VolumeMount{{Name: target.Volume.Name, MountPath: "/volume"}},
+				SecurityContext: securityContext,
+			}},
+			Volumes:                       []corev1.Volume{*target.Volume},
+			Tolerations:                   target.Pod.Spec.Tolerations,
+			SecurityContext:               target.Pod.Spec.SecurityContext,
+			ImagePullSecrets:              target.Pod.Spec.ImagePullSecrets,
+			TerminationGracePeriodSeconds: &grace,
+			AutomountServiceAccountToken:  &automount,
+		},
+	}
+	pod, err := s.kubeclient.CoreV1().Pods(pod.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("create the pod mounting volume %s failed: %s", target.Volume.Name, err))
+	}
+	s.log.Infof("created pod %s mounting volume %s on node %s", pod.Name, target.Volume.Name, pod.Spec.NodeName)
+	return pod, nil
+}
+
+// waitPodRunning waits until the containers of pod are started and returns the pod as it is then
+func (s *Server) waitPodRunning(pod *corev1.Pod, stop <-chan struct{}) (*corev1.Pod, error) {
+	current := pod
+	err := poll(s.opts.QuiesceTimeout, stop, func() (bool, error) {
+		var err error
+		current, err = s.kubeclient.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch current.Status.Phase {
+		case corev1.PodRunning:
+			return true, nil
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return false, errors.New(fmt.Sprintf("pod is %s", current.Status.Phase))
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("wait for pod %s to run: %s%s", pod.Name, err, pendingReason(current)))
+	}
+	return current, nil
+}
+
+// pendingReason tells why the containers of pod don't run yet, e.g. the image can't be pulled
+func pendingReason(pod *corev1.Pod) string {
+	var reasons []string
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" {
+			reasons = append(reasons, strings.TrimSpace(waiting.Reason+" "+waiting.Message))
+		}
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue && condition.Message != "" {
+			reasons = append(reasons, condition.Message)
+		}
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(reasons, ", ")
+}
+
+// deleteQuiescePod deletes the temporary pod and waits for it to be gone, so that the volume is free for the pods
+// of the workload
+func (s *Server) deleteQuiescePod(pod *corev1.Pod) error {
+	s.log.Infof("delete pod %s", pod.Name)
+	err := s.kubeclient.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.New(fmt.Sprintf("delete pod %s failed: %s", pod.Name, err))
+	}
+	return s.waitPodGone(pod, nil)
+}
+
+// poll calls check every pollInterval until it is done or fails, timeout passes or stop is closed
+func poll(timeout time.Duration, stop <-chan struct{}, check func() (bool, error)) error {
+	deadline := time.After(timeout)
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-deadline:
+			return errors.New(fmt.Sprintf("timed out after %s", timeout))
+		case <-stop:
+			return errors.New("interrupted")
+		case <-time.After(pollInterval):
+		}
+	}
+}
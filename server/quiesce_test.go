@@ -0,0 +1,250 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI serves the objects of a kubernetes api server by their path. The requests which change something are
+// recorded: a post creates the object under the collection, a put replaces it, a delete removes it and a patch
+// gets the object back unchanged.
+type fakeAPI struct {
+	mu       sync.Mutex
+	objects  map[string]interface{}
+	requests []string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodGet {
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+string(body))
+	}
+
+	p := r.URL.Path
+	if r.Method == http.MethodPost {
+		var meta struct {
+			Metadata metav1.ObjectMeta `json:"metadata"`
+		}
+		json.Unmarshal(body, &meta)
+		p += "/" + meta.Metadata.Name
+		if _, ok := f.objects[p]; ok {
+			f.status(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+			return
+		}
+	}
+	obj, ok := f.objects[p]
+	if r.Method == http.MethodPost || r.Method == http.MethodPut && ok {
+		obj = json.RawMessage(body)
+		f.objects[p] = obj
+	}
+	if !ok && r.Method != http.MethodPost {
+		f.status(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		delete(f.objects, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (f *fakeAPI) status(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusFailure,
+		Reason: reason, Code: int32(code)})
+}
+
+// changes returns the recorded requests and forgets them
+func (f *fakeAPI) changes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+// fakeServer returns a server of kind/name in namespace web whose client talks to api
+func fakeServer(t *testing.T, api *fakeAPI, kind, name string) *Server {
+	t.Helper()
+	apiserver := httptest.NewServer(api)
+	t.Cleanup(apiserver.Close)
+	config := &rest.Config{Host: apiserver.URL}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{kubeclient: client, restConfig: config, namespace: "web", resourceKind: kind, resourceName: name,
+		log: testLogger(), opts: TransferOptions{QuiesceTimeout: time.Second}}
+}
+
+func TestStopDeployment(t *testing.T) {
+	replicas := int32(3)
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "web"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 3, ReadyReplicas: 3, AvailableReplicas: 3},
+	}
+	api := &fakeAPI{objects: map[string]interface{}{"/apis/apps/v1/namespaces/web/deployments/nginx": deploy}}
+	s := fakeServer(t, api, deployKind, "nginx")
+
+	restore, err := s.stopWorkload()
+	if err != nil {
+		t.Fatalf("stopWorkload() failed: %s", err)
+	}
+	changes := api.changes()
+	if len(changes) != 1 || !strings.Contains(changes[0], `"replicas":0`) || !strings.Contains(changes[0], `"`+quiescedReplicasAnnotation+`":"3"`) {
+		t.Errorf("stopWorkload() requests = %q, want a patch to 0 replicas recording 3", changes)
+	}
+	if err = restore(); err != nil {
+		t.Fatalf("restore() failed: %s", err)
+	}
+	changes = api.changes()
+	if len(changes) != 1 || !strings.Contains(changes[0], `"replicas":3`) || !strings.Contains(changes[0], `"`+quiescedReplicasAnnotation+`":null`) {
+		t.Errorf("restore() requests = %q, want a patch back to 3 replicas removing the annotation", changes)
+	}
+
+	// an interrupted quiesce is not mistaken for a workload of 0 replicas
+	deploy.Annotations = map[string]string{quiescedReplicasAnnotation: "3"}
+	if restore, err = s.stopWorkload(); err == nil || restore != nil {
+		t.Errorf("stopWorkload() of a quiesced deployment succeeded")
+	}
+	if changes = api.changes(); len(changes) != 0 {
+		t.Errorf("stopWorkload() of a quiesced deployment changed it: %q", changes)
+	}
+}
+
+func TestStopDaemonset(t *testing.T) {
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "web"}}
+	api := &fakeAPI{objects: map[string]interface{}{"/apis/apps/v1/namespaces/web/daemonsets/agent": ds}}
+	s := fakeServer(t, api, daemonsetKind, "agent")
+
+	restore, err := s.stopWorkload()
+	if err != nil {
+		t.Fatalf("stopWorkload() failed: %s", err)
+	}
+	if changes := api.changes(); len(changes) != 1 || !strings.Contains(changes[0], `"nodeSelector":{"`+quiesceNodeSelector+`":"true"}`) {
+		t.Errorf("stopWorkload() requests = %q, want a patch of the node selector", changes)
+	}
+	if err = restore(); err != nil {
+		t.Fatalf("restore() failed: %s", err)
+	}
+	if changes := api.changes(); len(changes) != 1 || !strings.Contains(changes[0], `"nodeSelector":{"`+quiesceNodeSelector+`":null}`) {
+		t.Errorf("restore() requests = %q, want the node selector removed", changes)
+	}
+}
+
+func TestValidateQuiesce(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		kind    string
+		opts    TransferOptions
+		wantErr bool
+	}{
+		{name: "off", action: TransferCat, kind: podKind},
+		{name: "push", action: TransferTo, kind: deployKind, opts: TransferOptions{Quiesce: true}},
+		{name: "sync", action: TransferSync, kind: daemonsetKind, opts: TransferOptions{Quiesce: true}},
+		{name: "cat", action: TransferCat, kind: deployKind, opts: TransferOptions{Quiesce: true}, wantErr: true},
+		{name: "pod", action: TransferTo, kind: podKind, opts: TransferOptions{Quiesce: true}, wantErr: true},
+		{name: "watch", action: TransferTo, kind: deployKind, opts: TransferOptions{Quiesce: true, Watch: true}, wantErr: true},
+		{name: "hooks", action: TransferTo, kind: deployKind, opts: TransferOptions{Quiesce: true, PreHook: "sync"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		s := &Server{action: tt.action, resourceKind: tt.kind, opts: tt.opts}
+		err := s.validateQuiesce()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateQuiesce() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && tt.opts.Quiesce && (s.opts.QuiesceTimeout != DefaultQuiesceTimeout || s.opts.QuiesceImage != DefaultQuiesceImage) {
+			t.Errorf("%s: validateQuiesce() left the defaults unset: %s %q", tt.name, s.opts.QuiesceTimeout, s.opts.QuiesceImage)
+		}
+	}
+}
+
+func TestQuiescable(t *testing.T) {
+	tests := []struct {
+		source  corev1.VolumeSource
+		wantErr bool
+	}{
+		{source: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+		{source: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/data"}}},
+		{source: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}, wantErr: true},
+		{source: corev1.VolumeSource{Ephemeral: &corev1.EphemeralVolumeSource{}}, wantErr: true},
+		{source: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}, wantErr: true},
+		{source: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		volume := &corev1.Volume{Name: "data", VolumeSource: tt.source}
+		if err := quiescable(volume); (err != nil) != tt.wantErr {
+			t.Errorf("quiescable(%s) error = %v, wantErr %v", volumeSource(volume), err, tt.wantErr)
+		}
+	}
+}
+
+func TestPendingReason(t *testing.T) {
+	pod := &corev1.Pod{Status: corev1.PodStatus{
+		ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "pull k8s.gcr.io/pause:3.5 failed"},
+		}}},
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionTrue, Message: "ignored"},
+			{Type: corev1.ContainersReady, Status: corev1.ConditionFalse, Message: "containers with unready status: [quiesce]"},
+		},
+	}}
+	want := ", ImagePullBackOff pull k8s.gcr.io/pause:3.5 failed, containers with unready status: [quiesce]"
+	if got := pendingReason(pod); got != want {
+		t.Errorf("pendingReason() = %q, want %q", got, want)
+	}
+	if got := pendingReason(&corev1.Pod{}); got != "" {
+		t.Errorf("pendingReason() of a pod without reasons = %q", got)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	calls := 0
+	err := poll(time.Second, nil, func() (bool, error) {
+		calls++
+		return true, nil
+	})
+	if err != nil || calls != 1 {
+		t.Errorf("poll() of a done check = %v after %d calls", err, calls)
+	}
+	if err = poll(10*time.Millisecond, nil, func() (bool, error) { return false, nil }); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("poll() of a check which never ends = %v, want a timeout", err)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if err = poll(time.Minute, stop, func() (bool, error) { return false, nil }); err == nil || err.Error() != "interrupted" {
+		t.Errorf("poll() after stop = %v, want interrupted", err)
+	}
+}
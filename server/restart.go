@@ -0,0 +1,187 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRestartTimeout = 5 * time.Minute
+
+	// restartedAtAnnotation is the annotation of the pod template kubectl rollout restart sets
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+	revisionAnnotation    = "deployment.kubernetes.io/revision"
+)
+
+// validateRestart checks --restart, it makes sense once data is written into the volume of a workload
+func (s *Server) validateRestart() error {
+	if !s.opts.Restart {
+		return nil
+	}
+	switch s.action {
+	case TransferTo, TransferSync, TransferPut:
+	default:
+		return errors.New("restart can only be used when transfer data to a volume")
+	}
+	if s.resourceKind == podKind {
+		return errors.New("restart needs a deploy/sts/ds, a pod can't be restarted")
+	}
+	if s.opts.Watch {
+		return errors.New("restart can't be used with watch")
+	}
+	if s.opts.Quiesce {
+		return errors.New("restart can't be used with quiesce, the workload starts again after quiesce anyway")
+	}
+	if s.opts.RestartTimeout <= 0 {
+		s.opts.RestartTimeout = DefaultRestartTimeout
+	}
+	return nil
+}
+
+// restartWorkload restarts the pods of the workload like kubectl rollout restart does and waits for the rollout to
+// complete. When it doesn't, the error tells which pods are not ready and how to roll back.
+func (s *Server) restartWorkload() error {
+	ctx := context.TODO()
+	apps := s.kubeclient.AppsV1()
+	var selector *metav1.LabelSelector
+	var rollback string
+	var err error
+
+	switch s.resourceKind {
+	case deployKind:
+		var deploy *appsv1.Deployment
+		if deploy, err = apps.Deployments(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+		selector = deploy.Spec.Selector
+		rollback = fmt.Sprintf("kubectl rollout undo deployment/%s -n %s --to-revision=%s", s.resourceName, s.namespace,
+			deploy.Annotations[revisionAnnotation])
+	case statefulsetKind:
+		var sts *appsv1.StatefulSet
+		if sts, err = apps.StatefulSets(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+		if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			return errors.New(fmt.Sprintf("statefulset %s uses the OnDelete update strategy, delete its pods to restart them", s.resourceName))
+		}
+		selector = sts.Spec.Selector
+		rollback = fmt.Sprintf("kubectl rollout undo statefulset/%s -n %s", s.resourceName, s.namespace)
+	case daemonsetKind:
+		var ds *appsv1.DaemonSet
+		if ds, err = apps.DaemonSets(s.namespace).Get(ctx, s.resourceName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+		if ds.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+			return errors.New(fmt.Sprintf("daemonset %s uses the OnDelete update strategy, delete its pods to restart them", s.resourceName))
+		}
+		selector = ds.Spec.Selector
+		rollback = fmt.Sprintf("kubectl rollout undo daemonset/%s -n %s", s.resourceName, s.namespace)
+	default:
+		return errors.New(fmt.Sprintf("can't restart %s %s", s.resourceKind, s.resourceName))
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"template": map[string]interface{}{"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{restartedAtAnnotation: time.Now().Format(time.RFC3339)},
+		}}},
+	})
+	switch s.resourceKind {
+	case deployKind:
+		_, err = apps.Deployments(s.namespace).Patch(ctx, s.resourceName, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	case statefulsetKind:
+		_, err = apps.StatefulSets(s.namespace).Patch(ctx, s.resourceName, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	case daemonsetKind:
+		_, err = apps.DaemonSets(s.namespace).Patch(ctx, s.resourceName, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("restart %s %s failed: %s", s.resourceKind, s.resourceName, err))
+	}
+	s.log.Infof("restarted %s %s, wait for the rollout to complete", s.resourceKind, s.resourceName)
+
+	err = poll(s.opts.RestartTimeout, nil, func() (bool, error) {
+		if err := s.rolloutFailed(); err != nil {
+			return false, err
+		}
+		return s.workloadComplete()
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("rollout of %s %s did not complete: %s%s. The data is already written, to roll back the workload run: %s",
+			s.resourceKind, s.resourceName, err, s.unreadyPods(selector), rollback))
+	}
+	s.log.Infof("rollout of %s %s complete", s.resourceKind, s.resourceName)
+	return nil
+}
+
+// rolloutFailed returns an error once the deployment controller gave up the rollout, the other kinds never do
+func (s *Server) rolloutFailed() error {
+	if s.resourceKind != deployKind {
+		return nil
+	}
+	deploy, err := s.kubeclient.AppsV1().Deployments(s.namespace).Get(context.TODO(), s.resourceName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, condition := range deploy.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == "ProgressDeadlineExceeded" && deploy.Status.ObservedGeneration >= deploy.Generation {
+			return errors.New(condition.Message)
+		}
+	}
+	return nil
+}
+
+// unreadyPods lists the pods of selector which are not ready, with the reason when there is one
+func (s *Server) unreadyPods(selector *metav1.LabelSelector) string {
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return ""
+	}
+	pods, err := s.kubeclient.CoreV1().Pods(s.namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return ""
+	}
+	var unready []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp == nil && !podReady(pod) {
+			unready = append(unready, pod.Name+pendingReason(pod))
+		}
+	}
+	if len(unready) == 0 {
+		return ""
+	}
+	return "; pods not ready: " + strings.Join(unready, "; ")
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func TestRestartDeployment(t *testing.T) {
+	replicas := int32(2)
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "cms", Namespace: "web", Annotations: map[string]string{revisionAnnotation: "7"}},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas, Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "cms"}}},
+		Status:     appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2, AvailableReplicas: 2},
+	}
+	pods := &corev1.PodList{Items: []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "cms-old"}, Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cms-new"}, Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+		}}}}},
+	}}
+	api := &fakeAPI{objects: map[string]interface{}{
+		"/apis/apps/v1/namespaces/web/deployments/cms": deploy,
+		"/api/v1/namespaces/web/pods":                  pods,
+	}}
+	s := fakeServer(t, api, deployKind, "cms")
+	s.opts.RestartTimeout = s.opts.QuiesceTimeout
+
+	if err := s.restartWorkload(); err != nil {
+		t.Fatalf("restartWorkload() failed: %s", err)
+	}
+	if changes := api.changes(); len(changes) != 1 || !strings.Contains(changes[0], restartedAtAnnotation) {
+		t.Errorf("restartWorkload() requests = %q, want a patch of %s", changes, restartedAtAnnotation)
+	}
+
+	// the controller gives up, the error tells which pod is not ready and how to roll back
+	deploy.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse,
+		Reason: "ProgressDeadlineExceeded", Message: `ReplicaSet "cms-new" has timed out progressing.`}}
+	err := s.restartWorkload()
+	if err == nil {
+		t.Fatalf("restartWorkload() of a failed rollout succeeded")
+	}
+	for _, want := range []string{"has timed out progressing", "cms-new, CrashLoopBackOff", "kubectl rollout undo deployment/cms -n web --to-revision=7"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("restartWorkload() error = %q, want it to contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "cms-old") {
+		t.Errorf("restartWorkload() error lists the ready pod: %q", err)
+	}
+}
+
+func TestRestartOnDelete(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "pg", Namespace: "web"},
+		Spec:       appsv1.StatefulSetSpec{UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}},
+	}
+	api := &fakeAPI{objects: map[string]interface{}{"/apis/apps/v1/namespaces/web/statefulsets/pg": sts}}
+	s := fakeServer(t, api, statefulsetKind, "pg")
+	if err := s.restartWorkload(); err == nil || !strings.Contains(err.Error(), "OnDelete") {
+		t.Errorf("restartWorkload() of an OnDelete statefulset error = %v", err)
+	}
+	if changes := api.changes(); len(changes) != 0 {
+		t.Errorf("restartWorkload() of an OnDelete statefulset changed it: %q", changes)
+	}
+}
+
+// TestDaemonsetComplete checks that a daemonset is only complete once its pods are updated, the old ones are ready
+// until they are replaced
+func TestDaemonsetComplete(t *testing.T) {
+	ds := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "web"},
+		Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, CurrentNumberScheduled: 3, NumberReady: 3, NumberAvailable: 3,
+			UpdatedNumberScheduled: 1},
+	}
+	api := &fakeAPI{objects: map[string]interface{}{"/apis/apps/v1/namespaces/web/daemonsets/agent": ds}}
+	s := fakeServer(t, api, daemonsetKind, "agent")
+	if complete, err := s.workloadComplete(); complete || err != nil {
+		t.Errorf("workloadComplete() while rolling = %v, %v, want false", complete, err)
+	}
+	ds.Status.UpdatedNumberScheduled = 3
+	if complete, err := s.workloadComplete(); !complete || err != nil {
+		t.Errorf("workloadComplete() once rolled = %v, %v, want true", complete, err)
+	}
+}
+
+func TestValidateRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		kind    string
+		opts    TransferOptions
+		wantErr bool
+	}{
+		{name: "off", action: TransferFrom, kind: podKind},
+		{name: "push", action: TransferTo, kind: deployKind, opts: TransferOptions{Restart: true}},
+		{name: "put", action: TransferPut, kind: statefulsetKind, opts: TransferOptions{Restart: true}},
+		{name: "pull", action: TransferFrom, kind: deployKind, opts: TransferOptions{Restart: true}, wantErr: true},
+		{name: "pod", action: TransferTo, kind: podKind, opts: TransferOptions{Restart: true}, wantErr: true},
+		{name: "watch", action: TransferTo, kind: deployKind, opts: TransferOptions{Restart: true, Watch: true}, wantErr: true},
+		{name: "quiesce", action: TransferTo, kind: deployKind, opts: TransferOptions{Restart: true, Quiesce: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		s := &Server{action: tt.action, resourceKind: tt.kind, opts: tt.opts}
+		err := s.validateRestart()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateRestart() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && tt.opts.Restart && s.opts.RestartTimeout != DefaultRestartTimeout {
+			t.Errorf("%s: validateRestart() left the timeout at %s", tt.name, s.opts.RestartTimeout)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+	"sync-volume-data/utils"
+)
+
+// seLinuxOptions returns the seLinuxOptions of the container which mounts the volume, or the pod ones
+func seLinuxOptions(pod *corev1.Pod, volume *corev1.Volume) *corev1.SELinuxOptions {
+	for _, c := range pod.Spec.Containers {
+		for _, m := range c.VolumeMounts {
+			if m.Name == volume.Name && c.SecurityContext != nil && c.SecurityContext.SELinuxOptions != nil {
+				return c.SecurityContext.SELinuxOptions
+			}
+		}
+	}
+
+	if pod.Spec.SecurityContext != nil {
+		return pod.Spec.SecurityContext.SELinuxOptions
+	}
+	return nil
+}
+
+// seLinuxContext works out the file context of the volume. The context of the volume directory which has been
+// labeled by the container runtime is the base, the level (MCS categories) of seLinuxOptions wins when it is set.
+// user/role/type of seLinuxOptions are the labels of the process, they are not meant for files.
+func (s *Server) seLinuxContext(target *Target) (string, error) {
+	out, err := target.sshcli.Run(fmt.Sprintf("stat -c %%C %s", utils.ShellQuote(target.VolumePath)))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("get selinux context of %s failed: %s", target.VolumePath, err))
+	}
+
+	context := strings.TrimSpace(out)
+	parts := strings.SplitN(context, ":", 4)
+	if len(parts) < 3 || context == "?" {
+		return "", errors.New(fmt.Sprintf("volume directory %s has no selinux context, is selinux enabled on node %s ?",
+			target.VolumePath, target.NodeIP))
+	}
+
+	if opts := seLinuxOptions(target.Pod, target.Volume); opts != nil && opts.Level != "" {
+		parts = append(parts[:3], opts.Level)
+		s.log.Infof("use selinux level %s from pod %s", opts.Level, target.Pod.Name)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// relabel sets the selinux context of the pushed files on the node
+func (s *Server) relabel(target *Target, paths []string) error {
+	return s.relabelTo(target, paths, true)
+}
+
+// relabelTo is relabel, recursive false leaves the content of the directories of paths alone
+func (s *Server) relabelTo(target *Target, paths []string, recursive bool) error {
+	if !s.opts.SELinuxRelabel || len(paths) == 0 {
+		return nil
+	}
+
+	context, err := s.seLinuxContext(target)
+	if err != nil {
+		return err
+	}
+
+	s.log.Infof("relabel pushed files with selinux context %s on node %s", context, target.NodeIP)
+	flag := "-R "
+	if !recursive {
+		flag = ""
+	}
+	if _, err = target.sshcli.Run(fmt.Sprintf("chcon %s%s %s", flag, utils.ShellQuote(context), utils.ShellQuoteAll(paths))); err != nil {
+		return errors.New(fmt.Sprintf("relabel on node %s failed: %s", target.NodeIP, err))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"reflect"
+	"testing"
+)
+
+func TestSeLinuxOptions(t *testing.T) {
+	podLevel := &corev1.SELinuxOptions{Level: "s0:c1,c2"}
+	containerLevel := &corev1.SELinuxOptions{Level: "s0:c3,c4"}
+	volume := &corev1.Volume{Name: "data"}
+	container := func(mount string, opts *corev1.SELinuxOptions) corev1.Container {
+		c := corev1.Container{VolumeMounts: []corev1.VolumeMount{{Name: mount}}}
+		if opts != nil {
+			c.SecurityContext = &corev1.SecurityContext{SELinuxOptions: opts}
+		}
+		return c
+	}
+	tests := []struct {
+		name string
+		pod  corev1.PodSpec
+		want *corev1.SELinuxOptions
+	}{
+		{name: "none", pod: corev1.PodSpec{Containers: []corev1.Container{container("data", nil)}}},
+		{
+			name: "pod",
+			pod: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{SELinuxOptions: podLevel},
+				Containers:      []corev1.Container{container("data", nil)},
+			},
+			want: podLevel,
+		},
+		{
+			name: "container which mounts the volume wins",
+			pod: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{SELinuxOptions: podLevel},
+				Containers:      []corev1.Container{container("data", containerLevel)},
+			},
+			want: containerLevel,
+		},
+		{
+			name: "container which doesn't mount the volume",
+			pod: corev1.PodSpec{
+				SecurityContext: &corev1.PodSecurityContext{SELinuxOptions: podLevel},
+				Containers:      []corev1.Container{container("other", containerLevel), container("data", nil)},
+			},
+			want: podLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := seLinuxOptions(&corev1.Pod{Spec: tt.pod}, volume); got != tt.want {
+				t.Errorf("seLinuxOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXattrArgs(t *testing.T) {
+	tests := []struct {
+		opts TransferOptions
+		want []string
+	}{
+		{opts: TransferOptions{}},
+		{opts: TransferOptions{Xattrs: true}, want: []string{"-X"}},
+		{opts: TransferOptions{ACLs: true}, want: []string{"-A"}},
+		{opts: TransferOptions{Xattrs: true, ACLs: true}, want: []string{"-X", "-A"}},
+	}
+	for _, tt := range tests {
+		s := &Server{opts: tt.opts, log: testLogger()}
+		if got := s.rsyncTuningArgs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rsyncTuningArgs() with %+v = %q, want %q", tt.opts, got, tt.want)
+		}
+		// scp can't keep them, it only warns
+		if got := s.scpTuningArgs(); got != nil {
+			t.Errorf("scpTuningArgs() with %+v = %q, want none", tt.opts, got)
+		}
+	}
+}
+
+func TestValidateRelabel(t *testing.T) {
+	for action, wantErr := range map[string]bool{TransferTo: false, TransferPut: false, TransferSync: false, TransferFrom: true, TransferCat: true} {
+		s := &Server{action: action, opts: TransferOptions{SELinuxRelabel: true}}
+		if err := s.validateOwnership(); (err != nil) != wantErr {
+			t.Errorf("validateOwnership() of %s with selinux-relabel error = %v, wantErr %v", action, err, wantErr)
+		}
+	}
+}
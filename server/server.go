@@ -24,12 +24,19 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
 	remote "sync-volume-data/remote_execute"
 	"sync-volume-data/utils"
 	"syscall"
+	"time"
 )
 
 type TransferAction string
@@ -39,8 +46,78 @@ const (
 	TransferFrom = "from"
 )
 
+// TransferOptions holds the knobs that tune how data is moved, whatever the transport is
+type TransferOptions struct {
+	// BwLimit is a human readable rate such as 20MiB/s, empty means unlimited. BwLimitScope tells what shares it:
+	// every stream of the command (global) or the streams to and from the same node (node)
+	BwLimit      string
+	BwLimitScope string
+	// Compress is the in-transit compression algorithm, gzip or zstd, empty means none
+	Compress string
+	// CompressLevel is the compression level, 0 means the default level of the algorithm
+	CompressLevel int
+	// Output selects how the progress is rendered, text or json
+	Output string
+	// Chown is "auto", "uid", "uid:gid" or ":gid", applied on the node after a "to" transfer
+	Chown string
+	// Chmod is a comma separated list of chmod rules, D/F prefixed rules only match directories/files
+	Chmod string
+	// NumericIDs keeps uid/gid as numbers instead of mapping them by user/group name
+	NumericIDs bool
+	// SELinuxRelabel relabels the pushed files with the selinux context the pod expects
+	SELinuxRelabel bool
+	// Xattrs and ACLs preserve extended attributes and posix ACLs, rsync only
+	Xattrs bool
+	ACLs   bool
+	// Atomic uploads into a staging directory of the volume and swaps it into place, AtomicMode is symlink or rename
+	Atomic     bool
+	AtomicMode string
+	// Keys encrypt backups and snapshots with age, and decrypt them on restore
+	Keys *backup.Keys
+	// EncryptPull writes the data of a "from" transfer as an archive encrypted with Keys instead of plain files
+	EncryptPull bool
+	// Watch keeps pushing the local sources after the first transfer whenever they change, WatchDebounce is
+	// how long the sources must stay quiet before the changes are pushed
+	Watch         bool
+	WatchDebounce time.Duration
+	// PreHook and PostHook are shell commands run in the container of the pod before and after the transfer,
+	// HookFailure tells what a failing hook does: abort or continue
+	PreHook       string
+	PostHook      string
+	HookContainer string
+	HookTimeout   time.Duration
+	HookFailure   string
+	// Quiesce stops the workload during the transfer, which goes through a temporary pod mounting the volume and
+	// running QuiesceImage. QuiesceTimeout bounds every wait for pods and for the workload to be ready again.
+	Quiesce        bool
+	QuiesceTimeout time.Duration
+	QuiesceImage   string
+	// Restart restarts the pods of the workload after a successful transfer and waits up to RestartTimeout for the
+	// rollout to complete
+	Restart        bool
+	RestartTimeout time.Duration
+	// WaitLock is how long to wait for the lock of a volume someone else is writing into, 0 fails at once.
+	// ForceUnlock takes the lock whoever holds it.
+	WaitLock    time.Duration
+	ForceUnlock bool
+	// AnnotateClaim stamps the PVC after a write with the time, the writer and a digest of the volume listing
+	AnnotateClaim bool
+}
+
+const (
+	BwLimitGlobal = "global"
+	BwLimitNode   = "node"
+)
+
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
 type Server struct {
 	kubeclient    *kubernetes.Clientset
+	restConfig    *rest.Config
 	sshuser       string
 	sshpwd        string
 	sshPort       string
@@ -54,16 +131,37 @@ type Server struct {
 	errMsg        []error
 	action        string
 	log           *logrus.Entry
+	opts          TransferOptions
+	// bwLimit is opts.BwLimit parsed into bytes per second
+	bwLimit  int64
+	reporter progress.Reporter
+	// progress2 tells whether the local rsync reports the progress of the whole transfer, see rsyncHasProgress2
+	progress2 bool
+	// who runs the transfers, see identity
+	who *Identity
+	// scope is set while the lock of the volume is held, see withLock
+	scope *lockScope
 }
 
 func NewServer(tool, sshuser, sshpwd, sshPort, namespace, resourceKind, resourceName, volume string, sourceDir *[]string,
-	instanceIndex int, logger *logrus.Entry, action string) *Server {
-	errMsg := new([]error)
+	instanceIndex int, logger *logrus.Entry, action string, opts TransferOptions) *Server {
+	return NewServerForCluster(utils.NewRestConfig(), tool, sshuser, sshpwd, sshPort, namespace, resourceKind, resourceName, volume,
+		sourceDir, instanceIndex, logger, action, opts)
+}
 
-	kubeclient := utils.NewClientset()
+// NewServerForCluster is NewServer against the cluster of config instead of the one of --kubeconfig
+func NewServerForCluster(config *rest.Config, tool, sshuser, sshpwd, sshPort, namespace, resourceKind,
+	resourceName, volume string, sourceDir *[]string, instanceIndex int, logger *logrus.Entry, action string,
+	opts TransferOptions) *Server {
+	errMsg := new([]error)
+	kubeclient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logger.Fatalf("get clientset failed: %s", err.Error())
+	}
 
 	return &Server{
 		kubeclient:    kubeclient,
+		restConfig:    config,
 		tool:          tool,
 		namespace:     namespace,
 		resourceKind:  resourceKind,
@@ -77,6 +175,7 @@ func NewServer(tool, sshuser, sshpwd, sshPort, namespace, resourceKind, resource
 		errMsg:        *errMsg,
 		log:           logger,
 		action:        action,
+		opts:          opts,
 	}
 }
 
@@ -95,14 +194,66 @@ const (
 	podKind         = "Pod"
 )
 
+// Target is a volume resolved down to the directory of the node which hosts it
+type Target struct {
+	Pod    *corev1.Pod
+	Volume *corev1.Volume
+	NodeIP string
+	// VolumePath is the actual directory of the volume on the node
+	VolumePath string
+	sshcli     *remote.Cli
+}
+
 func (s *Server) Run() {
 	s.validateParameter()
-	var pod *corev1.Pod
-	var err error
-	var volume *corev1.Volume
-	var nodeIP string
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	target, err := s.resolveTarget()
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+
+	err = s.guardTransfer(target, func(target *Target) error {
+		if s.action == TransferFrom && s.opts.EncryptPull {
+			return s.pullEncrypted(target)
+		} else if s.opts.Watch {
+			return s.watch(target)
+		}
+		return s.transfer(target)
+	})
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+// guardTransfer runs transfer with what surrounds every transfer of the volume: it is recorded as events, the
+// volume is locked, the workload is quiesced and the hooks run around it, the workload is restarted after it. With
+// --quiesce transfer gets the target of the temporary pod.
+func (s *Server) guardTransfer(target *Target, transfer func(target *Target) error) error {
+	return s.withEvents(target, func() error {
+		return s.withLock(target, func() error {
+			err := s.withQuiesce(target, func(target *Target) error {
+				return s.withHooks(target, func() error {
+					if err := transfer(target); err != nil {
+						return err
+					}
+					s.annotateClaim(target)
+					return nil
+				})
+			})
+			if err == nil && s.opts.Restart {
+				err = s.restartWorkload()
+			}
+			return err
+		})
+	})
+}
+
+// volumePod finds the pod of the resource which mounts the volume
+func (s *Server) volumePod() (*corev1.Volume, *corev1.Pod, error) {
 	var sourceExec resourceInfoer
-	defaultRootDir := "/var/lib/kubelet/pods/"
 
 	if s.resourceKind == deployKind {
 		sourceExec = NewDeployServer(s.namespace, s.resourceName, s.volume, s.kubeclient, s.log)
@@ -114,42 +265,78 @@ func (s *Server) Run() {
 	} else if s.resourceKind == podKind {
 		sourceExec = NewPodServer(s.namespace, s.resourceName, s.volume, s.kubeclient)
 	}
+	return sourceExec.getVolumePod()
+}
 
-	volume, pod, err = sourceExec.getVolumePod()
+// resolveTarget finds the pod, the node and the directory on the node of the volume
+func (s *Server) resolveTarget() (*Target, error) {
+	volume, pod, err := s.volumePod()
 	if err != nil {
-		s.log.Fatal(err)
+		return nil, err
 	}
+	return s.podTarget(volume, pod)
+}
+
+// podTarget finds the node and the directory on the node of the volume mounted by pod
+func (s *Server) podTarget(volume *corev1.Volume, pod *corev1.Pod) (*Target, error) {
+	defaultRootDir := "/var/lib/kubelet/pods/"
 
-	nodeIP, err = s.getNodeIPFromPod(pod)
+	nodeIP, err := s.getNodeIPFromPod(pod)
 	if err != nil {
-		s.log.Fatal(err)
+		return nil, err
 	}
 	s.log.Infof("get node ip %s from pod %s", nodeIP, pod.Name)
 
-	volumeDir, err := s.GetVolumeDirectory(volume)
+	volumeDir, err := s.GetVolumeDirectory(volume, pod)
 	if err != nil {
-		s.log.Fatal(err)
+		return nil, err
 	}
 
 	volumePath := defaultRootDir + string(pod.UID) + "/volumes/*/" + volumeDir
 	s.log.Infof("get volume path: %s", volumePath)
 
-	//for debug
-	//nodeIP = "180.184.65.175"
-	//nodeIP = "180.184.64.139"
 	//TODO, now only support password method,key method will be supported later
 	sshcli := remote.NewCli(s.sshuser, s.sshpwd, fmt.Sprintf("%s:%s", nodeIP, s.sshPort), remote.SshPassword, "")
+	s.stopOnLockLoss(sshcli)
 
 	//get only a row as expected
 	actualVolumePath, err := sshcli.Run(fmt.Sprintf("ls -d %s | awk 'NR=1{printf $NF}'", volumePath))
 	if err != nil {
-		s.log.Fatal("get err from remote node %s : %s", nodeIP, err.Error())
+		return nil, errors.New(fmt.Sprintf("get err from remote node %s : %s", nodeIP, err.Error()))
 	}
 
 	s.log.Infof("get volume path from remote node: %s", actualVolumePath)
 
-	var args []string
-	command := s.tool
+	target := &Target{
+		Pod:        pod,
+		Volume:     volume,
+		NodeIP:     nodeIP,
+		VolumePath: actualVolumePath,
+		sshcli:     sshcli,
+	}
+	s.auditTarget(target)
+	return target, nil
+}
+
+// progressTarget converts target into the description used by the progress reporter
+func (s *Server) progressTarget(target *Target) progress.Target {
+	return progress.Target{
+		Namespace:  s.namespace,
+		Kind:       s.resourceKind,
+		Name:       s.resourceName,
+		Pod:        target.Pod.Name,
+		Node:       target.Pod.Spec.NodeName,
+		NodeIP:     target.NodeIP,
+		Volume:     s.volume,
+		VolumePath: target.VolumePath,
+	}
+}
+
+// transferArgs builds the command line of the rsync/scp process
+func (s *Server) transferArgs(target *Target) (command string, args []string) {
+	nodeIP := target.NodeIP
+	actualVolumePath := target.VolumePath
+	command = s.tool
 
 	if s.tool == "scp" {
 		args = []string{
@@ -157,6 +344,7 @@ func (s *Server) Run() {
 			"-P",
 			s.sshPort,
 		}
+		args = append(args, s.scpTuningArgs()...)
 		if s.action == TransferTo {
 			for _, file := range *s.sourceDir {
 				args = append(args, file)
@@ -180,6 +368,15 @@ func (s *Server) Run() {
 			"--progress",
 			"-e", fmt.Sprintf("ssh -p %s", s.sshPort),
 		}
+		if s.progress2 {
+			// report the progress of the whole transfer instead of per file, needs rsync >= 3.1.0
+			args = append(args, "--info=progress2")
+		}
+		args = append(args, s.rsyncTuningArgs()...)
+		if s.opts.Atomic && s.opts.AtomicMode == AtomicRename {
+			// the staging directory lives in the volume, unchanged files are copied on the node instead of uploaded
+			args = append(args, "--copy-dest=..")
+		}
 		if s.action == TransferTo {
 			for _, file := range *s.sourceDir {
 				args = append(args, file)
@@ -197,43 +394,200 @@ func (s *Server) Run() {
 			args = append(args, ".")
 		}
 	}
+	return command, args
+}
+
+// transfer runs rsync/scp against target and reports its progress
+func (s *Server) transfer(target *Target) (err error) {
+	dest := target
+	if s.opts.Atomic {
+		if dest, err = s.prepareStaging(target); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				s.dropStaging(dest)
+			}
+		}()
+	}
+
+	if s.tool == "rsync" {
+		s.progress2 = rsyncHasProgress2()
+	}
+	command, args := s.transferArgs(dest)
 	s.log.Infof("execute command: %s args: %s", command, args)
 
-	cmd := exec.Command(command, args...)
+	startTime := time.Now()
+	start := progress.Start{Tool: s.tool, Action: s.action, Target: s.progressTarget(target)}
+	if s.action == TransferTo {
+		_, start.TotalBytes = localSize(*s.sourceDir)
+	}
+	s.reporter.Start(start)
+
+	// the process is killed when the lock of the volume is lost
+	cmd := exec.CommandContext(s.context(), command, args...)
 	// 命令的错误输出和标准输出都连接到同一个管道
 	stdout, err := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
 	if err != nil {
-		s.log.Fatal(err.Error())
+		return err
 	}
 
 	if err = cmd.Start(); err != nil {
-		s.log.Fatal(err.Error())
-	}
-	// Get the output from the pipe in real time and print it to the terminal
-	for {
-		tmp := make([]byte, 2048)
-		_, err := stdout.Read(tmp)
-		fmt.Print(string(tmp))
-		if err != nil {
-			break
-		}
+		return err
 	}
+	// Get the output from the pipe in real time and turn it into progress events
+	stats := s.watchOutput(stdout, start.TotalBytes)
 
 	if err = cmd.Wait(); err != nil {
 		if ex, ok := err.(*exec.ExitError); ok {
 			res := ex.Sys().(syscall.WaitStatus).ExitStatus() //获取命令执行返回状态，相当于shell: echo $?
-			fmt.Println("#####################################################################################")
-			s.log.Errorf("sync data failed, exit code is %d, err: %s", res, err)
-			return
+			return errors.New(fmt.Sprintf("sync data failed, exit code is %d, err: %s", res, err))
+		}
+		return err
+	}
+
+	if err = s.postTransfer(dest); err != nil {
+		return err
+	}
+
+	if s.opts.Atomic {
+		if err = s.swapIn(target, dest); err != nil {
+			return err
+		}
+	}
+
+	if s.tool != "rsync" {
+		// scp doesn't report anything, count what has been sent or received instead
+		if s.action == TransferTo {
+			stats.files, stats.bytes = localSize(*s.sourceDir)
+		} else {
+			var local []string
+			for _, file := range *s.sourceDir {
+				local = append(local, filepath.Base(file))
+			}
+			stats.files, stats.bytes = localSize(local)
+		}
+	}
+
+	s.reporter.Done(progress.Summary{
+		Tool:     s.tool,
+		Action:   s.action,
+		Target:   start.Target,
+		Files:    stats.files,
+		Bytes:    stats.bytes,
+		Duration: time.Since(startTime),
+	})
+	s.log.Infof("sync data %s pod volume succeed !!", s.action)
+	return nil
+}
+
+// postTransfer fixes up what has been written into the volume
+func (s *Server) postTransfer(target *Target) error {
+	if s.action != TransferTo {
+		return nil
+	}
+
+	paths := s.pushedPaths(target)
+	if err := s.applyOwnership(target, paths); err != nil {
+		return err
+	}
+	return s.relabel(target, paths)
+}
+
+// limiter returns the limiter of the streams this tool reads from or writes to the node of target
+func (s *Server) limiter(target *Target) *utils.RateLimiter {
+	return sharedLimiter(s.bwLimit, s.opts.BwLimitScope, s.restConfig, target)
+}
+
+// sharedLimiter returns the limiter of rate all the streams of scope draw from, with the node scope one per node
+// of the cluster of config
+func sharedLimiter(rate int64, scope string, config *rest.Config, target *Target) *utils.RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	key := BwLimitGlobal
+	if scope == BwLimitNode {
+		key = config.Host + "/" + target.Pod.Spec.NodeName
+	}
+	return utils.SharedRateLimiter(key, rate)
+}
+
+// rsyncTuningArgs maps the bandwidth and compression options to rsync flags
+func (s *Server) rsyncTuningArgs() (args []string) {
+	if s.bwLimit > 0 {
+		// rsync takes KiB/s, round up so that a small limit never turns into "unlimited"
+		args = append(args, fmt.Sprintf("--bwlimit=%d", (s.bwLimit+1023)/1024))
+	}
+
+	if s.opts.NumericIDs {
+		if s.action == TransferFrom && os.Geteuid() != 0 {
+			s.log.Warnf("numeric-ids only keeps the ownership of pulled files when run as root, they belong to the local user")
 		}
+		args = append(args, "--numeric-ids")
+	}
+	if s.opts.Xattrs {
+		args = append(args, "-X")
+	}
+	if s.opts.ACLs {
+		args = append(args, "-A")
+	}
+
+	switch s.opts.Compress {
+	case CompressGzip:
+		args = append(args, "-z")
+	case CompressZstd:
+		// --compress-choice requires rsync >= 3.2.0 on both sides
+		args = append(args, "-z", "--compress-choice=zstd")
+	default:
+		return args
 	}
 
-	fmt.Println("#####################################################################################")
-	s.log.Infof("sync data to pod volume succeed !!")
+	if s.opts.CompressLevel > 0 {
+		args = append(args, fmt.Sprintf("--compress-level=%d", s.opts.CompressLevel))
+	}
+	return args
+}
+
+// scpTuningArgs maps the bandwidth and compression options to scp flags
+func (s *Server) scpTuningArgs() (args []string) {
+	if s.bwLimit > 0 {
+		// scp takes Kbit/s
+		kbits := s.bwLimit * 8 / 1000
+		if kbits < 1 {
+			kbits = 1
+		}
+		args = append(args, "-l", strconv.FormatInt(kbits, 10))
+	}
+
+	if s.opts.NumericIDs {
+		s.log.Warnf("scp doesn't preserve ownership, ignore numeric-ids")
+	}
+	if s.opts.Xattrs || s.opts.ACLs {
+		s.log.Warnf("scp doesn't preserve xattrs and ACLs, use rsync instead")
+	}
+
+	if s.opts.Compress == CompressGzip || s.opts.Compress == CompressZstd {
+		if s.opts.Compress == CompressZstd {
+			s.log.Warnf("scp only supports the zlib compression of ssh, use gzip instead of zstd")
+		}
+		if s.opts.CompressLevel > 0 {
+			s.log.Warnf("scp can't set the compression level, ignore compress-level %d", s.opts.CompressLevel)
+		}
+		args = append(args, "-C")
+	}
+	return args
 }
 
 func (s *Server) validateParameter() {
+	s.validateTarget()
+	s.ValidateSourceDir()
+	s.ValidateTransferOptions()
+	s.exitOnInvalid()
+}
+
+// validateTarget checks the parameters which select the volume
+func (s *Server) validateTarget() {
 	//s.ValidateTool()
 	s.ValidateSshPwd()
 	s.ValidateNamespace()
@@ -241,13 +595,15 @@ func (s *Server) validateParameter() {
 	s.ValidateSourceName()
 	s.ValidateVolume()
 	s.ValidateInstanceIndex()
-	s.ValidateSourceDir()
+}
 
+// exitOnInvalid prints every validation error and exits if there is any
+func (s *Server) exitOnInvalid() {
 	if len(s.errMsg) > 0 {
 		for _, err := range s.errMsg {
 			s.log.Errorf(err.Error())
 		}
-		os.Exit(1)
+		audit.Exit(1)
 	}
 }
 
@@ -273,31 +629,55 @@ func (s *Server) getNodeIPFromPod(pod *corev1.Pod) (nodeIP string, err error) {
 	return nodeIP, nil
 }
 
-func (s *Server) GetVolumeDirectory(volume *corev1.Volume) (string, error) {
-	// This case implies the administrator created the PV and attached it directly, without PVC.
-	// Note that only one VolumeSource can be populated per Volume on a pod
-	if volume.VolumeSource.PersistentVolumeClaim == nil {
-		if volume.VolumeSource.CSI != nil {
-			return volume.Name + "/mount", nil
-		}
-		return volume.Name, nil
-	}
-
-	// Most common case is that we have a PVC VolumeSource, and we need to check the PV it points to for a CSI source.
-	pvc, err := s.kubeclient.CoreV1().PersistentVolumeClaims(s.namespace).Get(context.TODO(), volume.VolumeSource.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+func (s *Server) GetVolumeDirectory(volume *corev1.Volume, pod *corev1.Pod) (string, error) {
+	_, pv, err := s.volumeClaim(s.namespace, pod, volume)
 	if err != nil {
 		return "", err
 	}
+	return volumeDirectory(volume, pv), nil
+}
+
+// volumeClaim returns the PVC and the PV of a volume of pod, both are nil for a volume without any claim. A generic
+// ephemeral volume is backed by the PVC <pod>-<volume>.
+func (s *Server) volumeClaim(namespace string, pod *corev1.Pod, volume *corev1.Volume) (*corev1.PersistentVolumeClaim, *corev1.PersistentVolume, error) {
+	var claimName string
+	if volume.VolumeSource.PersistentVolumeClaim != nil {
+		claimName = volume.VolumeSource.PersistentVolumeClaim.ClaimName
+	} else if volume.VolumeSource.Ephemeral != nil {
+		claimName = pod.Name + "-" + volume.Name
+	} else {
+		return nil, nil, nil
+	}
 
+	pvc, err := s.kubeclient.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if pvc.Spec.VolumeName == "" {
+		return nil, nil, errors.New(fmt.Sprintf("pvc %s is not bound to a pv", claimName))
+	}
 	pv, err := s.kubeclient.CoreV1().PersistentVolumes().Get(context.TODO(), pvc.Spec.VolumeName, metav1.GetOptions{})
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	return pvc, pv, nil
+}
+
+// volumeDirectory is the directory of a volume under /var/lib/kubelet/pods/<podUID>/volumes/<volume-plugin-name>/,
+// pv is nil for a volume without a claim
+func volumeDirectory(volume *corev1.Volume, pv *corev1.PersistentVolume) string {
+	// This case implies the administrator created the PV and attached it directly, without PVC.
+	// Note that only one VolumeSource can be populated per Volume on a pod
+	if pv == nil {
+		if volume.VolumeSource.CSI != nil {
+			return volume.Name + "/mount"
+		}
+		return volume.Name
 	}
 
 	// PV's been created with a CSI source.
 	if pv.Spec.CSI != nil {
-		return pvc.Spec.VolumeName + "/mount", nil
+		return pv.Name + "/mount"
 	}
-
-	return pvc.Spec.VolumeName, nil
+	return pv.Name
 }
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"reflect"
+	"testing"
+)
+
+func testLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logrus.NewEntry(logger)
+}
+
+func nodeTarget(node string) *Target {
+	return &Target{Pod: &corev1.Pod{Spec: corev1.PodSpec{NodeName: node}}}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	a := &rest.Config{Host: "https://cluster-a:6443"}
+	b := &rest.Config{Host: "https://cluster-b:6443"}
+
+	if l := sharedLimiter(0, BwLimitGlobal, a, nodeTarget("node-1")); l != nil {
+		t.Errorf("sharedLimiter() without a rate = %v, want nil", l)
+	}
+	if sharedLimiter(1024, BwLimitGlobal, a, nodeTarget("node-1")) != sharedLimiter(1024, BwLimitGlobal, b, nodeTarget("node-2")) {
+		t.Errorf("the global scope uses more than one limiter")
+	}
+
+	node1 := sharedLimiter(1024, BwLimitNode, a, nodeTarget("node-1"))
+	if node1 != sharedLimiter(1024, BwLimitNode, a, nodeTarget("node-1")) {
+		t.Errorf("the node scope uses another limiter for the same node")
+	}
+	if node1 == sharedLimiter(1024, BwLimitNode, a, nodeTarget("node-2")) {
+		t.Errorf("the node scope shares the limiter of two nodes")
+	}
+	// the same node name in another cluster is another node
+	if node1 == sharedLimiter(1024, BwLimitNode, b, nodeTarget("node-1")) {
+		t.Errorf("the node scope shares the limiter of two clusters")
+	}
+}
+
+func TestTuningArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		bwLimit   int64
+		opts      TransferOptions
+		wantRsync []string
+		wantScp   []string
+	}{
+		{name: "none"},
+		{
+			name:      "bwlimit",
+			bwLimit:   20 << 20,
+			wantRsync: []string{"--bwlimit=20480"},
+			wantScp:   []string{"-l", "167772"},
+		},
+		{
+			name:      "small bwlimit",
+			bwLimit:   100,
+			wantRsync: []string{"--bwlimit=1"},
+			wantScp:   []string{"-l", "1"},
+		},
+		{
+			name:      "gzip",
+			opts:      TransferOptions{Compress: CompressGzip, CompressLevel: 6},
+			wantRsync: []string{"-z", "--compress-level=6"},
+			wantScp:   []string{"-C"},
+		},
+		{
+			name:      "zstd",
+			bwLimit:   1024,
+			opts:      TransferOptions{Compress: CompressZstd},
+			wantRsync: []string{"--bwlimit=1", "-z", "--compress-choice=zstd"},
+			wantScp:   []string{"-l", "8", "-C"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{bwLimit: tt.bwLimit, opts: tt.opts, log: testLogger()}
+			if got := s.rsyncTuningArgs(); !reflect.DeepEqual(got, tt.wantRsync) {
+				t.Errorf("rsyncTuningArgs() = %q, want %q", got, tt.wantRsync)
+			}
+			if got := s.scpTuningArgs(); !reflect.DeepEqual(got, tt.wantScp) {
+				t.Errorf("scpTuningArgs() = %q, want %q", got, tt.wantScp)
+			}
+		})
+	}
+}
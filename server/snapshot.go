@@ -0,0 +1,275 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"time"
+)
+
+// SnapshotLatest restores the newest snapshot of the volume
+const SnapshotLatest = "latest"
+
+// Snapshot backs up the volume into repo as an incremental snapshot
+func (s *Server) Snapshot(repo *backup.Repository) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	s.exitOnInvalid()
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	target, err := s.resolveTarget()
+	if err == nil {
+		err = s.guardTransfer(target, func(target *Target) error { return s.snapshot(target, repo) })
+	}
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+// latestSnapshot returns the newest snapshot of the volume in repo, nil when there is none
+func (s *Server) latestSnapshot(repo *backup.Repository, meta backup.Metadata) (*backup.Listing, error) {
+	snapshots, skipped, err := repo.Snapshots(fmt.Sprintf("%s/%s/%s/", meta.Namespace, meta.Name, meta.Volume))
+	if err != nil {
+		return nil, err
+	}
+	for name, err := range skipped {
+		s.log.Warnf("skip snapshot %s: %s", name, err)
+	}
+	for i := range snapshots {
+		m := snapshots[i].Metadata
+		if m.Kind == meta.Kind && m.InstanceIndex == meta.InstanceIndex {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// snapshot lists the volume on the node, reads the files changed since the parent snapshot and stores their
+// new chunks, the other files reuse the chunks of the parent
+func (s *Server) snapshot(target *Target, repo *backup.Repository) error {
+	// a prune running at the same time could remove the chunks the snapshot reuses
+	unlock, err := repo.Lock(backup.LockBackup)
+	if err != nil {
+		if _, ok := err.(*backup.LockedError); ok {
+			return errors.New(fmt.Sprintf("%s, run the backup again when the prune is over", err))
+		}
+		return err
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			s.log.Warnf("unlock repository failed: %s", err)
+		}
+	}()
+
+	snap := &backup.Snapshot{Metadata: s.backupMetadata(target)}
+	snap.Metadata.Compression = backup.CompressZstd
+	var parent *backup.Tree
+	latest, err := s.latestSnapshot(repo, snap.Metadata)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		if parent, err = repo.LoadTree(latest.Snapshot.Tree); err != nil {
+			return err
+		}
+		snap.Parent = latest.Name
+		s.log.Infof("parent snapshot is %s", latest.Name)
+	}
+
+	var listing, stderr bytes.Buffer
+	find := fmt.Sprintf("find %s -mindepth 1 -printf %s", utils.ShellQuote(target.VolumePath), utils.ShellQuote(backup.FindFormat))
+	if err = target.sshcli.Stream(find, nil, &listing, &stderr); err != nil {
+		return errors.New(fmt.Sprintf("list volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	nodes, err := backup.ReadNodes(&listing)
+	if err != nil {
+		return err
+	}
+	tree := &backup.Tree{Nodes: nodes}
+	changed := backup.Plan(tree.Nodes, parent)
+
+	var total int64
+	sizes := make(map[string]int64, len(tree.Nodes))
+	for _, node := range tree.Nodes {
+		sizes[node.Path] = node.Size
+	}
+	for _, name := range changed {
+		total += sizes[name]
+	}
+	s.log.Infof("%d entries in the volume, %d files changed since the parent snapshot", len(tree.Nodes), len(changed))
+
+	startTime := time.Now()
+	start := progress.Start{Tool: "backup", Action: TransferFrom, Target: s.progressTarget(target), TotalBytes: total}
+	s.reporter.Start(start)
+
+	if len(changed) > 0 {
+		if err = s.readChanged(target, repo, tree, changed, total, &snap.Stats); err != nil {
+			return err
+		}
+	}
+
+	name, err := repo.Commit(snap, tree)
+	if err != nil {
+		return err
+	}
+
+	s.reporter.Done(progress.Summary{
+		Tool:     "backup",
+		Action:   TransferFrom,
+		Target:   start.Target,
+		Files:    snap.Stats.ChangedFiles,
+		Bytes:    snap.Stats.ReadBytes,
+		Duration: time.Since(startTime),
+	})
+	s.log.Infof("snapshot %s of volume %s succeed !! %d files (%s), %d changed, %d new chunks (%s)", name, s.volume,
+		snap.Stats.Files, progress.HumanBytes(snap.Stats.TotalBytes), snap.Stats.ChangedFiles, snap.Stats.NewChunks,
+		progress.HumanBytes(snap.Stats.NewBytes))
+	return nil
+}
+
+// readChanged streams a tar of the changed files from the node into the repository
+func (s *Server) readChanged(target *Target, repo *backup.Repository, tree *backup.Tree, changed []string, total int64, stats *backup.SnapshotStats) error {
+	pr, pw := io.Pipe()
+	counter := utils.NewCountingReader(pr)
+	srcErr := make(chan error, 1)
+	go func() {
+		var stderr bytes.Buffer
+		// a file removed since the listing is only a warning of tar, it is left out of the snapshot
+		shell := fmt.Sprintf("tar -C %s --null --no-recursion --hard-dereference --ignore-failed-read -T - -cf -",
+			utils.ShellQuote(target.VolumePath))
+		err := target.sshcli.Stream(shell, backup.ChangedList(changed), pw, &stderr)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("read volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+		}
+		pw.CloseWithError(err)
+		srcErr <- err
+	}()
+
+	done := make(chan struct{})
+	go reportRelayProgress(s.reporter, counter, total, done)
+
+	limiter := s.limiter(target)
+	err := repo.StoreFiles(tree, changed, limiter.Reader(counter), stats, func(name string, size int64) {
+		s.reporter.File(name)
+	})
+	close(done)
+	if err == nil {
+		io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(io.ErrClosedPipe)
+	if e := <-srcErr; e != nil {
+		return e
+	}
+	return err
+}
+
+// RestoreSnapshot puts the snapshot name of repo back into the volume, name latest means the newest snapshot of
+// the volume. verify reads every chunk before anything is written to the volume.
+func (s *Server) RestoreSnapshot(repo *backup.Repository, name string, verify bool) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	s.exitOnInvalid()
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	target, err := s.resolveTarget()
+	if err == nil {
+		err = s.guardTransfer(target, func(target *Target) error { return s.restoreSnapshot(target, repo, name, verify) })
+	}
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+func (s *Server) restoreSnapshot(target *Target, repo *backup.Repository, name string, verify bool) error {
+	var snap *backup.Snapshot
+	if name == SnapshotLatest {
+		meta := s.backupMetadata(target)
+		latest, err := s.latestSnapshot(repo, meta)
+		if err != nil {
+			return err
+		}
+		if latest == nil {
+			return errors.New(fmt.Sprintf("no snapshot of %s/%s volume %s in %s", s.namespace, s.resourceName, s.volume, repo))
+		}
+		name, snap = latest.Name, latest.Snapshot
+	} else {
+		var err error
+		if snap, err = repo.LoadSnapshot(name); err != nil {
+			return err
+		}
+	}
+	s.log.Infof("restore snapshot %s", name)
+	s.checkOrigin(snap.Metadata)
+
+	tree, err := repo.LoadTree(snap.Tree)
+	if err != nil {
+		return err
+	}
+	if verify {
+		if err = repo.Check(tree); err != nil {
+			return err
+		}
+		s.log.Infof("verify snapshot %s succeed, %d files", name, snap.Stats.Files)
+	}
+
+	startTime := time.Now()
+	start := progress.Start{Tool: "restore", Action: TransferTo, Target: s.progressTarget(target), TotalBytes: snap.Stats.TotalBytes}
+	s.reporter.Start(start)
+
+	files := 0
+	var skipped []string
+	err = s.extractOnNode(target, snap.Stats.TotalBytes, func(w io.Writer) error {
+		var err error
+		skipped, err = repo.WriteTar(w, tree, func(name string, size int64, sum string) {
+			files++
+			s.reporter.File(name)
+			audit.AddHash(name, sum)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		s.log.Warnf("%d special files such as devices or sockets are not restored", len(skipped))
+	}
+
+	restored := make([]string, 0, len(tree.Nodes))
+	for _, node := range tree.Nodes {
+		restored = append(restored, node.Path)
+	}
+	return s.finishRestore(target, progress.Summary{
+		Tool:     "restore",
+		Action:   TransferTo,
+		Target:   start.Target,
+		Files:    files,
+		Bytes:    snap.Stats.TotalBytes,
+		Duration: time.Since(startTime),
+	}, restored)
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"syscall"
+	"time"
+)
+
+const (
+	TransferCat = "cat"
+	TransferPut = "put"
+)
+
+// CatOptions selects the part of a file cat streams
+type CatOptions struct {
+	Path string
+	// Offset is where to start, counted from the end of the file when negative
+	Offset int64
+	// Length is the number of bytes to read, 0 reads up to the end
+	Length int64
+	// Follow keeps streaming what is appended to the file, like tail -F
+	Follow bool
+}
+
+// Cat streams a file of the volume into w
+func (s *Server) Cat(opts CatOptions, w io.Writer) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	if opts.Length < 0 {
+		s.errMsg = append(s.errMsg, errors.New("length cannot be negative"))
+	}
+	if opts.Follow && opts.Length > 0 {
+		s.errMsg = append(s.errMsg, errors.New("length cannot be used with follow"))
+	}
+	rel, err := streamPath(opts.Path)
+	if err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	s.exitOnInvalid()
+
+	target, err := s.resolveTarget()
+	var file string
+	if err == nil {
+		file, err = resolveInVolume(target, path.Join(target.VolumePath, rel))
+	}
+	if err == nil {
+		err = s.cat(target, file, opts, w)
+	}
+	if err != nil {
+		s.log.Fatal(err)
+	}
+}
+
+func (s *Server) cat(target *Target, file string, opts CatOptions, w io.Writer) error {
+	var stdin io.Reader
+	if opts.Follow {
+		// the ssh channel gets no signal when we go away, tail is killed once its stdin is closed instead
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupt)
+		go func() {
+			if _, ok := <-interrupt; ok {
+				pw.Close()
+			}
+		}()
+		stdin = pr
+	}
+	shell := catScript(file, opts)
+
+	pr, pw := io.Pipe()
+	srcErr := make(chan error, 1)
+	go func() {
+		var stderr io.Writer = &bytes.Buffer{}
+		if opts.Follow {
+			// tail -F reports truncation and rotation while it runs
+			stderr = os.Stderr
+		}
+		err := target.sshcli.Stream(shell, stdin, pw, stderr)
+		if err != nil {
+			msg := ""
+			if buf, ok := stderr.(*bytes.Buffer); ok {
+				msg = strings.TrimSpace(buf.String())
+			}
+			err = errors.New(fmt.Sprintf("read %s on node %s failed: %s %s", opts.Path, target.NodeIP, err, msg))
+		}
+		pw.CloseWithError(err)
+		srcErr <- err
+	}()
+
+	limiter := s.limiter(target)
+	h := sha256.New()
+	_, err := io.Copy(io.MultiWriter(w, h), limiter.Reader(pr))
+	pr.CloseWithError(io.ErrClosedPipe)
+	if e := <-srcErr; e != nil {
+		return e
+	}
+	audit.AddFile(opts.Path)
+	audit.AddHash("stdout", hex.EncodeToString(h.Sum(nil)))
+	return err
+}
+
+// catScript prints the part of file opts selects, with Follow it runs until its stdin is closed
+func catScript(file string, opts CatOptions) string {
+	quoted := utils.ShellQuote(file)
+	start := fmt.Sprintf("+%d", opts.Offset+1)
+	if opts.Offset < 0 {
+		start = fmt.Sprintf("%d", -opts.Offset)
+	}
+
+	var shell string
+	switch {
+	case opts.Follow:
+		shell = fmt.Sprintf("tail -F -c %s -- %s & pid=$!; cat > /dev/null; kill $pid 2>/dev/null", start, quoted)
+	case opts.Offset == 0 && opts.Length == 0:
+		shell = fmt.Sprintf("cat -- %s", quoted)
+	default:
+		shell = fmt.Sprintf("tail -c %s -- %s", start, quoted)
+		if opts.Length > 0 {
+			shell += fmt.Sprintf(" | head -c %d", opts.Length)
+		}
+	}
+	if !opts.Follow {
+		shell = fmt.Sprintf("[ -f %s ] || { echo %s: not a regular file >&2; exit 1; }; %s", quoted, quoted, shell)
+	}
+	return shell
+}
+
+// Put streams r into a file of the volume. It is written aside and renamed into place once all of it arrived, the
+// file keeps the owner and mode of the one it replaces.
+func (s *Server) Put(file string, r io.Reader) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	rel, err := streamPath(file)
+	if err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	s.exitOnInvalid()
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	target, err := s.resolveTarget()
+	if err == nil {
+		err = s.guardTransfer(target, func(target *Target) error { return s.put(target, rel, r) })
+	}
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+func (s *Server) put(target *Target, rel string, r io.Reader) error {
+	file, err := resolveInVolume(target, path.Join(target.VolumePath, rel))
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(file), fmt.Sprintf(".%s.put-%d", path.Base(file), time.Now().UnixNano()))
+	quoted, quotedTmp := utils.ShellQuote(file), utils.ShellQuote(tmp)
+	s.reporter.Start(progress.Start{Tool: TransferPut, Action: TransferTo, Target: s.progressTarget(target)})
+	startTime := time.Now()
+
+	h := sha256.New()
+	counter := utils.NewCountingReader(io.TeeReader(r, h))
+	limiter := s.limiter(target)
+	var stderr bytes.Buffer
+	shell := fmt.Sprintf("mkdir -p %s && cat > %s", utils.ShellQuote(path.Dir(file)), quotedTmp)
+	if err := target.sshcli.Stream(shell, limiter.Reader(counter), nil, &stderr); err != nil {
+		target.sshcli.Run(fmt.Sprintf("rm -f %s", quotedTmp))
+		return errors.New(fmt.Sprintf("write %s on node %s failed: %s %s", rel, target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+
+	// a broken connection ends the upload like the end of the input does, the size tells them apart
+	size := counter.Count()
+	finish := fmt.Sprintf(`if [ "$(stat -c %%s %s)" != %d ]; then rm -f %s; echo "%s is incomplete" >&2; exit 1; fi; `+
+		`if [ -e %s ]; then chown "$(stat -c %%u:%%g %s)" %s && chmod "$(stat -c %%a %s)" %s; fi && mv -f %s %s`,
+		quotedTmp, size, quotedTmp, rel, quoted, quoted, quotedTmp, quoted, quotedTmp, quotedTmp, quoted)
+	if _, err := target.sshcli.Run(finish); err != nil {
+		target.sshcli.Run(fmt.Sprintf("rm -f %s", quotedTmp))
+		return errors.New(fmt.Sprintf("write %s on node %s failed: %s", rel, target.NodeIP, err))
+	}
+	if err := s.applyOwnership(target, []string{file}); err != nil {
+		return err
+	}
+	if err := s.relabel(target, []string{file}); err != nil {
+		return err
+	}
+
+	audit.AddFile(rel)
+	audit.AddHash("stdin", hex.EncodeToString(h.Sum(nil)))
+	s.reporter.Done(progress.Summary{
+		Tool:     TransferPut,
+		Action:   TransferTo,
+		Target:   s.progressTarget(target),
+		Files:    1,
+		Bytes:    size,
+		Duration: time.Since(startTime),
+	})
+	return nil
+}
+
+// streamPath checks the file given to cat/put, it has to name a file inside the volume
+func streamPath(file string) (string, error) {
+	rel, err := volumeRelPath(file)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "", errors.New("you need specific a file in the volume")
+	}
+	return rel, nil
+}
+
+// resolveInVolume resolves the symlinks of p on the node, the parts which don't exist yet are kept as they are. The
+// tool runs as root on the node, a path the pod pointed out of the volume with a symlink is refused.
+func resolveInVolume(target *Target, p string) (string, error) {
+	out, err := target.sshcli.Run(realpathScript(target.VolumePath, p))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("resolve %s on node %s failed: %s", p, target.NodeIP, err))
+	}
+	return resolvedInVolume(p, out)
+}
+
+// realpathScript prints the volume and p resolved, each terminated by NUL
+func realpathScript(volumePath, p string) string {
+	return fmt.Sprintf("realpath -m -z -- %s %s", utils.ShellQuote(volumePath), utils.ShellQuote(p))
+}
+
+// resolvedInVolume returns p resolved from the output of realpathScript, unless it is outside of the volume
+func resolvedInVolume(p, out string) (string, error) {
+	resolved := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	if len(resolved) != 2 {
+		return "", errors.New(fmt.Sprintf("resolve %s failed: unexpected output %q", p, out))
+	}
+	if !insideDir(resolved[0], resolved[1]) {
+		return "", errors.New(fmt.Sprintf("refuse %s, it leads to %s outside of the volume", p, resolved[1]))
+	}
+	return resolved[1], nil
+}
+
+// insideDir tells whether the clean absolute path p is dir or under it
+func insideDir(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamPath(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{file: "app.log", want: "app.log"},
+		{file: "logs/./app.log", want: "logs/app.log"},
+		{file: "logs//app.log", want: "logs/app.log"},
+		{file: "/logs/app.log", wantErr: true},
+		{file: "logs/../app.log", wantErr: true},
+		{file: "../etc/passwd", wantErr: true},
+		{file: "", wantErr: true},
+		{file: "/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := streamPath(tt.file)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("streamPath(%q) = %q, %v, want %q, error %v", tt.file, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	tests := []struct {
+		dir, p string
+		want   bool
+	}{
+		{"/vol", "/vol", true},
+		{"/vol", "/vol/a/b", true},
+		{"/vol/", "/vol/a", true},
+		{"/vol", "/volume/a", false},
+		{"/vol", "/etc/passwd", false},
+		{"/vol", "/", false},
+	}
+	for _, tt := range tests {
+		if got := insideDir(tt.dir, tt.p); got != tt.want {
+			t.Errorf("insideDir(%q, %q) = %v, want %v", tt.dir, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestResolveInVolume(t *testing.T) {
+	root := t.TempDir()
+	vol, outside := filepath.Join(root, "vol"), filepath.Join(root, "etc")
+	writeFiles(t, vol, map[string]string{"data/app.log": "log"})
+	writeFiles(t, outside, map[string]string{"passwd": "root"})
+	for link, dest := range map[string]string{"logs": outside, "current": "data", "passwd": "../etc/passwd", "up": ".."} {
+		if err := os.Symlink(dest, filepath.Join(vol, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	realVol, err := filepath.EvalSymlinks(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{rel: "data/app.log", want: "data/app.log"},
+		{rel: "current/app.log", want: "data/app.log"},
+		{rel: "new/dir/file", want: "new/dir/file"},
+		{rel: "current/new/file", want: "data/new/file"},
+		{rel: "logs/passwd", wantErr: true},
+		{rel: "logs/new/file", wantErr: true},
+		{rel: "passwd", wantErr: true},
+		{rel: "up/etc/passwd", wantErr: true},
+	}
+	for _, tt := range tests {
+		out, err := exec.Command("sh", "-c", realpathScript(vol, filepath.Join(vol, tt.rel))).Output()
+		if err != nil {
+			t.Fatalf("realpath failed: %s", err)
+		}
+		got, err := resolvedInVolume(tt.rel, string(out))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolvedInVolume(%q) error = %v, wantErr %v", tt.rel, err, tt.wantErr)
+			continue
+		}
+		if want := filepath.Join(realVol, tt.want); !tt.wantErr && got != want {
+			t.Errorf("resolvedInVolume(%q) = %q, want %q", tt.rel, got, want)
+		}
+	}
+
+	if _, err = resolvedInVolume("a", "/vol\x00"); err == nil {
+		t.Errorf("resolvedInVolume() accepted the output of a single path")
+	}
+}
+
+func TestCatScript(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"it's a log": "0123456789"})
+	file := filepath.Join(dir, "it's a log")
+
+	tests := []struct {
+		name string
+		opts CatOptions
+		want string
+	}{
+		{name: "whole", want: "0123456789"},
+		{name: "offset", opts: CatOptions{Offset: 3}, want: "3456789"},
+		{name: "offset and length", opts: CatOptions{Offset: 3, Length: 4}, want: "3456"},
+		{name: "length", opts: CatOptions{Length: 2}, want: "01"},
+		{name: "from the end", opts: CatOptions{Offset: -4}, want: "6789"},
+		{name: "from the end with length", opts: CatOptions{Offset: -4, Length: 2}, want: "67"},
+		{name: "past the end", opts: CatOptions{Offset: 20}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := exec.Command("sh", "-c", catScript(file, tt.opts)).Output()
+			if err != nil {
+				t.Fatalf("script failed: %s", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("cat printed %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	if err := exec.Command("sh", "-c", catScript(dir, CatOptions{})).Run(); err == nil {
+		t.Errorf("cat of a directory succeeded")
+	}
+}
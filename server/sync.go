@@ -0,0 +1,965 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/backup"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"syscall"
+	"time"
+)
+
+const (
+	TransferSync = "sync"
+
+	// ConflictSkip reports the conflicts and leaves both sides alone, they are reported again by the next sync
+	ConflictSkip         = "skip"
+	ConflictPreferLocal  = "prefer-local"
+	ConflictPreferRemote = "prefer-remote"
+	// ConflictKeepBoth keeps the local version under the original name and moves the remote one aside, or the local
+	// one when the remote side is a directory
+	ConflictKeepBoth = "keep-both"
+
+	DefaultConflictSuffix = ".conflict"
+
+	syncOpPush         = "push"
+	syncOpPull         = "pull"
+	syncOpRemoveLocal  = "remove-local"
+	syncOpRemoveRemote = "remove-remote"
+	syncOpRenameLocal  = "rename-local"
+	syncOpRenameRemote = "rename-remote"
+	syncOpConflict     = "conflict"
+)
+
+// SyncOptions tunes a bidirectional sync
+type SyncOptions struct {
+	// LocalDir is synchronized with the root of the volume
+	LocalDir string
+	// Conflict is skip, prefer-local, prefer-remote or keep-both
+	Conflict string
+	// ConflictSuffix is inserted before the extension of the copy moved aside by keep-both
+	ConflictSuffix string
+	// DryRun prints the plan without changing anything
+	DryRun bool
+}
+
+// ValidateConflict checks a conflict resolution policy
+func ValidateConflict(policy string) error {
+	switch policy {
+	case ConflictSkip, ConflictPreferLocal, ConflictPreferRemote, ConflictKeepBoth:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("not support conflict resolution %s, please use %s, %s, %s or %s", policy,
+			ConflictSkip, ConflictPreferLocal, ConflictPreferRemote, ConflictKeepBoth))
+	}
+}
+
+// SyncAction is a step of a sync plan
+type SyncAction struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// To is the new name of a rename
+	To string `json:"to,omitempty"`
+	// Local and Remote describe both sides of a conflict
+	Local      string `json:"local,omitempty"`
+	Remote     string `json:"remote,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// syncPlan is what a sync does on both sides, in the order of its fields
+type syncPlan struct {
+	renameLocal  map[string]string
+	renameRemote map[string]string
+	// purge are directories replaced by a file or removed by a conflict resolution, removed with their content
+	purgeLocal   []string
+	purgeRemote  []string
+	removeLocal  []string
+	removeRemote []string
+	push         []string
+	pull         []string
+	// skipped are the unresolved conflicts, their baseline is kept
+	skipped   map[string]bool
+	conflicts []SyncAction
+}
+
+func newSyncPlan() *syncPlan {
+	return &syncPlan{renameLocal: map[string]string{}, renameRemote: map[string]string{}, skipped: map[string]bool{}}
+}
+
+// actions lists the plan in the order it is carried out
+func (p *syncPlan) actions() []SyncAction {
+	var actions []SyncAction
+	actions = append(actions, p.conflicts...)
+	for _, from := range sortedKeys(p.renameLocal) {
+		actions = append(actions, SyncAction{Op: syncOpRenameLocal, Path: from, To: p.renameLocal[from]})
+	}
+	for _, from := range sortedKeys(p.renameRemote) {
+		actions = append(actions, SyncAction{Op: syncOpRenameRemote, Path: from, To: p.renameRemote[from]})
+	}
+	for _, name := range append(append([]string{}, p.purgeLocal...), p.removeLocal...) {
+		actions = append(actions, SyncAction{Op: syncOpRemoveLocal, Path: name})
+	}
+	for _, name := range append(append([]string{}, p.purgeRemote...), p.removeRemote...) {
+		actions = append(actions, SyncAction{Op: syncOpRemoveRemote, Path: name})
+	}
+	for _, name := range p.push {
+		actions = append(actions, SyncAction{Op: syncOpPush, Path: name})
+	}
+	for _, name := range p.pull {
+		actions = append(actions, SyncAction{Op: syncOpPull, Path: name})
+	}
+	return actions
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syncEntry is the state of a path on both sides after the last sync
+type syncEntry struct {
+	Local  *backup.Node `json:"local"`
+	Remote *backup.Node `json:"remote"`
+}
+
+// syncState is the baseline of a local directory and a volume, the changes of both sides are found against it
+type syncState struct {
+	Cluster       string               `json:"cluster"`
+	Namespace     string               `json:"namespace"`
+	Kind          string               `json:"kind"`
+	Name          string               `json:"name"`
+	InstanceIndex int                  `json:"instanceIndex,omitempty"`
+	Volume        string               `json:"volume"`
+	LocalDir      string               `json:"localDir"`
+	SyncedAt      time.Time            `json:"syncedAt"`
+	Entries       map[string]syncEntry `json:"entries"`
+}
+
+// syncStateFile returns where the baseline of the target and localDir is kept
+func (s *Server) syncStateFile(localDir string) string {
+	key := strings.Join([]string{s.kubeclient.CoreV1().RESTClient().Get().URL().Host, s.namespace, s.resourceKind,
+		s.resourceName, fmt.Sprint(s.instanceIndex), s.volume, localDir}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(utils.HomeDir(), ".sync-volume-data", "sync", hex.EncodeToString(sum[:8])+".json")
+}
+
+func loadSyncState(file string) (*syncState, error) {
+	state := &syncState{Entries: make(map[string]syncEntry)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, errors.New(fmt.Sprintf("decode sync state %s failed: %s", file, err))
+	}
+	if state.Entries == nil {
+		state.Entries = make(map[string]syncEntry)
+	}
+	return state, nil
+}
+
+func (st *syncState) save(file string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := file + ".partial"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Sync synchronizes the volume and a local directory in both directions: the changes of each side since the last
+// sync are carried to the other side, a path changed on both sides is a conflict resolved by opts.Conflict
+func (s *Server) Sync(opts SyncOptions) {
+	s.validateTarget()
+	s.ValidateTransferOptions()
+	if err := ValidateConflict(opts.Conflict); err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	localDir, err := filepath.Abs(opts.LocalDir)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(localDir); err == nil && !info.IsDir() {
+			err = errors.New(fmt.Sprintf("%s is not a directory", opts.LocalDir))
+		}
+	}
+	if err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	s.exitOnInvalid()
+	opts.LocalDir = localDir
+	if opts.ConflictSuffix == "" {
+		opts.ConflictSuffix = DefaultConflictSuffix
+	}
+	s.reporter = progress.New(s.opts.Output, os.Stdout)
+
+	target, err := s.resolveTarget()
+	if err == nil {
+		err = s.guardTransfer(target, func(target *Target) error { return s.sync(target, opts) })
+	}
+	if err != nil {
+		s.reporter.Error(err)
+		s.log.Fatal(err)
+	}
+}
+
+func (s *Server) sync(target *Target, opts SyncOptions) error {
+	stateFile := s.syncStateFile(opts.LocalDir)
+	state, err := loadSyncState(stateFile)
+	if err != nil {
+		return err
+	}
+	if len(state.Entries) == 0 {
+		s.log.Infof("no baseline in %s, files which differ on both sides are conflicts", stateFile)
+	}
+
+	local, err := localNodes(opts.LocalDir)
+	if err != nil {
+		return err
+	}
+	remote, err := s.remoteNodes(target)
+	if err != nil {
+		return err
+	}
+
+	same, err := s.sameContent(target, candidates(state.Entries, local, remote), func(name string) string {
+		return filepath.Join(opts.LocalDir, filepath.FromSlash(name))
+	})
+	if err != nil {
+		return err
+	}
+	stamp := time.Now()
+	plan := planSync(state.Entries, local, remote, same, opts.Conflict, func(name string) string {
+		return conflictName(name, opts.ConflictSuffix, stamp)
+	})
+
+	if opts.DryRun {
+		return s.printPlan(plan)
+	}
+
+	startTime := time.Now()
+	start := progress.Start{Tool: "sync", Action: TransferSync, Target: s.progressTarget(target)}
+	s.reporter.Start(start)
+	for _, conflict := range plan.conflicts {
+		s.log.Warnf("conflict %s: local %s, remote %s, %s", conflict.Path, conflict.Local, conflict.Remote, conflict.Resolution)
+	}
+
+	files, size, removed, err := s.applyPlan(target, opts.LocalDir, plan)
+	if err != nil {
+		return err
+	}
+
+	// the paths the plan changed are listed again, the others keep what both sides looked like when the plan
+	// was made so that a change made during the sync is found by the next one
+	localNow, err := localNodes(opts.LocalDir)
+	if err != nil {
+		return err
+	}
+	remoteNow, err := s.remoteNodes(target)
+	if err != nil {
+		return err
+	}
+	entries := syncBaseline(state.Entries, plan, local, remote, localNow, remoteNow)
+	*state = syncState{
+		Cluster:   s.kubeclient.CoreV1().RESTClient().Get().URL().Host,
+		Namespace: s.namespace,
+		Kind:      s.resourceKind,
+		Name:      s.resourceName,
+		Volume:    s.volume,
+		LocalDir:  opts.LocalDir,
+		SyncedAt:  time.Now(),
+		Entries:   entries,
+	}
+	if s.resourceKind == statefulsetKind {
+		state.InstanceIndex = s.instanceIndex
+	}
+	if err = state.save(stateFile); err != nil {
+		return errors.New(fmt.Sprintf("save sync state %s failed: %s", stateFile, err))
+	}
+
+	s.reporter.Done(progress.Summary{
+		Tool:     "sync",
+		Action:   TransferSync,
+		Target:   start.Target,
+		Files:    files,
+		Bytes:    size,
+		Removed:  removed,
+		Duration: time.Since(startTime),
+	})
+	if len(plan.skipped) > 0 {
+		return errors.New(fmt.Sprintf("%d conflicts left, resolve them by hand or sync again with --conflict", len(plan.skipped)))
+	}
+	s.log.Infof("sync volume %s of %s/%s with %s succeed !! pushed %d, pulled %d, %d conflicts resolved", s.volume,
+		s.namespace, target.Pod.Name, opts.LocalDir, len(plan.push), len(plan.pull), len(plan.conflicts))
+	return nil
+}
+
+// touched returns the paths plan changes on either side, the content of the purged directories included
+func (p *syncPlan) touched() map[string]bool {
+	names := make(map[string]bool)
+	for from, to := range p.renameLocal {
+		names[from], names[to] = true, true
+	}
+	for from, to := range p.renameRemote {
+		names[from], names[to] = true, true
+	}
+	for _, list := range [][]string{p.purgeLocal, p.purgeRemote, p.removeLocal, p.removeRemote, p.push, p.pull} {
+		for _, name := range list {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// syncBaseline returns the baseline left by a sync. A path the plan left alone keeps the sides listed before
+// the sync, a path the plan changed takes the sides listed after it, but only when both agree: a file changed
+// again while it was transferred has no baseline, so that the next sync compares both sides. An unresolved
+// conflict keeps its old baseline so that it is reported again.
+func syncBaseline(old map[string]syncEntry, plan *syncPlan, local, remote, localNow, remoteNow map[string]*backup.Node) map[string]syncEntry {
+	touched := plan.touched()
+	var purged []string
+	purged = append(append(purged, plan.purgeLocal...), plan.purgeRemote...)
+
+	entries := make(map[string]syncEntry)
+	for name, l := range local {
+		if r := remote[name]; r != nil && !touched[name] && !underAny(purged, name) {
+			entries[name] = syncEntry{Local: l, Remote: r}
+		}
+	}
+	for name := range touched {
+		if l, r := localNow[name], remoteNow[name]; l != nil && r != nil && syncedNode(l, r) {
+			entries[name] = syncEntry{Local: l, Remote: r}
+		}
+	}
+	for _, dir := range purged {
+		for name, l := range localNow {
+			if r := remoteNow[name]; r != nil && strings.HasPrefix(name, dir+"/") && syncedNode(l, r) {
+				entries[name] = syncEntry{Local: l, Remote: r}
+			}
+		}
+	}
+	for name := range plan.skipped {
+		delete(entries, name)
+		if entry, ok := old[name]; ok {
+			entries[name] = entry
+		}
+	}
+	return entries
+}
+
+// syncedNode tells whether both sides of a transferred path are the same. tar keeps the mtime of a file to the
+// second only.
+func syncedNode(l, r *backup.Node) bool {
+	if l.Type != r.Type {
+		return false
+	}
+	switch l.Type {
+	case backup.NodeFile:
+		diff := l.ModTime.Sub(r.ModTime)
+		return l.Size == r.Size && diff < time.Second && diff > -time.Second
+	case backup.NodeSymlink:
+		return l.Target == r.Target
+	}
+	return true
+}
+
+// printPlan prints what a sync would do
+func (s *Server) printPlan(plan *syncPlan) error {
+	actions := plan.actions()
+	if s.opts.Output == progress.OutputJSON {
+		return json.NewEncoder(os.Stdout).Encode(actions)
+	}
+	for _, action := range actions {
+		switch {
+		case action.Op == syncOpConflict:
+			fmt.Printf("%-14s %s (local %s, remote %s): %s\n", action.Op, action.Path, action.Local, action.Remote, action.Resolution)
+		case action.To != "":
+			fmt.Printf("%-14s %s -> %s\n", action.Op, action.Path, action.To)
+		default:
+			fmt.Printf("%-14s %s\n", action.Op, action.Path)
+		}
+	}
+	if len(actions) == 0 {
+		fmt.Println("nothing to sync")
+	}
+	return nil
+}
+
+// localNodes lists dir the same way find -printf FindFormat lists the volume
+func localNodes(dir string) (map[string]*backup.Node, error) {
+	nodes := make(map[string]*backup.Node)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		node, err := localNode(p, filepath.ToSlash(rel), info)
+		if err != nil {
+			return err
+		}
+		nodes[node.Path] = node
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("list local directory %s failed: %s", dir, err))
+	}
+	return nodes, nil
+}
+
+// localNode describes the local file p as the entry name
+func localNode(p, name string, info os.FileInfo) (*backup.Node, error) {
+	node := &backup.Node{Path: name, Mode: unixMode(info.Mode()), ModTime: info.ModTime()}
+	switch {
+	case info.Mode().IsRegular():
+		node.Type = backup.NodeFile
+		node.Size = info.Size()
+	case info.IsDir():
+		node.Type = backup.NodeDir
+	case info.Mode()&os.ModeSymlink != 0:
+		node.Type = backup.NodeSymlink
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		node.Target = target
+	default:
+		node.Type = backup.NodeOther
+	}
+	return node, nil
+}
+
+func unixMode(mode os.FileMode) int64 {
+	bits := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// remoteNodes lists the volume on the node, lost+found of the file system is left out
+func (s *Server) remoteNodes(target *Target) (map[string]*backup.Node, error) {
+	nodes, err := s.listVolume(target, ".")
+	if err != nil {
+		return nil, err
+	}
+	for name := range nodes {
+		if name == "lost+found" || strings.HasPrefix(name, "lost+found/") {
+			delete(nodes, name)
+		}
+	}
+	return nodes, nil
+}
+
+// listVolume lists rel, a path of the volume, and everything below it on the node. The entries are named after
+// their path in the volume, nothing is listed when rel doesn't exist.
+func (s *Server) listVolume(target *Target, rel string) (map[string]*backup.Node, error) {
+	quoted, depth := utils.ShellQuote(rel), 0
+	if rel == "." {
+		depth = 1
+	}
+	script := fmt.Sprintf("cd %s && if [ -e %s ] || [ -L %s ]; then find %s -mindepth %d -printf %s; fi",
+		utils.ShellQuote(target.VolumePath), quoted, quoted, quoted, depth, utils.ShellQuote(backup.FindFormat))
+	var listing, stderr bytes.Buffer
+	if err := target.sshcli.Stream(script, nil, &listing, &stderr); err != nil {
+		return nil, errors.New(fmt.Sprintf("list volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	list, err := backup.ReadNodes(&listing)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*backup.Node, len(list))
+	for i := range list {
+		node := &list[i]
+		if rel != "." {
+			node.Path = path.Join(rel, node.Path)
+		}
+		nodes[node.Path] = node
+	}
+	return nodes, nil
+}
+
+// nodeChanged tells whether a side changed since its baseline. The mtime of a directory changes with its
+// content, which is synchronized entry by entry, so it is left out.
+func nodeChanged(old, cur *backup.Node) bool {
+	if old == nil || cur == nil {
+		return old != cur
+	}
+	if old.Type != cur.Type || old.Mode != cur.Mode {
+		return true
+	}
+	switch cur.Type {
+	case backup.NodeFile:
+		return old.Size != cur.Size || !old.ModTime.Equal(cur.ModTime)
+	case backup.NodeSymlink:
+		return old.Target != cur.Target
+	}
+	return false
+}
+
+// candidates are the files changed on both sides with the same size, they may well have the same content
+func candidates(base map[string]syncEntry, local, remote map[string]*backup.Node) []string {
+	var names []string
+	for name, l := range local {
+		r := remote[name]
+		if r == nil || l.Type != backup.NodeFile || r.Type != backup.NodeFile || l.Size != r.Size {
+			continue
+		}
+		entry := base[name]
+		if nodeChanged(entry.Local, l) && nodeChanged(entry.Remote, r) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sameContent compares the sha256 of names in the volume with the local files localPath maps them to
+func (s *Server) sameContent(target *Target, names []string, localPath func(name string) string) (map[string]bool, error) {
+	same := make(map[string]bool)
+	if len(names) == 0 {
+		return same, nil
+	}
+	var out, stderr bytes.Buffer
+	script := fmt.Sprintf("cd %s && xargs -0 -r sha256sum --", utils.ShellQuote(target.VolumePath))
+	if err := target.sshcli.Stream(script, backup.ChangedList(names), &out, &stderr); err != nil {
+		return nil, errors.New(fmt.Sprintf("checksum volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	sums := parseChecksums(out.String())
+	for _, name := range names {
+		sum, err := fileSHA256(localPath(name))
+		if err != nil {
+			return nil, err
+		}
+		same[name] = sums[name] == sum
+	}
+	return same, nil
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// conflictName inserts suffix and the time before the extension of name, e.g. report.conflict-20211019-150405.txt
+func conflictName(name, suffix string, at time.Time) string {
+	ext := path.Ext(name)
+	if ext == path.Base(name) {
+		// a dot file such as .env has no extension
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + suffix + "-" + at.Format("20060102-150405") + ext
+}
+
+func describeNode(node *backup.Node) string {
+	switch {
+	case node == nil:
+		return "deleted"
+	case node.Type == backup.NodeFile:
+		return fmt.Sprintf("file of %s modified at %s", progress.HumanBytes(node.Size), node.ModTime.Format(time.RFC3339))
+	case node.Type == backup.NodeSymlink:
+		return "symlink to " + node.Target
+	default:
+		return node.Type
+	}
+}
+
+// planSync compares both sides with the baseline. same tells whether a file changed on both sides has the same
+// content, rename gives the name of the remote copy kept by keep-both.
+func planSync(base map[string]syncEntry, local, remote map[string]*backup.Node, same map[string]bool, policy string,
+	rename func(name string) string) *syncPlan {
+	names := make(map[string]bool)
+	for name := range base {
+		names[name] = true
+	}
+	for name := range local {
+		names[name] = true
+	}
+	for name := range remote {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	// a directory comes before its content
+	sort.Strings(sorted)
+
+	plan := newSyncPlan()
+	// directories purged or replaced by a file, their content goes with them
+	var purged []string
+	for _, name := range sorted {
+		if underAny(purged, name) {
+			continue
+		}
+		entry, l, r := base[name], local[name], remote[name]
+		lc, rc := nodeChanged(entry.Local, l), nodeChanged(entry.Remote, r)
+		switch {
+		case !lc && !rc:
+		case lc && !rc:
+			if plan.toRemote(name, l, r) {
+				purged = append(purged, name)
+			}
+		case !lc && rc:
+			if plan.toLocal(name, l, r) {
+				purged = append(purged, name)
+			}
+		case l == nil && r == nil:
+		case l != nil && r != nil && sameNode(l, r, same[name]):
+		default:
+			conflict := SyncAction{Op: syncOpConflict, Path: name, Local: describeNode(l), Remote: describeNode(r), Resolution: policy}
+			switch policy {
+			case ConflictPreferLocal:
+				if plan.toRemote(name, l, r) {
+					purged = append(purged, name)
+				}
+			case ConflictPreferRemote:
+				if plan.toLocal(name, l, r) {
+					purged = append(purged, name)
+				}
+			case ConflictKeepBoth:
+				switch {
+				case l == nil:
+					plan.toLocal(name, l, r)
+				case r == nil:
+					plan.toRemote(name, l, r)
+				case r.Type != backup.NodeDir:
+					// the remote copy moves aside and comes back under its new name
+					to := rename(name)
+					plan.renameRemote[name] = to
+					plan.pull = append(plan.pull, to)
+					plan.toRemote(name, l, nil)
+					conflict.Resolution = fmt.Sprintf("%s, remote kept as %s", policy, to)
+				default:
+					to := rename(name)
+					plan.renameLocal[name] = to
+					plan.push = append(plan.push, to)
+					plan.toLocal(name, nil, r)
+					conflict.Resolution = fmt.Sprintf("%s, local kept as %s", policy, to)
+				}
+			default:
+				plan.skipped[name] = true
+			}
+			plan.conflicts = append(plan.conflicts, conflict)
+		}
+	}
+
+	// the content of a directory is removed before the directory itself
+	sort.Sort(sort.Reverse(sort.StringSlice(plan.removeLocal)))
+	sort.Sort(sort.Reverse(sort.StringSlice(plan.removeRemote)))
+	return plan
+}
+
+func underAny(dirs []string, name string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func sameNode(l, r *backup.Node, sameContent bool) bool {
+	if l.Type != r.Type {
+		return false
+	}
+	switch l.Type {
+	case backup.NodeFile:
+		return sameContent
+	case backup.NodeSymlink:
+		return l.Target == r.Target
+	}
+	return true
+}
+
+// toRemote carries the local side l of name over the remote side r, it returns true when a remote directory is
+// purged with its content
+func (p *syncPlan) toRemote(name string, l, r *backup.Node) bool {
+	purge := r != nil && r.Type == backup.NodeDir && (l == nil || l.Type != backup.NodeDir)
+	switch {
+	case purge:
+		p.purgeRemote = append(p.purgeRemote, name)
+	case l == nil && r != nil:
+		p.removeRemote = append(p.removeRemote, name)
+	case l != nil && r != nil && l.Type != r.Type:
+		p.removeRemote = append(p.removeRemote, name)
+	}
+	if l != nil {
+		p.push = append(p.push, name)
+	}
+	return purge
+}
+
+// toLocal carries the remote side r of name over the local side l, it returns true when a local directory is
+// purged with its content
+func (p *syncPlan) toLocal(name string, l, r *backup.Node) bool {
+	purge := l != nil && l.Type == backup.NodeDir && (r == nil || r.Type != backup.NodeDir)
+	switch {
+	case purge:
+		p.purgeLocal = append(p.purgeLocal, name)
+	case r == nil && l != nil:
+		p.removeLocal = append(p.removeLocal, name)
+	case l != nil && r != nil && l.Type != r.Type:
+		p.removeLocal = append(p.removeLocal, name)
+	}
+	if r != nil {
+		p.pull = append(p.pull, name)
+	}
+	return purge
+}
+
+// applyPlan carries out plan: renames, removals, then pushes and pulls
+func (s *Server) applyPlan(target *Target, localDir string, plan *syncPlan) (files int, size int64, removed int, err error) {
+	localPath := func(name string) string {
+		return filepath.Join(localDir, filepath.FromSlash(name))
+	}
+
+	for _, from := range sortedKeys(plan.renameLocal) {
+		if err = os.Rename(localPath(from), localPath(plan.renameLocal[from])); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	var script []string
+	for _, from := range sortedKeys(plan.renameRemote) {
+		script = append(script, fmt.Sprintf("mv -- %s %s", utils.ShellQuote(from), utils.ShellQuote(plan.renameRemote[from])))
+	}
+	if len(plan.purgeRemote) > 0 {
+		script = append(script, "rm -rf -- "+utils.ShellQuoteAll(plan.purgeRemote))
+	}
+	for _, name := range plan.removeRemote {
+		// a directory which still has content, e.g. a file kept by a conflict resolution, stays
+		script = append(script, fmt.Sprintf("{ rmdir -- %[1]s 2>/dev/null || rm -f -- %[1]s 2>/dev/null || true; }", utils.ShellQuote(name)))
+	}
+	if len(script) > 0 {
+		shell := fmt.Sprintf("cd %s && %s", utils.ShellQuote(target.VolumePath), strings.Join(script, " && "))
+		if _, err = target.sshcli.Run(shell); err != nil {
+			return 0, 0, 0, errors.New(fmt.Sprintf("change volume on node %s failed: %s", target.NodeIP, err))
+		}
+	}
+
+	for _, name := range plan.purgeLocal {
+		if err = os.RemoveAll(localPath(name)); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	for _, name := range plan.removeLocal {
+		// a directory which still has content, e.g. a file kept by a conflict resolution, stays
+		err = os.Remove(localPath(name))
+		if err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			s.log.Warnf("remove %s failed: %s", localPath(name), err)
+		}
+	}
+	removed = len(plan.purgeLocal) + len(plan.removeLocal) + len(plan.purgeRemote) + len(plan.removeRemote)
+
+	var entries []pushEntry
+	for _, name := range plan.push {
+		entries = append(entries, pushEntry{local: localPath(name), remote: name})
+		s.reporter.File(name)
+	}
+	pushed, pushedBytes, err := s.pushEntries(target, entries, false)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// tar runs as root on the node, the pushed entries would belong to the local user otherwise
+	var paths []string
+	for _, name := range plan.push {
+		paths = append(paths, target.VolumePath+"/"+name)
+	}
+	if err = s.applyOwnershipTo(target, paths, false); err != nil {
+		return 0, 0, 0, err
+	}
+	if err = s.relabelTo(target, paths, false); err != nil {
+		return 0, 0, 0, err
+	}
+
+	pulled, pulledBytes, err := s.pullEntries(target, plan.pull, localDir)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return pushed + pulled, pushedBytes + pulledBytes, removed, nil
+}
+
+// pullEntries reads names, without the content of directories, from the volume into localDir
+func (s *Server) pullEntries(target *Target, names []string, localDir string) (files int, size int64, err error) {
+	if len(names) == 0 {
+		return 0, 0, nil
+	}
+	pr, pw := io.Pipe()
+	srcErr := make(chan error, 1)
+	go func() {
+		var stderr bytes.Buffer
+		shell := fmt.Sprintf("tar -C %s --null --no-recursion -T - -cf -", utils.ShellQuote(target.VolumePath))
+		err := target.sshcli.Stream(shell, backup.ChangedList(names), pw, &stderr)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("read volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+		}
+		pw.CloseWithError(err)
+		srcErr <- err
+	}()
+
+	limiter := s.limiter(target)
+	files, size, err = extractLocal(limiter.Reader(pr), localDir, s.reporter.File)
+	if err == nil {
+		io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(io.ErrClosedPipe)
+	if e := <-srcErr; e != nil {
+		return 0, 0, e
+	}
+	return files, size, err
+}
+
+// extractLocal writes a tar stream into dir, a file is written aside and renamed into place
+func extractLocal(r io.Reader, dir string, onFile func(name string)) (files int, size int64, err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, size, nil
+		}
+		if err != nil {
+			return files, size, errors.New(fmt.Sprintf("read tar stream of the volume failed: %s", err))
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return files, size, errors.New(fmt.Sprintf("refuse to write %s outside of %s", hdr.Name, dir))
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err = mkdirLocal(dir, path.Dir(name)); err != nil {
+			return files, size, err
+		}
+		mode := hdr.FileInfo().Mode()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = mkdirLocal(dir, name); err == nil {
+				err = os.Chmod(dst, mode.Perm())
+			}
+		case tar.TypeSymlink:
+			os.Remove(dst)
+			err = os.Symlink(hdr.Linkname, dst)
+		case tar.TypeReg, tar.TypeRegA:
+			h := sha256.New()
+			if err = writeLocalFile(dst, io.TeeReader(tr, h), mode.Perm()); err == nil {
+				audit.AddHash(name, hex.EncodeToString(h.Sum(nil)))
+				err = os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+			}
+			files++
+			size += hdr.Size
+		default:
+			continue
+		}
+		if err != nil {
+			return files, size, err
+		}
+		onFile(name)
+	}
+}
+
+// mkdirLocal creates the directory rel under dir and its parents. A part of rel which is a local symlink is refused,
+// what is written under it would end up wherever it leads, outside of dir too.
+func mkdirLocal(dir, rel string) error {
+	if rel == "." {
+		return nil
+	}
+	p := dir
+	for _, part := range strings.Split(rel, "/") {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			if err = os.Mkdir(p, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return errors.New(fmt.Sprintf("refuse to write %s, %s is a symlink", rel, p))
+		case !info.IsDir():
+			return errors.New(fmt.Sprintf("refuse to write %s, %s is not a directory", rel, p))
+		}
+	}
+	return nil
+}
+
+func writeLocalFile(name string, r io.Reader, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".partial-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
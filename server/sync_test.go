@@ -0,0 +1,372 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync-volume-data/backup"
+	"testing"
+	"time"
+)
+
+var syncBase = time.Date(2021, 12, 1, 2, 0, 0, 0, time.UTC)
+
+func fileNode(name string, size int64, minute int) *backup.Node {
+	return &backup.Node{Path: name, Type: backup.NodeFile, Size: size, Mode: 0644, ModTime: syncBase.Add(time.Duration(minute) * time.Minute)}
+}
+
+func dirNode(name string) *backup.Node {
+	return &backup.Node{Path: name, Type: backup.NodeDir, Mode: 0755, ModTime: syncBase}
+}
+
+func nodes(list ...*backup.Node) map[string]*backup.Node {
+	m := make(map[string]*backup.Node)
+	for _, node := range list {
+		m[node.Path] = node
+	}
+	return m
+}
+
+// baseline records the nodes as synchronized on both sides
+func baseline(list ...*backup.Node) map[string]syncEntry {
+	m := make(map[string]syncEntry)
+	for _, node := range list {
+		m[node.Path] = syncEntry{Local: node, Remote: node}
+	}
+	return m
+}
+
+// planLists flattens a plan for comparison, renames are written from->to and empty lists are left out
+func planLists(p *syncPlan) map[string][]string {
+	lists := map[string][]string{
+		"purgeLocal": p.purgeLocal, "purgeRemote": p.purgeRemote, "removeLocal": p.removeLocal,
+		"removeRemote": p.removeRemote, "push": p.push, "pull": p.pull,
+	}
+	for from, to := range p.renameLocal {
+		lists["renameLocal"] = append(lists["renameLocal"], from+"->"+to)
+	}
+	for from, to := range p.renameRemote {
+		lists["renameRemote"] = append(lists["renameRemote"], from+"->"+to)
+	}
+	for name := range p.skipped {
+		lists["skipped"] = append(lists["skipped"], name)
+	}
+	for _, c := range p.conflicts {
+		lists["conflicts"] = append(lists["conflicts"], c.Path)
+	}
+	for key, list := range lists {
+		if len(list) == 0 {
+			delete(lists, key)
+			continue
+		}
+		sort.Strings(list)
+	}
+	return lists
+}
+
+func TestPlanSync(t *testing.T) {
+	rename := func(name string) string { return name + ".conflict" }
+	tests := []struct {
+		name   string
+		base   map[string]syncEntry
+		local  map[string]*backup.Node
+		remote map[string]*backup.Node
+		same   map[string]bool
+		policy string
+		want   map[string][]string
+	}{
+		{
+			name:   "unchanged",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 1, 0)),
+			remote: nodes(fileNode("a", 1, 0)),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "new on both sides",
+			local:  nodes(fileNode("l", 1, 0)),
+			remote: nodes(fileNode("r", 1, 0)),
+			want:   map[string][]string{"push": {"l"}, "pull": {"r"}},
+		},
+		{
+			name:   "modified locally",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(fileNode("a", 1, 0)),
+			want:   map[string][]string{"push": {"a"}},
+		},
+		{
+			name:   "modified remotely",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 1, 0)),
+			remote: nodes(fileNode("a", 1, 1)),
+			want:   map[string][]string{"pull": {"a"}},
+		},
+		{
+			name:   "removed locally",
+			base:   baseline(dirNode("d"), fileNode("d/a", 1, 0)),
+			local:  nodes(),
+			remote: nodes(dirNode("d"), fileNode("d/a", 1, 0)),
+			want:   map[string][]string{"purgeRemote": {"d"}},
+		},
+		{
+			name:   "removed remotely",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 1, 0)),
+			remote: nodes(),
+			want:   map[string][]string{"removeLocal": {"a"}},
+		},
+		{
+			name:   "removed on both sides",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(),
+			remote: nodes(),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "same change on both sides",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(fileNode("a", 2, 2)),
+			same:   map[string]bool{"a": true},
+			want:   map[string][]string{},
+		},
+		{
+			name:   "conflict skipped",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(fileNode("a", 3, 2)),
+			policy: ConflictSkip,
+			want:   map[string][]string{"conflicts": {"a"}, "skipped": {"a"}},
+		},
+		{
+			name:   "conflict prefer local",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(fileNode("a", 3, 2)),
+			policy: ConflictPreferLocal,
+			want:   map[string][]string{"conflicts": {"a"}, "push": {"a"}},
+		},
+		{
+			name:   "conflict prefer remote over a local removal",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(),
+			remote: nodes(fileNode("a", 3, 2)),
+			policy: ConflictPreferRemote,
+			want:   map[string][]string{"conflicts": {"a"}, "pull": {"a"}},
+		},
+		{
+			name:   "conflict keep both files",
+			base:   baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(fileNode("a", 3, 2)),
+			policy: ConflictKeepBoth,
+			want: map[string][]string{"conflicts": {"a"}, "renameRemote": {"a->a.conflict"}, "pull": {"a.conflict"},
+				"push": {"a"}},
+		},
+		{
+			name:   "conflict keep both remote directory",
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(dirNode("a"), fileNode("a/b", 1, 0)),
+			policy: ConflictKeepBoth,
+			want: map[string][]string{"conflicts": {"a"}, "renameLocal": {"a->a.conflict"}, "push": {"a.conflict"},
+				"pull": {"a", "a/b"}},
+		},
+		{
+			name:   "directory replaced by a file",
+			base:   baseline(dirNode("d"), fileNode("d/a", 1, 0)),
+			local:  nodes(fileNode("d", 1, 1)),
+			remote: nodes(dirNode("d"), fileNode("d/a", 1, 0)),
+			want:   map[string][]string{"purgeRemote": {"d"}, "push": {"d"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planLists(planSync(tt.base, tt.local, tt.remote, tt.same, tt.policy, rename))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSync() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncBaseline(t *testing.T) {
+	tests := []struct {
+		name string
+		old  map[string]syncEntry
+		// local and remote are listed before the sync, localNow and remoteNow after it
+		local, remote, localNow, remoteNow map[string]*backup.Node
+		plan                               func(p *syncPlan)
+		want                               []string
+	}{
+		{
+			name:   "untouched paths keep the planning listings",
+			local:  nodes(fileNode("a", 1, 0), fileNode("l", 1, 0)),
+			remote: nodes(fileNode("a", 1, 0)),
+			want:   []string{"a"},
+		},
+		{
+			name:      "pushed file synchronized",
+			local:     nodes(fileNode("a", 2, 1)),
+			remote:    nodes(fileNode("a", 1, 0)),
+			localNow:  nodes(fileNode("a", 2, 1)),
+			remoteNow: nodes(fileNode("a", 2, 1)),
+			plan:      func(p *syncPlan) { p.push = []string{"a"} },
+			want:      []string{"a"},
+		},
+		{
+			name:      "pushed file changed again during the transfer",
+			local:     nodes(fileNode("a", 2, 1)),
+			remote:    nodes(fileNode("a", 1, 0)),
+			localNow:  nodes(fileNode("a", 3, 5)),
+			remoteNow: nodes(fileNode("a", 2, 1)),
+			plan:      func(p *syncPlan) { p.push = []string{"a"} },
+			want:      nil,
+		},
+		{
+			name:      "content of a purged directory",
+			local:     nodes(dirNode("d"), fileNode("d/a", 1, 0)),
+			remote:    nodes(fileNode("d", 1, 0)),
+			localNow:  nodes(dirNode("d"), fileNode("d/a", 1, 0)),
+			remoteNow: nodes(dirNode("d"), fileNode("d/a", 1, 0)),
+			plan:      func(p *syncPlan) { p.purgeRemote, p.push = []string{"d"}, []string{"d", "d/a"} },
+			want:      []string{"d", "d/a"},
+		},
+		{
+			name:   "skipped conflict keeps its old baseline",
+			old:    baseline(fileNode("a", 1, 0)),
+			local:  nodes(fileNode("a", 2, 1)),
+			remote: nodes(fileNode("a", 3, 2)),
+			plan:   func(p *syncPlan) { p.skipped["a"] = true },
+			want:   []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := newSyncPlan()
+			if tt.plan != nil {
+				tt.plan(plan)
+			}
+			entries := syncBaseline(tt.old, plan, tt.local, tt.remote, tt.localNow, tt.remoteNow)
+			var got []string
+			for name := range entries {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("syncBaseline() has %v, want %v", got, tt.want)
+			}
+			for name, entry := range entries {
+				if old, ok := tt.old[name]; ok && plan.skipped[name] && !reflect.DeepEqual(entry, old) {
+					t.Errorf("the baseline of the skipped %s changed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	at := time.Date(2021, 10, 19, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name, suffix, want string
+	}{
+		{name: "report.txt", suffix: ".conflict", want: "report.conflict-20211019-150405.txt"},
+		{name: "dir/report.tar.gz", suffix: ".conflict", want: "dir/report.tar.conflict-20211019-150405.gz"},
+		{name: "README", suffix: ".conflict", want: "README.conflict-20211019-150405"},
+		{name: ".env", suffix: ".conflict", want: ".env.conflict-20211019-150405"},
+		{name: "conf.d/.env", suffix: "~mine", want: "conf.d/.env~mine-20211019-150405"},
+		{name: "conf.d/app", suffix: ".conflict", want: "conf.d/app.conflict-20211019-150405"},
+	}
+	for _, tt := range tests {
+		if got := conflictName(tt.name, tt.suffix, at); got != tt.want {
+			t.Errorf("conflictName(%q, %q) = %q, want %q", tt.name, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+// TestExtractLocalSymlinkParent checks that pulled entries aren't written through a directory the local side replaced
+// with a symlink
+func TestExtractLocalSymlinkParent(t *testing.T) {
+	outside := t.TempDir()
+	before, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		hdr  tar.Header
+	}{
+		{name: "file", hdr: tar.Header{Name: "link/evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}},
+		{name: "nested file", hdr: tar.Header{Name: "link/sub/evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}},
+		{name: "directory", hdr: tar.Header{Name: "link/sub", Typeflag: tar.TypeDir, Mode: 0777}},
+		{name: "directory itself", hdr: tar.Header{Name: "link", Typeflag: tar.TypeDir, Mode: 0777}},
+		{name: "symlink", hdr: tar.Header{Name: "link/evil.txt", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(&tt.hdr); err != nil {
+				t.Fatal(err)
+			}
+			if tt.hdr.Size > 0 {
+				tw.Write([]byte("evil"))
+			}
+			tw.Close()
+
+			if _, _, err := extractLocal(&buf, dir, func(string) {}); err == nil {
+				t.Errorf("extractLocal() of %s succeeded through a symlink", tt.hdr.Name)
+			}
+			if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+				t.Errorf("extractLocal() wrote outside of the root: %v", entries)
+			}
+			if info, _ := os.Stat(outside); info.Mode() != before.Mode() {
+				t.Errorf("extractLocal() changed the mode outside of the root to %s", info.Mode())
+			}
+		})
+	}
+}
+
+func TestMkdirLocal(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file": "x"})
+	if err := mkdirLocal(dir, "a/b/c"); err != nil {
+		t.Fatalf("mkdirLocal() failed: %s", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "a/b/c")); err != nil || !info.IsDir() {
+		t.Errorf("a/b/c wasn't created: %v", err)
+	}
+	if err := mkdirLocal(dir, "a/b"); err != nil {
+		t.Errorf("mkdirLocal() of an existing directory failed: %s", err)
+	}
+	if err := mkdirLocal(dir, "file/sub"); err == nil {
+		t.Errorf("mkdirLocal() under a file succeeded")
+	}
+	if err := mkdirLocal(dir, "."); err != nil {
+		t.Errorf("mkdirLocal() of the root failed: %s", err)
+	}
+}
@@ -0,0 +1,463 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync-volume-data/progress"
+	remote "sync-volume-data/remote_execute"
+	"text/tabwriter"
+)
+
+const (
+	TransferUsage = "du"
+
+	OutputCSV = "csv"
+
+	UsageSortUsed     = "used"
+	UsageSortInodes   = "inodes"
+	UsageSortCapacity = "capacity"
+	UsageSortPercent  = "percent"
+	UsageSortName     = "name"
+
+	DefaultUsageTop   = 5
+	DefaultUsageDepth = 2
+)
+
+// UsageOptions selects the volumes du measures and how they are reported
+type UsageOptions struct {
+	AllNamespaces bool
+	// Sort is used, inodes, capacity, percent or name, the largest come first
+	Sort string
+	// Top is the number of largest directories reported per volume, Depth how deep they are looked for
+	Top   int
+	Depth int
+}
+
+// VolumeUsage is what a volume mounted by the pods of a workload holds. A claim mounted by several pods is measured
+// once.
+type VolumeUsage struct {
+	Namespace    string   `json:"namespace"`
+	Workload     string   `json:"workload"`
+	Pods         []string `json:"pods"`
+	Node         string   `json:"node"`
+	NodeIP       string   `json:"nodeIP"`
+	Volume       string   `json:"volume"`
+	Type         string   `json:"type"`
+	PVC          string   `json:"pvc,omitempty"`
+	StorageClass string   `json:"storageClass,omitempty"`
+	// Capacity is the capacity in the status of the PVC, or the size limit of an emptyDir
+	Capacity int64  `json:"capacity,omitempty"`
+	Path     string `json:"path,omitempty"`
+	// Used and Inodes are measured with du and find inside the volume
+	Used   int64 `json:"used"`
+	Inodes int64 `json:"inodes"`
+	// the filesystem which holds the volume, from df
+	FSSize       int64      `json:"fsSize"`
+	FSUsed       int64      `json:"fsUsed"`
+	FSAvailable  int64      `json:"fsAvailable"`
+	FSInodes     int64      `json:"fsInodes"`
+	FSInodesUsed int64      `json:"fsInodesUsed"`
+	Largest      []DirUsage `json:"largest,omitempty"`
+	Error        string     `json:"error,omitempty"`
+
+	pod       *corev1.Pod
+	volume    *corev1.Volume
+	directory string
+}
+
+// DirUsage is the size of a directory of a volume
+type DirUsage struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ValidateUsageSort checks the --sort flag of du
+func ValidateUsageSort(key string) error {
+	switch key {
+	case UsageSortUsed, UsageSortInodes, UsageSortCapacity, UsageSortPercent, UsageSortName:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("not support sort key %s, please use used, inodes, capacity, percent or name", key))
+	}
+}
+
+// Usage measures the data volumes of every running pod of the namespace, or of all namespaces, and prints them as a
+// table, json or csv
+func (s *Server) Usage(opts UsageOptions) {
+	s.ValidateSshPwd()
+	if !opts.AllNamespaces {
+		s.ValidateNamespace()
+	}
+	if err := ValidateUsageSort(opts.Sort); err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	if s.opts.Output != OutputCSV {
+		if err := progress.ValidateOutput(s.opts.Output); err != nil {
+			s.errMsg = append(s.errMsg, errors.New(fmt.Sprintf("%s, or csv", err)))
+		}
+	}
+	s.exitOnInvalid()
+	if opts.Depth <= 0 {
+		opts.Depth = DefaultUsageDepth
+	}
+	if opts.Top < 0 {
+		opts.Top = 0
+	}
+
+	namespace := s.namespace
+	if opts.AllNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+	usages, err := s.volumeUsages(namespace)
+	if err != nil {
+		s.log.Fatal(err)
+	}
+	s.measureUsages(usages, opts)
+	sortUsages(usages, opts.Sort)
+
+	switch s.opts.Output {
+	case progress.OutputJSON:
+		if usages == nil {
+			usages = []*VolumeUsage{}
+		}
+		s.printJSON(usages)
+	case OutputCSV:
+		err = printUsageCSV(usages)
+	default:
+		printUsageTable(usages, opts.AllNamespaces)
+	}
+	if err != nil {
+		s.log.Fatal(err)
+	}
+}
+
+// volumeUsages lists the data volumes of the running pods: claims, generic ephemeral volumes, emptyDirs and csi
+// inline volumes. ConfigMaps, secrets and the like are left out, a hostPath is not under the directory of the pod.
+func (s *Server) volumeUsages(namespace string) ([]*VolumeUsage, error) {
+	pods, err := s.kubeclient.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	claims := make(map[string]*VolumeUsage)
+	var usages []*VolumeUsage
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for j := range pod.Spec.Volumes {
+			volume := &pod.Spec.Volumes[j]
+			usage := &VolumeUsage{
+				Namespace: pod.Namespace,
+				Pods:      []string{pod.Name},
+				Node:      pod.Spec.NodeName,
+				Volume:    volume.Name,
+				pod:       pod,
+				volume:    volume,
+			}
+			switch {
+			case volume.PersistentVolumeClaim != nil:
+				usage.Type = "pvc"
+			case volume.Ephemeral != nil:
+				usage.Type = "ephemeral"
+			case volume.EmptyDir != nil:
+				usage.Type = "emptyDir"
+				if limit := volume.EmptyDir.SizeLimit; limit != nil {
+					usage.Capacity = limit.Value()
+				}
+			case volume.CSI != nil:
+				usage.Type = "csi"
+			default:
+				continue
+			}
+			usage.Workload = s.podWorkload(pod, owners)
+
+			pvc, pv, err := s.volumeClaim(pod.Namespace, pod, volume)
+			if err != nil {
+				usage.Error = err.Error()
+			} else if pvc != nil {
+				key := pod.Namespace + "/" + pvc.Name
+				if shared := claims[key]; shared != nil {
+					shared.Pods = append(shared.Pods, pod.Name)
+					continue
+				}
+				claims[key] = usage
+				usage.PVC = pvc.Name
+				if pvc.Spec.StorageClassName != nil {
+					usage.StorageClass = *pvc.Spec.StorageClassName
+				}
+				if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+					usage.Capacity = capacity.Value()
+				}
+			}
+			usage.directory = volumeDirectory(volume, pv)
+			usages = append(usages, usage)
+		}
+	}
+	return usages, nil
+}
+
+// podWorkload names the workload which owns pod, e.g. deploy/web, a pod without owner is its own workload
+func (s *Server) podWorkload(pod *corev1.Pod, owners map[string]string) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "pod/" + pod.Name
+	}
+	if owner.Kind != replicaSetKind {
+		return workloadName(owner.Kind, owner.Name)
+	}
+
+	key := pod.Namespace + "/" + owner.Name
+	if name, ok := owners[key]; ok {
+		return name
+	}
+	name := workloadName(owner.Kind, owner.Name)
+	rs, err := s.kubeclient.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), owner.Name, metav1.GetOptions{})
+	if err == nil {
+		if deploy := metav1.GetControllerOf(rs); deploy != nil {
+			name = workloadName(deploy.Kind, deploy.Name)
+		}
+	}
+	owners[key] = name
+	return name
+}
+
+func workloadName(kind, name string) string {
+	switch kind {
+	case deployKind:
+		return "deploy/" + name
+	case statefulsetKind:
+		return "sts/" + name
+	case daemonsetKind:
+		return "ds/" + name
+	case replicaSetKind:
+		return "rs/" + name
+	default:
+		return strings.ToLower(kind) + "/" + name
+	}
+}
+
+// measureUsages measures the volumes over ssh, the nodes in parallel and the volumes of a node one after the other.
+// A node which can't be reached only fails its own volumes.
+func (s *Server) measureUsages(usages []*VolumeUsage, opts UsageOptions) {
+	byNode := make(map[string][]*VolumeUsage)
+	for _, usage := range usages {
+		if usage.Error == "" {
+			byNode[usage.Node] = append(byNode[usage.Node], usage)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for node, volumes := range byNode {
+		wg.Add(1)
+		go func(node string, volumes []*VolumeUsage) {
+			defer wg.Done()
+			nodeIP, err := s.getNodeIPFromPod(volumes[0].pod)
+			if err != nil {
+				for _, usage := range volumes {
+					usage.Error = err.Error()
+				}
+				return
+			}
+			sshcli := remote.NewCli(s.sshuser, s.sshpwd, fmt.Sprintf("%s:%s", nodeIP, s.sshPort), remote.SshPassword, "")
+			defer sshcli.Close()
+			for _, usage := range volumes {
+				usage.NodeIP = nodeIP
+				if err := measureVolume(sshcli, usage, opts); err != nil {
+					s.log.Warnf("measure volume %s of pod %s/%s failed: %s", usage.Volume, usage.Namespace, usage.Pods[0], err)
+					usage.Error = err.Error()
+				}
+			}
+		}(node, volumes)
+	}
+	wg.Wait()
+}
+
+// measureVolume runs du, find and df in the volume, their outputs are separated by "--" lines
+func measureVolume(sshcli *remote.Cli, usage *VolumeUsage, opts UsageOptions) error {
+	pattern := "/var/lib/kubelet/pods/" + string(usage.pod.UID) + "/volumes/*/" + usage.directory
+	script := fmt.Sprintf(`p=$(ls -d %s 2>/dev/null | head -n 1); [ -n "$p" ] || { echo "%s not found" >&2; exit 1; }; cd "$p" || exit 1; `+
+		`echo "$p"; echo --; du -bx --max-depth=%d . 2>/dev/null | sort -rn | head -n %d; echo --; `+
+		`find . -xdev 2>/dev/null | wc -l; echo --; df -Pk . | tail -n 1; df -Pi . | tail -n 1`,
+		pattern, pattern, opts.Depth, opts.Top+1)
+	out, err := sshcli.Run(script)
+	if err != nil {
+		return err
+	}
+	return parseUsage(out, usage, opts.Top)
+}
+
+func parseUsage(out string, usage *VolumeUsage, top int) (err error) {
+	sections := strings.Split(out, "\n--\n")
+	if len(sections) != 4 {
+		return errors.New(fmt.Sprintf("unexpected output of du/df: %q", out))
+	}
+	usage.Path = strings.TrimSpace(sections[0])
+
+	for _, line := range strings.Split(strings.TrimSpace(sections[1]), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if fields[1] == "." {
+			usage.Used = size
+		} else if len(usage.Largest) < top {
+			usage.Largest = append(usage.Largest, DirUsage{Path: path.Clean(fields[1]), Bytes: size})
+		}
+	}
+
+	if usage.Inodes, err = strconv.ParseInt(strings.TrimSpace(sections[2]), 10, 64); err != nil {
+		return errors.New(fmt.Sprintf("parse inode count %q failed: %s", sections[2], err))
+	}
+
+	// Filesystem 1024-blocks Used Available Capacity Mounted-on, then the same with inodes
+	df := strings.Split(strings.TrimSpace(sections[3]), "\n")
+	if len(df) != 2 {
+		return errors.New(fmt.Sprintf("unexpected output of df: %q", sections[3]))
+	}
+	blocks, inodes := strings.Fields(df[0]), strings.Fields(df[1])
+	if len(blocks) < 4 || len(inodes) < 3 {
+		return errors.New(fmt.Sprintf("unexpected output of df: %q", sections[3]))
+	}
+	values := []*int64{&usage.FSSize, &usage.FSUsed, &usage.FSAvailable, &usage.FSInodes, &usage.FSInodesUsed}
+	for i, field := range []string{blocks[1], blocks[2], blocks[3], inodes[1], inodes[2]} {
+		// busybox prints "-" for the inodes of a filesystem without a fixed number of them
+		if field == "-" {
+			continue
+		}
+		if *values[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+			return errors.New(fmt.Sprintf("parse df output %q failed: %s", field, err))
+		}
+	}
+	usage.FSSize, usage.FSUsed, usage.FSAvailable = usage.FSSize*1024, usage.FSUsed*1024, usage.FSAvailable*1024
+	return nil
+}
+
+// limit is the capacity of the volume, the size of its filesystem when it has none of its own
+func (u *VolumeUsage) limit() int64 {
+	if u.Capacity > 0 {
+		return u.Capacity
+	}
+	return u.FSSize
+}
+
+func (u *VolumeUsage) percent() float64 {
+	if u.limit() == 0 {
+		return 0
+	}
+	return float64(u.Used) * 100 / float64(u.limit())
+}
+
+func sortUsages(usages []*VolumeUsage, key string) {
+	name := func(u *VolumeUsage) string { return u.Namespace + "/" + u.Workload + "/" + u.Volume }
+	sort.SliceStable(usages, func(i, j int) bool {
+		a, b := usages[i], usages[j]
+		switch key {
+		case UsageSortInodes:
+			return a.Inodes > b.Inodes
+		case UsageSortCapacity:
+			return a.limit() > b.limit()
+		case UsageSortPercent:
+			return a.percent() > b.percent()
+		case UsageSortName:
+			return name(a) < name(b)
+		default:
+			return a.Used > b.Used
+		}
+	})
+}
+
+func printUsageTable(usages []*VolumeUsage, allNamespaces bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "WORKLOAD\tVOLUME\tTYPE\tPVC\tNODE\tUSED\tINODES\tCAPACITY\tUSE%\tFS-AVAIL"
+	if allNamespaces {
+		header = "NAMESPACE\t" + header
+	}
+	fmt.Fprintln(w, header)
+	for _, u := range usages {
+		row := []string{u.Workload, u.Volume, u.Type, valueOrNone(u.PVC), u.Node}
+		if u.Error != "" {
+			row = append(row, "error: "+u.Error)
+		} else {
+			capacity := "-"
+			if u.Capacity > 0 {
+				capacity = progress.HumanBytes(u.Capacity)
+			}
+			row = append(row, progress.HumanBytes(u.Used), strconv.FormatInt(u.Inodes, 10), capacity,
+				fmt.Sprintf("%.0f%%", u.percent()), progress.HumanBytes(u.FSAvailable))
+		}
+		if allNamespaces {
+			row = append([]string{u.Namespace}, row...)
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	for _, u := range usages {
+		if len(u.Largest) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s/%s volume %s, largest directories:\n", u.Namespace, u.Workload, u.Volume)
+		for _, dir := range u.Largest {
+			fmt.Printf("  %10s  %s\n", progress.HumanBytes(dir.Bytes), dir.Path)
+		}
+	}
+}
+
+func printUsageCSV(usages []*VolumeUsage) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"namespace", "workload", "pods", "node", "volume", "type", "pvc", "storageClass", "capacity",
+		"used", "inodes", "fsSize", "fsUsed", "fsAvailable", "fsInodes", "fsInodesUsed", "path", "largest", "error"})
+	for _, u := range usages {
+		var largest []string
+		for _, dir := range u.Largest {
+			largest = append(largest, fmt.Sprintf("%s=%d", dir.Path, dir.Bytes))
+		}
+		w.Write([]string{u.Namespace, u.Workload, strings.Join(u.Pods, " "), u.Node, u.Volume, u.Type, u.PVC,
+			u.StorageClass, strconv.FormatInt(u.Capacity, 10), strconv.FormatInt(u.Used, 10),
+			strconv.FormatInt(u.Inodes, 10), strconv.FormatInt(u.FSSize, 10), strconv.FormatInt(u.FSUsed, 10),
+			strconv.FormatInt(u.FSAvailable, 10), strconv.FormatInt(u.FSInodes, 10),
+			strconv.FormatInt(u.FSInodesUsed, 10), u.Path, strings.Join(largest, ";"), u.Error})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func valueOrNone(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func TestParseUsage(t *testing.T) {
+	const path = "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount\n--\n"
+	const df = "/dev/sdb 10485760 2097152 8388608 20% /var/lib/kubelet\n/dev/sdb 655360 1200 654160 1% /var/lib/kubelet"
+	tests := []struct {
+		name    string
+		out     string
+		top     int
+		want    VolumeUsage
+		wantErr bool
+	}{
+		{
+			name: "largest directories",
+			out:  path + "3072\t.\n2048\t./data\n1024\t./data/base\n512\t./logs\n--\n42\n--\n" + df + "\n",
+			top:  2,
+			want: VolumeUsage{
+				Path: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount", Used: 3072, Inodes: 42,
+				FSSize: 10737418240, FSUsed: 2147483648, FSAvailable: 8589934592, FSInodes: 655360, FSInodesUsed: 1200,
+				Largest: []DirUsage{{Path: "data", Bytes: 2048}, {Path: "data/base", Bytes: 1024}},
+			},
+		},
+		{
+			name: "empty volume",
+			out:  path + "4096\t.\n--\n1\n--\n" + df,
+			top:  5,
+			want: VolumeUsage{
+				Path: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount", Used: 4096, Inodes: 1,
+				FSSize: 10737418240, FSUsed: 2147483648, FSAvailable: 8589934592, FSInodes: 655360, FSInodesUsed: 1200,
+			},
+		},
+		{
+			name: "busybox without inode counts",
+			out: path + "10\t.\nnot a line\n--\n  7  \n--\n" +
+				"tmpfs 1024 4 1020 0% /dev/shm\ntmpfs - - - - /dev/shm\n",
+			top: 5,
+			want: VolumeUsage{
+				Path: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount", Used: 10, Inodes: 7,
+				FSSize: 1048576, FSUsed: 4096, FSAvailable: 1044480,
+			},
+		},
+		{name: "missing section", out: path + "10\t.\n--\n7\n", wantErr: true},
+		{name: "bad inode count", out: path + "10\t.\n--\nmany\n--\n" + df, wantErr: true},
+		{name: "one df line", out: path + "10\t.\n--\n7\n--\n/dev/sdb 10 2 8 20% /", wantErr: true},
+		{name: "short df line", out: path + "10\t.\n--\n7\n--\n/dev/sdb 10\n/dev/sdb 1 1", wantErr: true},
+		{name: "bad df value", out: path + "10\t.\n--\n7\n--\n/dev/sdb ten 2 8 20% /\n/dev/sdb 1 1 0 1% /", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got VolumeUsage
+			err := parseUsage(tt.out, &got, tt.top)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUsage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUsage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortUsages(t *testing.T) {
+	usages := []*VolumeUsage{
+		{Workload: "deploy/b", Volume: "data", Used: 50, Inodes: 9, Capacity: 1000},
+		{Workload: "sts/a", Volume: "data", Used: 300, Inodes: 1, FSSize: 600},
+		{Workload: "deploy/a", Volume: "logs", Used: 200, Inodes: 5, Capacity: 2000},
+	}
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: UsageSortUsed, want: []string{"sts/a", "deploy/a", "deploy/b"}},
+		{key: UsageSortInodes, want: []string{"deploy/b", "deploy/a", "sts/a"}},
+		// a volume without a capacity of its own is limited by its filesystem
+		{key: UsageSortCapacity, want: []string{"deploy/a", "deploy/b", "sts/a"}},
+		{key: UsageSortPercent, want: []string{"sts/a", "deploy/a", "deploy/b"}},
+		{key: UsageSortName, want: []string{"deploy/a", "deploy/b", "sts/a"}},
+	}
+	for _, tt := range tests {
+		sortUsages(usages, tt.key)
+		var got []string
+		for _, u := range usages {
+			got = append(got, u.Workload)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortUsages(%s) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPodWorkload(t *testing.T) {
+	controller := true
+	owned := func(kind, name string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "web"}}
+		if kind != "" {
+			pod.OwnerReferences = []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+		}
+		return pod
+	}
+	// the deployment of a replicaset is looked up once per replicaset
+	owners := map[string]string{"web/nginx-5d4f": "deploy/nginx"}
+	tests := []struct {
+		pod  *corev1.Pod
+		want string
+	}{
+		{pod: owned("", ""), want: "pod/web-0"},
+		{pod: owned(statefulsetKind, "web"), want: "sts/web"},
+		{pod: owned(daemonsetKind, "agent"), want: "ds/agent"},
+		{pod: owned(replicaSetKind, "nginx-5d4f"), want: "deploy/nginx"},
+		{pod: owned("Job", "backup"), want: "job/backup"},
+	}
+	s := &Server{}
+	for _, tt := range tests {
+		if got := s.podWorkload(tt.pod, owners); got != tt.want {
+			t.Errorf("podWorkload() = %s, want %s", got, tt.want)
+		}
+	}
+}
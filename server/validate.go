@@ -24,6 +24,8 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"os"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
 )
 
 func (s *Server) ValidateTool() error {
@@ -288,6 +290,120 @@ func (s *Server) ValidateSourceDir() (exist bool, err error) {
 	}
 }
 
+func (s *Server) ValidateTransferOptions() (err error) {
+	if err = progress.ValidateOutput(s.opts.Output); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateOwnership(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateEncryption(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateWatch(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateHooks(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateQuiesce(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateRestart(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateLock(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	if err = s.validateAnnotateClaim(); err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	s.bwLimit, err = utils.ParseBandwidth(s.opts.BwLimit)
+	if err != nil {
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+	switch s.opts.BwLimitScope {
+	case "":
+		s.opts.BwLimitScope = BwLimitGlobal
+	case BwLimitGlobal, BwLimitNode:
+	default:
+		err = errors.New(fmt.Sprintf("bwlimit-scope must be %s or %s, got %q", BwLimitGlobal, BwLimitNode, s.opts.BwLimitScope))
+		s.errMsg = append(s.errMsg, err)
+		return err
+	}
+
+	switch s.opts.Compress {
+	case "", CompressNone:
+		s.opts.Compress = ""
+		if s.opts.CompressLevel != 0 {
+			err = errors.New("compress-level needs compress to be set")
+			s.errMsg = append(s.errMsg, err)
+			return err
+		}
+		return nil
+	case CompressGzip:
+		if s.opts.CompressLevel < 0 || s.opts.CompressLevel > 9 {
+			err = errors.New(fmt.Sprintf("gzip compress-level must be between 1 and 9, got %d", s.opts.CompressLevel))
+		}
+	case CompressZstd:
+		if s.opts.CompressLevel < 0 || s.opts.CompressLevel > 22 {
+			err = errors.New(fmt.Sprintf("zstd compress-level must be between 1 and 22, got %d", s.opts.CompressLevel))
+		}
+	default:
+		err = errors.New(fmt.Sprintf("not support compress algorithm %s, please use gzip or zstd", s.opts.Compress))
+	}
+
+	if err != nil {
+		s.errMsg = append(s.errMsg, err)
+	}
+	return err
+}
+
+func (s *Server) validateOwnership() error {
+	if err := validateChown(s.opts.Chown); err != nil {
+		return err
+	}
+	if err := validateChmod(s.opts.Chmod); err != nil {
+		return err
+	}
+	pushes := s.action == TransferTo || s.action == TransferPut || s.action == TransferSync
+	if !pushes && (s.opts.Chown != "" || s.opts.Chmod != "") {
+		return errors.New("chown/chmod can only be used when transfer data to a volume, use numeric-ids to keep ownership on pulls")
+	}
+	if !pushes && s.opts.SELinuxRelabel {
+		return errors.New("selinux-relabel can only be used when transfer data to a volume")
+	}
+	if err := validateAtomicMode(s.opts.AtomicMode); err != nil {
+		return err
+	}
+	if s.action != TransferTo && s.opts.Atomic {
+		return errors.New("atomic can only be used when transfer data to a volume")
+	}
+	if s.opts.Atomic && s.opts.AtomicMode == AtomicRename && s.sourceDir != nil {
+		return validateAtomicRename(*s.sourceDir)
+	}
+	return nil
+}
+
 // DeploymentComplete considers a deployment to be complete once all of its desired replicas
 // are updated and available, and no old pods are running.
 func DeploymentComplete(deployment *appsv1.Deployment, newStatus *appsv1.DeploymentStatus) bool {
@@ -313,3 +429,34 @@ func DaemonsetComplete(ds *appsv1.DaemonSet, newStatus *appsv1.DaemonSetStatus)
 		newStatus.NumberMisscheduled == 0 && newStatus.NumberReady == newStatus.DesiredNumberScheduled &&
 		newStatus.ObservedGeneration >= ds.Generation
 }
+
+// validateEncryption checks --encrypt-pull, it only applies to "from" transfers and needs a recipient or a passphrase
+func (s *Server) validateEncryption() error {
+	if !s.opts.EncryptPull {
+		return nil
+	}
+	if s.action != TransferFrom {
+		return errors.New("encrypt-pull only applies to from transfers")
+	}
+	if !s.opts.Keys.Encrypting() {
+		return errors.New("encrypt-pull needs --encrypt-recipient or a passphrase")
+	}
+	return nil
+}
+
+// validateWatch checks --watch, it only pushes local changes into a volume
+func (s *Server) validateWatch() error {
+	if !s.opts.Watch {
+		return nil
+	}
+	if s.action != TransferTo {
+		return errors.New("watch can only be used when transfer data to a volume")
+	}
+	if s.opts.Atomic {
+		return errors.New("atomic can't be used with watch, the changes are pushed in place")
+	}
+	if s.opts.WatchDebounce <= 0 {
+		s.opts.WatchDebounce = DefaultWatchDebounce
+	}
+	return nil
+}
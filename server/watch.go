@@ -0,0 +1,519 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync-volume-data/audit"
+	"sync-volume-data/progress"
+	"sync-volume-data/utils"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultWatchDebounce = 300 * time.Millisecond
+	// watchResolveInterval is how often the pod is checked, and a failed push retried, while the sources are quiet
+	watchResolveInterval = 10 * time.Second
+)
+
+// watchRoot maps a local source onto the volume
+type watchRoot struct {
+	local string
+	// remote is the path in the volume, empty when the content of the directory is pushed like rsync "dir/"
+	remote string
+	file   bool
+}
+
+// pushEntry is a changed local file or directory and its path in the volume
+type pushEntry struct {
+	local  string
+	remote string
+}
+
+// watchSession keeps the resolved target and its ssh connection between the pushes of --watch
+type watchSession struct {
+	s       *Server
+	target  *Target
+	roots   []watchRoot
+	fsw     *fsnotify.Watcher
+	pending map[string]bool
+	out     io.Writer
+}
+
+// watch runs the transfer once, then pushes every change of the local sources until it is interrupted.
+// Changes are pushed as a tar stream over the ssh connection of the target, --compress only applies to the first transfer.
+func (s *Server) watch(target *Target) error {
+	if err := s.transfer(target); err != nil {
+		return err
+	}
+
+	roots, err := s.watchRoots()
+	if err != nil {
+		return err
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.New(fmt.Sprintf("watch local sources failed: %s", err))
+	}
+	defer fsw.Close()
+
+	w := &watchSession{s: s, target: target, roots: roots, fsw: fsw, pending: make(map[string]bool), out: os.Stdout}
+	defer func() { w.target.sshcli.Close() }()
+	for _, root := range roots {
+		if root.file {
+			// editors replace files by renaming, watch the directory instead of the file itself
+			if err = fsw.Add(filepath.Dir(root.local)); err != nil {
+				return errors.New(fmt.Sprintf("watch %s failed: %s", root.local, err))
+			}
+			continue
+		}
+		w.add(root.local)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	resolve := time.NewTicker(watchResolveInterval)
+	defer resolve.Stop()
+
+	s.log.Infof("watching %s, press Ctrl-C to stop", strings.Join(*s.sourceDir, ", "))
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if w.changed(event) {
+				debounce = time.After(s.opts.WatchDebounce)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			s.log.Warnf("watch local sources: %s", err)
+		case <-debounce:
+			debounce = nil
+			w.sync()
+		case <-resolve.C:
+			// a pod replaced while nothing changes locally still gets the sources
+			if err := w.followPod(); err != nil {
+				w.failed(err)
+			} else if len(w.pending) > 0 {
+				w.sync()
+			}
+		case <-interrupt:
+			s.log.Infof("stop watching %s", strings.Join(*s.sourceDir, ", "))
+			return nil
+		case <-s.context().Done():
+			// withLock tells why
+			return errors.New("stop watching")
+		}
+	}
+}
+
+// watchRoots maps the sources to the volume the same way the first transfer does
+func (s *Server) watchRoots() ([]watchRoot, error) {
+	return sourceRoots(*s.sourceDir, s.tool == "rsync")
+}
+
+// sourceRoots maps local sources to the volume like scp does, a source goes into the root of the volume under
+// its own name. contentSlash maps the content of "dir/" into the root of the volume instead, like rsync does.
+func sourceRoots(sources []string, contentSlash bool) ([]watchRoot, error) {
+	var roots []watchRoot
+	for _, file := range sources {
+		local, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(local)
+		if err != nil {
+			return nil, err
+		}
+		root := watchRoot{local: local, remote: filepath.Base(local), file: !info.IsDir()}
+		if contentSlash && strings.HasSuffix(file, "/") && info.IsDir() {
+			root.remote = ""
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// remotePath maps a local path onto its path in the volume, ok is false when it is not part of the sources
+func remotePath(roots []watchRoot, local string) (remote string, ok bool) {
+	for _, root := range roots {
+		if local == root.local {
+			return root.remote, root.remote != ""
+		}
+		if root.file {
+			continue
+		}
+		rel, err := filepath.Rel(root.local, local)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return path.Join(root.remote, filepath.ToSlash(rel)), true
+	}
+	return "", false
+}
+
+// add watches dir and every directory below it
+func (w *watchSession) add(dir string) {
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if err = w.fsw.Add(p); err != nil {
+			w.s.log.Warnf("watch %s failed: %s", p, err)
+		}
+		return nil
+	})
+}
+
+// changed records the path of event, it returns false when the path is not part of the sources
+func (w *watchSession) changed(event fsnotify.Event) bool {
+	if _, ok := remotePath(w.roots, event.Name); !ok {
+		return false
+	}
+	if event.Op&fsnotify.Create != 0 {
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			w.add(event.Name)
+		}
+	}
+	w.pending[event.Name] = true
+	return true
+}
+
+// followPod resolves the target again when its pod is gone, terminating or replaced, e.g. after a rollout.
+// Everything is pushed into the new pod.
+func (w *watchSession) followPod() error {
+	current := w.target.Pod
+	pod, err := w.s.kubeclient.CoreV1().Pods(w.s.namespace).Get(context.TODO(), current.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && pod.UID == current.UID && pod.Spec.NodeName == current.Spec.NodeName &&
+		pod.DeletionTimestamp == nil && pod.Status.Phase == corev1.PodRunning {
+		return nil
+	}
+
+	target, err := w.s.resolveTarget()
+	if err != nil {
+		return errors.New(fmt.Sprintf("pod %s is gone, resolve %s %s again failed: %s", current.Name, w.s.resourceKind, w.s.resourceName, err))
+	}
+	if target.Pod.UID == current.UID {
+		target.sshcli.Close()
+		return nil
+	}
+	w.s.log.Infof("pod %s on node %s replaced by %s on node %s, push everything", current.Name, current.Spec.NodeName,
+		target.Pod.Name, target.Pod.Spec.NodeName)
+	w.target.sshcli.Close()
+	w.target = target
+	for _, root := range w.roots {
+		w.pending[root.local] = true
+	}
+	return nil
+}
+
+// sync pushes the pending changes, they are kept for the next try when the push fails
+func (w *watchSession) sync() {
+	if err := w.followPod(); err != nil {
+		w.failed(err)
+		return
+	}
+	if len(w.pending) == 0 {
+		return
+	}
+	pending := w.pending
+	w.pending = make(map[string]bool)
+
+	startTime := time.Now()
+	push, remove := w.collect(pending)
+	files, size, err := w.push(push)
+	if err == nil {
+		err = w.remove(remove)
+	}
+	if err == nil {
+		err = w.fixup(push)
+	}
+	if err != nil {
+		for p := range pending {
+			w.pending[p] = true
+		}
+		// the connection may be broken, connect again on the next try
+		w.target.sshcli.Close()
+		w.failed(err)
+		return
+	}
+	w.synced(files, size, len(remove), time.Since(startTime))
+}
+
+// collect splits the pending paths into the entries to push and the paths to remove from the volume,
+// a path below another pending path is pushed or removed with it
+func (w *watchSession) collect(pending map[string]bool) (push []pushEntry, remove []string) {
+	var paths []string
+	for p := range pending {
+		if !pendingParent(pending, p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		if w.contentRoot(p) {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				w.s.log.Warnf("read local directory %s failed: %s", p, err)
+				continue
+			}
+			for _, entry := range entries {
+				push = append(push, pushEntry{local: filepath.Join(p, entry.Name()), remote: entry.Name()})
+			}
+			continue
+		}
+		remote, ok := remotePath(w.roots, p)
+		if !ok {
+			continue
+		}
+		if _, err := os.Lstat(p); err != nil {
+			remove = append(remove, remote)
+			continue
+		}
+		push = append(push, pushEntry{local: p, remote: remote})
+	}
+	return push, remove
+}
+
+func pendingParent(pending map[string]bool, p string) bool {
+	for dir := filepath.Dir(p); dir != p; p, dir = dir, filepath.Dir(dir) {
+		if pending[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// contentRoot tells whether p is a source directory whose content is pushed instead of the directory itself
+func (w *watchSession) contentRoot(p string) bool {
+	for _, root := range w.roots {
+		if root.local == p && root.remote == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// push streams entries into the volume
+func (w *watchSession) push(entries []pushEntry) (files int, size int64, err error) {
+	return w.s.pushEntries(w.target, entries, true)
+}
+
+// pushEntries streams entries into the volume as a tar stream over the ssh connection of target, recursive
+// pushes everything below the directories as well
+func (s *Server) pushEntries(target *Target, entries []pushEntry, recursive bool) (files int, size int64, err error) {
+	if len(entries) == 0 {
+		return 0, 0, nil
+	}
+	pr, pw := io.Pipe()
+	produced := make(chan error, 1)
+	go func() {
+		var err error
+		files, size, err = writeTar(pw, entries, recursive)
+		pw.CloseWithError(err)
+		produced <- err
+	}()
+
+	untar := fmt.Sprintf("tar -C %s -xf -", utils.ShellQuote(target.VolumePath))
+	if s.opts.NumericIDs {
+		untar += " --numeric-owner"
+	}
+	var stderr bytes.Buffer
+	limiter := s.limiter(target)
+	err = target.sshcli.Stream(untar, limiter.Reader(pr), nil, &stderr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if e := <-produced; e != nil {
+		return 0, 0, e
+	}
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("write volume on node %s failed: %s %s", target.NodeIP, err, strings.TrimSpace(stderr.String())))
+	}
+	return files, size, nil
+}
+
+// remove deletes the paths removed locally from the volume
+func (w *watchSession) remove(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	script := fmt.Sprintf("cd %s && rm -rf -- %s", utils.ShellQuote(w.target.VolumePath), utils.ShellQuoteAll(paths))
+	if _, err := w.target.sshcli.Run(script); err != nil {
+		return errors.New(fmt.Sprintf("remove files on node %s failed: %s", w.target.NodeIP, err))
+	}
+	return nil
+}
+
+// fixup applies --chown/--chmod/--selinux-relabel to the pushed entries
+func (w *watchSession) fixup(entries []pushEntry) error {
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, w.target.VolumePath+"/"+entry.remote)
+	}
+	if err := w.s.applyOwnership(w.target, paths); err != nil {
+		return err
+	}
+	return w.s.relabel(w.target, paths)
+}
+
+// synced prints the compact line of a successful push
+func (w *watchSession) synced(files int, size int64, removed int, took time.Duration) {
+	if w.s.opts.Output == progress.OutputJSON {
+		w.s.reporter.Done(progress.Summary{
+			Tool:     "watch",
+			Action:   TransferTo,
+			Target:   w.s.progressTarget(w.target),
+			Files:    files,
+			Bytes:    size,
+			Removed:  removed,
+			Duration: took,
+		})
+		return
+	}
+	fmt.Fprintf(w.out, "%s synced %d files (%s), removed %d into %s/%s in %s\n", time.Now().Format("15:04:05"),
+		files, progress.HumanBytes(size), removed, w.s.namespace, w.target.Pod.Name, took.Round(time.Millisecond))
+}
+
+// failed prints the compact line of a failed push
+func (w *watchSession) failed(err error) {
+	if w.s.opts.Output == progress.OutputJSON {
+		w.s.reporter.Error(err)
+		return
+	}
+	fmt.Fprintf(w.out, "%s sync failed, retry in %s: %s\n", time.Now().Format("15:04:05"), watchResolveInterval, err)
+}
+
+// writeTar writes entries as a tar stream named after their paths in the volume, recursive writes everything
+// below them as well
+func writeTar(w io.Writer, entries []pushEntry, recursive bool) (files int, size int64, err error) {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		err = filepath.Walk(entry.local, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				// removed since the event, the event of the removal deletes it from the volume
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(entry.local, p)
+			if err != nil {
+				return err
+			}
+			n, regular, err := writeTarEntry(tw, p, path.Join(entry.remote, filepath.ToSlash(rel)), info)
+			if regular {
+				files++
+				size += n
+			}
+			if err == nil && info.IsDir() && !recursive {
+				return filepath.SkipDir
+			}
+			return err
+		})
+		if err != nil {
+			return files, size, err
+		}
+	}
+	return files, size, tw.Close()
+}
+
+// writeTarEntry writes a directory, a symlink or a regular file, anything else is skipped
+func writeTarEntry(tw *tar.Writer, local, name string, info os.FileInfo) (n int64, regular bool, err error) {
+	var link string
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(local); err != nil {
+			return 0, false, nil
+		}
+	case !info.IsDir() && !info.Mode().IsRegular():
+		return 0, false, nil
+	}
+
+	var f *os.File
+	if info.Mode().IsRegular() {
+		if f, err = os.Open(local); err != nil {
+			if os.IsNotExist(err) {
+				return 0, false, nil
+			}
+			return 0, false, err
+		}
+		defer f.Close()
+		if info, err = f.Stat(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return 0, false, err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err = tw.WriteHeader(hdr); err != nil || f == nil {
+		return 0, false, err
+	}
+
+	// the audit log gets the sha256 of what is sent, not of the file read again later
+	h := sha256.New()
+	w := io.MultiWriter(tw, h)
+	n, err = io.CopyN(w, f, hdr.Size)
+	if err == io.EOF {
+		// truncated while it is read, keep the stream valid, the next event pushes it again
+		_, err = io.CopyN(w, zeroReader{}, hdr.Size-n)
+	}
+	if err == nil {
+		audit.AddHash(name, hex.EncodeToString(h.Sum(nil)))
+	}
+	return n, true, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWatchRoots(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"site/index.html": "x", "app.yaml": "y"})
+	site, file := filepath.Join(dir, "site"), filepath.Join(dir, "app.yaml")
+	tests := []struct {
+		name    string
+		sources []string
+		tool    string
+		want    []watchRoot
+		wantErr bool
+	}{
+		{
+			name:    "scp",
+			sources: []string{site + "/", file},
+			tool:    "scp",
+			want:    []watchRoot{{local: site, remote: "site"}, {local: file, remote: "app.yaml", file: true}},
+		},
+		{
+			name:    "rsync content of dir/",
+			sources: []string{site + "/", site, file + "/"},
+			tool:    "rsync",
+			want:    []watchRoot{{local: site}, {local: site, remote: "site"}, {local: file, remote: "app.yaml", file: true}},
+		},
+		{name: "missing", sources: []string{filepath.Join(dir, "missing")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		s := &Server{sourceDir: &tt.sources, tool: tt.tool}
+		got, err := s.watchRoots()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: watchRoots() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: watchRoots() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	roots := []watchRoot{
+		{local: "/src/site", remote: "site"},
+		{local: "/src/content"},
+		{local: "/src/app.yaml", remote: "app.yaml", file: true},
+	}
+	tests := []struct {
+		local string
+		want  string
+		ok    bool
+	}{
+		{local: "/src/site", want: "site", ok: true},
+		{local: "/src/site/css/main.css", want: "site/css/main.css", ok: true},
+		{local: "/src/content/index.html", want: "index.html", ok: true},
+		{local: "/src/content"},
+		{local: "/src/app.yaml", want: "app.yaml", ok: true},
+		{local: "/src/app.yaml.swp"},
+		{local: "/src/site2/x"},
+		{local: "/src/..site/x"},
+		{local: "/other"},
+	}
+	for _, tt := range tests {
+		got, ok := remotePath(roots, tt.local)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("remotePath(%s) = %q, %v, want %q, %v", tt.local, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"site/a.html": "a", "site/css/main.css": "c", "content/index.html": "i"})
+	site, content := filepath.Join(dir, "site"), filepath.Join(dir, "content")
+	w := &watchSession{
+		s:     &Server{log: testLogger()},
+		roots: []watchRoot{{local: site, remote: "site"}, {local: content}},
+	}
+
+	pending := map[string]bool{
+		filepath.Join(site, "css"):           true,
+		filepath.Join(site, "css/main.css"):  true,
+		filepath.Join(site, "gone.html"):     true,
+		content:                              true,
+		filepath.Join(content, "index.html"): true,
+		filepath.Join(dir, "outside"):        true,
+	}
+	push, remove := w.collect(pending)
+	wantPush := []pushEntry{
+		{local: filepath.Join(content, "index.html"), remote: "index.html"},
+		{local: filepath.Join(site, "css"), remote: "site/css"},
+	}
+	if !reflect.DeepEqual(push, wantPush) {
+		t.Errorf("collect() push = %+v, want %+v", push, wantPush)
+	}
+	if want := []string{"site/gone.html"}; !reflect.DeepEqual(remove, want) {
+		t.Errorf("collect() remove = %q, want %q", remove, want)
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"site/a.html": "aa", "site/css/main.css": "ccc"})
+	if err := os.Symlink("a.html", filepath.Join(dir, "site/index.html")); err != nil {
+		t.Fatal(err)
+	}
+	entries := []pushEntry{{local: filepath.Join(dir, "site"), remote: "www"}}
+
+	tests := []struct {
+		recursive bool
+		wantNames []string
+		wantFiles int
+		wantSize  int64
+	}{
+		{recursive: true, wantNames: []string{"www/", "www/a.html", "www/css/", "www/css/main.css", "www/index.html"}, wantFiles: 2, wantSize: 5},
+		{recursive: false, wantNames: []string{"www/"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		files, size, err := writeTar(&buf, entries, tt.recursive)
+		if err != nil {
+			t.Fatalf("writeTar() failed: %s", err)
+		}
+		if files != tt.wantFiles || size != tt.wantSize {
+			t.Errorf("writeTar(recursive %v) = %d files %d bytes, want %d files %d bytes", tt.recursive, files, size, tt.wantFiles, tt.wantSize)
+		}
+		var names []string
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+			if hdr.Name == "www/index.html" && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "a.html") {
+				t.Errorf("www/index.html is not the symlink to a.html: %+v", hdr)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.wantNames) {
+			t.Errorf("writeTar(recursive %v) names = %q, want %q", tt.recursive, names, tt.wantNames)
+		}
+	}
+}
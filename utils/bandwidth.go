@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var bandwidthUnits = map[string]int64{
+	"":    1024, // like rsync, a bare number means KiB/s
+	"b":   1,
+	"k":   1024,
+	"kb":  1000,
+	"kib": 1024,
+	"m":   1024 * 1024,
+	"mb":  1000 * 1000,
+	"mib": 1024 * 1024,
+	"g":   1024 * 1024 * 1024,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1024 * 1024 * 1024,
+}
+
+// ParseBandwidth converts a human readable rate such as "20MiB/s", "500KB/s" or "1024"
+// into bytes per second. An empty string means unlimited and returns 0.
+func ParseBandwidth(rate string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(rate))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "/s")
+
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	if i == 0 {
+		return 0, errors.New(fmt.Sprintf("invalid bandwidth %q, expect something like 20MiB/s", rate))
+	}
+
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid bandwidth %q: %s", rate, err))
+	}
+
+	unit, ok := bandwidthUnits[strings.TrimSpace(s[i:])]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("invalid bandwidth unit in %q, supported units are B, K/KB/KiB, M/MB/MiB, G/GB/GiB", rate))
+	}
+
+	bytes := int64(value * float64(unit))
+	if bytes <= 0 {
+		return 0, errors.New(fmt.Sprintf("bandwidth %q must be greater than zero", rate))
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import "testing"
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    int64
+		wantErr bool
+	}{
+		{rate: "", want: 0},
+		{rate: "  ", want: 0},
+		{rate: "1024", want: 1024 * 1024},
+		{rate: "20MiB/s", want: 20 * 1024 * 1024},
+		{rate: "20mib/s", want: 20 * 1024 * 1024},
+		{rate: "500KB/s", want: 500 * 1000},
+		{rate: "500K", want: 500 * 1024},
+		{rate: "1.5M", want: 1536 * 1024},
+		{rate: "2GB/s", want: 2 * 1000 * 1000 * 1000},
+		{rate: "100B/s", want: 100},
+		{rate: " 1 MiB/s ", want: 1024 * 1024},
+		{rate: "MiB/s", wantErr: true},
+		{rate: "20XB/s", wantErr: true},
+		{rate: "1.2.3M", wantErr: true},
+		{rate: "0", wantErr: true},
+		{rate: "0.1B", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.rate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBandwidth(%q) error = %v, wantErr %v", tt.rate, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBandwidth(%q) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
@@ -17,33 +17,88 @@ limitations under the License.
 package utils
 
 import (
-	"k8s.io/client-go/kubernetes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"log"
 	"os"
+	"strings"
 )
 
 var Kubeconfig *string
 
-func NewClientset() (clientset *kubernetes.Clientset) {
-	var err error
-	var config *rest.Config
-
+// NewRestConfig returns the config to connect with, the one of the service account in a pod or the one of
+// --kubeconfig
+func NewRestConfig() *rest.Config {
 	// use ServiceAccount（InCluster mode）
-	if config, err = rest.InClusterConfig(); err != nil {
+	config, err := rest.InClusterConfig()
+	if err != nil {
 		// 使用 KubeConfig 文件创建集群配置
 		if config, err = clientcmd.BuildConfigFromFlags("", *Kubeconfig); err != nil {
 			log.Fatalf("get kubeconfig failed: %s", err.Error())
 		}
 	}
+	return config
+}
 
-	// 创建 clientset
-	clientset, err = kubernetes.NewForConfig(config)
+// NewRestConfigFor returns the rest config of a context of a kubeconfig file. An empty kubeconfig falls back to the
+// default loading rules ($KUBECONFIG, ~/.kube/config), an empty context uses the current context.
+func NewRestConfigFor(kubeconfig, context string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 	if err != nil {
-		log.Fatalf("get clientset failed: %s", err.Error())
+		return nil, errors.New(fmt.Sprintf("load kubeconfig %q context %q failed: %s", kubeconfig, context, err))
+	}
+	return config, nil
+}
+
+// ConfigUser tells as whom config authenticates, as far as the config itself shows it: the impersonated user, the
+// basic auth user, the common name of the client certificate or the subject of a service account token. It is
+// empty for the other credentials, e.g. exec plugins.
+func ConfigUser(config *rest.Config) string {
+	if config.Impersonate.UserName != "" {
+		return config.Impersonate.UserName
+	}
+	if config.Username != "" {
+		return config.Username
+	}
+
+	certData := config.CertData
+	if len(certData) == 0 && config.CertFile != "" {
+		certData, _ = ioutil.ReadFile(config.CertFile)
+	}
+	if block, _ := pem.Decode(certData); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName
+		}
+	}
+
+	token := config.BearerToken
+	if token == "" && config.BearerTokenFile != "" {
+		data, _ := ioutil.ReadFile(config.BearerTokenFile)
+		token = strings.TrimSpace(string(data))
+	}
+	// a service account token is a jwt, other tokens are opaque
+	if parts := strings.Split(token, "."); len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if err == nil && json.Unmarshal(payload, &claims) == nil {
+			return claims.Subject
+		}
 	}
-	return clientset
+	return ""
 }
 
 func HomeDir() string {
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"k8s.io/client-go/rest"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: a
+  cluster:
+    server: https://cluster-a:6443
+- name: b
+  cluster:
+    server: https://cluster-b:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: context-a
+  context:
+    cluster: a
+    user: admin
+- name: context-b
+  context:
+    cluster: b
+    user: admin
+current-context: context-a
+`
+
+func TestNewRestConfigFor(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		context  string
+		wantHost string
+		wantErr  bool
+	}{
+		{context: "", wantHost: "https://cluster-a:6443"},
+		{context: "context-a", wantHost: "https://cluster-a:6443"},
+		{context: "context-b", wantHost: "https://cluster-b:6443"},
+		{context: "missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		config, err := NewRestConfigFor(kubeconfig, tt.context)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewRestConfigFor() of context %q error = %v, wantErr %v", tt.context, err, tt.wantErr)
+			continue
+		}
+		if err == nil && config.Host != tt.wantHost {
+			t.Errorf("NewRestConfigFor() of context %q = %s, want %s", tt.context, config.Host, tt.wantHost)
+		}
+	}
+
+	if _, err := NewRestConfigFor(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Errorf("NewRestConfigFor() of a missing kubeconfig succeeded")
+	}
+}
+
+func TestConfigUser(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "kubernetes-admin"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	dir := t.TempDir()
+	certFile, tokenFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "token")
+	jwt := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"system:serviceaccount:web:deployer"}`)) + ".c2ln"
+	if err = ioutil.WriteFile(certFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(tokenFile, []byte(jwt+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config rest.Config
+		want   string
+	}{
+		{name: "impersonated", config: rest.Config{Username: "admin", Impersonate: rest.ImpersonationConfig{UserName: "alice"}}, want: "alice"},
+		{name: "basic auth", config: rest.Config{Username: "admin"}, want: "admin"},
+		{name: "certificate", config: rest.Config{TLSClientConfig: rest.TLSClientConfig{CertData: cert}}, want: "kubernetes-admin"},
+		{name: "certificate file", config: rest.Config{TLSClientConfig: rest.TLSClientConfig{CertFile: certFile}}, want: "kubernetes-admin"},
+		{name: "service account token", config: rest.Config{BearerToken: jwt}, want: "system:serviceaccount:web:deployer"},
+		{name: "token file", config: rest.Config{BearerTokenFile: tokenFile}, want: "system:serviceaccount:web:deployer"},
+		{name: "opaque token", config: rest.Config{BearerToken: "abcdef.0123456789abcdef"}},
+		{name: "no credentials", config: rest.Config{}},
+	}
+	for _, tt := range tests {
+		if got := ConfigUser(&tt.config); got != tt.want {
+			t.Errorf("%s: ConfigUser() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter spreads reads over time so that they never exceed a rate in bytes per second.
+// A single limiter can be shared by several readers to enforce a global limit.
+type RateLimiter struct {
+	mu    sync.Mutex
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second, 0 means unlimited
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate}
+}
+
+var (
+	sharedMu       sync.Mutex
+	sharedLimiters = map[string]*RateLimiter{}
+)
+
+// SharedRateLimiter returns the limiter of key, the streams of the process which use the same key draw from it
+// together. The rate of the first call is kept, 0 means unlimited.
+func SharedRateLimiter(key string, rate int64) *RateLimiter {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	l, ok := sharedLimiters[key]
+	if !ok {
+		l = NewRateLimiter(rate)
+		sharedLimiters[key] = l
+	}
+	return l
+}
+
+// wait blocks until n more bytes fit into the rate
+func (l *RateLimiter) wait(n int) {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	l.sent += int64(n)
+	due := l.start.Add(time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Reader wraps r, every read is accounted to the limiter
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, limiter: l}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// keep the chunks small, otherwise a low rate turns into long stalls
+	if max := 32 * 1024; len(p) > max {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	l.limiter.wait(n)
+	return n, err
+}
+
+// CountingReader counts the bytes read through it, Count is safe to call from another goroutine
+type CountingReader struct {
+	r io.Reader
+	n int64
+}
+
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 4 << 20
+	data := make([]byte, rate/4)
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, NewRateLimiter(rate).Reader(bytes.NewReader(data)))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("read %d bytes, err %v, want %d", n, err, len(data))
+	}
+	// a quarter of the rate takes a quarter of a second, less the first chunk which is not waited for
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("reading %d bytes at %d B/s took %s", len(data), rate, elapsed)
+	}
+
+	var unlimited *RateLimiter
+	start = time.Now()
+	if _, err = io.Copy(ioutil.Discard, unlimited.Reader(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("reading without a limit took %s", elapsed)
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	a := SharedRateLimiter("test/node-a", 1024)
+	if got := SharedRateLimiter("test/node-a", 2048); got != a {
+		t.Errorf("SharedRateLimiter() returned another limiter for the same key")
+	}
+	if a.rate != 1024 {
+		t.Errorf("rate = %d, want the rate of the first call 1024", a.rate)
+	}
+	if SharedRateLimiter("test/node-b", 1024) == a {
+		t.Errorf("SharedRateLimiter() returned the same limiter for another key")
+	}
+
+	// two readers of one limiter together keep to its rate
+	const rate = 4 << 20
+	shared := SharedRateLimiter("test/shared", rate)
+	data := make([]byte, rate/8)
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := io.Copy(ioutil.Discard, shared.Reader(bytes.NewReader(data)))
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("two readers of %d bytes at %d B/s took %s, the rate is not shared", len(data), rate, elapsed)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Box-Cube
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "''"},
+		{in: "data", want: "'data'"},
+		{in: "a b", want: "'a b'"},
+		{in: "it's", want: `'it'\''s'`},
+		{in: "''", want: `''\'''\'''`},
+		{in: "$HOME `id` \\ \"x\"", want: "'$HOME `id` \\ \"x\"'"},
+		{in: "line\nbreak", want: "'line\nbreak'"},
+	}
+	for _, tt := range tests {
+		if got := ShellQuote(tt.in); got != tt.want {
+			t.Errorf("ShellQuote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		// the shell must get the word back unchanged
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(tt.in)).Output()
+		if err != nil {
+			t.Fatalf("sh -c failed: %s", err)
+		}
+		if string(out) != tt.in {
+			t.Errorf("sh reads ShellQuote(%q) as %q", tt.in, out)
+		}
+	}
+}
+
+func TestShellQuoteAll(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want string
+	}{
+		{in: nil, want: ""},
+		{in: []string{"a"}, want: "'a'"},
+		{in: []string{"a b", "it's", ""}, want: `'a b' 'it'\''s' ''`},
+	}
+	for _, tt := range tests {
+		if got := ShellQuoteAll(tt.in); got != tt.want {
+			t.Errorf("ShellQuoteAll(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}